@@ -0,0 +1,70 @@
+package kite
+
+import "fmt"
+
+// Authorizer decides whether the caller can call a method of the kite. It's
+// called after the request is authenticated, with the name of the method,
+// the authenticated username of the caller and the authentication it used.
+// For the methods that don't require authentication the caller is unknown,
+// the username is empty and the authentication is nil. The call is rejected
+// with CodePermissionDenied if it returns an error.
+type Authorizer interface {
+	Authorize(method, username string, auth *Auth) error
+}
+
+// AuthorizerFunc is an adapter to use ordinary functions as an Authorizer.
+type AuthorizerFunc func(method, username string, auth *Auth) error
+
+// Authorize calls f(method, username, auth).
+func (f AuthorizerFunc) Authorize(method, username string, auth *Auth) error {
+	return f(method, username, auth)
+}
+
+// MethodAllowlist is an Authorizer allowing only the listed usernames to
+// call a method. The keys are the method names, the methods that are not in
+// the map can be called by anyone. A listed method that doesn't require
+// authentication can't be called by anyone, as the caller is unknown.
+type MethodAllowlist map[string][]string
+
+// Authorize returns an error if the method is in the allowlist and the
+// username is not allowed to call it.
+func (a MethodAllowlist) Authorize(method, username string, _ *Auth) error {
+	usernames, ok := a[method]
+	if !ok {
+		return nil
+	}
+
+	for _, u := range usernames {
+		if u == username {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%q is not allowed to call %q", username, method)
+}
+
+// authorize checks the request with the Authorizer of the local kite, if it
+// has any. The username is the authenticated one, not the one the caller
+// claims in its kite, which is all there is if the request is not
+// authenticated, so the Authorizer gets an empty username then.
+func (r *Request) authorize(authenticated bool) *Error {
+	a := r.LocalKite.Authorizer
+	if a == nil {
+		return nil
+	}
+
+	username, auth := r.Username, r.Auth
+	if !authenticated {
+		username, auth = "", nil
+	}
+
+	if err := a.Authorize(r.Method, username, auth); err != nil {
+		return &Error{
+			Type:    "authorizationError",
+			Message: err.Error(),
+			CodeVal: CodePermissionDenied,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package kite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/koding/kite/protocol"
+)
+
+func TestMethodAllowlist(t *testing.T) {
+	a := MethodAllowlist{"admin.evict": {"admin", "ops"}}
+
+	tests := []struct {
+		method   string
+		username string
+		allowed  bool
+	}{
+		{"admin.evict", "admin", true},
+		{"admin.evict", "ops", true},
+		{"admin.evict", "devrim", false},
+		{"square", "devrim", true},
+	}
+
+	for _, test := range tests {
+		err := a.Authorize(test.method, test.username, nil)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%s calling %s: expected allowed=%t, got error %v", test.username, test.method, test.allowed, err)
+		}
+	}
+}
+
+func TestRequestAuthorize(t *testing.T) {
+	auth := &Auth{Type: "token", Key: "abc"}
+
+	// the kite claims to be admin, but the token is of devrim
+	r := &Request{
+		Method:    "admin.evict",
+		LocalKite: &Kite{},
+		Client:    &Client{Kite: protocol.Kite{Username: "admin"}},
+		Username:  "devrim",
+		Auth:      auth,
+	}
+
+	if err := r.authorize(true); err != nil {
+		t.Errorf("expected no error without an authorizer, got %v", err)
+	}
+
+	var got string
+	var gotAuth *Auth
+	r.LocalKite.Authorizer = AuthorizerFunc(func(method, username string, auth *Auth) error {
+		got, gotAuth = method+" "+username, auth
+		return MethodAllowlist{"admin.evict": {"admin"}}.Authorize(method, username, auth)
+	})
+
+	err := r.authorize(true)
+	if ErrorCode(err) != CodePermissionDenied {
+		t.Errorf("expected %q, got %v", CodePermissionDenied, err)
+	}
+
+	if got != "admin.evict devrim" || gotAuth != auth {
+		t.Errorf("unexpected arguments of the authorizer: %q, %+v", got, gotAuth)
+	}
+
+	// without authentication the username is the one the kite claims, it's
+	// not trusted
+	r.Username, r.Auth = "admin", nil
+
+	err = r.authorize(false)
+	if ErrorCode(err) != CodePermissionDenied {
+		t.Errorf("spoofed username: expected %q, got %v", CodePermissionDenied, err)
+	}
+
+	if got != "admin.evict " || gotAuth != nil {
+		t.Errorf("unexpected arguments of the authorizer: %q, %+v", got, gotAuth)
+	}
+}
+
+func TestAuthorizeSpoofedUsername(t *testing.T) {
+	callee := New("callee", "0.0.1")
+	callee.Authorizer = MethodAllowlist{"evict": {"admin"}}
+	callee.HandleFunc("evict", func(*Request) (interface{}, error) {
+		return "evicted", nil
+	}).DisableAuthentication()
+
+	// the caller claims to be admin in its kite, without authenticating
+	caller := New("caller", "0.0.1")
+	caller.Config.Username = "admin"
+
+	c, _ := connectPipe(caller, callee)
+
+	_, err := c.TellWithTimeout("evict", time.Second)
+	if ErrorCode(err) != CodePermissionDenied {
+		t.Errorf("expected %q for a spoofed username, got %v", CodePermissionDenied, err)
+	}
+}
@@ -1,13 +1,17 @@
 package kite
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -19,6 +23,14 @@ import (
 
 var forever = backoff.NewExponentialBackOff()
 
+// ErrMessageTooLarge is returned when a kite sends a message larger than
+// Config.MaxMessageSize. The connection is closed then.
+var ErrMessageTooLarge = errors.New("kite: message is too large")
+
+// closeMessageTooLarge is the close code of the connections sending too
+// large messages, the same as the websocket one.
+const closeMessageTooLarge = 1009
+
 func init() {
 	forever.MaxElapsedTime = 365 * 24 * time.Hour // 1 year
 }
@@ -36,27 +48,99 @@ type Client struct {
 	// Credentials that we sent in each request.
 	Auth *Auth
 
-	// Should we reconnect if disconnected?
+	// Should we reconnect if disconnected? The remote kite is redialed with
+	// an exponential backoff, the OnConnect handlers are called again once
+	// it's reconnected.
 	Reconnect bool
 
+	// RequeueTimeout is the duration the calls waiting for a response are
+	// kept when the connection drops, if Reconnect is set. They are sent
+	// again if the client is reconnected within it, otherwise they fail
+	// with a disconnect error. If zero, they fail immediately.
+	RequeueTimeout time.Duration
+
 	// SockJS base URL
 	URL string
 
+	// Weight is the weight the kite is registered to kontrol with, if it's
+	// discovered with GetKites. Zero is the default weight of 1, see
+	// WeightedPick.
+	Weight float64
+
+	// failoverURLs are dialed in turn when URL can't be dialed, URL is set
+	// to the one being dialed under urlMu, see dialURL.
+	failoverURLs []string
+	urlMu        sync.RWMutex
+
+	// TLSConfig is used when dialing https URLs. If nil, the client
+	// certificate files of the kite's config are presented to the server,
+	// if they are set.
+	TLSConfig *tls.Config
+
+	// peerCertificates are the verified client certificates of a kite
+	// connected to the local kite's server.
+	peerCertificates []*x509.Certificate
+
+	// remoteAddr is the address of a kite connected to the local kite's
+	// server
+	remoteAddr string
+
 	// Should we process incoming messages concurrently or not? Default: true
 	Concurrent bool
 
 	// To signal waiters of Go() on disconnect.
 	disconnect chan struct{}
 
+	// connected is closed while the client is connected. It's replaced
+	// with a new one on disconnect.
+	connected   chan struct{}
+	connectedMu sync.Mutex
+
 	// SockJS session
 	// TODO: replace this with a proper interface to support multiple
 	// transport/protocols
 	session sockjs.Session
 	send    chan []byte
 
+	// sessionMu protects Reconnect and setting session, Close may be called
+	// while the client is redialed, see reconnect and setSession.
+	sessionMu sync.Mutex
+
 	// dnode scrubber for saving callbacks sent to remote.
 	scrubber *dnode.Scrubber
 
+	// lastActivity is the time in unix nanoseconds a message is received
+	// last, see Config.IdleTimeout.
+	lastActivity int64
+
+	// handshaken is closed once the first method call of the remote kite
+	// is authenticated, see Config.HandshakeTimeout.
+	handshaken     chan struct{}
+	handshakenOnce sync.Once
+
+	// the streams of the calls made with TellStream and of the calls
+	// received by the local kite, see Stream
+	clientStreams map[string]*ClientStream
+	serverStreams map[string]*Stream
+	streamsMu     sync.Mutex
+
+	// inFlightCalls is the number of messages of the remote kite being
+	// handled, see acquireMessage.
+	inFlightCalls int32
+
+	// compress is 1 if the large messages sent are compressed, it's set
+	// once the remote kite is known to support it.
+	compress int32
+
+	// compressionOffered is 1 once the local kite has offered to accept
+	// compressed messages in a call to the remote kite.
+	compressionOffered int32
+
+	// codec encodes the arguments of the calls to the remote kite, it's set
+	// once the codec is negotiated, see Codec.
+	codec   Codec
+	codecMu sync.Mutex
+
 	// Time to wait before redial connection.
 	redialBackOff backoff.ExponentialBackOff
 
@@ -79,6 +163,26 @@ type callOptions struct {
 	Auth             *Auth          `json:"authentication"`
 	WithArgs         *dnode.Partial `json:"withArgs" dnode:"-"`
 	ResponseCallback dnode.Function `json:"responseCallback"`
+
+	// Compression is advertised by the caller if it accepts compressed
+	// messages, like "gzip".
+	Compression string `json:"compression,omitempty"`
+
+	// CorrelationID identifies the chain of calls this call belongs to.
+	CorrelationID string `json:"correlationId,omitempty"`
+
+	// TraceContext is the OpenTelemetry trace context of the caller's span.
+	TraceContext map[string]string `json:"traceContext,omitempty"`
+
+	// StreamID is set by TellStream, the result is sent in chunks with it.
+	StreamID string `json:"streamId,omitempty"`
+
+	// Codecs are the codecs the caller accepts the result encoded with.
+	// Codec is the one EncodedArgs are encoded with, instead of WithArgs
+	// in JSON. See Codec.
+	Codecs      []string `json:"codecs,omitempty"`
+	Codec       string   `json:"codec,omitempty"`
+	EncodedArgs []byte   `json:"encodedArgs,omitempty"`
 }
 
 // callOptionsOut is the same structure with callOptions.
@@ -111,14 +215,40 @@ func (k *Kite) NewClient(remoteURL string) *Client {
 		LocalKite:     k,
 		URL:           remoteURL,
 		disconnect:    make(chan struct{}),
+		connected:     make(chan struct{}),
+		handshaken:    make(chan struct{}),
 		redialBackOff: *forever,
 		scrubber:      dnode.NewScrubber(),
+		clientStreams: make(map[string]*ClientStream),
+		serverStreams: make(map[string]*Stream),
 		Concurrent:    true,
-		send:          make(chan []byte, 512), // buffered
+		send:          make(chan []byte, k.sendQueueSize()),
 	}
 
 	go r.sendHub()
 
+	r.OnConnect(func() {
+		r.connectedMu.Lock()
+		select {
+		case <-r.connected:
+		default:
+			close(r.connected)
+		}
+		r.connectedMu.Unlock()
+	})
+
+	// must be registered before closing the disconnect channel, so the
+	// requeued calls wait for the next connection
+	r.OnDisconnect(func() {
+		r.connectedMu.Lock()
+		select {
+		case <-r.connected:
+			r.connected = make(chan struct{})
+		default:
+		}
+		r.connectedMu.Unlock()
+	})
+
 	var m sync.Mutex
 	r.OnDisconnect(func() {
 		m.Lock()
@@ -136,25 +266,37 @@ func (c *Client) SetUsername(username string) {
 	c.muProt.Unlock()
 }
 
-// Dial connects to the remote Kite. Returns error if it can't.
+// Dial connects to the remote Kite. If it can't, the failover URLs of the
+// client, like the alternate URLs of a discovered kite, are tried in turn.
+// Returns the error of the last one if none can be dialed.
 func (c *Client) Dial() (err error) {
-	c.LocalKite.Log.Debug("Dialing '%s' kite: %s", c.Kite.Name, c.URL)
-
-	if err := c.dial(); err != nil {
-		return err
+	attempts := len(c.failoverURLs)
+	if attempts == 0 {
+		attempts = 1
 	}
 
-	go c.run()
+	for i := 0; i < attempts; i++ {
+		c.LocalKite.Log.Debug("Dialing '%s' kite: %s", c.Kite.Name, c.dialURL())
 
-	return nil
+		// dial sets URL to the next failover URL if it fails
+		if err = c.dial(); err == nil {
+			go c.run()
+			return nil
+		}
+	}
+
+	return err
 }
 
 // Dial connects to the remote Kite. If it can't connect, it retries
 // indefinitely. It returns a channel to check if it's connected or not.
 func (c *Client) DialForever() (connected chan bool, err error) {
-	c.LocalKite.Log.Info("Dialing '%s' kite: %s", c.Kite.Name, c.URL)
+	c.LocalKite.Log.Info("Dialing '%s' kite: %s", c.Kite.Name, c.dialURL())
 
+	c.sessionMu.Lock()
 	c.Reconnect = true
+	c.sessionMu.Unlock()
+
 	connected = make(chan bool, 1) // This will be closed on first connection.
 	go c.dialForever(connected)
 	return
@@ -162,7 +304,7 @@ func (c *Client) DialForever() (connected chan bool, err error) {
 
 func (c *Client) dialForever(connectNotifyChan chan bool) {
 	dial := func() error {
-		if !c.Reconnect {
+		if !c.reconnect() {
 			return nil
 		}
 		return c.dial()
@@ -178,13 +320,30 @@ func (c *Client) dialForever(connectNotifyChan chan bool) {
 }
 
 func (c *Client) dial() (err error) {
-	c.session, err = sockjsclient.ConnectWebsocketSession(c.URL)
+	tlsConfig := c.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig, err = c.LocalKite.clientTLSConfig()
+		if err != nil {
+			return err
+		}
+	}
+
+	session, err := sockjsclient.DialWebsocketSessionTimeout(c.dialURL(), tlsConfig, c.LocalKite.Config.HandshakeTimeout)
 	if err != nil {
 		// explicitly set nil to avoid panicing when used the methods of that interface
-		c.session = nil
+		c.setSession(nil)
+		c.failover()
 		return err
 	}
 
+	// the messages are escaped in the SockJS frames, so the frames may be
+	// larger than the messages
+	if limit := c.LocalKite.Config.MaxMessageSize; limit > 0 {
+		session.SetReadLimit(2*limit + 64)
+	}
+
+	c.setSession(session)
+
 	// Reset the wait time.
 	c.redialBackOff.Reset()
 
@@ -195,7 +354,63 @@ func (c *Client) dial() (err error) {
 	return nil
 }
 
+// reconnect returns the value of Reconnect.
+func (c *Client) reconnect() bool {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	return c.Reconnect
+}
+
+func (c *Client) setSession(session sockjs.Session) {
+	c.sessionMu.Lock()
+	c.session = session
+	c.sessionMu.Unlock()
+}
+
+// failover sets URL to the next of the failover URLs, if any.
+func (c *Client) failover() {
+	if len(c.failoverURLs) == 0 {
+		return
+	}
+
+	c.urlMu.Lock()
+	prev := c.URL
+	next := c.failoverURLs[0]
+	for i, u := range c.failoverURLs {
+		if u == prev {
+			next = c.failoverURLs[(i+1)%len(c.failoverURLs)]
+			break
+		}
+	}
+	c.URL = next
+	c.urlMu.Unlock()
+
+	c.LocalKite.Log.Warning("Cannot connect to %s, failing over to %s", prev, next)
+}
+
+// dialURL returns the URL the client dials, it changes on failover.
+func (c *Client) dialURL() string {
+	c.urlMu.RLock()
+	defer c.urlMu.RUnlock()
+	return c.URL
+}
+
+// PeerCertificates returns the certificates the remote kite presented when
+// it connected to the local kite's server with mutual TLS, the first one is
+// its own certificate. It can be used in the OnConnect handlers to authorize
+// the kite by the subject of its certificate. It returns nil for the clients
+// dialed by the local kite.
+func (c *Client) PeerCertificates() []*x509.Certificate {
+	return c.peerCertificates
+}
+
+// RemoteAddr returns the address of the remote kite, or an empty string if it's
+// unknown, like for the SockJS transports other than websocket.
 func (c *Client) RemoteAddr() string {
+	if c.remoteAddr != "" {
+		return c.remoteAddr
+	}
+
 	if c.session == nil {
 		return ""
 	}
@@ -223,7 +438,7 @@ func (c *Client) run() {
 	// falls here when connection disconnects
 	c.callOnDisconnectHandlers()
 
-	if c.Reconnect {
+	if c.reconnect() {
 		go c.dialForever(nil)
 	}
 }
@@ -236,14 +451,17 @@ func (c *Client) readLoop() error {
 			return err
 		}
 
+		// The messages above the concurrency limit are handled here
+		// instead of a new goroutine, their method calls are rejected.
+		if !c.acquireMessage() {
+			c.handleMessage(msg, true)
+			continue
+		}
+
 		processed := make(chan bool)
 		go func(msg []byte, processed chan bool) {
-			if err := c.processMessage(msg); err != nil {
-				// don't log callback not found errors
-				if _, ok := err.(dnode.CallbackNotFoundError); !ok {
-					c.LocalKite.Log.Warning("error processing message err: %s message: %q", err.Error(), string(msg))
-				}
-			}
+			c.handleMessage(msg, false)
+			atomic.AddInt32(&c.inFlightCalls, -1)
 			close(processed)
 		}(msg, processed)
 
@@ -253,8 +471,19 @@ func (c *Client) readLoop() error {
 	}
 }
 
+// handleMessage processes the message and logs its error.
+func (c *Client) handleMessage(msg []byte, overLimit bool) {
+	if err := c.processMessage(msg, overLimit); err != nil {
+		// don't log callback not found errors
+		if _, ok := err.(dnode.CallbackNotFoundError); !ok {
+			c.LocalKite.Log.Warning("error processing message err: %s message: %q", err.Error(), string(msg))
+		}
+	}
+}
+
 // processMessage processes a single message and calls a handler or callback.
-func (c *Client) processMessage(data []byte) (err error) {
+// The method calls are rejected if the message is over the concurrency limit.
+func (c *Client) processMessage(data []byte, overLimit bool) (err error) {
 	var (
 		ok  bool
 		msg dnode.Message
@@ -300,7 +529,7 @@ func (c *Client) processMessage(data []byte) (err error) {
 			return err
 		}
 
-		c.runMethod(m, msg.Arguments)
+		c.runMethod(m, msg.Arguments, overLimit)
 	default:
 		return fmt.Errorf("Method is not string or integer: %+v (%T)", msg.Method, msg.Method)
 	}
@@ -308,9 +537,13 @@ func (c *Client) processMessage(data []byte) (err error) {
 }
 
 func (c *Client) Close() {
+	c.sessionMu.Lock()
 	c.Reconnect = false
-	if c.session != nil {
-		c.session.Close(3000, "Go away!")
+	session := c.session
+	c.sessionMu.Unlock()
+
+	if session != nil {
+		session.Close(3000, "Go away!")
 	}
 }
 
@@ -324,12 +557,24 @@ func (c *Client) sendHub() {
 				return
 			}
 
+			atomic.AddInt64(&c.LocalKite.metrics.SendQueueDepth, -1)
+
 			c.LocalKite.Log.Debug("Sending: %s", string(msg))
 			if c.session == nil {
 				c.LocalKite.Log.Error("not connected")
 				continue
 			}
 
+			if atomic.LoadInt32(&c.compress) == 1 && len(msg) >= compressMinSize {
+				compressed, err := compressMessage(msg)
+				if err != nil {
+					c.LocalKite.Log.Error("cannot compress message: %s", err)
+				} else {
+					msg = compressed
+				}
+			}
+
+			atomic.AddUint64(&c.LocalKite.metrics.BytesOut, uint64(len(msg)))
 			c.session.Send(string(msg))
 		}
 	}
@@ -342,10 +587,112 @@ func (c *Client) receiveData() ([]byte, error) {
 	}
 
 	msg, err := c.session.Recv()
+	if err != nil {
+		return nil, err
+	}
 
-	c.LocalKite.Log.Debug("Received : %s", msg)
+	atomic.AddUint64(&c.LocalKite.metrics.BytesIn, uint64(len(msg)))
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
 
-	return []byte(msg), err
+	limit := c.LocalKite.Config.MaxMessageSize
+	if limit > 0 && int64(len(msg)) > limit {
+		return nil, c.rejectMessage(int64(len(msg)))
+	}
+
+	// The compressed messages are only accepted once compression is
+	// negotiated, otherwise they are left to fail as invalid messages, so
+	// unauthenticated peers can't make the kite decompress.
+	data := []byte(msg)
+	if isCompressed(data) && c.compressionNegotiated() {
+		if data, err = decompressMessage(data, limit); err == ErrMessageTooLarge {
+			return nil, c.rejectMessage(-1)
+		} else if err != nil {
+			return nil, err
+		}
+
+		// the remote kite supports compression, as it has sent a
+		// compressed message
+		if c.LocalKite.Config.Compression {
+			atomic.StoreInt32(&c.compress, 1)
+		}
+	}
+
+	c.LocalKite.Log.Debug("Received : %s", data)
+
+	return data, nil
+}
+
+// compressionNegotiated returns true if the remote kite may send compressed
+// messages, because either side has offered compression and the other has
+// accepted it.
+func (c *Client) compressionNegotiated() bool {
+	return atomic.LoadInt32(&c.compress) == 1 || atomic.LoadInt32(&c.compressionOffered) == 1
+}
+
+// rejectMessage closes the connection after receiving a message larger than
+// Config.MaxMessageSize. The size is negative if it's unknown, like for the
+// compressed messages.
+func (c *Client) rejectMessage(size int64) error {
+	limit := c.LocalKite.Config.MaxMessageSize
+	if size < 0 {
+		c.LocalKite.Log.Error("Closing connection to %q: message exceeds the limit of %d bytes", c.Kite, limit)
+	} else {
+		c.LocalKite.Log.Error("Closing connection to %q: message of %d bytes exceeds the limit of %d bytes", c.Kite, size, limit)
+	}
+
+	c.session.Close(closeMessageTooLarge, ErrMessageTooLarge.Error())
+	return ErrMessageTooLarge
+}
+
+// markHandshaken completes the handshake of the remote kite, once its first
+// method call is authenticated.
+func (c *Client) markHandshaken() {
+	c.handshakenOnce.Do(func() { close(c.handshaken) })
+}
+
+// closeUnlessHandshaken closes the session if the handshake isn't completed
+// by the deadline, unless stop is closed before.
+func (c *Client) closeUnlessHandshaken(deadline time.Time, stop chan struct{}) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		c.LocalKite.Log.Info("Closing session %q: no authenticated call within the handshake timeout", c.session.ID())
+		c.session.Close(3000, "Handshake timeout")
+	case <-c.handshaken:
+	case <-stop:
+	}
+}
+
+// closeWhenIdle closes the session once no message is received for the given
+// timeout, until stop is closed.
+func (c *Client) closeWhenIdle(timeout time.Duration, stop chan struct{}) {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !c.idle(timeout) {
+				continue
+			}
+
+			c.LocalKite.Log.Info("Closing idle session %q of kite %q", c.session.ID(), c.Kite)
+			c.session.Close(3000, "Idle timeout")
+			return
+		case <-stop:
+			return
+		}
+	}
+}
+
+// idle returns true if no message is received for the given timeout.
+func (c *Client) idle(timeout time.Duration) bool {
+	last := atomic.LoadInt64(&c.lastActivity)
+	return time.Since(time.Unix(0, last)) > timeout
 }
 
 // OnConnect registers a function to run on connect.
@@ -386,15 +733,36 @@ func (c *Client) callOnDisconnectHandlers() {
 	c.m.RUnlock()
 }
 
-func (c *Client) wrapMethodArgs(args []interface{}, responseCallback dnode.Function) []interface{} {
+func (c *Client) wrapMethodArgs(ctx context.Context, args []interface{}, responseCallback dnode.Function) []interface{} {
 	options := callOptionsOut{
 		WithArgs: args,
 		callOptions: callOptions{
 			Kite:             *c.LocalKite.Kite(),
 			Auth:             c.Auth,
 			ResponseCallback: responseCallback,
+			CorrelationID:    CorrelationID(ctx),
 		},
 	}
+
+	options.StreamID, _ = ctx.Value(streamIDKey{}).(string)
+
+	if c.LocalKite.Config.Compression {
+		options.Compression = compressionGzip
+		atomic.StoreInt32(&c.compressionOffered, 1)
+	}
+
+	if c.LocalKite.Config.Tracing {
+		options.TraceContext = injectTraceContext(ctx)
+	}
+
+	if len(c.LocalKite.Codecs) != 0 {
+		options.Codecs = c.LocalKite.codecNames()
+
+		if codec := c.negotiatedCodec(); codec != nil {
+			c.encodeArgs(codec, &options)
+		}
+	}
+
 	return []interface{}{options}
 }
 
@@ -413,6 +781,15 @@ func (c *Client) TellWithTimeout(method string, timeout time.Duration, args ...i
 	return response.Result, response.Err
 }
 
+// TellWithContext does the same thing with Tell() method except it stops
+// waiting for the reply once ctx is done. The error of ctx is returned in
+// that case, like context.DeadlineExceeded, and the response callback is
+// removed.
+func (c *Client) TellWithContext(ctx context.Context, method string, args ...interface{}) (result *dnode.Partial, err error) {
+	response := <-c.GoWithContext(ctx, method, args...)
+	return response.Result, response.Err
+}
+
 // Go makes an unblocking method call to the server.
 // It returns a channel that the caller can wait on it to get the response.
 func (c *Client) Go(method string, args ...interface{}) chan *response {
@@ -423,19 +800,68 @@ func (c *Client) Go(method string, args ...interface{}) chan *response {
 // extra argument that is the timeout for waiting reply from the remote Kite.
 // If timeout is given 0, the behavior is same as Go().
 func (c *Client) GoWithTimeout(method string, timeout time.Duration, args ...interface{}) chan *response {
+	if timeout == 0 {
+		return c.GoWithContext(context.Background(), method, args...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	contextChan := c.GoWithContext(ctx, method, args...)
+
+	responseChan := make(chan *response, 1)
+	go func() {
+		defer cancel()
+
+		resp := <-contextChan
+		if resp.Err == context.DeadlineExceeded {
+			resp.Err = &Error{
+				Type:    "timeout",
+				Message: fmt.Sprintf("No response to %q method in %s", method, timeout),
+				CodeVal: CodeTimeout,
+			}
+		}
+
+		responseChan <- resp
+	}()
+
+	return responseChan
+}
+
+// GoWithContext does the same thing with Go() method except it stops
+// waiting for the reply once ctx is done, see TellWithContext. The
+// correlation ID of ctx is sent with the call, a new one is generated if it
+// doesn't have any.
+func (c *Client) GoWithContext(ctx context.Context, method string, args ...interface{}) chan *response {
+	if CorrelationID(ctx) == "" {
+		ctx = WithCorrelationID(ctx, newCorrelationID())
+	}
+
 	// We will return this channel to the caller.
 	// It can wait on this channel to get the response.
 	c.LocalKite.Log.Debug("Telling method [%s] on kite [%s]", method, c.Name)
 	responseChan := make(chan *response, 1)
 
-	c.sendMethod(method, args, timeout, responseChan)
+	if !c.LocalKite.Config.Tracing {
+		c.sendMethod(ctx, method, args, responseChan)
+		return responseChan
+	}
+
+	ctx, span := c.startClientSpan(ctx, method)
+	tracedChan := make(chan *response, 1)
+
+	c.sendMethod(ctx, method, args, tracedChan)
+
+	go func() {
+		resp := <-tracedChan
+		endSpan(span, resp.Err)
+		responseChan <- resp
+	}()
 
 	return responseChan
 }
 
 // sendMethod wraps the arguments, adds a response callback,
 // marshals the message and send it over the wire.
-func (c *Client) sendMethod(method string, args []interface{}, timeout time.Duration, responseChan chan *response) {
+func (c *Client) sendMethod(ctx context.Context, method string, args []interface{}, responseChan chan *response) {
 	// To clean the sent callback after response is received.
 	// Send/Receive in a channel to prevent race condition because
 	// the callback is run in a separate goroutine.
@@ -444,8 +870,11 @@ func (c *Client) sendMethod(method string, args []interface{}, timeout time.Dura
 	// When a callback is called it will send the response to this channel.
 	doneChan := make(chan *response, 1)
 
+	// the arguments are sent again if the call is requeued
+	methodArgs := args
+
 	cb := c.makeResponseCallback(doneChan, removeCallback, method, args)
-	args = c.wrapMethodArgs(args, cb)
+	args = c.wrapMethodArgs(ctx, args, cb)
 
 	// BUG: This sometimes does not return an error, even if the remote
 	// kite is disconnected. I could not find out why.
@@ -457,39 +886,42 @@ func (c *Client) sendMethod(method string, args []interface{}, timeout time.Dura
 			Err: &Error{
 				Type:    "sendError",
 				Message: err.Error(),
+				CodeVal: CodeUnavailable,
 			},
 		}
 		return
 	}
 
-	// nil value of afterTimeout means no timeout, it will not selected in
-	// select statement
-	var afterTimeout <-chan time.Time
-	if timeout > 0 {
-		afterTimeout = time.After(timeout)
-	}
-
 	// Waits until the response has came or the connection has disconnected.
 	go func() {
 		select {
 		case resp := <-doneChan:
 			responseChan <- resp
 		case <-c.disconnect:
+			if c.reconnect() && c.RequeueTimeout > 0 {
+				// The callback is not called by the remote kite after the
+				// disconnect, a new one is sent with the requeued call.
+				if id, ok := <-removeCallback; ok {
+					c.scrubber.RemoveCallback(id)
+				}
+
+				if c.waitConnected(ctx, c.RequeueTimeout) {
+					c.LocalKite.Log.Debug("Requeuing method [%s] on kite [%s]", method, c.Name)
+					c.sendMethod(ctx, method, methodArgs, responseChan)
+					return
+				}
+			}
+
 			responseChan <- &response{
 				nil,
 				&Error{
 					Type:    "disconnect",
 					Message: "Remote kite has disconnected",
+					CodeVal: CodeUnavailable,
 				},
 			}
-		case <-afterTimeout:
-			responseChan <- &response{
-				nil,
-				&Error{
-					Type:    "timeout",
-					Message: fmt.Sprintf("No response to %q method in %s", method, timeout),
-				},
-			}
+		case <-ctx.Done():
+			responseChan <- &response{nil, ctx.Err()}
 
 			// Remove the callback function from the map so we do not
 			// consume memory for unused callbacks.
@@ -502,6 +934,26 @@ func (c *Client) sendMethod(method string, args []interface{}, timeout time.Dura
 	sendCallbackID(callbacks, removeCallback)
 }
 
+// waitConnected waits until the client is connected, for at most the given
+// timeout. It returns false if it's not connected in time or ctx is done.
+func (c *Client) waitConnected(ctx context.Context, timeout time.Duration) bool {
+	c.connectedMu.Lock()
+	connected := c.connected
+	c.connectedMu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-connected:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
 // marshalAndSend takes a method and arguments, scrubs the arguments to create
 // a dnode message, marshals the message to JSON and sends it over the wire.
 func (c *Client) marshalAndSend(method interface{}, arguments []interface{}) (callbacks map[string]dnode.Path, err error) {
@@ -534,7 +986,7 @@ func (c *Client) marshalAndSend(method interface{}, arguments []interface{}) (ca
 		return nil, err
 	}
 
-	c.send <- data
+	err = c.enqueue(data)
 	return
 }
 
@@ -583,6 +1035,10 @@ func (c *Client) makeResponseCallback(doneChan chan *response, removeCallback <-
 		var resp struct {
 			Result *dnode.Partial `json:"result"`
 			Err    *Error         `json:"error"`
+
+			// the result is encoded with a codec, see Codec
+			Codec         string `json:"codec"`
+			EncodedResult []byte `json:"encodedResult"`
 		}
 
 		// Notify that the callback is finished.
@@ -627,6 +1083,24 @@ func (c *Client) makeResponseCallback(doneChan chan *response, removeCallback <-
 			}
 			return
 		}
+
+		if resp.Codec != "" {
+			// only the codecs of the local kite are offered
+			codec := c.LocalKite.codec(resp.Codec)
+			if codec == nil {
+				resp.Err = &Error{
+					Type:    "invalidResponse",
+					Message: fmt.Sprintf("Server has sent a result encoded with unsupported codec %q", resp.Codec),
+				}
+				return
+			}
+
+			resp.Result = &dnode.Partial{Raw: resp.EncodedResult, Codec: codec}
+
+			// the remote kite supports it, so the arguments of the
+			// following calls are encoded with it too
+			c.setCodec(codec)
+		}
 	})
 }
 
@@ -655,6 +1129,7 @@ func onError(err error) {
 				Error: &Error{
 					Type:    "methodNotFound",
 					Message: err.Error(),
+					CodeVal: CodeMethodNotFound,
 				},
 			}
 			options.ResponseCallback.Call(response)
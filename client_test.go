@@ -0,0 +1,276 @@
+package kite
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientTellWithContext(t *testing.T) {
+	// the client is not connected, so no response is ever received
+	c := New("exp", "0.0.1").NewClient("http://127.0.0.1:9999/kite")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.TellWithContext(ctx, "foo"); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	_, err := c.TellWithTimeout("foo", 10*time.Millisecond)
+	if kiteErr, ok := err.(*Error); !ok || kiteErr.Type != "timeout" {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+}
+
+func TestClientWaitConnected(t *testing.T) {
+	c := New("exp", "0.0.1").NewClient("http://127.0.0.1:9999/kite")
+	ctx := context.Background()
+
+	if c.waitConnected(ctx, 10*time.Millisecond) {
+		t.Error("new client should not be connected")
+	}
+
+	c.callOnConnectHandlers()
+	if !c.waitConnected(ctx, 10*time.Millisecond) {
+		t.Error("client should be connected")
+	}
+
+	c.callOnDisconnectHandlers()
+	if c.waitConnected(ctx, 10*time.Millisecond) {
+		t.Error("client should be disconnected")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.callOnConnectHandlers()
+	}()
+
+	if !c.waitConnected(ctx, time.Second) {
+		t.Error("client should be reconnected")
+	}
+}
+
+func TestClientFailover(t *testing.T) {
+	urls := []string{
+		"http://127.0.0.1:9997/kite",
+		"http://127.0.0.1:9998/kite",
+		"http://127.0.0.1:9999/kite",
+	}
+
+	c := New("exp", "0.0.1").NewClient(urls[0])
+	c.failoverURLs = urls
+
+	for _, want := range []string{urls[1], urls[2], urls[0]} {
+		c.failover()
+		if c.dialURL() != want {
+			t.Errorf("expected to fail over to %s, got %s", want, c.dialURL())
+		}
+	}
+}
+
+// TestClientFailoverConcurrent fails over while the URL is read, like by the
+// OnConnect handlers of a client dialed again, it's meant to be run with
+// the race detector.
+func TestClientFailoverConcurrent(t *testing.T) {
+	urls := []string{"http://127.0.0.1:9998/kite", "http://127.0.0.1:9999/kite"}
+
+	c := New("exp", "0.0.1").NewClient(urls[0])
+	c.failoverURLs = urls
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.failover()
+		}()
+		go func() {
+			defer wg.Done()
+			if u := c.dialURL(); u != urls[0] && u != urls[1] {
+				t.Errorf("unexpected URL %s", u)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClientDialFailover(t *testing.T) {
+	// the relay only opens the SockJS session
+	upgrader := websocket.Upgrader{}
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteMessage(websocket.TextMessage, []byte("o"))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer relay.Close()
+
+	urls := []string{"http://127.0.0.1:9999/kite", relay.URL + "/kite"}
+
+	c := New("exp", "0.0.1").NewClient(urls[0])
+	c.failoverURLs = urls
+
+	if err := c.Dial(); err != nil {
+		t.Fatalf("expected to fall back to the relay, got %s", err)
+	}
+	defer c.Close()
+
+	if c.URL != urls[1] {
+		t.Errorf("expected to be connected to %s, got %s", urls[1], c.URL)
+	}
+}
+
+func TestRegisterURLs(t *testing.T) {
+	k := New("exp", "0.0.1")
+	k.Config.AlternateURLs = []string{"ws://10.0.0.1:4444/kite"}
+
+	if urls := k.registerURLs(); len(urls) != 1 {
+		t.Errorf("expected only the alternate URL, got %v", urls)
+	}
+
+	k.kontrol.relayURL = "http://proxy.example.com/proxy/123"
+
+	urls := k.registerURLs()
+	if len(urls) != 2 || urls[1] != k.kontrol.relayURL {
+		t.Errorf("expected the relay URL to be the last, got %v", urls)
+	}
+
+	if len(k.Config.AlternateURLs) != 1 {
+		t.Errorf("alternate URLs of the config are modified: %v", k.Config.AlternateURLs)
+	}
+}
+
+func TestClientConcurrencyLimit(t *testing.T) {
+	k := New("exp", "0.0.1")
+	k.Config.MaxConcurrentCalls = 2
+
+	c := k.NewClient("")
+
+	for i := 0; i < 2; i++ {
+		if !c.acquireMessage() {
+			t.Fatalf("message %d should be accepted", i)
+		}
+	}
+
+	if c.acquireMessage() {
+		t.Error("expected the message to be rejected")
+	}
+
+	if n := c.InFlightCalls(); n != 2 {
+		t.Errorf("expected 2 messages in flight, got %d", n)
+	}
+}
+
+func TestKiteConcurrencyLimit(t *testing.T) {
+	k := New("exp", "0.0.1")
+	k.Config.MaxConcurrentCallsTotal = 1
+
+	if err := k.acquireCall(); err != nil {
+		t.Fatalf("call should be accepted: %s", err)
+	}
+
+	if err := k.acquireCall(); ErrorCode(err) != CodeTooManyRequests {
+		t.Errorf("expected the call to be rejected, got %v", err)
+	}
+
+	// the rejected call is not counted
+	if n := atomic.LoadInt64(&k.acceptedCalls); n != 1 {
+		t.Errorf("expected 1 accepted call, got %d", n)
+	}
+}
+
+func TestClientIdle(t *testing.T) {
+	c := New("exp", "0.0.1").NewClient("")
+
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+	if c.idle(time.Minute) {
+		t.Error("client should not be idle")
+	}
+
+	atomic.StoreInt64(&c.lastActivity, time.Now().Add(-2*time.Minute).UnixNano())
+	if !c.idle(time.Minute) {
+		t.Error("client should be idle")
+	}
+}
+
+func TestClientHandshakeTimeout(t *testing.T) {
+	k := New("exp", "0.0.1")
+
+	// the deadline counts from the accept time, it may have passed already
+	s := &recvSession{}
+	c := k.NewClient("")
+	c.session = s
+	c.closeUnlessHandshaken(time.Now().Add(-time.Second), make(chan struct{}))
+
+	if s.closed != 3000 {
+		t.Errorf("got close code %d, want 3000", s.closed)
+	}
+
+	s = &recvSession{}
+	c = k.NewClient("")
+	c.session = s
+	c.markHandshaken()
+	c.markHandshaken() // only the first call completes the handshake
+	c.closeUnlessHandshaken(time.Now().Add(time.Hour), make(chan struct{}))
+
+	if s.closed != 0 {
+		t.Errorf("handshaken session is closed with %d", s.closed)
+	}
+
+	accepted := time.Now().Add(-time.Minute)
+	if got, ok := acceptTime(withAcceptTime(context.Background(), accepted)); !ok || !got.Equal(accepted) {
+		t.Errorf("got accept time %s, %t, want %s", got, ok, accepted)
+	}
+}
+
+// recvSession is a session receiving the given messages.
+type recvSession struct {
+	messages []string
+	closed   uint32
+}
+
+func (s *recvSession) ID() string                     { return "recv" }
+func (s *recvSession) Send(string) error              { return nil }
+func (s *recvSession) Close(c uint32, _ string) error { s.closed = c; return nil }
+
+func (s *recvSession) Recv() (string, error) {
+	msg := s.messages[0]
+	s.messages = s.messages[1:]
+	return msg, nil
+}
+
+func TestClientMaxMessageSize(t *testing.T) {
+	k := New("exp", "0.0.1")
+	k.Config.MaxMessageSize = 8
+
+	s := &recvSession{messages: []string{"12345678", "123456789"}}
+	c := k.NewClient("")
+	c.session = s
+
+	if _, err := c.receiveData(); err != nil {
+		t.Fatalf("message of the limit size is rejected: %s", err)
+	}
+
+	if _, err := c.receiveData(); err != ErrMessageTooLarge {
+		t.Fatalf("got %v, want ErrMessageTooLarge", err)
+	}
+
+	if s.closed != closeMessageTooLarge {
+		t.Errorf("got close code %d, want %d", s.closed, closeMessageTooLarge)
+	}
+}
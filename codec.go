@@ -0,0 +1,189 @@
+package kite
+
+import (
+	"reflect"
+
+	"github.com/koding/kite/dnode"
+)
+
+// Codec encodes the arguments and the results of the method calls. dnode's
+// JSON is the default, a more compact encoding like msgpack or CBOR can be
+// used by adding a Codec implementing it to Kite.Codecs of both kites.
+//
+// The codec is negotiated per connection, like the compression. The caller
+// offers its codecs in every call, and the remote kite encodes the results
+// of the accepted calls with the first of its own codecs the caller offers.
+// Once the caller receives a result encoded with a codec, it encodes the
+// arguments of its following calls with it too. The kites that don't support
+// any codec of the other side keep using JSON.
+//
+// The messages stay dnode messages, the encoded data is sent in them base64
+// encoded, as SockJS messages are strings. The arguments and the results
+// containing functions are always sent as JSON, the callbacks are dnode's.
+type Codec interface {
+	// Name identifies the codec in the negotiation, like "msgpack".
+	Name() string
+
+	// Marshal encodes v.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes data into v. It must be able to decode into an
+	// interface{}, see dnode.Codec.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// codecResponse is a Response with the result encoded with a Codec.
+type codecResponse struct {
+	Response
+
+	Codec         string `json:"codec"`
+	EncodedResult []byte `json:"encodedResult"`
+}
+
+// codec returns the codec of the kite with the given name, nil if the kite
+// doesn't support it.
+func (k *Kite) codec(name string) Codec {
+	for _, c := range k.Codecs {
+		if c.Name() == name {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// codecNames returns the names of the codecs of the kite, which are offered
+// to the remote kites.
+func (k *Kite) codecNames() []string {
+	names := make([]string, len(k.Codecs))
+	for i, c := range k.Codecs {
+		names[i] = c.Name()
+	}
+
+	return names
+}
+
+// acceptCodec returns the first codec of the kite that is in the offered
+// ones, nil if there is none.
+func (k *Kite) acceptCodec(offered []string) Codec {
+	for _, c := range k.Codecs {
+		for _, name := range offered {
+			if c.Name() == name {
+				return c
+			}
+		}
+	}
+
+	return nil
+}
+
+// negotiatedCodec returns the codec the remote kite is known to accept, nil
+// if it's not negotiated yet.
+func (c *Client) negotiatedCodec() Codec {
+	c.codecMu.Lock()
+	defer c.codecMu.Unlock()
+	return c.codec
+}
+
+func (c *Client) setCodec(codec Codec) {
+	c.codecMu.Lock()
+	c.codec = codec
+	c.codecMu.Unlock()
+}
+
+// encodeArgs encodes the arguments of the call with the codec, unless they
+// contain functions. The arguments are sent as JSON if they can't be encoded.
+func (c *Client) encodeArgs(codec Codec, options *callOptionsOut) {
+	if hasFunctions(reflect.ValueOf(options.WithArgs)) {
+		return
+	}
+
+	data, err := codec.Marshal(options.WithArgs)
+	if err != nil {
+		c.LocalKite.Log.Warning("Cannot encode arguments with %s, sending them as JSON: %s", codec.Name(), err)
+		return
+	}
+
+	options.Codec = codec.Name()
+	options.EncodedArgs = data
+	options.WithArgs = nil
+}
+
+// encodeResult returns the response to send with the result encoded with
+// the codec, or the response as is if it can't be encoded.
+func (c *Client) encodeResult(codec Codec, response Response) interface{} {
+	if response.Error != nil || response.Result == nil || hasFunctions(reflect.ValueOf(response.Result)) {
+		return response
+	}
+
+	data, err := codec.Marshal(response.Result)
+	if err != nil {
+		c.LocalKite.Log.Warning("Cannot encode result with %s, sending it as JSON: %s", codec.Name(), err)
+		return response
+	}
+
+	return codecResponse{Codec: codec.Name(), EncodedResult: data}
+}
+
+var functionType = reflect.TypeOf(dnode.Function{})
+
+// hasFunctions returns true if v contains a function, which can only be sent
+// as a dnode callback.
+func hasFunctions(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Func:
+		return true
+	case reflect.Interface, reflect.Ptr:
+		return !v.IsNil() && hasFunctions(v.Elem())
+	case reflect.Struct:
+		if v.Type() == functionType {
+			return true
+		}
+
+		for i := 0; i < v.NumField(); i++ {
+			if hasFunctions(v.Field(i)) {
+				return true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		// the large arrays of numbers are not walked
+		if !mayHaveFunctions(v.Type().Elem()) {
+			return false
+		}
+
+		for i := 0; i < v.Len(); i++ {
+			if hasFunctions(v.Index(i)) {
+				return true
+			}
+		}
+	case reflect.Map:
+		if !mayHaveFunctions(v.Type().Elem()) {
+			return false
+		}
+
+		iter := v.MapRange()
+		for iter.Next() {
+			if hasFunctions(iter.Value()) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// mayHaveFunctions returns false if the values of type t can't contain a
+// function.
+func mayHaveFunctions(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return false
+	case reflect.Slice, reflect.Array, reflect.Ptr:
+		return mayHaveFunctions(t.Elem())
+	}
+
+	return true
+}
@@ -0,0 +1,188 @@
+package kite
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/dnode"
+)
+
+// prefixCodec is JSON with a prefix, so the data it encodes can't be
+// mistaken for JSON.
+type prefixCodec struct{}
+
+func (prefixCodec) Name() string { return "prefix" }
+
+func (prefixCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	return append([]byte("prefix:"), data...), err
+}
+
+func (prefixCodec) Unmarshal(data []byte, v interface{}) error {
+	if !bytes.HasPrefix(data, []byte("prefix:")) {
+		return errors.New("data is not encoded with prefixCodec")
+	}
+
+	return json.Unmarshal(data[len("prefix:"):], v)
+}
+
+// pipeSession is a session sending the messages to another pipeSession,
+// recording them.
+type pipeSession struct {
+	in, out chan string
+
+	mu   sync.Mutex
+	sent []string
+}
+
+func (s *pipeSession) ID() string                 { return "pipe" }
+func (s *pipeSession) Close(uint32, string) error { return nil }
+func (s *pipeSession) Recv() (string, error)      { return <-s.in, nil }
+
+func (s *pipeSession) Send(msg string) error {
+	s.mu.Lock()
+	s.sent = append(s.sent, msg)
+	s.mu.Unlock()
+
+	s.out <- msg
+	return nil
+}
+
+func (s *pipeSession) lastSent() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent[len(s.sent)-1]
+}
+
+// connectPipe connects a client of the caller to a client of the callee in
+// process, and returns the session of the caller.
+func connectPipe(caller, callee *Kite) (*Client, *pipeSession) {
+	callerToCallee, calleeToCaller := make(chan string, 16), make(chan string, 16)
+
+	c := caller.NewClient("")
+	s := &pipeSession{in: calleeToCaller, out: callerToCallee}
+	c.session = s
+
+	remote := callee.NewClient("")
+	remote.session = &pipeSession{in: callerToCallee, out: calleeToCaller}
+
+	go c.readLoop()
+	go remote.readLoop()
+
+	return c, s
+}
+
+func newSumKite(codecs ...Codec) *Kite {
+	k := New("sum", "0.0.1")
+	k.Codecs = codecs
+	k.HandleFunc("sum", func(r *Request) (interface{}, error) {
+		var nums []float64
+		r.Args.One().MustUnmarshal(&nums)
+
+		var sum float64
+		for _, n := range nums {
+			sum += n
+		}
+
+		return map[string]float64{"sum": sum}, nil
+	}).DisableAuthentication()
+
+	return k
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	caller := New("caller", "0.0.1")
+	caller.Codecs = []Codec{prefixCodec{}}
+
+	c, s := connectPipe(caller, newSumKite(prefixCodec{}))
+
+	for i := 0; i < 2; i++ {
+		result, err := c.TellWithTimeout("sum", time.Second, []float64{1, 2, 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Codec == nil {
+			t.Errorf("call %d: result is not encoded with the codec", i)
+		}
+
+		if sum := result.MustMap()["sum"].MustFloat64(); sum != 6 {
+			t.Errorf("call %d: got sum %v, want 6", i, sum)
+		}
+
+		// the arguments are encoded once the codec is negotiated by
+		// the first result
+		if encoded := strings.Contains(s.lastSent(), `"encodedArgs"`); encoded != (i == 1) {
+			t.Errorf("call %d: arguments encoded: %t", i, encoded)
+		}
+	}
+
+	// the callbacks are dnode's, so the arguments with functions are JSON
+	f := dnode.Callback(func(*dnode.Partial) {})
+	if _, err := c.TellWithTimeout("sum", time.Second, []interface{}{1, 2, f}); err == nil {
+		t.Error("expected an error for the invalid arguments")
+	}
+
+	if strings.Contains(s.lastSent(), `"encodedArgs"`) {
+		t.Error("arguments with functions are encoded")
+	}
+}
+
+func TestCodecFallback(t *testing.T) {
+	caller := New("caller", "0.0.1")
+	caller.Codecs = []Codec{prefixCodec{}}
+
+	// the callee doesn't support the codec of the caller
+	c, s := connectPipe(caller, newSumKite())
+
+	for i := 0; i < 2; i++ {
+		result, err := c.TellWithTimeout("sum", time.Second, []float64{1, 2, 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Codec != nil {
+			t.Errorf("call %d: result is encoded", i)
+		}
+
+		if sum := result.MustMap()["sum"].MustFloat64(); sum != 6 {
+			t.Errorf("call %d: got sum %v, want 6", i, sum)
+		}
+
+		if strings.Contains(s.lastSent(), `"encodedArgs"`) {
+			t.Errorf("call %d: arguments are encoded", i)
+		}
+	}
+
+	if c.negotiatedCodec() != nil {
+		t.Error("codec is negotiated with a kite not supporting it")
+	}
+}
+
+func TestHasFunctions(t *testing.T) {
+	f := dnode.Callback(func(*dnode.Partial) {})
+
+	tests := []struct {
+		v    interface{}
+		want bool
+	}{
+		{[]float64{1, 2, 3}, false},
+		{map[string]interface{}{"a": "b", "c": []int{1}}, false},
+		{[]interface{}{1, f}, true},
+		{map[string]interface{}{"cb": f}, true},
+		{struct{ F func() }{}, true},
+		{&struct{ D dnode.Function }{}, true},
+	}
+
+	for _, test := range tests {
+		if got := hasFunctions(reflect.ValueOf(test.v)); got != test.want {
+			t.Errorf("%#v: got %t, want %t", test.v, got, test.want)
+		}
+	}
+}
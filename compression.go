@@ -0,0 +1,77 @@
+package kite
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+)
+
+// compressionGzip is the only compression supported for now.
+const compressionGzip = "gzip"
+
+// compressMinSize is the size of the smallest message that is compressed.
+// Smaller messages don't get smaller enough to be worth it.
+const compressMinSize = 1024
+
+// gzipPrefix marks the compressed messages. The dnode messages are JSON
+// objects, so they can't start with it. The compressed data is base64
+// encoded, because the SockJS messages are strings.
+var gzipPrefix = []byte("gzip:")
+
+// isCompressed returns true if msg is compressed with compressMessage.
+func isCompressed(msg []byte) bool {
+	return bytes.HasPrefix(msg, gzipPrefix)
+}
+
+// compressMessage compresses the given dnode message.
+func compressMessage(msg []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(gzipPrefix)
+
+	enc := base64.NewEncoder(base64.StdEncoding, &buf)
+	zw := gzip.NewWriter(enc)
+
+	if _, err := zw.Write(msg); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompressMessage returns the dnode message compressed with
+// compressMessage. It returns ErrMessageTooLarge if the decompressed message
+// is larger than limit, unless it's zero.
+func decompressMessage(msg []byte, limit int64) ([]byte, error) {
+	msg = bytes.TrimPrefix(msg, gzipPrefix)
+
+	zr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(msg)))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	if limit <= 0 {
+		return ioutil.ReadAll(zr)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(zr, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > limit {
+		return nil, ErrMessageTooLarge
+	}
+
+	return data, nil
+}
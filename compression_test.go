@@ -0,0 +1,137 @@
+package kite
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+
+	"github.com/koding/kite/dnode"
+)
+
+// largeMessage returns a dnode message with a representative payload, a
+// list of records like the ones returned by the methods of our kites.
+func largeMessage() []byte {
+	type record struct {
+		ID       int     `json:"id"`
+		Name     string  `json:"name"`
+		Status   string  `json:"status"`
+		Hostname string  `json:"hostname"`
+		Load     float64 `json:"load"`
+	}
+
+	records := make([]record, 500)
+	for i := range records {
+		records[i] = record{
+			ID:       i,
+			Name:     "vm-" + string(rune('a'+i%26)),
+			Status:   "running",
+			Hostname: "kontainer.koding.com",
+			Load:     float64(i%100) / 100,
+		}
+	}
+
+	args, _ := json.Marshal([]interface{}{map[string]interface{}{"result": records}})
+	msg, _ := json.Marshal(dnode.Message{
+		Method:    float64(1),
+		Arguments: &dnode.Partial{Raw: args},
+	})
+
+	return msg
+}
+
+func TestCompressMessage(t *testing.T) {
+	msg := largeMessage()
+
+	compressed, err := compressMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isCompressed(compressed) || isCompressed(msg) {
+		t.Fatal("compressed messages are not detected")
+	}
+
+	if len(compressed) >= len(msg) {
+		t.Errorf("message is not smaller after compression: %d >= %d", len(compressed), len(msg))
+	}
+
+	got, err := decompressMessage(compressed, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, msg) {
+		t.Errorf("decompressed message differs: %s", got)
+	}
+}
+
+func BenchmarkCompressMessage(b *testing.B) {
+	msg := largeMessage()
+
+	var compressed []byte
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var err error
+		if compressed, err = compressMessage(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportMetric(float64(len(msg)), "raw-bytes/msg")
+	b.ReportMetric(float64(len(compressed)), "wire-bytes/msg")
+}
+
+func TestDecompressMessageLimit(t *testing.T) {
+	msg := largeMessage()
+
+	compressed, err := compressMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := decompressMessage(compressed, int64(len(msg))); err != nil {
+		t.Errorf("message of the limit size is rejected: %s", err)
+	}
+
+	if _, err := decompressMessage(compressed, int64(len(msg)-1)); err != ErrMessageTooLarge {
+		t.Errorf("got %v, want ErrMessageTooLarge", err)
+	}
+}
+
+func TestReceiveCompressed(t *testing.T) {
+	msg := largeMessage()
+
+	compressed, err := compressMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := New("testkite", "0.0.1")
+	k.Config.Compression = true
+
+	c := k.NewClient("")
+	c.session = &recvSession{messages: []string{string(compressed), string(compressed)}}
+
+	// compression is not negotiated yet
+	data, err := c.receiveData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, compressed) {
+		t.Error("message is decompressed before negotiating compression")
+	}
+
+	atomic.StoreInt32(&c.compress, 1)
+
+	if data, err = c.receiveData(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, msg) {
+		t.Errorf("message is not decompressed after negotiating compression")
+	}
+}
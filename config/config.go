@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/koding/kite/kitekey"
 )
@@ -20,15 +22,177 @@ type Config struct {
 	DisableAuthentication bool
 	DisableConcurrency    bool
 
+	// MaxConcurrentCalls limits the messages handled at the same time for
+	// each connection, and MaxConcurrentCallsTotal the authenticated method
+	// calls handled at the same time for all of them. The calls above the
+	// limits are rejected with a "tooManyRequests" error. Zero means no
+	// limit.
+	MaxConcurrentCalls      int
+	MaxConcurrentCallsTotal int
+
+	// IdleTimeout closes the connections of the kites that don't send any
+	// message for the given duration. Kites don't ping the servers they
+	// are connected to, so it should be longer than the expected silence
+	// of the long lived connections. Zero disables it, which is the
+	// default.
+	IdleTimeout time.Duration
+
+	// PingInterval is the interval the server sends heartbeat frames to the
+	// connected kites, so dead TCP connections are detected by the failing
+	// writes. It's 25 seconds if zero.
+	PingInterval time.Duration
+
+	// HandshakeTimeout is the longest duration a connection is given to
+	// complete its handshake, the TLS handshake and the websocket upgrade,
+	// both when dialing a kite and when accepting a connection. The
+	// accepted connections must also make their first authenticated call
+	// within the same duration since they are accepted. The connection is
+	// closed if it doesn't complete in time. Zero disables it, the default
+	// is 30 seconds.
+	HandshakeTimeout time.Duration
+
+	// TokenLeeway is the clock skew tolerated when checking the expiration
+	// (exp) and the not before (nbf) times of the tokens and kite keys, so
+	// the tokens of a kite whose clock is a few seconds off are not
+	// rejected. Zero disables it, the default is 60 seconds.
+	TokenLeeway time.Duration
+
+	// MaxMessageSize is the size of the largest message, in bytes, that is
+	// accepted from the connected kites, after decompression. The
+	// connections sending larger messages are closed. Zero disables the
+	// limit, the default is 16 MB.
+	MaxMessageSize int64
+
+	// SendQueueSize is the number of outgoing messages queued for each
+	// connection, 512 if zero. SendQueuePolicy defines what happens when
+	// the queue of a peer that can't keep up is full, and
+	// SendQueueTimeout the longest duration the senders are blocked with
+	// the SendQueueBlock policy, forever if zero.
+	SendQueueSize    int
+	SendQueuePolicy  SendQueuePolicy
+	SendQueueTimeout time.Duration
+
+	// DisablePanicRecovery makes the kite crash on the panics of the method
+	// handlers. By default they are recovered, logged and sent back to the
+	// caller as errors, so the kite keeps serving the other requests.
+	DisablePanicRecovery bool
+
+	// RegisterTTL is the duration after which kontrol removes the kite if it
+	// doesn't send any heartbeats. Useful for short living kites, kontrol's
+	// default is used if zero.
+	RegisterTTL time.Duration
+
+	// HeartbeatJitter randomizes the interval of the heartbeats sent to
+	// kontrol by the given fraction, like 0.1 for ±10%, so many kites
+	// started at the same time don't send their heartbeats in sync. The
+	// first heartbeat is delayed by a random duration too.
+	HeartbeatJitter float64
+
+	// HeartbeatFailureThreshold is the number of consecutive heartbeats
+	// that fail to reach kontrol after which the Kite.OnHeartbeatFailure
+	// handlers are called. Each heartbeat is acknowledged with a ping to
+	// kontrol if it's set. Zero disables it.
+	HeartbeatFailureThreshold int
+
+	// Capabilities are advertised to kontrol on registration, like "gpu" or
+	// "ssd", so other kites can query kites by them.
+	Capabilities []string
+
+	// Tags are registered to kontrol as free-form labels of the kite, like
+	// "team:payments" or "tier:canary", so the kites can be grouped and
+	// queried by them.
+	Tags []string
+
+	// Weight is the share of the traffic the kite should receive relative
+	// to the other kites of a query, like 2 for a kite running on a machine
+	// twice as large. It's 1 if zero. See kite.WeightedPick.
+	Weight float64
+
+	// HealthScore is called on registration and with each heartbeat to
+	// kontrol. The kite is registered with Weight multiplied by the
+	// returned score, which is clamped to [0, 1], so an overloaded or
+	// unhealthy kite receives less traffic without being evicted. It's
+	// optional.
+	HealthScore func() float64
+
+	// AlternateURLs are registered to kontrol in addition to the kite's
+	// URL, like an internal ws URL of a kite that is registered with its
+	// public wss URL.
+	AlternateURLs []string
+
+	// Compression compresses the large messages exchanged with the kites
+	// that have it enabled too. It's negotiated on each connection, the
+	// messages to other kites are not compressed.
+	Compression bool
+
+	// Tracing enables the OpenTelemetry spans of the method calls, with the
+	// global tracer provider and propagator. The trace context is sent with
+	// the calls, so the spans of the remote kites are children of the
+	// callers' spans.
+	Tracing bool
+
+	// Readiness is called by the "kite.health" method to tell whether the
+	// kite is ready to serve requests, like when its database is reachable.
+	// A non-nil error marks the kite as not ready. It's optional.
+	Readiness func() error
+
 	// Options for Server
 	IP   string
 	Port int
 
+	// TLSCertFile and TLSKeyFile make the server serve https and wss with
+	// the certificate of the given PEM files. The kite is registered to
+	// kontrol with its https URL. The certificate is reloaded on SIGHUP.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSClientCAFile enables mutual TLS on the server. Only the clients
+	// presenting a certificate signed by one of the CAs in the PEM file can
+	// connect, see Client.PeerCertificates. The kites still authenticate
+	// with their tokens too.
+	TLSClientCAFile string
+
+	// TLSClientCertFile and TLSClientKeyFile are the client certificate
+	// presented to the kites that require mutual TLS.
+	TLSClientCertFile string
+	TLSClientKeyFile  string
+
 	KontrolURL  string
 	KontrolKey  string
 	KontrolUser string
+
+	// KontrolURLs are the kontrols to fail over to when KontrolURL can't
+	// be connected. They are tried in order, the kite is registered again
+	// to the one it's connected to.
+	KontrolURLs []string
+
+	// DiscoveryCacheTTL enables caching the results of GetKites for the
+	// given duration. After it, the cached kites are still returned for
+	// DiscoveryCacheStaleTTL while they are refreshed in the background, so
+	// the last known kites are served while kontrol is unreachable. The
+	// expired tokens of the cached kites are renewed from kontrol, they are
+	// served as they are if kontrol can't renew them.
+	DiscoveryCacheTTL      time.Duration
+	DiscoveryCacheStaleTTL time.Duration
 }
 
+// SendQueuePolicy defines how the messages are sent to a peer whose send
+// queue is full.
+type SendQueuePolicy int
+
+const (
+	// SendQueueBlock blocks the senders until there's room in the queue,
+	// for at most Config.SendQueueTimeout. This is the default.
+	SendQueueBlock SendQueuePolicy = iota
+
+	// SendQueueDropOldest drops the oldest queued message to make room for
+	// the new one.
+	SendQueueDropOldest
+
+	// SendQueueDisconnect closes the connection to the peer.
+	SendQueueDisconnect
+)
+
 // DefaultConfig contains the default settings.
 var DefaultConfig = &Config{
 	Username:    "unknown",
@@ -36,6 +200,11 @@ var DefaultConfig = &Config{
 	Region:      "unknown",
 	IP:          "0.0.0.0",
 	Port:        0,
+
+	HeartbeatJitter:  0.1,
+	MaxMessageSize:   16 << 20,
+	HandshakeTimeout: 30 * time.Second,
+	TokenLeeway:      60 * time.Second,
 }
 
 // New returns a new Config initialized with defaults.
@@ -71,10 +240,43 @@ func (c *Config) ReadEnvironmentVariables() error {
 		}
 	}
 
+	if size := os.Getenv("KITE_MAX_MESSAGE_SIZE"); size != "" {
+		c.MaxMessageSize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+
+	if timeout := os.Getenv("KITE_HANDSHAKE_TIMEOUT"); timeout != "" {
+		c.HandshakeTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	if leeway := os.Getenv("KITE_TOKEN_LEEWAY"); leeway != "" {
+		c.TokenLeeway, err = time.ParseDuration(leeway)
+		if err != nil {
+			return err
+		}
+	}
+
 	if kontrolURL := os.Getenv("KITE_KONTROL_URL"); kontrolURL != "" {
 		c.KontrolURL = kontrolURL
 	}
 
+	if kontrolURLs := os.Getenv("KITE_KONTROL_URLS"); kontrolURLs != "" {
+		c.KontrolURLs = strings.Split(kontrolURLs, ",")
+	}
+
+	if certFile := os.Getenv("KITE_TLS_CERT_FILE"); certFile != "" {
+		c.TLSCertFile = certFile
+	}
+
+	if keyFile := os.Getenv("KITE_TLS_KEY_FILE"); keyFile != "" {
+		c.TLSKeyFile = keyFile
+	}
+
 	return nil
 }
 
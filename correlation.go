@@ -0,0 +1,57 @@
+package kite
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a copy of ctx carrying the given correlation ID.
+// The calls made with TellWithContext and GoWithContext send it to the
+// remote kite, so the calls made while handling a request can be traced
+// back to it.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation ID of ctx, or an empty string if it
+// doesn't have any.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// newCorrelationID returns a new random correlation ID.
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// correlationLogger prefixes the messages with a correlation ID.
+type correlationLogger struct {
+	Logger
+	id string
+}
+
+func (l *correlationLogger) Fatal(format string, args ...interface{}) {
+	l.Logger.Fatal("["+l.id+"] "+format, args...)
+}
+
+func (l *correlationLogger) Error(format string, args ...interface{}) {
+	l.Logger.Error("["+l.id+"] "+format, args...)
+}
+
+func (l *correlationLogger) Warning(format string, args ...interface{}) {
+	l.Logger.Warning("["+l.id+"] "+format, args...)
+}
+
+func (l *correlationLogger) Info(format string, args ...interface{}) {
+	l.Logger.Info("["+l.id+"] "+format, args...)
+}
+
+func (l *correlationLogger) Debug(format string, args ...interface{}) {
+	l.Logger.Debug("["+l.id+"] "+format, args...)
+}
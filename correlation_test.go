@@ -0,0 +1,44 @@
+package kite
+
+import (
+	"context"
+	"testing"
+
+	"github.com/koding/kite/dnode"
+)
+
+func TestCorrelationID(t *testing.T) {
+	ctx := WithCorrelationID(context.Background(), "1234")
+	if id := CorrelationID(ctx); id != "1234" {
+		t.Errorf("expected correlation id 1234, got %q", id)
+	}
+
+	if id := CorrelationID(context.Background()); id != "" {
+		t.Errorf("expected no correlation id, got %q", id)
+	}
+
+	k := New("testkite", "0.0.1")
+	c := k.NewClient("http://localhost:3999/kite")
+
+	args := c.wrapMethodArgs(ctx, nil, dnode.Function{})
+	if id := args[0].(callOptionsOut).CorrelationID; id != "1234" {
+		t.Errorf("expected correlation id 1234 in the call options, got %q", id)
+	}
+
+	// the client isn't connected, skip the first request handlers
+	c.firstRequestHandlersNotified.Do(func() {})
+
+	request, _ := c.newRequest("foo", &dnode.Partial{Raw: []byte(`[{"correlationId":"1234"}]`)})
+	if request.CorrelationID != "1234" {
+		t.Errorf("expected correlation id 1234 in the request, got %q", request.CorrelationID)
+	}
+
+	if id := CorrelationID(request.Ctx); id != "1234" {
+		t.Errorf("expected correlation id 1234 in the request context, got %q", id)
+	}
+
+	request, _ = c.newRequest("foo", &dnode.Partial{Raw: []byte(`[{}]`)})
+	if request.CorrelationID == "" {
+		t.Error("expected a generated correlation id")
+	}
+}
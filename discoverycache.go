@@ -0,0 +1,206 @@
+package kite
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite/protocol"
+)
+
+// discoveryCache keeps the kites kontrol returned for the queries of
+// GetKites, see Config.DiscoveryCacheTTL.
+type discoveryCache struct {
+	mu      sync.Mutex
+	entries map[string]*discoveryEntry
+}
+
+type discoveryEntry struct {
+	kites      []*protocol.KiteWithToken
+	fetchedAt  time.Time
+	refreshing bool
+}
+
+func newDiscoveryCache() *discoveryCache {
+	return &discoveryCache{
+		entries: make(map[string]*discoveryEntry),
+	}
+}
+
+// discoveryKey returns the cache key of the query.
+func discoveryKey(query *protocol.KontrolQuery) string {
+	key, _ := json.Marshal(query)
+	return string(key)
+}
+
+// get returns the kites of the key if they are fetched within ttl+staleTTL,
+// along with the time since they are fetched. refresh is true if they are
+// older than ttl and the caller should refresh them, it's true only for one
+// caller until set is called.
+func (c *discoveryCache) get(key string, ttl, staleTTL time.Duration) (kites []*protocol.KiteWithToken, age time.Duration, ok, refresh bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, 0, false, false
+	}
+
+	age = time.Since(e.fetchedAt)
+	if age > ttl+staleTTL {
+		return nil, 0, false, false
+	}
+
+	if age > ttl && !e.refreshing {
+		e.refreshing = true
+		refresh = true
+	}
+
+	return e.kites, age, true, refresh
+}
+
+// set stores the kites of the key.
+func (c *discoveryCache) set(key string, kites []*protocol.KiteWithToken) {
+	c.mu.Lock()
+	c.entries[key] = &discoveryEntry{
+		kites:     kites,
+		fetchedAt: time.Now(),
+	}
+	c.mu.Unlock()
+}
+
+// setTokens replaces the kites of the key with the ones with renewed tokens,
+// the entry is kept as fresh or stale as it was.
+func (c *discoveryCache) setTokens(key string, kites []*protocol.KiteWithToken) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		e.kites = kites
+	}
+	c.mu.Unlock()
+}
+
+// refreshFailed lets the next caller refresh the kites of the key again.
+func (c *discoveryCache) refreshFailed(key string) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		e.refreshing = false
+	}
+	c.mu.Unlock()
+}
+
+// OnStaleKites registers a function to run when GetKites returns the kites
+// of a query from the discovery cache that are older than
+// Config.DiscoveryCacheTTL, like while kontrol is unreachable. It's called
+// with the query and the time since the kites are fetched from kontrol.
+func (k *Kite) OnStaleKites(handler func(query *protocol.KontrolQuery, age time.Duration)) {
+	k.onStaleKitesHandlers = append(k.onStaleKitesHandlers, handler)
+}
+
+// getCachedKites returns the kites of the query from the discovery cache, or
+// fetches them from kontrol if they are not cached. Stale kites are
+// returned while they are refreshed in the background, so the last known
+// kites are served while kontrol is unreachable, see OnStaleKites.
+func (k *Kite) getCachedKites(query *protocol.KontrolQuery) ([]*protocol.KiteWithToken, error) {
+	cache := k.kontrol.cache
+	key := discoveryKey(query)
+	ttl := k.Config.DiscoveryCacheTTL
+
+	kites, age, ok, refresh := cache.get(key, ttl, k.Config.DiscoveryCacheStaleTTL)
+	if ok {
+		if refresh {
+			go func() {
+				result, err := k.fetchKites(protocol.GetKitesArgs{Query: query})
+				if err != nil {
+					k.Log.Warning("Cannot refresh the kites of query %s, serving stale ones: %s", query, err)
+					cache.refreshFailed(key)
+					return
+				}
+
+				cache.set(key, result.Kites)
+			}()
+		}
+
+		if age > ttl {
+			for _, handler := range k.onStaleKitesHandlers {
+				handler(query, age)
+			}
+		}
+
+		// the tokens may expire before the kites do. If they can't be
+		// renewed, like when kontrol is unreachable, the kites are served
+		// with their tokens, the kites may still accept them for a while
+		// with their leeway.
+		renewed, err := k.renewExpiredTokens(kites)
+		if err != nil {
+			k.Log.Warning("Cannot renew the tokens of the cached kites of query %s: %s", query, err)
+			return kites, nil
+		}
+
+		if renewed != nil {
+			cache.setTokens(key, renewed)
+			kites = renewed
+		}
+
+		return kites, nil
+	}
+
+	result, err := k.fetchKites(protocol.GetKitesArgs{Query: query})
+	if err != nil {
+		return nil, err
+	}
+
+	cache.set(key, result.Kites)
+	return result.Kites, nil
+}
+
+// renewExpiredTokens returns the kites with their expired tokens replaced by
+// new ones, fetched with a single getTokens request. The kites kontrol
+// can't issue a token for, like the ones that are gone, are left out. It
+// returns nil if none of the tokens is expired. The given kites are not
+// modified, they are shared by the callers of the cache.
+func (k *Kite) renewExpiredTokens(kites []*protocol.KiteWithToken) ([]*protocol.KiteWithToken, error) {
+	var ids []string
+	for _, kt := range kites {
+		if tokenExpired(kt.Token, k.RSAKey) {
+			ids = append(ids, kt.Kite.ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	result, err := k.GetTokens(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	renewed := make([]*protocol.KiteWithToken, 0, len(kites))
+	for _, kt := range kites {
+		if !tokenExpired(kt.Token, k.RSAKey) {
+			renewed = append(renewed, kt)
+			continue
+		}
+
+		token, ok := result.Tokens[kt.Kite.ID]
+		if !ok {
+			k.Log.Warning("Cannot renew the token of cached kite %s: %s", kt.Kite.ID, result.Errors[kt.Kite.ID])
+			continue
+		}
+
+		kite := *kt
+		kite.Token = token
+		renewed = append(renewed, &kite)
+	}
+
+	return renewed, nil
+}
+
+// tokenExpired returns true if the token is rejected only because it's
+// expired.
+func tokenExpired(token string, keyFunc jwt.Keyfunc) bool {
+	_, err := jwt.Parse(token, keyFunc)
+	vErr, ok := err.(*jwt.ValidationError)
+	return ok && vErr.Errors == jwt.ValidationErrorExpired
+}
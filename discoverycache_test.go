@@ -0,0 +1,135 @@
+package kite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/testkeys"
+)
+
+func TestDiscoveryCache(t *testing.T) {
+	c := newDiscoveryCache()
+	key := discoveryKey(&protocol.KontrolQuery{Username: "devrim", Name: "mathworker"})
+
+	if _, _, ok, _ := c.get(key, time.Minute, time.Minute); ok {
+		t.Fatal("expected a cache miss")
+	}
+
+	c.set(key, []*protocol.KiteWithToken{{URL: "http://localhost:3636/kite"}})
+
+	kites, age, ok, refresh := c.get(key, time.Minute, time.Minute)
+	if !ok || refresh || len(kites) != 1 || age > time.Minute {
+		t.Fatalf("expected a fresh hit, got ok=%t refresh=%t kites=%d", ok, refresh, len(kites))
+	}
+
+	// make the entry stale
+	c.entries[key].fetchedAt = time.Now().Add(-90 * time.Second)
+
+	if _, age, ok, refresh := c.get(key, time.Minute, time.Minute); !ok || !refresh || age < 90*time.Second {
+		t.Errorf("expected a stale hit to be refreshed, got ok=%t refresh=%t age=%s", ok, refresh, age)
+	}
+
+	if _, _, ok, refresh := c.get(key, time.Minute, time.Minute); !ok || refresh {
+		t.Errorf("expected only one refresh, got ok=%t refresh=%t", ok, refresh)
+	}
+
+	c.refreshFailed(key)
+
+	if _, _, _, refresh := c.get(key, time.Minute, time.Minute); !refresh {
+		t.Error("expected a refresh after the failed one")
+	}
+
+	// too old to be served
+	c.entries[key].fetchedAt = time.Now().Add(-3 * time.Minute)
+
+	if _, _, ok, _ := c.get(key, time.Minute, time.Minute); ok {
+		t.Error("expected a miss for the expired entry")
+	}
+}
+
+// signExpiring returns a token of kontrol expiring at exp.
+func signExpiring(t *testing.T, exp time.Time) string {
+	token := jwt.New(jwt.GetSigningMethod("RS256"))
+	token.Claims = map[string]interface{}{"iss": "kontrol", "exp": exp.Unix()}
+
+	signed, err := token.SignedString([]byte(testkeys.Private))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestStaleKites(t *testing.T) {
+	// there is no kontrol to renew the tokens with
+	k := New("stale", "0.0.1")
+	k.Config.KontrolURL = ""
+	k.Config.KontrolUser = "kontrol"
+	k.Config.KontrolKey = testkeys.Public
+	k.Config.DiscoveryCacheTTL = time.Minute
+	k.Config.DiscoveryCacheStaleTTL = time.Minute
+
+	var staleAge time.Duration
+	k.OnStaleKites(func(_ *protocol.KontrolQuery, age time.Duration) {
+		staleAge = age
+	})
+
+	query := &protocol.KontrolQuery{Username: "devrim", Name: "mathworker"}
+	key := discoveryKey(query)
+	expired := signExpiring(t, time.Now().Add(-time.Hour))
+
+	k.kontrol.cache.set(key, []*protocol.KiteWithToken{{URL: "http://localhost:3636/kite", Token: expired}})
+
+	kites, err := k.getCachedKites(query)
+	if err != nil || len(kites) != 1 || kites[0].Token != expired {
+		t.Fatalf("expected the kites with their tokens when they can't be renewed, got %v, %v", kites, err)
+	}
+
+	if staleAge != 0 {
+		t.Errorf("fresh kites are reported as stale: %s", staleAge)
+	}
+
+	// stale, it's being refreshed already
+	e := k.kontrol.cache.entries[key]
+	e.fetchedAt = time.Now().Add(-90 * time.Second)
+	e.refreshing = true
+
+	if kites, err := k.getCachedKites(query); err != nil || len(kites) != 1 {
+		t.Fatalf("expected the stale kites, got %v, %v", kites, err)
+	}
+
+	if staleAge < 90*time.Second {
+		t.Errorf("expected the stale kites to be reported, got age %s", staleAge)
+	}
+}
+
+func TestTokenExpired(t *testing.T) {
+	keyFunc := func(*jwt.Token) (interface{}, error) {
+		return []byte(testkeys.Public), nil
+	}
+
+	if tokenExpired(signExpiring(t, time.Now().Add(time.Hour)), keyFunc) {
+		t.Error("expected a valid token not to be expired")
+	}
+
+	expired := signExpiring(t, time.Now().Add(-time.Hour))
+	if !tokenExpired(expired, keyFunc) {
+		t.Error("expected the token to be expired")
+	}
+
+	// an invalid token can't be renewed
+	if tokenExpired(expired+"x", keyFunc) {
+		t.Error("expected a token with an invalid signature not to be renewed")
+	}
+
+	// none of the cached kites need new tokens
+	k := New("exp", "0.0.1")
+	k.Config.KontrolUser = "kontrol"
+	k.Config.KontrolKey = testkeys.Public
+	kites := []*protocol.KiteWithToken{{Token: signExpiring(t, time.Now().Add(time.Hour))}}
+	if renewed, err := k.renewExpiredTokens(kites); err != nil || renewed != nil {
+		t.Errorf("expected no renewal, got %v, %v", renewed, err)
+	}
+}
@@ -11,11 +11,34 @@ import (
 type Partial struct {
 	Raw           []byte
 	CallbackSpecs []CallbackSpec
+
+	// Codec decodes Raw if it's not JSON, like the arguments and the
+	// results encoded with a codec the kites have negotiated. The data
+	// encoded with it can't contain callbacks.
+	Codec Codec
+}
+
+// Codec encodes and decodes the raw data of a Partial that is not JSON. It
+// must be able to decode into an interface{}, the helpers like Slice and Map
+// decode the data into generic values and encode their elements again.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
 }
 
-// MarshalJSON returns the raw bytes of the Partial.
+// MarshalJSON returns the raw bytes of the Partial. The data encoded with a
+// Codec is converted to JSON.
 func (p *Partial) MarshalJSON() ([]byte, error) {
-	return p.Raw, nil
+	if p.Codec == nil {
+		return p.Raw, nil
+	}
+
+	var v interface{}
+	if err := p.Codec.Unmarshal(p.Raw, &v); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
 }
 
 // UnmarshalJSON puts the data into Partial.Raw.
@@ -36,6 +59,10 @@ func (p *Partial) Unmarshal(v interface{}) error {
 		return fmt.Errorf("Cannot unmarshal nil argument")
 	}
 
+	if p.Codec != nil {
+		return p.Codec.Unmarshal(p.Raw, v)
+	}
+
 	if err := json.Unmarshal(p.Raw, &v); err != nil {
 		return fmt.Errorf("%s. Data: %s", err.Error(), string(p.Raw))
 	}
@@ -62,13 +89,29 @@ func (p *Partial) MustUnmarshal(v interface{}) {
 
 // Slice is a helper method to unmarshal a JSON Array.
 func (p *Partial) Slice() (a []*Partial, err error) {
+	if p != nil && p.Codec != nil {
+		var values []interface{}
+		if err := p.Unmarshal(&values); err != nil {
+			return nil, err
+		}
+
+		a = make([]*Partial, len(values))
+		for i, v := range values {
+			if a[i], err = p.encode(v); err != nil {
+				return nil, err
+			}
+		}
+
+		return a, nil
+	}
+
 	err = p.Unmarshal(&a)
 	return
 }
 
 // SliceOfLength is a helper method to unmarshal a JSON Array with specified length.
 func (p *Partial) SliceOfLength(length int) (a []*Partial, err error) {
-	err = p.Unmarshal(&a)
+	a, err = p.Slice()
 	if err != nil {
 		return
 	}
@@ -82,10 +125,37 @@ func (p *Partial) SliceOfLength(length int) (a []*Partial, err error) {
 
 // Map is a helper method to unmarshal to a JSON Object.
 func (p *Partial) Map() (m map[string]*Partial, err error) {
+	if p != nil && p.Codec != nil {
+		var values map[string]interface{}
+		if err := p.Unmarshal(&values); err != nil {
+			return nil, err
+		}
+
+		m = make(map[string]*Partial, len(values))
+		for k, v := range values {
+			if m[k], err = p.encode(v); err != nil {
+				return nil, err
+			}
+		}
+
+		return m, nil
+	}
+
 	err = p.Unmarshal(&m)
 	return
 }
 
+// encode returns a Partial of v encoded with the Codec of p, for the elements
+// of the data encoded with it.
+func (p *Partial) encode(v interface{}) (*Partial, error) {
+	raw, err := p.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Partial{Raw: raw, Codec: p.Codec}, nil
+}
+
 // String is a helper to unmarshal a JSON String.
 func (p *Partial) String() (s string, err error) {
 	err = p.Unmarshal(&s)
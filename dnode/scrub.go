@@ -80,6 +80,11 @@ func (s *Scrubber) collectFields(v reflect.Value, path Path, callbackMap map[str
 		f := v.Type().Field(i)
 
 		if f.PkgPath != "" { // unexported
+			// The exported fields of an embedded struct of unexported
+			// type are promoted, the struct itself can't be Interface()d.
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				s.collectFields(v.Field(i), path, callbackMap)
+			}
 			continue
 		}
 
@@ -33,6 +33,7 @@ func TestScrub(t *testing.T) {
 			"3": {"E", "f3"},
 			"4": {"f1"},
 		}},
+		{embedding{inner{C: cb}}, map[string]Path{"0": {"c"}}},
 	}
 
 	for i, c := range cases {
@@ -56,6 +57,15 @@ type T struct {
 	E *T
 }
 
+type inner struct {
+	C Function `json:"c"`
+}
+
+// embedding has the exported fields of an unexported type.
+type embedding struct {
+	inner
+}
+
 // Combination of exported/unexported value/pointer receiver methods.
 func (t T) F1(p *Partial)  {}
 func (t T) f2(p *Partial)  {}
@@ -1,6 +1,7 @@
 package kite
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/koding/kite/dnode"
@@ -13,6 +14,86 @@ type Error struct {
 	CodeVal string `json:"code"`
 }
 
+// The standard error codes. The handlers can return errors with them with
+// NewError, so the callers can switch on them with ErrorCode, like for
+// retrying only the calls that failed with CodeUnavailable.
+const (
+	// CodeUnknown is returned by ErrorCode for the errors without a code.
+	CodeUnknown = "unknown"
+
+	// CodeInvalidArgument is for the calls with invalid arguments.
+	CodeInvalidArgument = "invalidArgument"
+
+	// CodeNotFound is for the calls of things that don't exist.
+	CodeNotFound = "notFound"
+
+	// CodeMethodNotFound is for the calls of methods the kite doesn't have.
+	CodeMethodNotFound = "methodNotFound"
+
+	// CodeUnauthenticated is for the calls that can't be authenticated.
+	CodeUnauthenticated = "unauthenticated"
+
+	// CodePermissionDenied is for the authenticated calls that are not
+	// allowed.
+	CodePermissionDenied = "permissionDenied"
+
+	// CodeAlreadyExists is for the calls that create things that exist.
+	CodeAlreadyExists = "alreadyExists"
+
+	// CodeUnavailable is for the calls that can't reach the kite, they can
+	// be retried.
+	CodeUnavailable = "unavailable"
+
+	// CodeTimeout is for the calls that are not responded in time.
+	CodeTimeout = "timeout"
+
+	// CodeTooManyRequests is for the calls rejected because of a limit,
+	// they can be retried later.
+	CodeTooManyRequests = "tooManyRequests"
+
+	// CodeInternal is for the calls that failed because of a bug, like
+	// the panics of the handlers.
+	CodeInternal = "internal"
+)
+
+// NewError returns an error with the given code and formatted message. It's
+// sent to the caller with the code when it's returned from a handler.
+func NewError(code, format string, args ...interface{}) *Error {
+	return &Error{
+		Type:    "genericError",
+		Message: fmt.Sprintf(format, args...),
+		CodeVal: code,
+	}
+}
+
+// ErrorCode returns the code of an error returned from a method call, or
+// CodeUnknown if it doesn't have any. It returns an empty string for nil.
+func ErrorCode(err error) string {
+	var code string
+
+	switch e := err.(type) {
+	case nil:
+		return ""
+	case *Error:
+		if e == nil {
+			return ""
+		}
+		code = e.CodeVal
+	case Error:
+		code = e.CodeVal
+	default:
+		if err == context.DeadlineExceeded {
+			code = CodeTimeout
+		}
+	}
+
+	if code == "" {
+		return CodeUnknown
+	}
+
+	return code
+}
+
 func (e Error) Code() string {
 	return e.CodeVal
 }
@@ -39,6 +120,7 @@ func createError(r interface{}) *Error {
 		kiteErr = &Error{
 			Type:    "argumentError",
 			Message: err.Error(),
+			CodeVal: CodeInvalidArgument,
 		}
 	default:
 		kiteErr = &Error{
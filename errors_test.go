@@ -0,0 +1,47 @@
+package kite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestErrorCode(t *testing.T) {
+	var nilErr *Error
+
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{nil, ""},
+		{nilErr, ""},
+		{NewError(CodeNotFound, "no user %q", "foo"), CodeNotFound},
+		{Error{CodeVal: CodePermissionDenied}, CodePermissionDenied},
+		{errors.New("plain"), CodeUnknown},
+		{context.DeadlineExceeded, CodeTimeout},
+		{createError(errors.New("plain")), CodeUnknown},
+	}
+
+	for i, test := range tests {
+		if code := ErrorCode(test.err); code != test.code {
+			t.Errorf("%d: expected code %q, got %q", i, test.code, code)
+		}
+	}
+}
+
+func TestErrorMarshal(t *testing.T) {
+	data, err := json.Marshal(Response{Error: NewError(CodeNotFound, "no user %q", "foo")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp Response
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if ErrorCode(resp.Error) != CodeNotFound || resp.Error.Message != `no user "foo"` {
+		t.Errorf("unexpected error after unmarshaling: %#v", resp.Error)
+	}
+}
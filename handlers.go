@@ -2,22 +2,31 @@ package kite
 
 import (
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os/exec"
 	"runtime"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"code.google.com/p/go.crypto/ssh/terminal"
 	"github.com/gorilla/websocket"
+	"github.com/koding/kite/dnode"
 	"github.com/koding/kite/sockjsclient"
 	"github.com/koding/kite/systeminfo"
+	"github.com/koding/kite/utils"
 )
 
 func (k *Kite) addDefaultHandlers() {
 	k.HandleFunc("kite.systemInfo", systemInfo)
 	k.HandleFunc("kite.heartbeat", k.handleHeartbeat)
 	k.HandleFunc("kite.ping", handlePing).DisableAuthentication()
+	k.HandleFunc("kite.health", k.handleHealth).DisableAuthentication()
+	k.HandleFunc("kite.methods", k.handleMethods)
+	k.HandleFunc("kite.streamChunk", handleStreamChunk).DisableAuthentication()
+	k.HandleFunc("kite.streamAck", handleStreamAck).DisableAuthentication()
 	k.HandleFunc("kite.tunnel", handleTunnel)
 	k.HandleFunc("kite.log", k.handleLog)
 	k.HandleFunc("kite.print", handlePrint)
@@ -33,22 +42,107 @@ func systemInfo(r *Request) (interface{}, error) {
 	return systeminfo.New()
 }
 
-// handleHeartbeat pings the callback with the given interval seconds.
+// handleHeartbeat pings the callback with the given interval seconds. The
+// interval is randomized by the configured HeartbeatJitter.
 func (k *Kite) handleHeartbeat(r *Request) (interface{}, error) {
 	args := r.Args.MustSliceOfLength(2)
 	seconds := args[0].MustFloat64()
 	ping := args[1].MustFunction()
 
-	go func() {
-		for {
-			time.Sleep(time.Duration(seconds) * time.Second)
-			if err := ping.Call(); err != nil {
+	interval := time.Duration(seconds) * time.Second
+
+	// the heartbeat callback has no response, kontrol is pinged to know
+	// that it's reachable
+	pingKontrol := func() error {
+		_, err := r.Client.TellWithTimeout("kite.ping", interval)
+		return err
+	}
+
+	go k.sendHeartbeats(interval, ping, pingKontrol)
+
+	return nil, nil
+}
+
+// sendHeartbeats calls ping with the given interval. If the calls fail, it
+// keeps trying until Config.HeartbeatFailureThreshold failures in a row, or
+// it stops at the first failure if there is no threshold. It stops when the
+// kite is shut down.
+func (k *Kite) sendHeartbeats(interval time.Duration, ping dnode.Function, pingKontrol func() error) {
+	fraction := k.Config.HeartbeatJitter
+	threshold := k.Config.HeartbeatFailureThreshold
+
+	// the first heartbeat is sent at a random offset within the interval
+	wait := interval
+	if fraction > 0 && interval > 0 {
+		wait = time.Duration(rand.Int63n(int64(interval)))
+	}
+
+	for {
+		select {
+		case <-time.After(wait):
+		case <-k.shutdownC:
+			return
+		}
+
+		wait = utils.Jitter(interval, fraction)
+
+		// the current weight is sent with the heartbeat, so it follows
+		// the health score
+		var pingArgs []interface{}
+		if k.Config.HealthScore != nil {
+			pingArgs = append(pingArgs, k.weight())
+		}
+
+		if err := ping.Call(pingArgs...); err != nil {
+			if failures := k.heartbeatFailed(err); threshold <= 0 || failures >= threshold {
 				return
 			}
+			continue
 		}
-	}()
 
-	return nil, nil
+		if threshold > 0 {
+			if err := pingKontrol(); err != nil {
+				k.heartbeatFailed(err)
+			} else {
+				atomic.StoreInt32(&k.heartbeatFailures, 0)
+			}
+		}
+	}
+}
+
+// OnHeartbeatFailure registers a function to run when the heartbeats to
+// kontrol fail Config.HeartbeatFailureThreshold times in a row, like when
+// the kite is partitioned from kontrol and it's probably evicted. The
+// handler can put the kite into a degraded mode or shut it down, for
+// example. It's called again if the failures continue for another
+// threshold.
+func (k *Kite) OnHeartbeatFailure(handler func(failures int)) {
+	k.onHeartbeatFailureHandlers = append(k.onHeartbeatFailureHandlers, handler)
+}
+
+// HeartbeatFailures returns the number of consecutive heartbeats that failed
+// to reach kontrol.
+func (k *Kite) HeartbeatFailures() int {
+	return int(atomic.LoadInt32(&k.heartbeatFailures))
+}
+
+// heartbeatFailed counts a failed heartbeat and calls the OnHeartbeatFailure
+// handlers once the threshold is reached. It returns the number of failures
+// in a row.
+func (k *Kite) heartbeatFailed(err error) int {
+	failures := int(atomic.AddInt32(&k.heartbeatFailures, 1))
+	k.Log.Warning("Heartbeat to kontrol failed (%d in a row): %s", failures, err)
+
+	threshold := k.Config.HeartbeatFailureThreshold
+	if threshold <= 0 || failures%threshold != 0 {
+		return failures
+	}
+
+	for _, handler := range k.onHeartbeatFailureHandlers {
+		handler(failures)
+	}
+
+	return failures
 }
 
 // handleLog prints a log message to stderr.
@@ -63,6 +157,86 @@ func handlePing(r *Request) (interface{}, error) {
 	return "pong", nil
 }
 
+// Health is the result of the "kite.health" method.
+type Health struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+
+	// Uptime is the number of seconds since the kite is created.
+	Uptime float64 `json:"uptime"`
+
+	// ActiveConnections is the number of kites connected to the kite.
+	ActiveConnections int64 `json:"activeConnections"`
+
+	// Ready is false if the readiness function of the config returned an
+	// error, which is set to Reason.
+	Ready  bool   `json:"ready"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// handleHealth returns the health of the kite, so load balancers and kontrol
+// can probe any kite the same way.
+func (k *Kite) handleHealth(r *Request) (interface{}, error) {
+	return k.health(), nil
+}
+
+func (k *Kite) health() *Health {
+	h := &Health{
+		Name:              k.name,
+		Version:           k.version,
+		Uptime:            time.Since(k.startedAt).Seconds(),
+		ActiveConnections: atomic.LoadInt64(&k.metrics.ActiveConnections),
+		Ready:             true,
+	}
+
+	if k.Config.Readiness != nil {
+		if err := k.Config.Readiness(); err != nil {
+			h.Ready = false
+			h.Reason = err.Error()
+		}
+	}
+
+	return h
+}
+
+// MethodInfo describes a method of a kite, it's returned by the
+// "kite.methods" method.
+type MethodInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	// Authenticated is false if the method can be called without
+	// authentication.
+	Authenticated bool `json:"authenticated"`
+}
+
+// handleMethods returns the methods of the kite sorted by name. The method
+// requires authentication, so the method names are not exposed to the
+// unauthenticated callers.
+func (k *Kite) handleMethods(r *Request) (interface{}, error) {
+	return k.methods(), nil
+}
+
+func (k *Kite) methods() []MethodInfo {
+	methods := make([]MethodInfo, 0, len(k.handlers))
+	for name, m := range k.handlers {
+		methods = append(methods, MethodInfo{
+			Name:          name,
+			Description:   m.description,
+			Authenticated: m.authenticate,
+		})
+	}
+
+	sort.Sort(methodsByName(methods))
+	return methods
+}
+
+type methodsByName []MethodInfo
+
+func (m methodsByName) Len() int           { return len(m) }
+func (m methodsByName) Less(i, j int) bool { return m[i].Name < m[j].Name }
+func (m methodsByName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
 // handlePrint prints a message to stdout.
 func handlePrint(r *Request) (interface{}, error) {
 	return fmt.Print(r.Args.One().MustString())
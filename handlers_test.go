@@ -0,0 +1,136 @@
+package kite
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/dnode"
+)
+
+func TestHealth(t *testing.T) {
+	k := New("testkite", "0.0.1")
+
+	h := k.health()
+	if !h.Ready || h.Name != "testkite" || h.Version != "0.0.1" {
+		t.Errorf("unexpected health: %+v", h)
+	}
+
+	k.Config.Readiness = func() error {
+		return errors.New("database is not reachable")
+	}
+
+	h = k.health()
+	if h.Ready || h.Reason != "database is not reachable" {
+		t.Errorf("expected the kite not to be ready, got %+v", h)
+	}
+}
+
+func TestHeartbeatFailures(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.HeartbeatFailureThreshold = 2
+
+	var calls []int
+	k.OnHeartbeatFailure(func(failures int) {
+		calls = append(calls, failures)
+	})
+
+	for i := 0; i < 5; i++ {
+		k.heartbeatFailed(errors.New("timeout"))
+	}
+
+	if n := k.HeartbeatFailures(); n != 5 {
+		t.Errorf("expected 5 failures, got %d", n)
+	}
+
+	if len(calls) != 2 || calls[0] != 2 || calls[1] != 4 {
+		t.Errorf("expected the handler to be called at 2 and 4 failures, got %v", calls)
+	}
+}
+
+// pingFunc is a heartbeat callback returning the errors in order, nil once
+// they are used up.
+type pingFunc struct {
+	errs  []error
+	calls int
+}
+
+func (p *pingFunc) Call(args ...interface{}) error {
+	p.calls++
+	if len(p.errs) == 0 {
+		return nil
+	}
+
+	err := p.errs[0]
+	p.errs = p.errs[1:]
+	return err
+}
+
+func TestSendHeartbeats(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.HeartbeatFailureThreshold = 3
+
+	var calls []int
+	k.OnHeartbeatFailure(func(failures int) {
+		calls = append(calls, failures)
+	})
+
+	timeout := errors.New("timeout")
+
+	// the failures are reset by the successful ping, then the pings fail
+	// until the threshold
+	ping := &pingFunc{errs: []error{timeout, timeout, nil, timeout, timeout, timeout}}
+	pingKontrol := func() error { return nil }
+
+	done := make(chan struct{})
+	go func() {
+		k.sendHeartbeats(time.Millisecond, dnode.Function{Caller: ping}, pingKontrol)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("heartbeats are not stopped at the threshold")
+	}
+
+	if ping.calls != 6 {
+		t.Errorf("expected 6 pings, got %d", ping.calls)
+	}
+
+	if len(calls) != 1 || calls[0] != 3 {
+		t.Errorf("expected the handler to be called at 3 failures, got %v", calls)
+	}
+}
+
+func TestMethods(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.HandleFunc("square", func(r *Request) (interface{}, error) {
+		return nil, nil
+	}).Description("Returns the square of a number")
+
+	methods := k.methods()
+
+	var found bool
+	for i, m := range methods {
+		if i > 0 && methods[i-1].Name > m.Name {
+			t.Errorf("methods are not sorted: %q is before %q", methods[i-1].Name, m.Name)
+		}
+
+		switch m.Name {
+		case "square":
+			found = true
+			if m.Description != "Returns the square of a number" || !m.Authenticated {
+				t.Errorf("unexpected method info: %+v", m)
+			}
+		case "kite.ping":
+			if m.Authenticated {
+				t.Error("kite.ping should not require authentication")
+			}
+		}
+	}
+
+	if !found {
+		t.Error("square method is not listed")
+	}
+}
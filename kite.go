@@ -12,11 +12,13 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/koding/kite/config"
 	"github.com/koding/kite/protocol"
-	"github.com/nu7hatch/gouuid"
 	"gopkg.in/igm/sockjs-go.v2/sockjs"
 )
 
@@ -51,6 +53,22 @@ type Kite struct {
 	// Keys are the authentication types (options.auth.type).
 	Authenticators map[string]func(*Request) error
 
+	// Authorizer decides whether the authenticated callers can call the
+	// methods, like a MethodAllowlist. If nil, all methods can be called.
+	Authorizer Authorizer
+
+	// IsRevoked, if set, is called with the jti and the sub claims of the
+	// kite keys and the tokens the calls are authenticated with, the calls
+	// are rejected with ErrRevoked if it returns true. The kites verify the
+	// tokens on their own, they don't know about the kites revoked by
+	// kontrol otherwise, see kontrol.RevocationChecker.
+	IsRevoked func(id, username string) bool
+
+	// Codecs are the encodings the kite accepts for the arguments and the
+	// results of the method calls besides JSON, in the order of preference.
+	// See Codec.
+	Codecs []Codec
+
 	// Kontrol keys to trust. Kontrol will issue access tokens for kites
 	// that are signed with the private counterpart of these keys.
 	// Key data must be PEM encoded.
@@ -60,12 +78,17 @@ type Kite struct {
 	handlers     map[string]*Method // method map for exported methods
 	preHandlers  []Handler          // a list of handlers that are executed before any handler
 	postHandlers []Handler          // a list of handlers that are executed after any handler
+	middlewares  []Middleware       // wrapped around every method call, see Use
 
 	// MethodHandling defines how the kite is returning the response for
 	// multiple handlers
 	MethodHandling MethodHandling
 
-	httpHandler http.Handler
+	httpHandler     http.Handler
+	httpHandlerOnce sync.Once // the handler is created with the config on first use
+
+	// metrics are the connection and call counters, see Metrics
+	metrics *Metrics
 
 	// kontrolclient is used to register to kontrol and query third party kites
 	// from kontrol
@@ -80,6 +103,33 @@ type Kite struct {
 	// Handlers to call when a client has disconnected.
 	onDisconnectHandlers []func(*Client)
 
+	// Handlers to call when the kite is shut down, see SetupShutdownHandler.
+	onShutdownHandlers []func()
+
+	// Handlers to call when the heartbeats to kontrol fail, and the number
+	// of consecutive failures.
+	onHeartbeatFailureHandlers []func(failures int)
+	heartbeatFailures          int32
+
+	// Handlers to call when a method call is rejected.
+	onRejectedHandlers []func(*Rejection)
+
+	// Handlers to call when stale kites are returned from the discovery
+	// cache, see OnStaleKites.
+	onStaleKitesHandlers []func(*protocol.KontrolQuery, time.Duration)
+
+	// acceptedCalls is the number of authenticated method calls being
+	// handled, see Config.MaxConcurrentCallsTotal
+	acceptedCalls int64
+
+	// calls are the method calls being handled, Shutdown waits for them.
+	// Once shuttingDown is set no more calls are accepted, and shutdownC
+	// is closed to stop the heartbeats.
+	calls        sync.WaitGroup
+	shutdownMu   sync.Mutex // protects shuttingDown and adding to calls
+	shuttingDown bool
+	shutdownC    chan struct{}
+
 	// server fields, are initialized and used when
 	// TODO: move them to their own struct, just like KontrolClient
 	listener  net.Listener
@@ -87,9 +137,10 @@ type Kite struct {
 	readyC    chan bool // To signal when kite is ready to accept connections
 	closeC    chan bool // To signal when kite is closed with Close()
 
-	name    string
-	version string
-	Id      string // Unique kite instance id
+	name      string
+	version   string
+	Id        string    // Unique kite instance id
+	startedAt time.Time // used for the uptime of kite.health
 }
 
 // New creates, initialize and then returns a new Kite instance. Version must
@@ -104,17 +155,13 @@ func New(name, version string) *Kite {
 		panic("kite: version must be 3-digits semantic version")
 	}
 
-	kiteID, err := uuid.NewV4()
-	if err != nil {
-		panic(fmt.Sprintf("kite: cannot generate unique ID: %s", err.Error()))
-	}
-
 	l, setlevel := newLogger(name)
 
 	kClient := &kontrolClient{
 		readyConnected:  make(chan struct{}),
 		readyRegistered: make(chan struct{}),
 		registerChan:    make(chan *url.URL, 1),
+		cache:           newDiscoveryCache(),
 	}
 
 	k := &Kite{
@@ -127,15 +174,16 @@ func New(name, version string) *Kite {
 		preHandlers:        make([]Handler, 0),
 		postHandlers:       make([]Handler, 0),
 		kontrol:            kClient,
+		metrics:            newMetrics(),
 		name:               name,
 		version:            version,
-		Id:                 kiteID.String(),
+		Id:                 protocol.NewKiteID(),
+		startedAt:          time.Now(),
 		readyC:             make(chan bool),
 		closeC:             make(chan bool),
+		shutdownC:          make(chan struct{}),
 	}
 
-	k.httpHandler = sockjs.NewHandler("/kite", sockjs.DefaultOptions, k.sockjsHandler)
-
 	// Add useful debug logs
 	k.OnConnect(func(c *Client) { k.Log.Debug("New session: %s", c.session.ID()) })
 	k.OnFirstRequest(func(c *Client) { k.Log.Debug("Session %q is identified as %q", c.session.ID(), c.Kite) })
@@ -173,6 +221,34 @@ func (k *Kite) TrustKontrolKey(issuer, key string) {
 }
 
 func (k *Kite) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	k.httpHandlerOnce.Do(func() {
+		opts := sockjs.DefaultOptions
+		if k.Config.PingInterval > 0 {
+			opts.HeartbeatDelay = k.Config.PingInterval
+		}
+
+		k.httpHandler = sockjs.NewHandler("/kite", opts, k.sockjsHandler)
+	})
+
+	// the handshake of the connections accepted by other servers starts
+	// with the request
+	if k.Config.HandshakeTimeout > 0 {
+		if _, ok := acceptTime(req.Context()); !ok {
+			req = req.WithContext(withAcceptTime(req.Context(), time.Now()))
+		}
+	}
+
+	// The messages are limited before they are read by the sockjs handler,
+	// the JSON encoding of the transports may double their size. They are
+	// checked again once received, see Client.receiveData.
+	if limit := k.Config.MaxMessageSize; limit > 0 {
+		if isWebsocketUpgrade(req) {
+			w = &limitResponseWriter{ResponseWriter: w, limit: 2*limit + 64}
+		} else if req.Body != nil {
+			req.Body = http.MaxBytesReader(w, req.Body, 2*limit+64)
+		}
+	}
+
 	k.httpHandler.ServeHTTP(w, req)
 }
 
@@ -183,9 +259,41 @@ func (k *Kite) sockjsHandler(session sockjs.Session) {
 	// Since both sides can send/receive messages the client code is reused here.
 	c := k.NewClient("")
 	c.session = session
+	if req := sessionRequest(session); req != nil {
+		c.remoteAddr = req.RemoteAddr
+		if req.TLS != nil {
+			c.peerCertificates = req.TLS.PeerCertificates
+		}
+	}
+
+	atomic.AddInt64(&k.metrics.ActiveConnections, 1)
+	defer atomic.AddInt64(&k.metrics.ActiveConnections, -1)
 
 	k.callOnConnectHandlers(c)
 
+	if k.Config.IdleTimeout > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+
+		go c.closeWhenIdle(k.Config.IdleTimeout, stop)
+	}
+
+	// the handshake started when the connection was accepted, it completes
+	// with the first authenticated call
+	if timeout := k.Config.HandshakeTimeout; timeout > 0 {
+		start := time.Now()
+		if req := sessionRequest(session); req != nil {
+			if t, ok := acceptTime(req.Context()); ok {
+				start = t
+			}
+		}
+
+		stop := make(chan struct{})
+		defer close(stop)
+
+		go c.closeUnlessHandshaken(start.Add(timeout), stop)
+	}
+
 	// Run after methods are registered and delegate is set
 	c.readLoop()
 
@@ -193,6 +301,18 @@ func (k *Kite) sockjsHandler(session sockjs.Session) {
 	k.callOnDisconnectHandlers(c)
 }
 
+// sessionRequest returns the HTTP request that opened the session, or nil if
+// the session doesn't carry it.
+func sessionRequest(session sockjs.Session) *http.Request {
+	if s, ok := session.(interface {
+		Request() *http.Request
+	}); ok {
+		return s.Request()
+	}
+
+	return nil
+}
+
 func (k *Kite) OnConnect(handler func(*Client)) {
 	k.onConnectHandlers = append(k.onConnectHandlers, handler)
 }
@@ -1,6 +1,7 @@
 package kite
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net/http"
@@ -263,3 +264,93 @@ func SquareCB(r *Request) (interface{}, error) {
 
 	return nil, nil
 }
+
+func TestShutdown(t *testing.T) {
+	k := New("testkite", "0.0.1")
+
+	if !k.beginCall() {
+		t.Fatal("call should be accepted before shutdown")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := k.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected to time out waiting for the call, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		k.calls.Done()
+	}()
+
+	if err := k.Shutdown(context.Background()); err != nil {
+		t.Errorf("unexpected error after the call is finished: %v", err)
+	}
+
+	if k.beginCall() {
+		t.Error("call should be rejected after shutdown")
+	}
+}
+
+func TestShutdownRejectsCalls(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+
+	callee := New("callee", "0.0.1")
+	callee.HandleFunc("wait", func(*Request) (interface{}, error) {
+		close(started)
+		<-release
+		return "done", nil
+	}).DisableAuthentication()
+	callee.HandleFunc("square", func(*Request) (interface{}, error) {
+		return 4, nil
+	}).DisableAuthentication()
+
+	c, _ := connectPipe(New("caller", "0.0.1"), callee)
+
+	waited := make(chan error, 1)
+	go func() {
+		_, err := c.TellWithTimeout("wait", time.Second)
+		waited <- err
+	}()
+
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- callee.Shutdown(context.Background()) }()
+
+	// the call in flight keeps the kite from shutting down
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned before the call is finished: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if _, err := c.TellWithTimeout("square", time.Second); ErrorCode(err) != CodeUnavailable {
+		t.Errorf("expected %q for a call during shutdown, got %v", CodeUnavailable, err)
+	}
+
+	close(release)
+
+	if err := <-waited; err != nil {
+		t.Errorf("call in flight should finish: %v", err)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("unexpected shutdown error: %v", err)
+	}
+}
+
+func TestShutdownHandlers(t *testing.T) {
+	k := New("testkite", "0.0.1")
+
+	var called []int
+	k.OnShutdown(func() { called = append(called, 1) })
+	k.OnShutdown(func() { called = append(called, 2) })
+
+	k.shutdown(time.Second)
+
+	if len(called) != 2 || called[0] != 1 || called[1] != 2 {
+		t.Errorf("expected the shutdown handlers to be called in order, got %v", called)
+	}
+}
@@ -0,0 +1,182 @@
+// Package kitegen generates typed Go clients for the methods of a kite, so
+// the arguments and the results of the Tell calls don't have to be marshaled
+// by hand.
+package kitegen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// Description describes the client to generate. It's usually read from a
+// JSON file.
+type Description struct {
+	// Package is the package name of the generated file.
+	Package string `json:"package"`
+
+	// Client is the type name of the generated client, like "MathClient".
+	Client string `json:"client"`
+
+	// Imports are the packages of the argument and result types.
+	Imports []string `json:"imports,omitempty"`
+
+	Methods []Method `json:"methods"`
+}
+
+// Method describes a method of the kite.
+type Method struct {
+	// Name is the name of the method the kite handles, like "square".
+	Name string `json:"name"`
+
+	// Func is the name of the generated function, it's derived from Name
+	// if empty, like "Square".
+	Func string `json:"func,omitempty"`
+
+	// Args and Result are the Go types of the argument and the result of
+	// the method, like "float64" or "*types.User". They are optional for
+	// the methods without an argument or a result.
+	Args   string `json:"args,omitempty"`
+	Result string `json:"result,omitempty"`
+
+	Description string `json:"description,omitempty"`
+}
+
+// Generate returns the formatted Go source of the client.
+func Generate(desc *Description) ([]byte, error) {
+	if desc.Package == "" || desc.Client == "" {
+		return nil, errors.New("kitegen: package and client names are required")
+	}
+
+	d := *desc
+	d.Methods = make([]Method, len(desc.Methods))
+
+	for i, m := range desc.Methods {
+		if m.Name == "" {
+			return nil, fmt.Errorf("kitegen: method %d has no name", i)
+		}
+
+		if m.Func == "" {
+			m.Func = funcName(m.Name)
+		}
+
+		d.Methods[i] = m
+	}
+
+	var buf bytes.Buffer
+	if err := clientTemplate.Execute(&buf, &d); err != nil {
+		return nil, err
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("kitegen: invalid generated code: %s", err)
+	}
+
+	return src, nil
+}
+
+// funcName returns the exported Go name of a method name, like "FsReadFile"
+// for "fs.readFile".
+func funcName(method string) string {
+	parts := strings.FieldsFunc(method, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var name string
+	for _, p := range parts {
+		name += strings.ToUpper(p[:1]) + p[1:]
+	}
+
+	return name
+}
+
+// commentLines prefixes the lines of s with "// ".
+func commentLines(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight("// "+line, " ")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+var clientTemplate = template.Must(template.New("client").Funcs(template.FuncMap{
+	"comment": commentLines,
+}).Parse(`// Code generated by kitegen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/koding/kite"
+{{range .Imports}}	"{{.}}"
+{{end}})
+
+// {{.Client}} calls the methods of a kite with typed arguments and results.
+type {{.Client}} struct {
+	*kite.Client
+}
+
+// New{{.Client}} returns a typed client using c, which must be dialed
+// before the calls.
+func New{{.Client}}(c *kite.Client) *{{.Client}} {
+	return &{{.Client}}{Client: c}
+}
+
+// CheckMethods returns an error if the kite doesn't handle one of the
+// methods of the client, like when it's older than the client.
+func (c *{{.Client}}) CheckMethods(ctx context.Context) error {
+	result, err := c.Client.TellWithContext(ctx, "kite.methods")
+	if err != nil {
+		return err
+	}
+
+	var methods []kite.MethodInfo
+	if err := result.Unmarshal(&methods); err != nil {
+		return err
+	}
+
+	handled := make(map[string]bool, len(methods))
+	for _, m := range methods {
+		handled[m.Name] = true
+	}
+
+	for _, name := range []string{ {{- range .Methods}}
+		{{printf "%q" .Name}},{{end}}
+	} {
+		if !handled[name] {
+			return fmt.Errorf("kite doesn't handle the %q method", name)
+		}
+	}
+
+	return nil
+}
+{{range .Methods}}
+// {{.Func}} calls the {{printf "%q" .Name}} method.
+{{- if .Description}}
+//
+{{comment .Description}}
+{{- end}}
+func (c *{{$.Client}}) {{.Func}}(ctx context.Context{{if .Args}}, args {{.Args}}{{end}}) {{if .Result}}({{.Result}}, error){{else}}error{{end}} {
+{{- if .Result}}
+	var resp {{.Result}}
+{{end}}
+	{{if .Result}}result{{else}}_{{end}}, err := c.Client.TellWithContext(ctx, {{printf "%q" .Name}}{{if .Args}}, args{{end}})
+	if err != nil {
+		return {{if .Result}}resp, {{end}}err
+	}
+{{if .Result}}
+	err = result.Unmarshal(&resp)
+	return resp, err
+{{- else}}
+	return nil
+{{- end}}
+}
+{{end}}`))
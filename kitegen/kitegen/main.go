@@ -0,0 +1,54 @@
+// Command kitegen generates a typed Go client from a JSON description of the
+// methods of a kite, see the kitegen package.
+//
+// Usage:
+//
+//	kitegen -in math.json -out mathclient/client.go
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/koding/kite/kitegen"
+)
+
+var (
+	flagIn  = flag.String("in", "", "JSON description of the methods")
+	flagOut = flag.String("out", "", "Output file, stdout if empty")
+)
+
+func main() {
+	flag.Parse()
+
+	if *flagIn == "" {
+		log.Fatal("Please specify the description file via -in. Aborting.")
+	}
+
+	data, err := ioutil.ReadFile(*flagIn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var desc kitegen.Description
+	if err := json.Unmarshal(data, &desc); err != nil {
+		log.Fatalf("Cannot parse %s: %s", *flagIn, err)
+	}
+
+	src, err := kitegen.Generate(&desc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *flagOut == "" {
+		os.Stdout.Write(src)
+		return
+	}
+
+	if err := ioutil.WriteFile(*flagOut, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
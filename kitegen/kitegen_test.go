@@ -0,0 +1,44 @@
+package kitegen
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	src, err := Generate(&Description{
+		Package: "mathclient",
+		Client:  "MathClient",
+		Methods: []Method{
+			{Name: "square", Args: "float64", Result: "float64", Description: "Square returns\nthe square."},
+			{Name: "reset"},
+			{Name: "fs.readFile", Args: "string", Result: "[]byte"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		"func (c *MathClient) Square(ctx context.Context, args float64) (float64, error) {",
+		"// Square returns\n// the square.",
+		"func (c *MathClient) Reset(ctx context.Context) error {",
+		"func (c *MathClient) FsReadFile(ctx context.Context, args string) ([]byte, error) {",
+		`"fs.readFile",`,
+	} {
+		if !strings.Contains(string(src), s) {
+			t.Errorf("missing %q in:\n%s", s, src)
+		}
+	}
+}
+
+func TestGenerateInvalid(t *testing.T) {
+	_, err := Generate(&Description{
+		Package: "mathclient",
+		Client:  "MathClient",
+		Methods: []Method{{Name: "square", Args: "float64)"}},
+	})
+	if err == nil {
+		t.Error("expected an error for the invalid type")
+	}
+}
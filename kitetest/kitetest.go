@@ -0,0 +1,133 @@
+// Package kitetest runs a kontrol and kites in the test process, so the
+// registration and the discovery of kites can be tested end to end without a
+// kontrol deployment or a database. Kontrol stores the kites in memory and
+// every kite is served on its own loopback listener:
+//
+//	env := kitetest.Start()
+//	defer env.Close()
+//
+//	math := env.NewKite("math", "1.0.0")
+//	math.HandleFunc("square", square)
+//	if err := env.Serve(math); err != nil {
+//		t.Fatal(err)
+//	}
+//
+//	clients, err := env.NewKite("caller", "1.0.0").GetKites(&protocol.KontrolQuery{
+//		Username: env.Username,
+//		Name:     "math",
+//	})
+package kitetest
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"sync"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/kontrol"
+	"github.com/koding/kite/testkeys"
+	"github.com/koding/kite/testutil"
+)
+
+// Environment is a kontrol and the kites using it, started with Start.
+type Environment struct {
+	// Kontrol is the kontrol of the environment, it can be configured
+	// further before the kites are served.
+	Kontrol *kontrol.Kontrol
+
+	// KontrolURL is the URL the kites connect to kontrol with.
+	KontrolURL string
+
+	// Username is the username the kites are registered with.
+	Username string
+
+	server *httptest.Server
+
+	mu      sync.Mutex
+	kites   []*kite.Kite
+	servers []*httptest.Server
+}
+
+// Start starts a kontrol with an in-memory storage. The registrations are
+// not rate limited. Close must be called to stop it.
+func Start() *Environment {
+	conf := testutil.NewConfig()
+
+	k := kontrol.New(conf, "0.0.1", testkeys.Public, testkeys.Private)
+	k.SetStorage(kontrol.NewMemory())
+	k.RegisterRate = 0
+
+	server := httptest.NewServer(k.Kite)
+
+	// the kites and kontrol itself find it with the URL of the server
+	conf.KontrolURL = server.URL + "/kite"
+
+	k.Start()
+
+	return &Environment{
+		Kontrol:    k,
+		KontrolURL: conf.KontrolURL,
+		Username:   conf.Username,
+		server:     server,
+	}
+}
+
+// Config returns a new config for the kites of the environment, with a kite
+// key trusted by its kontrol.
+func (e *Environment) Config() *config.Config {
+	conf := testutil.NewConfig()
+	conf.KontrolURL = e.KontrolURL
+	return conf
+}
+
+// NewKite returns a kite configured to use the kontrol of the environment.
+// It isn't served, so it can only call other kites until it's served with
+// Serve. It's closed by Close.
+func (e *Environment) NewKite(name, version string) *kite.Kite {
+	k := kite.New(name, version)
+	k.Config = e.Config()
+
+	e.mu.Lock()
+	e.kites = append(e.kites, k)
+	e.mu.Unlock()
+
+	return k
+}
+
+// Serve serves the kite on a loopback listener and registers it to kontrol,
+// so other kites can discover it. The handlers of the kite should be added
+// before it's served.
+func (e *Environment) Serve(k *kite.Kite) error {
+	server := httptest.NewServer(k)
+
+	e.mu.Lock()
+	e.servers = append(e.servers, server)
+	e.mu.Unlock()
+
+	u, err := url.Parse(server.URL + "/kite")
+	if err != nil {
+		return err
+	}
+
+	_, err = k.Register(u)
+	return err
+}
+
+// Close closes the kites of the environment, which deregisters them, and
+// stops kontrol.
+func (e *Environment) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, k := range e.kites {
+		k.Close()
+	}
+
+	for _, server := range e.servers {
+		server.Close()
+	}
+
+	e.Kontrol.Close()
+	e.server.Close()
+}
@@ -0,0 +1,51 @@
+package kitetest
+
+import (
+	"testing"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/protocol"
+)
+
+func TestEnvironment(t *testing.T) {
+	env := Start()
+	defer env.Close()
+
+	math := env.NewKite("math", "1.0.0")
+	math.HandleFunc("square", func(r *kite.Request) (interface{}, error) {
+		a := r.Args.One().MustFloat64()
+		return a * a, nil
+	})
+
+	if err := env.Serve(math); err != nil {
+		t.Fatal(err)
+	}
+
+	clients, err := env.NewKite("caller", "1.0.0").GetKites(&protocol.KontrolQuery{
+		Username:    env.Username,
+		Environment: math.Config.Environment,
+		Name:        "math",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(clients) != 1 || clients[0].ID != math.Id {
+		t.Fatalf("got %d kites, want the registered one", len(clients))
+	}
+
+	c := clients[0]
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	result, err := c.Tell("square", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := result.MustFloat64(); n != 16 {
+		t.Errorf("got %v, want 16", n)
+	}
+}
@@ -1,6 +1,8 @@
 package kontrol
 
 import (
+	"database/sql"
+	"fmt"
 	"testing"
 
 	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
@@ -49,6 +51,55 @@ func BenchmarkPostgresGet(b *testing.B) {
 	}
 }
 
+func BenchmarkPostgresGetPrepared(b *testing.B) {
+	kon.SetStorage(NewPostgres(&PostgresConfig{PrepareStatements: true}, kon.Kite.Log))
+
+	query := &protocol.KontrolQuery{
+		ID: "b9cc3baf-4f03-47d0-5a62-7de2e9f22476",
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		kon.storage.Get(query)
+	}
+}
+
+// BenchmarkPostgresQueryStmts measures the overhead of the statement cache
+// and its locking with concurrent queries, without a database.
+func BenchmarkPostgresQueryStmts(b *testing.B) {
+	kites := []*protocol.Kite{
+		{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host1", ID: "1"},
+	}
+
+	query, args, err := selectQuery("kite", &protocol.KontrolQuery{Username: "cenk"})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, prepared := range []bool{false, true} {
+		p := &Postgres{DB: newFakeDB(kites)}
+		if prepared {
+			p.stmts = make(map[string]*sql.Stmt)
+		}
+
+		b.Run(fmt.Sprintf("prepared=%t", prepared), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					rows, err := p.query(query, args...)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					rows.Close()
+				}
+			})
+		})
+
+		p.DB.Close()
+	}
+}
+
 func BenchmarkEtcdAdd(b *testing.B) {
 	kon.SetStorage(NewEtcd(nil, kon.Kite.Log))
 
@@ -0,0 +1,370 @@
+package kontrol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/koding/kite"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+// Bolt implements the Storage interface with a bbolt database file, so
+// kontrol can run without an external datastore and keep the kites over
+// restarts.
+//
+// The kites bucket maps the kite IDs to the encoded kites. The keys bucket
+// maps the kite keys, like "/koding/production/os/0.0.1/sj/kontainer1/1234asdf",
+// to the IDs, so the queries are prefix scans over the sorted keys. Kites
+// are expired by a cleaner.
+type Bolt struct {
+	DB  *bolt.DB
+	Log kite.Logger
+
+	// expire is the duration after which a kite that isn't updated is
+	// deleted by the cleaner.
+	expire time.Duration
+
+	// closeC stops the cleaner once closed
+	closeC    chan struct{}
+	closeOnce sync.Once
+}
+
+var (
+	_ Storage          = (*Bolt)(nil)
+	_ ConstraintGetter = (*Bolt)(nil)
+)
+
+var (
+	boltKitesBucket = []byte("kites")
+	boltKeysBucket  = []byte("keys")
+)
+
+// boltKite is the encoded value of the kites bucket.
+type boltKite struct {
+	Kite      protocol.Kite                 `json:"kite"`
+	Value     kontrolprotocol.RegisterValue `json:"value"`
+	UpdatedAt time.Time                     `json:"updatedAt"`
+}
+
+// expired returns true if the kite isn't updated within its TTL, or the
+// given expire duration if it's registered without one.
+func (b *boltKite) expired(now time.Time, expire time.Duration) bool {
+	if b.Value.TTL > 0 {
+		expire = b.Value.TTL
+	}
+
+	return now.Sub(b.UpdatedAt) > expire
+}
+
+// NewBolt returns a storage using the bbolt database file at the given path.
+// The file is created if it doesn't exist.
+func NewBolt(path string, log kite.Logger) *Bolt {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		panic(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltKitesBucket, boltKeysBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	cleanInterval := 30 * time.Second  // clean every 30 second
+	expireInterval := 20 * time.Second // clean kites that are 20 second old
+
+	b := &Bolt{
+		DB:     db,
+		Log:    log,
+		expire: expireInterval,
+		closeC: make(chan struct{}),
+	}
+
+	go b.RunCleaner(cleanInterval, expireInterval)
+
+	return b
+}
+
+// RunCleaner deletes every "interval" duration the kites which are not
+// updated within "expire" duration, or their own TTL.
+func (b *Bolt) RunCleaner(interval, expire time.Duration) {
+	cleanFunc := func() {
+		deleted, err := b.CleanExpiredRows(expire)
+		if err != nil {
+			b.Log.Warning("bolt: cleaning old kites failed: %s", err)
+		} else if deleted != 0 {
+			b.Log.Info("bolt: cleaned up %d kites", deleted)
+		}
+	}
+
+	cleanFunc() // run for the first time
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cleanFunc()
+		case <-b.closeC:
+			return
+		}
+	}
+}
+
+// CleanExpiredRows deletes the kites that are at least "expire" duration
+// old. Kites that are registered with their own TTL are deleted once it's
+// passed.
+func (b *Bolt) CleanExpiredRows(expire time.Duration) (int64, error) {
+	var deleted int64
+	now := time.Now().UTC()
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		var expired []*boltKite
+
+		err := tx.Bucket(boltKitesBucket).ForEach(func(_, v []byte) error {
+			var k boltKite
+			if err := json.Unmarshal(v, &k); err != nil {
+				return err
+			}
+
+			if k.expired(now, expire) {
+				expired = append(expired, &k)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// the buckets can't be modified while iterating over them
+		for _, k := range expired {
+			if err := boltDelete(tx, &k.Kite); err != nil {
+				return err
+			}
+		}
+
+		deleted = int64(len(expired))
+		return nil
+	})
+
+	return deleted, err
+}
+
+// ExpireInterval returns the duration after which a kite that isn't updated
+// is removed from the storage.
+func (b *Bolt) ExpireInterval() time.Duration {
+	return b.expire
+}
+
+// Count returns the number of kites in the storage.
+func (b *Bolt) Count() (int64, error) {
+	var count int64
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		count = int64(tx.Bucket(boltKitesBucket).Stats().KeyN)
+		return nil
+	})
+
+	return count, err
+}
+
+// Close stops the cleaner and closes the database file.
+func (b *Bolt) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closeC)
+	})
+
+	return b.DB.Close()
+}
+
+func (b *Bolt) Get(query *protocol.KontrolQuery) (Kites, error) {
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		// version is a malformed, just return the error
+		return nil, err
+	}
+
+	return b.GetWithConstraint(query, constraint)
+}
+
+// GetWithConstraint retrieves the kites with the given query. If constraint
+// is not nil, it's used instead of the version field of the query.
+func (b *Bolt) GetWithConstraint(query *protocol.KontrolQuery, constraint version.Constraints) (Kites, error) {
+	kites := make(Kites, 0)
+
+	add := func(v []byte) error {
+		var k boltKite
+		if err := json.Unmarshal(v, &k); err != nil {
+			return err
+		}
+
+		// the prefix matches the fields partially, like "foo" of "foobar",
+		// and the version constraint and the fields after it are checked
+		// here. Expired kites are left to the cleaner.
+		if !matchQuery(&k.Kite, query, constraint) ||
+			!hasCapabilities(k.Value.Capabilities, query.Capabilities) ||
+			!hasTags(k.Value.Tags, query) ||
+			!k.UpdatedAt.After(query.SinceUpdatedAt) ||
+			k.expired(time.Now().UTC(), b.expire) {
+			return nil
+		}
+
+		kites = append(kites, &protocol.KiteWithToken{
+			Kite: k.Kite,
+			URL:  k.Value.URL,
+			URLs: k.Value.URLs,
+
+			Weight: k.Value.Weight,
+			Tags:   k.Value.Tags,
+		})
+
+		return nil
+	}
+
+	if onlyIDQuery(query) {
+		err := b.DB.View(func(tx *bolt.Tx) error {
+			if v := tx.Bucket(boltKitesBucket).Get([]byte(query.ID)); v != nil {
+				return add(v)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return kites, nil
+	}
+
+	prefixQuery := query
+	if constraint != nil {
+		// We will read all kites under this name and filter the result
+		// later.
+		prefixQuery = &protocol.KontrolQuery{
+			Username:    query.Username,
+			Environment: query.Environment,
+			Name:        query.Name,
+		}
+	}
+
+	// only let query with usernames, otherwise the whole database would be
+	// read
+	key, err := GetQueryKey(prefixQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := []byte(key)
+
+	err = b.DB.View(func(tx *bolt.Tx) error {
+		kitesBucket := tx.Bucket(boltKitesBucket)
+
+		c := tx.Bucket(boltKeysBucket).Cursor()
+		for k, id := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, id = c.Next() {
+			v := kitesBucket.Get(id)
+			if v == nil {
+				continue
+			}
+
+			if err := add(v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	kites.Select(query.Selection)
+
+	return kites, nil
+}
+
+func (b *Bolt) Add(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return b.Upsert(kiteProt, value)
+}
+
+// Update updates the value of the kite and extends its expiration. It adds
+// the kite if it doesn't exist.
+func (b *Bolt) Update(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return b.Upsert(kiteProt, value)
+}
+
+func (b *Bolt) Upsert(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	// check that the incoming URL is valid to prevent malformed input
+	if _, err := url.Parse(value.URL); err != nil {
+		return err
+	}
+
+	if kiteProt.ID == "" {
+		return errors.New("empty kite id")
+	}
+
+	v, err := json.Marshal(&boltKite{
+		Kite:      *kiteProt,
+		Value:     *value,
+		UpdatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		// the key of the ID changes if the kite is registered with other
+		// fields, like a new version
+		if err := boltDelete(tx, kiteProt); err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(boltKitesBucket).Put([]byte(kiteProt.ID), v); err != nil {
+			return err
+		}
+
+		return tx.Bucket(boltKeysBucket).Put([]byte(kiteProt.String()), []byte(kiteProt.ID))
+	})
+}
+
+func (b *Bolt) Delete(kiteProt *protocol.Kite) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		return boltDelete(tx, kiteProt)
+	})
+}
+
+// boltDelete deletes the kite with the ID of the given kite and its key.
+func boltDelete(tx *bolt.Tx, kiteProt *protocol.Kite) error {
+	kitesBucket := tx.Bucket(boltKitesBucket)
+
+	v := kitesBucket.Get([]byte(kiteProt.ID))
+	if v == nil {
+		return nil
+	}
+
+	var k boltKite
+	if err := json.Unmarshal(v, &k); err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(boltKeysBucket).Delete([]byte(k.Kite.String())); err != nil {
+		return err
+	}
+
+	return kitesBucket.Delete([]byte(kiteProt.ID))
+}
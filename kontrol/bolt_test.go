@@ -0,0 +1,123 @@
+package kontrol
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/koding/kite"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+func newTestBolt(t *testing.T) (*Bolt, func()) {
+	dir, err := ioutil.TempDir("", "kontrol-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBolt(filepath.Join(dir, "kontrol.db"), kite.New("bolt-test", "0.0.1").Log)
+
+	return b, func() {
+		b.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBolt(t *testing.T) {
+	b, cleanup := newTestBolt(t)
+	defer cleanup()
+
+	k1 := &protocol.Kite{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host1", ID: "1"}
+	k2 := &protocol.Kite{Username: "cenk", Environment: "production", Name: "worker", Version: "2.0.0", Region: "sj", Hostname: "host2", ID: "2"}
+	k3 := &protocol.Kite{Username: "cenk", Environment: "production", Name: "workerx", Version: "1.0.0", Region: "sj", Hostname: "host3", ID: "3"}
+
+	for _, k := range []*protocol.Kite{k1, k2, k3} {
+		if err := b.Add(k, &kontrolprotocol.RegisterValue{URL: "http://" + k.Hostname + "/kite"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kites, err := b.Get(&protocol.KontrolQuery{Username: "cenk", Environment: "production", Name: "worker"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kites) != 2 {
+		t.Errorf("expected 2 workers, got %d", len(kites))
+	}
+
+	kites, err = b.Get(&protocol.KontrolQuery{Username: "cenk", Environment: "production", Name: "worker", Version: ">= 2.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kites) != 1 || kites[0].Kite.ID != "2" {
+		t.Errorf("expected the kite 2 for the version constraint, got %+v", kites)
+	}
+
+	kites, err = b.Get(&protocol.KontrolQuery{ID: "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kites) != 1 || kites[0].URL != "http://host3/kite" {
+		t.Errorf("unexpected kites for the ID query: %+v", kites)
+	}
+
+	// registering with a new version replaces the old key of the ID
+	k1.Version = "1.1.0"
+	if err := b.Update(k1, &kontrolprotocol.RegisterValue{URL: "http://host1/kite"}); err != nil {
+		t.Fatal(err)
+	}
+
+	kites, err = b.Get(&protocol.KontrolQuery{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kites) != 0 {
+		t.Errorf("expected no kites with the old version, got %+v", kites)
+	}
+
+	if err := b.Delete(k2); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := b.Count(); err != nil || n != 2 {
+		t.Errorf("expected 2 kites after delete, got %d (%v)", n, err)
+	}
+}
+
+func TestBoltCleanExpiredRows(t *testing.T) {
+	b, cleanup := newTestBolt(t)
+	defer cleanup()
+
+	k1 := &protocol.Kite{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host1", ID: "1"}
+	k2 := &protocol.Kite{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host2", ID: "2"}
+
+	b.Add(k1, &kontrolprotocol.RegisterValue{URL: "http://host1/kite", TTL: time.Nanosecond})
+	b.Add(k2, &kontrolprotocol.RegisterValue{URL: "http://host2/kite"})
+
+	time.Sleep(time.Millisecond)
+
+	// the cleaner of NewBolt may have deleted it already
+	if _, err := b.CleanExpiredRows(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := b.Count(); err != nil || n != 1 {
+		t.Errorf("expected 1 kite after cleaning, got %d (%v)", n, err)
+	}
+
+	kites, err := b.Get(&protocol.KontrolQuery{Username: "cenk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kites) != 1 || kites[0].Kite.ID != "2" {
+		t.Errorf("unexpected kites: %+v", kites)
+	}
+}
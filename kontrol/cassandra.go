@@ -0,0 +1,369 @@
+package kontrol
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/hashicorp/go-version"
+
+	"github.com/koding/kite"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+// Cassandra implements the Storage interface with a Cassandra or ScyllaDB
+// cluster.
+//
+// The kites are stored in two tables. The kite table has the kite ID as
+// partition key and is used for the ID queries. The kite_by_username table
+// has the username as partition key and the rest of the kite key as
+// clustering columns, so the other queries read a single partition with
+// the exact fields of the query as a prefix of the clustering key. Both
+// rows of a kite are written in a single batch. Kites are expired with the
+// TTL of their rows instead of a cleaner. The tags of the kites are not
+// stored.
+type Cassandra struct {
+	Session *gocql.Session
+	Log     kite.Logger
+
+	// expire is the duration after which a kite that isn't updated is
+	// deleted.
+	expire time.Duration
+}
+
+var (
+	_ Storage          = (*Cassandra)(nil)
+	_ ConstraintGetter = (*Cassandra)(nil)
+)
+
+// cassandraTables are the tables created by NewCassandra.
+var cassandraTables = []string{
+	`CREATE TABLE IF NOT EXISTS kite (
+		id text PRIMARY KEY,
+		username text,
+		environment text,
+		kitename text,
+		version text,
+		region text,
+		hostname text,
+		url text,
+		ttl bigint,
+		capabilities set<text>,
+		urls list<text>,
+		weight double
+	)`,
+	`CREATE TABLE IF NOT EXISTS kite_by_username (
+		username text,
+		environment text,
+		kitename text,
+		version text,
+		region text,
+		hostname text,
+		id text,
+		url text,
+		ttl bigint,
+		capabilities set<text>,
+		urls list<text>,
+		weight double,
+		PRIMARY KEY ((username), environment, kitename, version, region, hostname, id)
+	)`,
+}
+
+// cassandraAddedColumns are the columns added to the tables after they are
+// created, they are added to the existing tables by NewCassandra.
+var cassandraAddedColumns = []struct{ name, typ string }{
+	{"urls", "list<text>"},
+	{"weight", "double"},
+}
+
+// cassandraColumns are the columns read from both tables, in the order of
+// the queried key fields.
+const cassandraColumns = `username, environment, kitename, version, region, hostname, id, url, ttl, capabilities, urls, weight`
+
+// NewCassandra returns a storage using the keyspace of the given cluster. The
+// tables are created if they don't exist.
+func NewCassandra(cluster *gocql.ClusterConfig, log kite.Logger) *Cassandra {
+	if cluster == nil || cluster.Keyspace == "" {
+		panic("keyspace is not set for cassandra kontrol storage")
+	}
+
+	session, err := cluster.CreateSession()
+	if err != nil {
+		panic(err)
+	}
+
+	for _, table := range cassandraTables {
+		if err := session.Query(table).Exec(); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := addCassandraColumns(session, cluster.Keyspace); err != nil {
+		panic(err)
+	}
+
+	return &Cassandra{
+		Session: session,
+		Log:     log,
+		expire:  20 * time.Second, // delete kites that are 20 second old
+	}
+}
+
+// addCassandraColumns adds the columns of cassandraAddedColumns missing from
+// the tables created by an earlier version.
+func addCassandraColumns(session *gocql.Session, keyspace string) error {
+	meta, err := session.KeyspaceMetadata(keyspace)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"kite", "kite_by_username"} {
+		t, ok := meta.Tables[table]
+		if !ok {
+			return fmt.Errorf("cassandra: table %q is not found", table)
+		}
+
+		for _, column := range cassandraAddedColumns {
+			if _, ok := t.Columns[column.name]; ok {
+				continue
+			}
+
+			if err := session.Query(`ALTER TABLE ` + table + ` ADD ` + column.name + ` ` + column.typ).Exec(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ExpireInterval returns the duration after which a kite that isn't updated
+// is removed from the storage.
+func (c *Cassandra) ExpireInterval() time.Duration {
+	return c.expire
+}
+
+// Close closes the session.
+func (c *Cassandra) Close() error {
+	c.Session.Close()
+	return nil
+}
+
+func (c *Cassandra) Get(query *protocol.KontrolQuery) (Kites, error) {
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		// version is a malformed, just return the error
+		return nil, err
+	}
+
+	return c.GetWithConstraint(query, constraint)
+}
+
+// GetWithConstraint retrieves the kites with the given query. If constraint
+// is not nil, it's used instead of the version field of the query.
+func (c *Cassandra) GetWithConstraint(query *protocol.KontrolQuery, constraint version.Constraints) (Kites, error) {
+	if hasTagQuery(query) {
+		return nil, ErrTagsNotSupported
+	}
+
+	if !query.SinceUpdatedAt.IsZero() {
+		return nil, ErrSinceUpdatedAtNotSupported
+	}
+
+	var q *gocql.Query
+
+	if onlyIDQuery(query) {
+		q = c.Session.Query(`SELECT `+cassandraColumns+` FROM kite WHERE id = ?`, query.ID)
+	} else {
+		// only let query with usernames, otherwise the whole cluster would
+		// be read
+		if _, err := GetQueryKey(query); err != nil {
+			return nil, err
+		}
+
+		prefixQuery := query
+		if constraint != nil {
+			// We will read all kites under this name and filter the result
+			// later.
+			prefixQuery = &protocol.KontrolQuery{
+				Username:    query.Username,
+				Environment: query.Environment,
+				Name:        query.Name,
+			}
+		}
+
+		cql, args := cassandraSelect(prefixQuery)
+		q = c.Session.Query(cql, args...)
+	}
+
+	var (
+		k            protocol.Kite
+		kiteURL      string
+		ttl          int64
+		capabilities []string
+		urls         []string
+		weight       float64
+	)
+
+	kites := make(Kites, 0)
+
+	iter := q.Iter()
+	for iter.Scan(&k.Username, &k.Environment, &k.Name, &k.Version, &k.Region,
+		&k.Hostname, &k.ID, &kiteURL, &ttl, &capabilities, &urls, &weight) {
+
+		// the version constraint and the fields after it are checked here
+		if !matchQuery(&k, query, constraint) ||
+			!hasCapabilities(capabilities, query.Capabilities) {
+			continue
+		}
+
+		kites = append(kites, &protocol.KiteWithToken{
+			Kite:         k,
+			URL:          kiteURL,
+			URLs:         urls,
+			Weight:       weight,
+			Capabilities: capabilities,
+		})
+
+		// the slices are reused by Scan otherwise
+		capabilities, urls = nil, nil
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	kites.Select(query.Selection)
+
+	return kites, nil
+}
+
+// cassandraSelect returns the CQL query reading the kites of the
+// kite_by_username table matching the fields of the query up to the first
+// empty one.
+func cassandraSelect(query *protocol.KontrolQuery) (string, []interface{}) {
+	columns := map[string]string{"name": "kitename"}
+
+	cql := `SELECT ` + cassandraColumns + ` FROM kite_by_username WHERE `
+	var args []interface{}
+
+	fields := query.Fields()
+	for i, key := range keyOrder {
+		v := fields[key]
+		if v == "" {
+			break
+		}
+
+		column, ok := columns[key]
+		if !ok {
+			column = key
+		}
+
+		if i != 0 {
+			cql += ` AND `
+		}
+
+		cql += column + ` = ?`
+		args = append(args, v)
+	}
+
+	return cql, args
+}
+
+func (c *Cassandra) Add(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return c.Upsert(kiteProt, value)
+}
+
+// Update updates the value of the kite and extends its expiration. As the
+// writes of Cassandra are upserts, it adds the kite if it doesn't exist.
+func (c *Cassandra) Update(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return c.Upsert(kiteProt, value)
+}
+
+func (c *Cassandra) Upsert(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	// check that the incoming URL is valid to prevent malformed input
+	_, err := url.Parse(value.URL)
+	if err != nil {
+		return err
+	}
+
+	if kiteProt.ID == "" {
+		return errors.New("empty kite id")
+	}
+
+	// Kites registered with their own TTL expire after it, the others after
+	// the expire interval.
+	expire := c.expire
+	if value.TTL > 0 {
+		expire = value.TTL
+	}
+
+	// a TTL of zero means the row never expires
+	ttl := int64(expire / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	// The row of kite_by_username is keyed by the fields of the kite, the
+	// row of its previous fields must be deleted if they are changed, like
+	// when the kite is registered again with a new version.
+	var old protocol.Kite
+	err = c.Session.Query(`SELECT username, environment, kitename, version, region, hostname, id
+	FROM kite WHERE id = ?`, kiteProt.ID).Scan(&old.Username, &old.Environment, &old.Name,
+		&old.Version, &old.Region, &old.Hostname, &old.ID)
+	if err != nil && err != gocql.ErrNotFound {
+		return err
+	}
+
+	b := c.Session.NewBatch(gocql.LoggedBatch)
+	if err == nil && old != *kiteProt {
+		deleteCassandraIndexRow(b, &old)
+	}
+
+	for _, table := range []string{"kite", "kite_by_username"} {
+		b.Query(`INSERT INTO `+table+` (`+cassandraColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) USING TTL ?`,
+			kiteProt.Username,
+			kiteProt.Environment,
+			kiteProt.Name,
+			kiteProt.Version,
+			kiteProt.Region,
+			kiteProt.Hostname,
+			kiteProt.ID,
+			value.URL,
+			int64(value.TTL),
+			value.Capabilities,
+			value.URLs,
+			value.Weight,
+			ttl,
+		)
+	}
+
+	return c.Session.ExecuteBatch(b)
+}
+
+func (c *Cassandra) Delete(kiteProt *protocol.Kite) error {
+	b := c.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`DELETE FROM kite WHERE id = ?`, kiteProt.ID)
+	deleteCassandraIndexRow(b, kiteProt)
+
+	return c.Session.ExecuteBatch(b)
+}
+
+// deleteCassandraIndexRow adds the deletion of the row of the kite in the
+// kite_by_username table to the batch.
+func deleteCassandraIndexRow(b *gocql.Batch, kiteProt *protocol.Kite) {
+	b.Query(`DELETE FROM kite_by_username WHERE username = ? AND environment = ?
+	AND kitename = ? AND version = ? AND region = ? AND hostname = ? AND id = ?`,
+		kiteProt.Username,
+		kiteProt.Environment,
+		kiteProt.Name,
+		kiteProt.Version,
+		kiteProt.Region,
+		kiteProt.Hostname,
+		kiteProt.ID,
+	)
+}
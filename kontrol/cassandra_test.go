@@ -0,0 +1,26 @@
+package kontrol
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/koding/kite/protocol"
+)
+
+func TestCassandraSelect(t *testing.T) {
+	cql, args := cassandraSelect(&protocol.KontrolQuery{
+		Username:    "devrim",
+		Environment: "production",
+		Name:        "mathworker",
+		Hostname:    "host", // ignored, version and region are empty
+	})
+
+	want := `SELECT ` + cassandraColumns + ` FROM kite_by_username WHERE username = ? AND environment = ? AND kitename = ?`
+	if cql != want {
+		t.Errorf("got %q, want %q", cql, want)
+	}
+
+	if !reflect.DeepEqual(args, []interface{}{"devrim", "production", "mathworker"}) {
+		t.Errorf("unexpected args: %v", args)
+	}
+}
@@ -0,0 +1,204 @@
+package kontrol
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/koding/kite/protocol"
+	sq "github.com/lann/squirrel"
+)
+
+// Claim claims the kites matching the query for the claimant, like the ID of
+// the kite or the process doing the work, until the given TTL passes. Only
+// one claimant holds a claim on the matching kites at a time, like the leader
+// running a singleton job that only one of the peers should run. One of the
+// kites is claimed and returned, the kite claimed by the claimant already is
+// preferred, so the claimant can call it again to renew its claim.
+// ErrClaimLost is returned while any of the kites is claimed by another
+// claimant, until its claim is released or expires, and ErrKiteNotFound if
+// no kite matches the query.
+//
+// The matching rows are locked in a transaction in the order of their IDs,
+// so the concurrent claims of the same kites are serialized, and only the
+// first one wins. The version of the query must be exact, version
+// constraints are not supported.
+func (p *Postgres) Claim(query *protocol.KontrolQuery, claimant string, ttl time.Duration) (*protocol.KiteWithToken, error) {
+	defer p.logSlow("claim", time.Now(), query.String())
+
+	if p.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	if claimant == "" || ttl < time.Second {
+		return nil, errors.New("a claimant and a TTL of at least a second are required")
+	}
+
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if constraint != nil {
+		return nil, errors.New("version constraints can't be claimed")
+	}
+
+	if err := p.checkEncryptedQuery(query); err != nil {
+		return nil, err
+	}
+
+	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+
+	selectID, args, err := buildSelectQuery(psql, p.table, query, []string{"id"})
+	if err != nil {
+		return nil, err
+	}
+
+	claimantArg := fmt.Sprintf("$%d", len(args)+1)
+	ttlArg := fmt.Sprintf("$%d", len(args)+2)
+	now := p.now()
+
+	lockKites := selectID + ` ORDER BY id FOR UPDATE`
+
+	claimedByOthers := `SELECT EXISTS (` + selectID + ` AND claimed_by <> ` + claimantArg +
+		` AND claim_expires_at >= ` + now + `)`
+
+	claimKite := `UPDATE ` + p.table + ` SET
+	claimed_by = ` + claimantArg + `,
+	claim_expires_at = ` + now + ` + ((INTERVAL '1 second') * ` + ttlArg + `)
+	WHERE id = (` + selectID + `
+		ORDER BY claimed_by = ` + claimantArg + ` DESC NULLS LAST
+		LIMIT 1)
+	RETURNING ` + strings.Join(kiteColumns, ", ")
+
+	tx, err := p.db().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(lockKites, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	found := rows.Next()
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, ErrKiteNotFound
+	}
+
+	args = append(args, claimant)
+
+	var claimed bool
+	if err := tx.QueryRow(claimedByOthers, args...).Scan(&claimed); err != nil {
+		return nil, err
+	}
+
+	if claimed {
+		return nil, ErrClaimLost
+	}
+
+	kite, err := p.claim(tx, claimKite, append(args, int64(ttl/time.Second)))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return kite, nil
+}
+
+// claim runs the given claim query in the transaction and returns the
+// claimed kite, ErrKiteNotFound if no kite is claimed.
+func (p *Postgres) claim(tx *sql.Tx, claimKite string, args []interface{}) (*protocol.KiteWithToken, error) {
+	rows, err := tx.Query(claimKite, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		return nil, ErrKiteNotFound
+	}
+
+	kite, err := scanKite(rows, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.decryptKites(Kites{kite}); err != nil {
+		return nil, err
+	}
+
+	return kite, nil
+}
+
+// Renew extends the claim of the claimant on the kite with the given ID by
+// the TTL. ErrClaimLost is returned if the claimant doesn't hold the claim,
+// like when it expired and the kite is claimed by another claimant.
+func (p *Postgres) Renew(id, claimant string, ttl time.Duration) error {
+	defer p.logSlow("renew", time.Now(), id)
+
+	if p.readOnly {
+		return ErrReadOnly
+	}
+
+	now := p.now()
+	renewClaim := `UPDATE ` + p.table + ` SET
+	claim_expires_at = ` + now + ` + ((INTERVAL '1 second') * $3)
+	WHERE id = $1 AND claimed_by = $2 AND claim_expires_at >= ` + now
+
+	res, err := p.db().Exec(renewClaim, id, claimant, int64(ttl/time.Second))
+	if err != nil {
+		return err
+	}
+
+	return claimResult(res.RowsAffected())
+}
+
+// Release releases the claim of the claimant on the kite with the given ID,
+// so it can be claimed by others right away. ErrClaimLost is returned if the
+// claimant doesn't hold the claim.
+func (p *Postgres) Release(id, claimant string) error {
+	defer p.logSlow("release", time.Now(), id)
+
+	if p.readOnly {
+		return ErrReadOnly
+	}
+
+	releaseClaim := `UPDATE ` + p.table + ` SET claimed_by = NULL, claim_expires_at = NULL
+	WHERE id = $1 AND claimed_by = $2`
+
+	res, err := p.db().Exec(releaseClaim, id, claimant)
+	if err != nil {
+		return err
+	}
+
+	return claimResult(res.RowsAffected())
+}
+
+// claimResult returns ErrClaimLost if no row is updated.
+func claimResult(affected int64, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrClaimLost
+	}
+
+	return nil
+}
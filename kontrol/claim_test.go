@@ -0,0 +1,192 @@
+package kontrol
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+func TestClaimInvalid(t *testing.T) {
+	p := &Postgres{}
+	query := &protocol.KontrolQuery{Username: "claimtest", Name: "worker", Version: "1.0.0"}
+
+	if _, err := p.Claim(query, "", time.Minute); err == nil {
+		t.Error("expected an error for an empty claimant")
+	}
+
+	if _, err := p.Claim(query, "worker-1", time.Millisecond); err == nil {
+		t.Error("expected an error for a TTL less than a second")
+	}
+
+	constraint := &protocol.KontrolQuery{Username: "claimtest", Name: "worker", Version: ">= 1.0.0"}
+	if _, err := p.Claim(constraint, "worker-1", time.Minute); err == nil {
+		t.Error("expected an error for a version constraint")
+	}
+
+	p.readOnly = true
+	if _, err := p.Claim(query, "worker-1", time.Minute); err != ErrReadOnly {
+		t.Errorf("got %v, want %v", err, ErrReadOnly)
+	}
+}
+
+// newClaimTestKites registers n kites of a unique username to the postgres
+// storage of the tests and returns the query matching them.
+func newClaimTestKites(t *testing.T, n int) (*Postgres, *protocol.KontrolQuery, func()) {
+	if os.Getenv("KONTROL_STORAGE") != "postgres" {
+		t.Skip("KONTROL_STORAGE is not postgres")
+	}
+
+	p, ok := kon.storage.(*Postgres)
+	if !ok {
+		t.Fatalf("unexpected storage: %T", kon.storage)
+	}
+
+	username := "claimtest-" + protocol.NewKiteID()
+	value := &kontrolprotocol.RegisterValue{URL: "ws://localhost:4444/kite"}
+
+	var kites []*protocol.Kite
+	for i := 0; i < n; i++ {
+		k := &protocol.Kite{
+			Username:    username,
+			Environment: "production",
+			Name:        "worker",
+			Version:     "1.0.0",
+			Region:      "sj",
+			Hostname:    fmt.Sprintf("host%d", i),
+			ID:          protocol.NewKiteID(),
+		}
+
+		if err := p.Upsert(k, value); err != nil {
+			t.Fatal(err)
+		}
+
+		kites = append(kites, k)
+	}
+
+	cleanup := func() {
+		for _, k := range kites {
+			p.Delete(k)
+		}
+	}
+
+	return p, &protocol.KontrolQuery{Username: username, Name: "worker", Version: "1.0.0"}, cleanup
+}
+
+func TestPostgresClaim(t *testing.T) {
+	p, query, cleanup := newClaimTestKites(t, 2)
+	defer cleanup()
+
+	a, err := p.Claim(query, "worker-a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// claiming again renews the claim of the same kite
+	again, err := p.Claim(query, "worker-a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.Kite.ID != a.Kite.ID {
+		t.Errorf("got kite %s on the second claim, want %s", again.Kite.ID, a.Kite.ID)
+	}
+
+	// the other kite is free, but only one claimant holds a claim
+	if _, err := p.Claim(query, "worker-b", time.Minute); err != ErrClaimLost {
+		t.Fatalf("got %v claiming the kites of another claimant, want %v", err, ErrClaimLost)
+	}
+
+	if err := p.Renew(a.Kite.ID, "worker-b", time.Minute); err != ErrClaimLost {
+		t.Errorf("got %v renewing the claim of another claimant, want %v", err, ErrClaimLost)
+	}
+
+	if err := p.Renew(a.Kite.ID, "worker-a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Release(a.Kite.ID, "worker-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := p.Claim(query, "worker-b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Claim(query, "worker-a", time.Minute); err != ErrClaimLost {
+		t.Errorf("got %v after the claim is taken over, want %v", err, ErrClaimLost)
+	}
+
+	if err := p.Release(a.Kite.ID, "worker-a"); err != ErrClaimLost {
+		t.Errorf("got %v releasing a lost claim, want %v", err, ErrClaimLost)
+	}
+
+	// an expired claim doesn't keep the others from claiming
+	expire := `UPDATE ` + p.table + ` SET claim_expires_at = claim_expires_at - interval '1 hour' WHERE id = $1`
+	if _, err := p.DB.Exec(expire, b.Kite.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Claim(query, "worker-a", time.Minute); err != nil {
+		t.Errorf("got %v after the claim expired", err)
+	}
+
+	missing := *query
+	missing.Username = "claimtest-" + protocol.NewKiteID()
+	if _, err := p.Claim(&missing, "worker-a", time.Minute); err != ErrKiteNotFound {
+		t.Errorf("got %v without kites, want %v", err, ErrKiteNotFound)
+	}
+}
+
+// TestPostgresClaimConcurrent claims the kites concurrently, only one of the
+// claimants may get a kite.
+func TestPostgresClaimConcurrent(t *testing.T) {
+	const n = 8
+
+	p, query, cleanup := newClaimTestKites(t, n)
+	defer cleanup()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		leaders []string
+		errs    = make(chan error, n)
+	)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(claimant string) {
+			defer wg.Done()
+
+			_, err := p.Claim(query, claimant, time.Minute)
+			if err == ErrClaimLost {
+				return
+			}
+
+			if err != nil {
+				errs <- fmt.Errorf("%s: %s", claimant, err)
+				return
+			}
+
+			mu.Lock()
+			leaders = append(leaders, claimant)
+			mu.Unlock()
+		}(fmt.Sprintf("worker-%d", i))
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if len(leaders) != 1 {
+		t.Errorf("got the claimants %v holding a claim, want one", leaders)
+	}
+}
@@ -0,0 +1,308 @@
+package kontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-version"
+
+	"github.com/koding/kite"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+// Consul implements the Storage interface with the KV store of Consul.
+//
+// The kites are stored under the same keys as in etcd, without the leading
+// slash, like "kites/koding/production/os/0.0.1/sj/kontainer1/1234asdf".
+// Another key with the ID, like "kites/1234asdf", refers to the kite's key
+// for the ID queries. Both keys are held by a Consul session with the TTL
+// of the kite and the "delete" behavior, so Consul deletes them once the
+// session isn't renewed by the heartbeats. Consul may invalidate a session
+// up to twice its TTL later.
+type Consul struct {
+	client *api.Client
+	log    kite.Logger
+
+	// sessions are the Consul sessions of the kites by their ID
+	sessions   map[string]string
+	sessionsMu sync.Mutex
+}
+
+var (
+	_ Storage          = (*Consul)(nil)
+	_ ConstraintGetter = (*Consul)(nil)
+)
+
+// consulPrefix is the prefix of the kite keys
+var consulPrefix = strings.TrimPrefix(KitesPrefix, "/")
+
+// NewConsul returns a storage using the given Consul client. If client is nil
+// a client for the local agent is created.
+func NewConsul(client *api.Client, log kite.Logger) *Consul {
+	if client == nil {
+		var err error
+		client, err = api.NewClient(api.DefaultConfig())
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return &Consul{
+		client:   client,
+		log:      log,
+		sessions: make(map[string]string),
+	}
+}
+
+// ExpireInterval returns the TTL of the sessions of the kites. A kite that
+// isn't updated within this duration is removed by Consul.
+func (c *Consul) ExpireInterval() time.Duration {
+	return HeartbeatDelay
+}
+
+func (c *Consul) Get(query *protocol.KontrolQuery) (Kites, error) {
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		// version is a malformed, just return the error
+		return nil, err
+	}
+
+	return c.GetWithConstraint(query, constraint)
+}
+
+// GetWithConstraint retrieves the kites with the given query. If constraint
+// is not nil, it's used instead of the version field of the query.
+func (c *Consul) GetWithConstraint(query *protocol.KontrolQuery, constraint version.Constraints) (Kites, error) {
+	if !query.SinceUpdatedAt.IsZero() {
+		return nil, ErrSinceUpdatedAtNotSupported
+	}
+
+	var prefix string
+
+	if onlyIDQuery(query) {
+		pair, _, err := c.client.KV().Get(consulPrefix+"/"+query.ID, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if pair == nil {
+			return make(Kites, 0), nil
+		}
+
+		prefix = string(pair.Value)
+	} else {
+		prefixQuery := query
+		if constraint != nil {
+			// We will read all kites under this name and filter the result
+			// later.
+			prefixQuery = &protocol.KontrolQuery{
+				Username:    query.Username,
+				Environment: query.Environment,
+				Name:        query.Name,
+			}
+		}
+
+		key, err := GetQueryKey(prefixQuery)
+		if err != nil {
+			return nil, err
+		}
+
+		prefix = consulPrefix + key
+	}
+
+	pairs, _, err := c.client.KV().List(prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	kites := make(Kites, 0, len(pairs))
+
+	for _, pair := range pairs {
+		k, err := consulKite(pair.Key)
+		if err != nil {
+			// the keys of the IDs are listed for the ID prefixes
+			continue
+		}
+
+		var value kontrolprotocol.RegisterValue
+		if err := json.Unmarshal(pair.Value, &value); err != nil {
+			c.log.Warning("consul: invalid value of %s: %s", pair.Key, err)
+			continue
+		}
+
+		// the prefix matches the fields partially, like "foo" of "foobar",
+		// and the version constraint and the fields after it are checked
+		// here
+		if !matchQuery(k, query, constraint) ||
+			!hasCapabilities(value.Capabilities, query.Capabilities) ||
+			!hasTags(value.Tags, query) {
+			continue
+		}
+
+		kites = append(kites, &protocol.KiteWithToken{
+			Kite: *k,
+			URL:  value.URL,
+			URLs: value.URLs,
+
+			Weight: value.Weight,
+			Tags:   value.Tags,
+		})
+	}
+
+	kites.Select(query.Selection)
+
+	return kites, nil
+}
+
+// consulKite returns the kite of the given kite key.
+func consulKite(key string) (*protocol.Kite, error) {
+	fields := strings.Split(strings.TrimPrefix(key, consulPrefix+"/"), "/")
+	if len(fields) != len(keyOrder) {
+		return nil, errors.New("not a kite key")
+	}
+
+	return &protocol.Kite{
+		Username:    fields[0],
+		Environment: fields[1],
+		Name:        fields[2],
+		Version:     fields[3],
+		Region:      fields[4],
+		Hostname:    fields[5],
+		ID:          fields[6],
+	}, nil
+}
+
+func (c *Consul) Add(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return c.Upsert(k, value)
+}
+
+// Update renews the session of the kite and updates its value. The kite is
+// added again if its session is expired.
+func (c *Consul) Update(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return c.Upsert(k, value)
+}
+
+func (c *Consul) Upsert(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	session, err := c.session(k, value)
+	if err != nil {
+		return err
+	}
+
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	key := consulPrefix + k.String()
+
+	pairs := []*api.KVPair{
+		{Key: key, Value: valueBytes, Session: session},
+		{Key: consulPrefix + "/" + k.ID, Value: []byte(key), Session: session},
+	}
+
+	for _, pair := range pairs {
+		if err := c.acquire(pair); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// acquire sets the key with the session of the pair. If the key is held by
+// another session, like of a kontrol instance the kite was connected to
+// before, that session is destroyed first.
+func (c *Consul) acquire(pair *api.KVPair) error {
+	ok, _, err := c.client.KV().Acquire(pair, nil)
+	if err != nil || ok {
+		return err
+	}
+
+	old, _, err := c.client.KV().Get(pair.Key, nil)
+	if err != nil {
+		return err
+	}
+
+	if old != nil && old.Session != "" && old.Session != pair.Session {
+		if _, err := c.client.Session().Destroy(old.Session, nil); err != nil {
+			return err
+		}
+	}
+
+	ok, _, err = c.client.KV().Acquire(pair, nil)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.New("consul: cannot acquire " + pair.Key)
+	}
+
+	return nil
+}
+
+// session returns the renewed session of the kite or creates a new one if it
+// doesn't have any or it's expired.
+func (c *Consul) session(k *protocol.Kite, value *kontrolprotocol.RegisterValue) (string, error) {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+
+	if id, ok := c.sessions[k.ID]; ok {
+		entry, _, err := c.client.Session().Renew(id, nil)
+		if err != nil {
+			return "", err
+		}
+
+		if entry != nil {
+			return id, nil
+		}
+
+		// the session is expired, the keys are already deleted
+		delete(c.sessions, k.ID)
+	}
+
+	// Consul doesn't accept TTLs shorter than 10 seconds
+	ttl := time.Duration(keyTTL(value)) * time.Second
+	if ttl < 10*time.Second {
+		ttl = 10 * time.Second
+	}
+
+	id, _, err := c.client.Session().Create(&api.SessionEntry{
+		Name:      "kite " + k.ID,
+		TTL:       ttl.String(),
+		Behavior:  api.SessionBehaviorDelete,
+		LockDelay: time.Nanosecond, // the kite can register again immediately
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	c.sessions[k.ID] = id
+	return id, nil
+}
+
+func (c *Consul) Delete(k *protocol.Kite) error {
+	c.sessionsMu.Lock()
+	id, ok := c.sessions[k.ID]
+	delete(c.sessions, k.ID)
+	c.sessionsMu.Unlock()
+
+	// destroying the session deletes the keys too
+	if ok {
+		if _, err := c.client.Session().Destroy(id, nil); err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.client.KV().Delete(consulPrefix+k.String(), nil); err != nil {
+		return err
+	}
+
+	_, err := c.client.KV().Delete(consulPrefix+"/"+k.ID, nil)
+	return err
+}
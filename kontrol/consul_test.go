@@ -0,0 +1,33 @@
+package kontrol
+
+import (
+	"testing"
+
+	"github.com/koding/kite/protocol"
+)
+
+func TestConsulKite(t *testing.T) {
+	k := &protocol.Kite{
+		Username:    "devrim",
+		Environment: "production",
+		Name:        "mathworker",
+		Version:     "1.0.0",
+		Region:      "us-east-1",
+		Hostname:    "host",
+		ID:          "2ba5b5ad-3d3d-4b1f-5d5b-12ea8ab1a5b2",
+	}
+
+	got, err := consulKite(consulPrefix + k.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *got != *k {
+		t.Errorf("got %+v, want %+v", got, k)
+	}
+
+	// the keys of the IDs are not kite keys
+	if _, err := consulKite(consulPrefix + "/" + k.ID); err == nil {
+		t.Error("expected an error for an ID key")
+	}
+}
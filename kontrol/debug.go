@@ -0,0 +1,151 @@
+package kontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite"
+	"github.com/koding/kite/protocol"
+)
+
+// eacher is implemented by storages that can stream the kites of a query.
+type eacher interface {
+	Each(query *protocol.KontrolQuery, fn func(*protocol.KiteWithToken) error) error
+}
+
+// DebugHandler returns an HTTP handler that writes the registered kites as a
+// JSON array. The query string is mapped to the fields of the query, like:
+//
+//	/debug/kites?username=koding&environment=production&name=os
+//
+// An empty query lists all kites if the storage supports it. Requests must be
+// authenticated with a kite key issued by this kontrol in the Authorization
+// header, like "Bearer <kite.key>", and its user must be an admin according to
+// IsAdmin.
+func (k *Kontrol) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := k.authenticateAdmin(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		v := r.URL.Query()
+		query := &protocol.KontrolQuery{
+			Username:    v.Get("username"),
+			Environment: v.Get("environment"),
+			Name:        v.Get("name"),
+			Version:     v.Get("version"),
+			Region:      v.Get("region"),
+			Hostname:    v.Get("hostname"),
+			ID:          v.Get("id"),
+		}
+
+		if c := v.Get("capabilities"); c != "" {
+			query.Capabilities = strings.Split(c, ",")
+		}
+
+		if t := v.Get("tags"); t != "" {
+			query.Tags = strings.Split(t, ",")
+		}
+
+		if t := v.Get("anyTags"); t != "" {
+			query.AnyTags = strings.Split(t, ",")
+		}
+
+		query.Selection = protocol.Selection(v.Get("selection"))
+
+		w.Header().Set("Content-Type", "application/json")
+
+		// the kites are written while they are read from the storage, once
+		// the first one is written the status can't be changed anymore
+		enc := json.NewEncoder(w)
+		n := 0
+		write := func(kite *protocol.KiteWithToken) error {
+			sep := ","
+			if n == 0 {
+				sep = "["
+			}
+			n++
+
+			if _, err := w.Write([]byte(sep)); err != nil {
+				return err
+			}
+
+			return enc.Encode(kite)
+		}
+
+		var err error
+		if e, ok := k.storage.(eacher); ok {
+			err = e.Each(query, write)
+		} else {
+			var kites Kites
+			kites, err = k.storage.Get(query)
+			for i := 0; err == nil && i < len(kites); i++ {
+				err = write(kites[i])
+			}
+		}
+
+		if err != nil {
+			if n == 0 {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			k.Kite.Log.Error("debug handler: %s", err)
+			return
+		}
+
+		if n == 0 {
+			w.Write([]byte("[]\n"))
+			return
+		}
+
+		w.Write([]byte("]\n"))
+	})
+}
+
+// authenticateAdmin authenticates the HTTP request with the kite key in its
+// Authorization header and checks that its user is an admin.
+func (k *Kontrol) authenticateAdmin(r *http.Request) error {
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if key == "" {
+		return errors.New("no kite key in the Authorization header")
+	}
+
+	// the key must be signed by this kontrol, so the key in the token itself
+	// is not trusted. The public key would be accepted as the secret of an
+	// HMAC signature, so only RSA signatures are allowed.
+	token, err := jwt.Parse(key, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		if issuer, _ := token.Claims["iss"].(string); issuer != k.Kite.Kite().Username {
+			return nil, fmt.Errorf("issuer is not trusted: %s", issuer)
+		}
+
+		return []byte(k.publicKey), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !token.Valid {
+		return errors.New("invalid kite key")
+	}
+
+	username, ok := token.Claims["sub"].(string)
+	if !ok {
+		return errors.New("username is not present in kite key")
+	}
+
+	if k.IsAdmin == nil || !k.IsAdmin(&kite.Request{Username: username}) {
+		return errors.New("not an admin: " + username)
+	}
+
+	return nil
+}
@@ -0,0 +1,494 @@
+package kontrol
+
+import (
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/hashicorp/go-version"
+
+	"github.com/koding/kite"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+// DynamoDBConfig holds DynamoDB related configuration
+type DynamoDBConfig struct {
+	// Region of the table, defaults to the AWS_REGION environment variable.
+	Region string
+
+	// Endpoint overrides the DynamoDB endpoint, like the address of a
+	// DynamoDB Local instance. Empty means the endpoint of the region.
+	Endpoint string
+
+	// TableName is the name of the kite table, defaults to "kite". It's
+	// created if it doesn't exist.
+	TableName string
+}
+
+// DynamoDB implements the Storage interface with an Amazon DynamoDB table.
+//
+// The kite ID is the partition key of the table. The kites are queried with
+// the "username-key-index" global secondary index, which has the username as
+// partition and the rest of the kite key as sort key, so the queries are
+// made with a begins_with condition on the key. Expired kites are deleted by
+// the DynamoDB TTL feature on the expire_at attribute instead of a cleaner.
+// As the deletion can be delayed, expired kites are filtered out by Get too.
+type DynamoDB struct {
+	DB  *dynamodb.DynamoDB
+	Log kite.Logger
+
+	table string
+
+	// expire is the duration after which a kite that isn't updated is
+	// deleted.
+	expire time.Duration
+}
+
+var (
+	_ Storage          = (*DynamoDB)(nil)
+	_ ConstraintGetter = (*DynamoDB)(nil)
+)
+
+// dynamoIndex is the global secondary index used for the queries
+const dynamoIndex = "username-key-index"
+
+func NewDynamoDB(conf *DynamoDBConfig, log kite.Logger) *DynamoDB {
+	if conf == nil {
+		conf = &DynamoDBConfig{}
+	}
+
+	if conf.Region == "" {
+		conf.Region = os.Getenv("AWS_REGION")
+		if conf.Region == "" {
+			panic("region is not set for dynamodb kontrol storage")
+		}
+	}
+
+	if conf.TableName == "" {
+		conf.TableName = "kite"
+	}
+
+	awsConf := aws.NewConfig().WithRegion(conf.Region)
+	if conf.Endpoint != "" {
+		awsConf = awsConf.WithEndpoint(conf.Endpoint)
+	}
+
+	sess, err := session.NewSession(awsConf)
+	if err != nil {
+		panic(err)
+	}
+
+	d := &DynamoDB{
+		DB:     dynamodb.New(sess),
+		Log:    log,
+		table:  conf.TableName,
+		expire: 20 * time.Second, // delete kites that are 20 second old
+	}
+
+	if err := d.createTable(); err != nil {
+		panic(err)
+	}
+
+	return d
+}
+
+// createTable creates the kite table and the index if they don't exist, and
+// enables the TTL of the expire_at attribute.
+func (d *DynamoDB) createTable() error {
+	_, err := d.DB.CreateTable(&dynamodb.CreateTableInput{
+		TableName:   aws.String(d.table),
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: aws.String("S")},
+			{AttributeName: aws.String("username"), AttributeType: aws.String("S")},
+			{AttributeName: aws.String("key"), AttributeType: aws.String("S")},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: aws.String("HASH")},
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{{
+			IndexName: aws.String(dynamoIndex),
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String("username"), KeyType: aws.String("HASH")},
+				{AttributeName: aws.String("key"), KeyType: aws.String("RANGE")},
+			},
+			Projection: &dynamodb.Projection{
+				ProjectionType: aws.String(dynamodb.ProjectionTypeAll),
+			},
+		}},
+	})
+	if err != nil && !isAWSError(err, dynamodb.ErrCodeResourceInUseException) {
+		return err
+	}
+
+	err = d.DB.WaitUntilTableExists(&dynamodb.DescribeTableInput{
+		TableName: aws.String(d.table),
+	})
+	if err != nil {
+		return err
+	}
+
+	// the TTL can't be enabled twice, so the error is not fatal, like for
+	// the indexes of Postgres
+	_, err = d.DB.UpdateTimeToLive(&dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(d.table),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String("expire_at"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		d.Log.Warning("dynamodb: enable ttl: %s", err)
+	}
+
+	return nil
+}
+
+// ExpireInterval returns the duration after which a kite that isn't updated
+// is removed from the storage.
+func (d *DynamoDB) ExpireInterval() time.Duration {
+	return d.expire
+}
+
+func (d *DynamoDB) Get(query *protocol.KontrolQuery) (Kites, error) {
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		// version is a malformed, just return the error
+		return nil, err
+	}
+
+	return d.GetWithConstraint(query, constraint)
+}
+
+// GetWithConstraint retrieves the kites with the given query. If constraint
+// is not nil, it's used instead of the version field of the query.
+func (d *DynamoDB) GetWithConstraint(query *protocol.KontrolQuery, constraint version.Constraints) (Kites, error) {
+	var items []map[string]*dynamodb.AttributeValue
+	var err error
+
+	if onlyIDQuery(query) {
+		items, err = d.getByID(query.ID)
+	} else {
+		items, err = d.queryIndex(query, constraint)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Unix()
+	kites := make(Kites, 0, len(items))
+
+	// updated_at is stored in seconds, the kites updated within the second
+	// of SinceUpdatedAt are returned too
+	var since int64
+	if !query.SinceUpdatedAt.IsZero() {
+		since = query.SinceUpdatedAt.Unix()
+	}
+
+	for _, item := range items {
+		k, value, expireAt := dynamoKite(item)
+
+		// the TTL of DynamoDB deletes the expired items eventually
+		if expireAt < now {
+			continue
+		}
+
+		if since != 0 && dynamoUpdatedAt(item) < since {
+			continue
+		}
+
+		// the index is queried with the prefix of the exact fields, the
+		// version constraint and the fields after it are checked here
+		if !matchQuery(k, query, constraint) ||
+			!hasCapabilities(value.Capabilities, query.Capabilities) ||
+			!hasTags(value.Tags, query) {
+			continue
+		}
+
+		kites = append(kites, &protocol.KiteWithToken{
+			Kite: *k,
+			URL:  value.URL,
+			URLs: value.URLs,
+
+			Weight: value.Weight,
+			Tags:   value.Tags,
+		})
+	}
+
+	kites.Select(query.Selection)
+
+	return kites, nil
+}
+
+// getByID returns the item of the kite with the given ID.
+func (d *DynamoDB) getByID(id string) ([]map[string]*dynamodb.AttributeValue, error) {
+	out, err := d.DB.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	return []map[string]*dynamodb.AttributeValue{out.Item}, nil
+}
+
+// queryIndex returns the items of the kites matching the prefix of the query.
+func (d *DynamoDB) queryIndex(query *protocol.KontrolQuery, constraint version.Constraints) ([]map[string]*dynamodb.AttributeValue, error) {
+	// only let query with usernames, otherwise the whole table would be
+	// scanned
+	if _, err := GetQueryKey(query); err != nil {
+		return nil, err
+	}
+
+	prefixQuery := *query
+	if constraint != nil {
+		// We will query all kites under this name and filter the result
+		// later.
+		prefixQuery = protocol.KontrolQuery{
+			Username:    query.Username,
+			Environment: query.Environment,
+			Name:        query.Name,
+		}
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(d.table),
+		IndexName:              aws.String(dynamoIndex),
+		KeyConditionExpression: aws.String("username = :username AND begins_with(#key, :prefix)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#key": aws.String("key"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":username": {S: aws.String(query.Username)},
+			":prefix":   {S: aws.String(dynamoKeyPrefix(&prefixQuery))},
+		},
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	err := d.DB.QueryPages(input, func(out *dynamodb.QueryOutput, last bool) bool {
+		items = append(items, out.Items...)
+		return true
+	})
+
+	return items, err
+}
+
+func (d *DynamoDB) Add(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return d.Upsert(kiteProt, value)
+}
+
+// Update updates the value of the kite and extends its expiration. Kites that
+// don't exist are not created.
+func (d *DynamoDB) Update(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	// check that the incoming url is valid to prevent malformed input
+	_, err := url.Parse(value.URL)
+	if err != nil {
+		return err
+	}
+
+	item := d.item(kiteProt, value)
+
+	_, err = d.DB.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(d.table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+	if isAWSError(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+		return nil
+	}
+
+	return err
+}
+
+func (d *DynamoDB) Upsert(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	// check that the incoming URL is valid to prevent malformed input
+	_, err := url.Parse(value.URL)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item:      d.item(kiteProt, value),
+	})
+
+	return err
+}
+
+func (d *DynamoDB) Delete(kiteProt *protocol.Kite) error {
+	_, err := d.DB.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(d.table),
+		Key:       map[string]*dynamodb.AttributeValue{"id": {S: aws.String(kiteProt.ID)}},
+	})
+
+	return err
+}
+
+// item returns the DynamoDB item of the given kite. Kites registered with
+// their own TTL expire after it, the others after the expire interval.
+func (d *DynamoDB) item(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) map[string]*dynamodb.AttributeValue {
+	expire := d.expire
+	if value.TTL > 0 {
+		expire = value.TTL
+	}
+
+	now := time.Now().UTC()
+	return dynamoItem(kiteProt, value, now, now.Add(expire))
+}
+
+// dynamoItem returns the DynamoDB item of the given kite.
+func dynamoItem(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue, updatedAt, expireAt time.Time) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{
+		"id":          {S: aws.String(kiteProt.ID)},
+		"username":    {S: aws.String(kiteProt.Username)},
+		"key":         {S: aws.String(dynamoKey(kiteProt))},
+		"environment": {S: aws.String(kiteProt.Environment)},
+		"kitename":    {S: aws.String(kiteProt.Name)},
+		"version":     {S: aws.String(kiteProt.Version)},
+		"region":      {S: aws.String(kiteProt.Region)},
+		"hostname":    {S: aws.String(kiteProt.Hostname)},
+		"url":         {S: aws.String(value.URL)},
+		"updated_at":  {N: aws.String(strconv.FormatInt(updatedAt.Unix(), 10))},
+		"expire_at":   {N: aws.String(strconv.FormatInt(expireAt.Unix(), 10))},
+		"ttl":         {N: aws.String(strconv.FormatInt(int64(value.TTL), 10))},
+	}
+
+	// empty sets are not allowed
+	if len(value.Capabilities) != 0 {
+		item["capabilities"] = &dynamodb.AttributeValue{SS: aws.StringSlice(value.Capabilities)}
+	}
+
+	if len(value.Tags) != 0 {
+		item["tags"] = &dynamodb.AttributeValue{SS: aws.StringSlice(value.Tags)}
+	}
+
+	// a list keeps the order of the URLs, unlike a set
+	if len(value.URLs) != 0 {
+		urls := make([]*dynamodb.AttributeValue, len(value.URLs))
+		for i, u := range value.URLs {
+			urls[i] = &dynamodb.AttributeValue{S: aws.String(u)}
+		}
+		item["urls"] = &dynamodb.AttributeValue{L: urls}
+	}
+
+	if value.Weight != 0 {
+		item["weight"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatFloat(value.Weight, 'g', -1, 64))}
+	}
+
+	return item
+}
+
+// dynamoUpdatedAt returns the update time of the given item in unix seconds.
+func dynamoUpdatedAt(item map[string]*dynamodb.AttributeValue) int64 {
+	v, ok := item["updated_at"]
+	if !ok {
+		return 0
+	}
+
+	n, _ := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+	return n
+}
+
+// dynamoKite returns the kite, its value and the expiration time in unix
+// seconds from the given item.
+func dynamoKite(item map[string]*dynamodb.AttributeValue) (*protocol.Kite, *kontrolprotocol.RegisterValue, int64) {
+	str := func(name string) string {
+		if v, ok := item[name]; ok {
+			return aws.StringValue(v.S)
+		}
+		return ""
+	}
+
+	num := func(name string) int64 {
+		if v, ok := item[name]; ok {
+			n, _ := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+			return n
+		}
+		return 0
+	}
+
+	k := &protocol.Kite{
+		Username:    str("username"),
+		Environment: str("environment"),
+		Name:        str("kitename"),
+		Version:     str("version"),
+		Region:      str("region"),
+		Hostname:    str("hostname"),
+		ID:          str("id"),
+	}
+
+	value := &kontrolprotocol.RegisterValue{
+		URL: str("url"),
+		TTL: time.Duration(num("ttl")),
+	}
+
+	if v, ok := item["capabilities"]; ok {
+		value.Capabilities = aws.StringValueSlice(v.SS)
+	}
+
+	if v, ok := item["tags"]; ok {
+		value.Tags = aws.StringValueSlice(v.SS)
+	}
+
+	if v, ok := item["urls"]; ok {
+		for _, u := range v.L {
+			value.URLs = append(value.URLs, aws.StringValue(u.S))
+		}
+	}
+
+	if v, ok := item["weight"]; ok {
+		value.Weight, _ = strconv.ParseFloat(aws.StringValue(v.N), 64)
+	}
+
+	return k, value, num("expire_at")
+}
+
+// dynamoKey returns the sort key of the kite in the index. It's the key of
+// the kite without the username, which is the partition key of the index,
+// like: /production/mathworker/1.0.0/us-east-1/host/<id>/
+func dynamoKey(k *protocol.Kite) string {
+	return strings.Join([]string{
+		"", k.Environment, k.Name, k.Version, k.Region, k.Hostname, k.ID, "",
+	}, "/")
+}
+
+// dynamoKeyPrefix returns the prefix of the sort keys of the kites matching
+// the fields of the query up to the first empty one. The prefix ends with a
+// slash, so a query for "foo" doesn't match the kites named "foobar".
+func dynamoKeyPrefix(query *protocol.KontrolQuery) string {
+	prefix := "/"
+
+	fields := query.Fields()
+	for _, key := range keyOrder[1:] { // skip the username
+		v := fields[key]
+		if v == "" {
+			break
+		}
+
+		prefix += v + "/"
+	}
+
+	return prefix
+}
+
+// isAWSError returns true if err is an AWS error with the given code.
+func isAWSError(err error, code string) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == code
+	}
+
+	return false
+}
@@ -0,0 +1,82 @@
+package kontrol
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+func TestDynamoItem(t *testing.T) {
+	k := &protocol.Kite{
+		Username:    "devrim",
+		Environment: "production",
+		Name:        "mathworker",
+		Version:     "1.0.0",
+		Region:      "us-east-1",
+		Hostname:    "host",
+		ID:          "2ba5b5ad-3d3d-4b1f-5d5b-12ea8ab1a5b2",
+	}
+
+	value := &kontrolprotocol.RegisterValue{
+		URL:          "http://localhost:4444/kite",
+		TTL:          30 * time.Second,
+		Capabilities: []string{"gpu"},
+		URLs:         []string{"ws://10.0.0.1:4444/kite", "ws://10.0.0.2:4444/kite"},
+	}
+
+	updatedAt := time.Unix(1390000000, 0)
+	expireAt := time.Unix(1400000000, 0)
+	item := dynamoItem(k, value, updatedAt, expireAt)
+	gotKite, gotValue, gotExpireAt := dynamoKite(item)
+
+	if !reflect.DeepEqual(gotKite, k) {
+		t.Errorf("kite: got %+v, want %+v", gotKite, k)
+	}
+
+	if !reflect.DeepEqual(gotValue, value) {
+		t.Errorf("value: got %+v, want %+v", gotValue, value)
+	}
+
+	if gotExpireAt != expireAt.Unix() {
+		t.Errorf("expire_at: got %d, want %d", gotExpireAt, expireAt.Unix())
+	}
+
+	if got := dynamoUpdatedAt(item); got != updatedAt.Unix() {
+		t.Errorf("updated_at: got %d, want %d", got, updatedAt.Unix())
+	}
+}
+
+func TestDynamoKeyPrefix(t *testing.T) {
+	k := &protocol.Kite{
+		Username:    "devrim",
+		Environment: "production",
+		Name:        "mathworker",
+		Version:     "1.0.0",
+		Region:      "us-east-1",
+		Hostname:    "host",
+		ID:          "2ba5b5ad-3d3d-4b1f-5d5b-12ea8ab1a5b2",
+	}
+
+	key := dynamoKey(k)
+
+	matching := []*protocol.KontrolQuery{
+		{Username: "devrim"},
+		{Username: "devrim", Environment: "production", Name: "mathworker"},
+		k.Query(),
+	}
+
+	for _, q := range matching {
+		if prefix := dynamoKeyPrefix(q); !strings.HasPrefix(key, prefix) {
+			t.Errorf("key %q doesn't begin with %q", key, prefix)
+		}
+	}
+
+	q := &protocol.KontrolQuery{Username: "devrim", Environment: "production", Name: "math"}
+	if prefix := dynamoKeyPrefix(q); strings.HasPrefix(key, prefix) {
+		t.Errorf("key %q shouldn't begin with %q", key, prefix)
+	}
+}
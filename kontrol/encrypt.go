@@ -0,0 +1,196 @@
+package kontrol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+// encryptedPrefix marks the values encrypted by a columnCipher.
+const encryptedPrefix = "enc:v1:"
+
+// encryptableColumns are the columns that can be encrypted. They are not a
+// part of the key, so the kites are still found by the queries. The tags can
+// be encrypted only if the kites are not queried by their tags.
+var encryptableColumns = map[string]bool{
+	"urls": true,
+	"tags": true,
+}
+
+// columnCipher encrypts the values of some columns with AES-GCM before they
+// are stored, and decrypts them once they are scanned. An encrypted column
+// keeps its type, its value is a single element array of the ciphertext of
+// the JSON encoded values. The ID of the kite is authenticated with the
+// ciphertext, so it can't be copied to the row of another kite.
+type columnCipher struct {
+	aead    cipher.AEAD
+	columns map[string]bool
+}
+
+// newColumnCipher returns a cipher for the given columns. The key must be
+// 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256. It returns
+// nil if no column is given.
+func newColumnCipher(key []byte, columns []string) (*columnCipher, error) {
+	if len(columns) == 0 {
+		return nil, nil
+	}
+
+	c := &columnCipher{columns: make(map[string]bool, len(columns))}
+	for _, column := range columns {
+		if !encryptableColumns[column] {
+			return nil, fmt.Errorf("column can't be encrypted: %q", column)
+		}
+
+		c.columns[column] = true
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	c.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// encrypts returns true if the column is encrypted.
+func (c *columnCipher) encrypts(column string) bool {
+	return c != nil && c.columns[column]
+}
+
+// encryptValue returns a copy of the value of the kite with the given ID
+// with the values of the encrypted columns replaced by their ciphertexts.
+// The value itself is returned if no column is encrypted.
+func (c *columnCipher) encryptValue(id string, value *kontrolprotocol.RegisterValue) (*kontrolprotocol.RegisterValue, error) {
+	if c == nil {
+		return value, nil
+	}
+
+	v := *value
+
+	var err error
+	if c.encrypts("urls") {
+		if v.URLs, err = c.encrypt(id, v.URLs); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.encrypts("tags") {
+		if v.Tags, err = c.encrypt(id, v.Tags); err != nil {
+			return nil, err
+		}
+	}
+
+	return &v, nil
+}
+
+// rekeyValue returns a copy of the value of the kite whose ID is changed from
+// oldID to newID, with the ciphertexts of the encrypted columns replaced by
+// the ones for newID, as they are authenticated with the ID of the kite.
+func (c *columnCipher) rekeyValue(oldID, newID string, value *kontrolprotocol.RegisterValue) (*kontrolprotocol.RegisterValue, error) {
+	if c == nil {
+		return value, nil
+	}
+
+	v := *value
+
+	var err error
+	if v.URLs, err = c.decrypt(oldID, v.URLs); err != nil {
+		return nil, err
+	}
+
+	if v.Tags, err = c.decrypt(oldID, v.Tags); err != nil {
+		return nil, err
+	}
+
+	return c.encryptValue(newID, &v)
+}
+
+// decryptKite replaces the ciphertexts of the encrypted columns of the kite
+// with their values.
+func (c *columnCipher) decryptKite(k *protocol.KiteWithToken) error {
+	if c == nil {
+		return nil
+	}
+
+	var err error
+	if k.URLs, err = c.decrypt(k.Kite.ID, k.URLs); err != nil {
+		return err
+	}
+
+	k.Tags, err = c.decrypt(k.Kite.ID, k.Tags)
+	return err
+}
+
+// encrypt returns the ciphertext of the values of the kite with the given ID
+// as a single element slice. Empty values are not encrypted, so the empty
+// columns stay empty.
+func (c *columnCipher) encrypt(id string, values []string) ([]string, error) {
+	if len(values) == 0 {
+		return values, nil
+	}
+
+	plaintext, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := c.aead.Seal(nonce, nonce, plaintext, associatedData(id))
+	return []string{encryptedPrefix + base64.RawStdEncoding.EncodeToString(sealed)}, nil
+}
+
+// decrypt returns the values of a ciphertext returned by encrypt for the kite
+// with the given ID. The values that are not encrypted, like the ones stored
+// before the column was encrypted, are returned as they are.
+func (c *columnCipher) decrypt(id string, values []string) ([]string, error) {
+	if len(values) != 1 || !strings.HasPrefix(values[0], encryptedPrefix) {
+		return values, nil
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(values[0], encryptedPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	size := c.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, errors.New("encrypted value is too short")
+	}
+
+	plaintext, err := c.aead.Open(nil, sealed[:size], sealed[size:], associatedData(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var decrypted []string
+	if err := json.Unmarshal(plaintext, &decrypted); err != nil {
+		return nil, err
+	}
+
+	return decrypted, nil
+}
+
+// associatedData returns the data the ciphertexts of the kite with the given
+// ID are authenticated with. The IDs are scanned from the uuid column in
+// lower case, whatever case they are stored with.
+func associatedData(id string) []byte {
+	return []byte(strings.ToLower(id))
+}
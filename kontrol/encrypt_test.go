@@ -0,0 +1,133 @@
+package kontrol
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+var testEncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestColumnCipher(t *testing.T) {
+	c, err := newColumnCipher(testEncryptionKey, []string{"urls", "tags"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := &kontrolprotocol.RegisterValue{
+		URL:  "wss://example.com/kite",
+		URLs: []string{"ws://10.0.0.1:4444/kite"},
+		Tags: []string{"customer:acme", "tier:canary"},
+	}
+
+	encrypted, err := c.encryptValue("1", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if encrypted.URL != value.URL {
+		t.Errorf("the URL is not encrypted, got %s", encrypted.URL)
+	}
+
+	for _, values := range [][]string{encrypted.URLs, encrypted.Tags} {
+		if len(values) != 1 || !strings.HasPrefix(values[0], encryptedPrefix) ||
+			strings.Contains(values[0], "acme") {
+			t.Errorf("expected a single ciphertext, got %v", values)
+		}
+	}
+
+	if len(value.Tags) != 2 {
+		t.Errorf("the value is modified: %+v", value)
+	}
+
+	// the values are stored and scanned as they are
+	k := &protocol.KiteWithToken{Kite: protocol.Kite{ID: "1"}, URL: encrypted.URL, URLs: encrypted.URLs, Tags: encrypted.Tags}
+	if err := c.decryptKite(k); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(k.URLs, value.URLs) || !reflect.DeepEqual(k.Tags, value.Tags) {
+		t.Errorf("unexpected decrypted kite: %+v", k)
+	}
+
+	// the ciphertexts can't be moved to another kite
+	if err := c.decryptKite(&protocol.KiteWithToken{Kite: protocol.Kite{ID: "2"}, Tags: encrypted.Tags}); err == nil {
+		t.Error("expected an error for the ciphertext of another kite")
+	}
+
+	// the rows stored before the encryption are read as they are
+	k = &protocol.KiteWithToken{Tags: []string{"tier:stable"}}
+	if err := c.decryptKite(k); err != nil || !reflect.DeepEqual(k.Tags, []string{"tier:stable"}) {
+		t.Errorf("unexpected plain kite: %+v, %v", k, err)
+	}
+
+	// another key can't decrypt them
+	other, err := newColumnCipher([]byte("fedcba9876543210fedcba9876543210"), []string{"tags"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.decryptKite(&protocol.KiteWithToken{Kite: protocol.Kite{ID: "1"}, Tags: encrypted.Tags}); err == nil {
+		t.Error("expected an error for a wrong key")
+	}
+}
+
+func TestColumnCipherRekey(t *testing.T) {
+	c, err := newColumnCipher(testEncryptionKey, []string{"urls", "tags"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := &kontrolprotocol.RegisterValue{
+		URLs: []string{"ws://10.0.0.1:4444/kite"},
+		Tags: []string{"customer:acme"},
+	}
+
+	encrypted, err := c.encryptValue("old", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rekeyed, err := c.rekeyValue("old", "new", encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := &protocol.KiteWithToken{Kite: protocol.Kite{ID: "new"}, URLs: rekeyed.URLs, Tags: rekeyed.Tags}
+	if err := c.decryptKite(k); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(k.URLs, value.URLs) || !reflect.DeepEqual(k.Tags, value.Tags) {
+		t.Errorf("unexpected rekeyed kite: %+v", k)
+	}
+
+	// the ciphertexts of the old ID aren't valid for the new one
+	if _, err := c.rekeyValue("new", "other", encrypted); err == nil {
+		t.Error("expected an error for the ciphertexts of another kite")
+	}
+}
+
+func TestColumnCipherConfig(t *testing.T) {
+	if c, err := newColumnCipher(nil, nil); c != nil || err != nil {
+		t.Errorf("expected no cipher without columns, got %v, %v", c, err)
+	}
+
+	if _, err := newColumnCipher(testEncryptionKey, []string{"url"}); err == nil {
+		t.Error("expected an error for a key column")
+	}
+
+	if _, err := newColumnCipher([]byte("short"), []string{"tags"}); err == nil {
+		t.Error("expected an error for an invalid key")
+	}
+
+	// a nil cipher doesn't encrypt anything
+	var c *columnCipher
+	value := &kontrolprotocol.RegisterValue{Tags: []string{"a"}}
+	if v, err := c.encryptValue("1", value); err != nil || v != value {
+		t.Errorf("unexpected value: %+v, %v", v, err)
+	}
+}
@@ -31,6 +31,11 @@ type Etcd struct {
 	log    kite.Logger
 }
 
+var (
+	_ Storage          = (*Etcd)(nil)
+	_ ConstraintGetter = (*Etcd)(nil)
+)
+
 func NewEtcd(machines []string, log kite.Logger) *Etcd {
 	if machines == nil || len(machines) == 0 {
 		machines = []string{"127.0.0.1:4001"}
@@ -48,6 +53,12 @@ func NewEtcd(machines []string, log kite.Logger) *Etcd {
 	}
 }
 
+// ExpireInterval returns the TTL of the kite keys. A kite that isn't updated
+// within this duration is removed by etcd.
+func (e *Etcd) ExpireInterval() time.Duration {
+	return HeartbeatDelay
+}
+
 func (e *Etcd) Delete(k *protocol.Kite) error {
 	etcdKey := KitesPrefix + k.String()
 	etcdIDKey := KitesPrefix + "/" + k.ID
@@ -72,16 +83,17 @@ func (e *Etcd) Add(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error
 
 	valueBytes, _ := json.Marshal(value)
 	valueString := string(valueBytes)
+	ttl := keyTTL(value)
 
 	// Set the kite key.
 	// Example "/koding/production/os/0.0.1/sj/kontainer1.sj.koding.com/1234asdf..."
-	_, err := e.client.Set(etcdKey, valueString, uint64(HeartbeatDelay/time.Second))
+	_, err := e.client.Set(etcdKey, valueString, ttl)
 	if err != nil {
 		return err
 	}
 
 	// Also store the the kite.Key Id for easy lookup
-	_, err = e.client.Set(etcdIDKey, valueString, uint64(HeartbeatDelay/time.Second))
+	_, err = e.client.Set(etcdIDKey, valueString, ttl)
 	if err != nil {
 		return err
 	}
@@ -95,16 +107,17 @@ func (e *Etcd) Update(k *protocol.Kite, value *kontrolprotocol.RegisterValue) er
 
 	valueBytes, _ := json.Marshal(value)
 	valueString := string(valueBytes)
+	ttl := keyTTL(value)
 
 	// update the kite key.
 	// Example "/koding/production/os/0.0.1/sj/kontainer1.sj.koding.com/1234asdf..."
-	_, err := e.client.Update(etcdKey, valueString, uint64(HeartbeatDelay/time.Second))
+	_, err := e.client.Update(etcdKey, valueString, ttl)
 	if err != nil {
 		return err
 	}
 
 	// Also update the the kite.Key Id for easy lookup
-	_, err = e.client.Update(etcdIDKey, valueString, uint64(HeartbeatDelay/time.Second))
+	_, err = e.client.Update(etcdIDKey, valueString, ttl)
 	if err != nil {
 		return err
 	}
@@ -119,7 +132,40 @@ func (e *Etcd) Update(k *protocol.Kite, value *kontrolprotocol.RegisterValue) er
 	return nil
 }
 
+// keyTTL returns the TTL in seconds for the etcd keys of a kite.
+func keyTTL(value *kontrolprotocol.RegisterValue) uint64 {
+	if value.TTL > 0 && value.TTL < HeartbeatDelay {
+		return uint64(value.TTL / time.Second)
+	}
+
+	return uint64(HeartbeatDelay / time.Second)
+}
+
 func (e *Etcd) Get(query *protocol.KontrolQuery) (Kites, error) {
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		// version is a malformed, just return the error
+		return nil, err
+	}
+
+	return e.GetWithConstraint(query, constraint)
+}
+
+// GetWithConstraint retrieves the kites with the given query. If constraint
+// is not nil, it's used instead of the version field of the query.
+func (e *Etcd) GetWithConstraint(query *protocol.KontrolQuery, constraint version.Constraints) (Kites, error) {
+	if len(query.Capabilities) != 0 {
+		return nil, ErrCapabilitiesNotSupported
+	}
+
+	if hasTagQuery(query) {
+		return nil, ErrTagsNotSupported
+	}
+
+	if !query.SinceUpdatedAt.IsZero() {
+		return nil, ErrSinceUpdatedAtNotSupported
+	}
+
 	// We will make a get request to etcd store with this key. So get a "etcd"
 	// key from the given query so that we can use it to query from Etcd.
 	etcdKey, err := e.etcdKey(query)
@@ -129,21 +175,9 @@ func (e *Etcd) Get(query *protocol.KontrolQuery) (Kites, error) {
 
 	// If version field contains a constraint we need no make a new query up to
 	// "name" field and filter the results after getting all versions.
-	// NewVersion returns an error if it's a constraint, like: ">= 1.0, < 1.4"
-	// Because NewConstraint doesn't return an error for version's like "0.0.1"
-	// we check it with the NewVersion function.
 	var hasVersionConstraint bool // does query contains a constraint on version?
 	var keyRest string            // query key after the version field
-	var versionConstraint version.Constraints
-	_, err = version.NewVersion(query.Version)
-	if err != nil && query.Version != "" {
-		// now parse our constraint
-		versionConstraint, err = version.NewConstraint(query.Version)
-		if err != nil {
-			// version is a malformed, just return the error
-			return nil, err
-		}
-
+	if constraint != nil {
 		hasVersionConstraint = true
 		nameQuery := &protocol.KontrolQuery{
 			Username:    query.Username,
@@ -188,12 +222,11 @@ func (e *Etcd) Get(query *protocol.KontrolQuery) (Kites, error) {
 
 		// Filter kites by version constraint
 		if hasVersionConstraint {
-			kites.Filter(versionConstraint, keyRest)
+			kites.Filter(constraint, keyRest)
 		}
 	}
 
-	// Shuffle the list
-	kites.Shuffle()
+	kites.Select(query.Selection)
 
 	return kites, nil
 }
@@ -0,0 +1,118 @@
+package kontrol
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+// ExportedKite is a kite written by Export, with all of its columns. The
+// token of the embedded KiteWithToken is always empty.
+type ExportedKite struct {
+	protocol.KiteWithToken
+
+	// TTL is the TTL the kite is registered with, zero if it's expired by
+	// the cleaner's expire interval.
+	TTL time.Duration `json:"ttl,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// ClaimedBy and ClaimExpiresAt are set if the kite is claimed, see
+	// Postgres.Claim.
+	ClaimedBy      string     `json:"claimedBy,omitempty"`
+	ClaimExpiresAt *time.Time `json:"claimExpiresAt,omitempty"`
+}
+
+// Export writes all of the registered kites to w as JSON Lines, one
+// ExportedKite per line, while they are read from the database. It's meant
+// for backups and for moving the kites to another storage with Import.
+func (p *Postgres) Export(w io.Writer) error {
+	defer p.logSlow("export", time.Now(), "all kites")
+
+	columns := append(kiteColumns[:len(kiteColumns):len(kiteColumns)],
+		"created_at",
+		"updated_at",
+		"EXTRACT(EPOCH FROM expire_at - updated_at)",
+		"claimed_by",
+		"claim_expires_at",
+	)
+
+	rows, err := p.db().Query(`SELECT ` + strings.Join(columns, ", ") + ` FROM ` + p.table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+
+	for rows.Next() {
+		var (
+			exported  ExportedKite
+			ttl       sql.NullFloat64
+			claimedBy sql.NullString
+		)
+
+		kite, err := scanKite(rows, nil, &exported.CreatedAt, &exported.UpdatedAt,
+			&ttl, &claimedBy, &exported.ClaimExpiresAt)
+		if err != nil {
+			return err
+		}
+
+		if err := p.decryptKites(Kites{kite}); err != nil {
+			return err
+		}
+
+		exported.KiteWithToken = *kite
+		exported.TTL = time.Duration(ttl.Float64 * float64(time.Second))
+		exported.ClaimedBy = claimedBy.String
+
+		if err := enc.Encode(&exported); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Import upserts the kites read from r, in the format written by Export.
+// The kites are registered with their exported TTL, their timestamps are set
+// to the time of the import and their claims are not restored. It stops at
+// the first error, the kites before it stay imported.
+func (p *Postgres) Import(r io.Reader) error {
+	return importKites(r, p)
+}
+
+// importKites upserts each kite of the JSON Lines read from r into the
+// storage.
+func importKites(r io.Reader, storage Storage) error {
+	dec := json.NewDecoder(r)
+
+	for n := 1; ; n++ {
+		var kite ExportedKite
+		if err := dec.Decode(&kite); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("import: kite %d: %s", n, err)
+		}
+
+		value := &kontrolprotocol.RegisterValue{
+			URL:          kite.URL,
+			URLs:         kite.URLs,
+			TTL:          kite.TTL,
+			Capabilities: kite.Capabilities,
+			Weight:       kite.Weight,
+			Tags:         kite.Tags,
+		}
+
+		if err := storage.Upsert(&kite.Kite, value); err != nil {
+			return fmt.Errorf("import: kite %s: %s", kite.Kite.ID, err)
+		}
+	}
+}
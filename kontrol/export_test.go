@@ -0,0 +1,175 @@
+package kontrol
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+func TestImportKites(t *testing.T) {
+	lines := `{"kite":{"username":"cenk","environment":"production","name":"worker","version":"1.0.0","region":"sj","hostname":"host1","id":"1"},"url":"wss://example.com/kite","token":"","urls":["ws://10.0.0.1:4444/kite"],"weight":2,"tags":["tier:canary"]}
+{"kite":{"username":"cenk","environment":"production","name":"worker","version":"1.0.1","region":"sj","hostname":"host2","id":"2"},"url":"ws://10.0.0.2:4444/kite","token":""}
+`
+
+	m := NewMemory()
+	if err := importKites(strings.NewReader(lines), m); err != nil {
+		t.Fatal(err)
+	}
+
+	kites, err := m.Get(&protocol.KontrolQuery{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &protocol.KiteWithToken{
+		Kite:   protocol.Kite{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host1", ID: "1"},
+		URL:    "wss://example.com/kite",
+		URLs:   []string{"ws://10.0.0.1:4444/kite"},
+		Weight: 2,
+		Tags:   []string{"tier:canary"},
+	}
+
+	if len(kites) != 1 || !reflect.DeepEqual(kites[0], want) {
+		t.Errorf("got %+v, want %+v", kites, want)
+	}
+
+	if n, _ := m.Count(); n != 2 {
+		t.Errorf("expected 2 kites, got %d", n)
+	}
+
+	err = importKites(strings.NewReader(lines+"{not json}\n"), NewMemory())
+	if err == nil || !strings.Contains(err.Error(), "kite 3") {
+		t.Errorf("expected the error of the third kite, got %v", err)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	claimExpiresAt := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	exported := &ExportedKite{
+		KiteWithToken: protocol.KiteWithToken{
+			Kite:         protocol.Kite{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host1", ID: "1"},
+			URL:          "wss://example.com/kite",
+			URLs:         []string{"ws://10.0.0.1:4444/kite"},
+			Weight:       2,
+			Tags:         []string{"tier:canary"},
+			Capabilities: []string{"gpu", "ssd"},
+		},
+		TTL:            90 * time.Second,
+		CreatedAt:      time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+		UpdatedAt:      time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC),
+		ClaimedBy:      "worker-1",
+		ClaimExpiresAt: &claimExpiresAt,
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(exported); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded ExportedKite
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(&decoded, exported) {
+		t.Errorf("decoded %+v, want %+v", decoded, exported)
+	}
+
+	m := NewMemory()
+	if err := importKites(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+
+	want := kontrolprotocol.RegisterValue{
+		URL:          "wss://example.com/kite",
+		URLs:         []string{"ws://10.0.0.1:4444/kite"},
+		TTL:          90 * time.Second,
+		Capabilities: []string{"gpu", "ssd"},
+		Tags:         []string{"tier:canary"},
+		Weight:       2,
+	}
+
+	if k, ok := m.kites["1"]; !ok || !reflect.DeepEqual(k.value, want) {
+		t.Errorf("imported %+v, want %+v", k, want)
+	}
+}
+
+// TestPostgresExport exports the kites of the postgres storage and imports
+// them back. It's skipped unless the tests are run with the postgres storage.
+func TestPostgresExport(t *testing.T) {
+	if os.Getenv("KONTROL_STORAGE") != "postgres" {
+		t.Skip("KONTROL_STORAGE is not postgres")
+	}
+
+	p, ok := kon.storage.(*Postgres)
+	if !ok {
+		t.Fatalf("unexpected storage: %T", kon.storage)
+	}
+
+	k := &protocol.Kite{Username: "exporttest", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host1", ID: protocol.NewKiteID()}
+	value := &kontrolprotocol.RegisterValue{
+		URL:          "wss://example.com/kite",
+		URLs:         []string{"ws://10.0.0.1:4444/kite"},
+		TTL:          90 * time.Second,
+		Capabilities: []string{"gpu"},
+		Tags:         []string{"tier:canary"},
+		Weight:       2,
+	}
+
+	if err := p.Upsert(k, value); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Delete(k)
+
+	var buf bytes.Buffer
+	if err := p.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var exported *ExportedKite
+	for dec := json.NewDecoder(bytes.NewReader(buf.Bytes())); ; {
+		var e ExportedKite
+		if err := dec.Decode(&e); err != nil {
+			break
+		}
+
+		if e.Kite.ID == k.ID {
+			exported = &e
+		}
+	}
+
+	if exported == nil {
+		t.Fatalf("kite %s is not exported", k.ID)
+	}
+
+	if exported.TTL != value.TTL || !reflect.DeepEqual(exported.Capabilities, value.Capabilities) ||
+		exported.CreatedAt.IsZero() || exported.UpdatedAt.IsZero() {
+		t.Errorf("unexpected exported kite: %+v", exported)
+	}
+
+	if err := p.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	kites, err := p.Get(&protocol.KontrolQuery{ID: k.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kites) != 1 || !reflect.DeepEqual(kites[0].Capabilities, value.Capabilities) ||
+		!reflect.DeepEqual(kites[0].URLs, value.URLs) || kites[0].Weight != value.Weight {
+		t.Errorf("unexpected imported kites: %+v", kites)
+	}
+}
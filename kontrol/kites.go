@@ -1,7 +1,9 @@
 package kontrol
 
 import (
+	"errors"
 	"math/rand"
+	"sort"
 	"strings"
 
 	"github.com/hashicorp/go-version"
@@ -19,27 +21,188 @@ func (k Kites) Attach(token string) {
 	}
 }
 
+// withDefaults returns a copy of the kite with the empty region set to the
+// given default region. It also returns the names of the fields set. The kite
+// itself is returned if no field is set. The hostname is left as is, it's set
+// by the kite itself and the hostname of kontrol would be wrong for the
+// remote kites.
+func withDefaults(k *protocol.Kite, region string) (*protocol.Kite, []string) {
+	var filled []string
+	c := *k
+
+	if c.Region == "" && region != "" {
+		c.Region = region
+		filled = append(filled, "region="+region)
+	}
+
+	if filled == nil {
+		return k, nil
+	}
+
+	return &c, filled
+}
+
 // Shuffle shuffles the order of the kites. This is usefull if you want send
 // back a randomized list of kites.
-func (k Kites) Shuffle() {
-	shuffled := make(Kites, len(k))
-	for i, v := range rand.Perm(len(k)) {
-		shuffled[v] = k[i]
+func (k *Kites) Shuffle() {
+	shuffled := make(Kites, len(*k))
+	for i, v := range rand.Perm(len(*k)) {
+		shuffled[v] = (*k)[i]
 	}
 
-	k = shuffled
+	*k = shuffled
 }
 
-// Filter filters out kites with the given constraints
-func (k Kites) Filter(constraint version.Constraints, keyRest string) {
-	filtered := make(Kites, 0)
-	for _, kite := range k {
+// Select orders the kites as the given selection of a query. They are
+// shuffled if the selection is empty.
+func (k *Kites) Select(selection protocol.Selection) {
+	switch selection {
+	case protocol.SortByVersion:
+		sort.SliceStable(*k, func(i, j int) bool {
+			a, b := (*k)[i].Kite, (*k)[j].Kite
+			if c := compareVersions(a.Version, b.Version); c != 0 {
+				return c < 0
+			}
+
+			return a.ID < b.ID
+		})
+	case protocol.SortByID:
+		sort.SliceStable(*k, func(i, j int) bool {
+			return (*k)[i].Kite.ID < (*k)[j].Kite.ID
+		})
+	case protocol.None:
+	default:
+		// randomize the result, if it's just single result there is no
+		// need
+		if len(*k) > 1 {
+			k.Shuffle()
+		}
+	}
+}
+
+// compareVersions compares two kite versions. The invalid versions are
+// compared as strings and sorted after the valid ones.
+func compareVersions(a, b string) int {
+	va, errA := version.NewVersion(a)
+	vb, errB := version.NewVersion(b)
+
+	switch {
+	case errA == nil && errB == nil:
+		return va.Compare(vb)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+// errInvalidSelection is returned for the queries with an unknown selection.
+var errInvalidSelection = errors.New("invalid selection")
+
+// validSelection returns an error if the selection of the query is unknown.
+func validSelection(selection protocol.Selection) error {
+	switch selection {
+	case "", protocol.Shuffle, protocol.SortByVersion, protocol.SortByID, protocol.None:
+		return nil
+	default:
+		return errInvalidSelection
+	}
+}
+
+// Filter filters out kites with the given constraints. It returns the number
+// of kites filtered out.
+func (k *Kites) Filter(constraint version.Constraints, keyRest string) int {
+	filtered := make(Kites, 0, len(*k))
+	for _, kite := range *k {
 		if isValid(&kite.Kite, constraint, keyRest) {
 			filtered = append(filtered, kite)
 		}
 	}
 
-	k = filtered
+	discarded := len(*k) - len(filtered)
+	*k = filtered
+	return discarded
+}
+
+// Canary reports whether the kite is a canary, which gets only a fraction of
+// the traffic while a new version is validated.
+type Canary func(*protocol.KiteWithToken) bool
+
+// CanaryTag returns a Canary for the kites registered with the given tag, like
+// "tier:canary".
+func CanaryTag(tag string) Canary {
+	return func(k *protocol.KiteWithToken) bool {
+		for _, t := range k.Tags {
+			if t == tag {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// CanaryVersion returns a Canary for the kites with a version matching the
+// given constraint, like ">= 2.0".
+func CanaryVersion(constraint string) (Canary, error) {
+	c, err := version.NewConstraint(constraint)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(k *protocol.KiteWithToken) bool {
+		v, err := version.NewVersion(k.Kite.Version)
+		return err == nil && c.Check(v)
+	}, nil
+}
+
+// PickCanary returns a random canary kite percent of the time, where percent
+// is between 0 and 100, and a random stable kite otherwise. If there are only
+// canaries or only stable kites, one of them is returned regardless of the
+// percentage. It returns nil if there are no kites.
+func (k Kites) PickCanary(percent float64, isCanary Canary) *protocol.KiteWithToken {
+	return k.pickCanary(percent, isCanary, rand.Float64())
+}
+
+// pickCanary picks a canary if r, between 0 and 1, is below the fraction.
+func (k Kites) pickCanary(percent float64, isCanary Canary, r float64) *protocol.KiteWithToken {
+	var canaries, stable Kites
+	for _, kite := range k {
+		if isCanary(kite) {
+			canaries = append(canaries, kite)
+		} else {
+			stable = append(stable, kite)
+		}
+	}
+
+	pick := stable
+	if len(stable) == 0 || (len(canaries) != 0 && r*100 < percent) {
+		pick = canaries
+	}
+
+	if len(pick) == 0 {
+		return nil
+	}
+
+	return pick[rand.Intn(len(pick))]
+}
+
+// versionConstraint parses the version field of the query if it's a
+// constraint, like ">= 1.0, < 1.4". It returns nil if the version is empty or
+// an exact version. Because NewConstraint doesn't return an error for
+// versions like "0.0.1" we check it with the NewVersion function first.
+func versionConstraint(query *protocol.KontrolQuery) (version.Constraints, error) {
+	if query.Version == "" {
+		return nil, nil
+	}
+
+	if _, err := version.NewVersion(query.Version); err == nil {
+		return nil, nil
+	}
+
+	return version.NewConstraint(query.Version)
 }
 
 func isValid(k *protocol.Kite, c version.Constraints, keyRest string) bool {
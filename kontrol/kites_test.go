@@ -0,0 +1,173 @@
+package kontrol
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-version"
+	"github.com/koding/kite/protocol"
+)
+
+func TestKitesFilter(t *testing.T) {
+	kites := Kites{
+		{Kite: protocol.Kite{ID: "1", Version: "1.0.0", Region: "sj"}},
+		{Kite: protocol.Kite{ID: "2", Version: "1.1.0", Region: "sj"}},
+		{Kite: protocol.Kite{ID: "3", Version: "2.0.0", Region: "sj"}},
+		{Kite: protocol.Kite{ID: "4", Version: "1.2.0", Region: "ams"}},
+	}
+
+	constraint, err := version.NewConstraint(">= 1.1, < 2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the filtered kites must be visible to the caller
+	kites.Filter(constraint, "/sj")
+
+	if len(kites) != 1 || kites[0].Kite.ID != "2" {
+		t.Errorf("unexpected kites after filtering: %+v", kites)
+	}
+}
+
+func TestKitesShuffle(t *testing.T) {
+	kites := make(Kites, 50)
+	for i := range kites {
+		kites[i] = &protocol.KiteWithToken{Kite: protocol.Kite{ID: string(rune('a' + i))}}
+	}
+
+	original := make(Kites, len(kites))
+	copy(original, kites)
+
+	kites.Shuffle()
+
+	if len(kites) != len(original) {
+		t.Fatalf("got %d kites after shuffling, want %d", len(kites), len(original))
+	}
+
+	seen := make(map[string]bool)
+	moved := false
+	for i, k := range kites {
+		seen[k.Kite.ID] = true
+		if k != original[i] {
+			moved = true
+		}
+	}
+
+	if len(seen) != len(original) {
+		t.Errorf("got %d distinct kites after shuffling, want %d", len(seen), len(original))
+	}
+
+	// the chance of 50 kites keeping their order is negligible
+	if !moved {
+		t.Error("kites are not shuffled")
+	}
+}
+
+func canaryKites() Kites {
+	return Kites{
+		{Kite: protocol.Kite{ID: "1", Version: "1.0.0"}},
+		{Kite: protocol.Kite{ID: "2", Version: "1.0.0"}},
+		{Kite: protocol.Kite{ID: "3", Version: "2.0.0"}, Tags: []string{"tier:canary"}},
+	}
+}
+
+func TestPickCanary(t *testing.T) {
+	kites := canaryKites()
+	isCanary := CanaryTag("tier:canary")
+
+	tests := []struct {
+		percent float64
+		r       float64
+		canary  bool
+	}{
+		{10, 0.05, true},
+		{10, 0.1, false},
+		{10, 0.5, false},
+		{0, 0, false},
+		{100, 0.99, true},
+	}
+
+	for _, test := range tests {
+		k := kites.pickCanary(test.percent, isCanary, test.r)
+		if k == nil {
+			t.Fatalf("%v%% with %v: no kite is picked", test.percent, test.r)
+		}
+
+		if isCanary(k) != test.canary {
+			t.Errorf("%v%% with %v: picked kite %s, canary expected: %t", test.percent, test.r, k.Kite.ID, test.canary)
+		}
+	}
+
+	// kites of the other group are picked if a group is empty
+	if k := kites[2:].pickCanary(0, isCanary, 0.5); k == nil || k.Kite.ID != "3" {
+		t.Errorf("expected the canary when there are no stable kites, got %+v", k)
+	}
+
+	if k := kites[:2].pickCanary(100, isCanary, 0); k == nil || isCanary(k) {
+		t.Errorf("expected a stable kite when there are no canaries, got %+v", k)
+	}
+
+	if k := (Kites{}).PickCanary(50, isCanary); k != nil {
+		t.Errorf("expected no kite, got %+v", k)
+	}
+}
+
+func TestCanaryVersion(t *testing.T) {
+	isCanary, err := CanaryVersion(">= 2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range canaryKites() {
+		if isCanary(k) != (k.Kite.Version == "2.0.0") {
+			t.Errorf("unexpected canary result for version %s", k.Kite.Version)
+		}
+	}
+
+	if _, err := CanaryVersion("invalid"); err == nil {
+		t.Error("expected an error for an invalid constraint")
+	}
+}
+
+func TestKitesSelect(t *testing.T) {
+	newKites := func() Kites {
+		return Kites{
+			{Kite: protocol.Kite{ID: "c", Version: "1.10.0"}},
+			{Kite: protocol.Kite{ID: "a", Version: "1.9.0"}},
+			{Kite: protocol.Kite{ID: "d", Version: "invalid"}},
+			{Kite: protocol.Kite{ID: "b", Version: "1.9.0"}},
+		}
+	}
+
+	tests := []struct {
+		selection protocol.Selection
+		ids       string
+	}{
+		{protocol.SortByVersion, "abcd"},
+		{protocol.SortByID, "abcd"},
+		{protocol.None, "cadb"},
+	}
+
+	for _, test := range tests {
+		kites := newKites()
+		kites.Select(test.selection)
+
+		var ids string
+		for _, k := range kites {
+			ids += k.Kite.ID
+		}
+
+		if ids != test.ids {
+			t.Errorf("%q: got kites %s, want %s", test.selection, ids, test.ids)
+		}
+	}
+
+	kites := newKites()
+	kites.Select("")
+	if len(kites) != 4 {
+		t.Errorf("expected the shuffled kites to be kept, got %d", len(kites))
+	}
+
+	if err := validSelection("random"); err != errInvalidSelection {
+		t.Errorf("expected an error for an unknown selection, got %v", err)
+	}
+}
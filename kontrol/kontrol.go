@@ -3,9 +3,12 @@
 package kontrol
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -33,6 +36,10 @@ var (
 	TokenTTL    = 48 * time.Hour
 	DefaultPort = 4000
 
+	// GetKitesTimeout is the default duration the storage query of a
+	// getKites request can take.
+	GetKitesTimeout = 5 * time.Second
+
 	tokenCache   = make(map[string]string)
 	tokenCacheMu sync.Mutex
 )
@@ -46,19 +53,75 @@ type Kontrol struct {
 	// before they register to this machine.
 	MachineAuthenticate func(r *kite.Request) error
 
+	// IsolateTenants restricts the queries of getKites, getToken and
+	// getTokens to the kites of the caller's username, regardless of the
+	// username in the query, so no tokens are issued for the kites of other
+	// users. Callers for which IsAdmin returns true can query the kites of
+	// any user.
+	IsolateTenants bool
+	IsAdmin        func(r *kite.Request) bool
+
 	// RSA keys
 	publicKey  string // for validating tokens
 	privateKey string // for signing tokens
 
 	// Holds refence to all connected clients (key is ID of kite)
-	clients map[string]*kite.Client
+	clients   map[string]*kite.Client
+	clientsMu sync.Mutex // protects clients
+
+	// revoked holds the revoked kite keys and tokens if the storage can't
+	// keep them, see RevocationStorage.
+	revoked *revocationList
+
+	// watchers holds the watchers created with the getKites method (key is
+	// the ID of the watcher)
+	watchers   map[string]*watcher
+	watchersMu sync.Mutex // protects watchers
 
 	// storage defines the storage of the kites.
 	storage Storage
 
+	// storageWatch is true if the watchers are fed by the storage's events,
+	// see StorageWatcher. Otherwise only the kites registered to this
+	// kontrol are sent to the watchers.
+	storageWatch bool
+
 	// RegisterURL defines the URL that is used to self register when adding
 	// itself to the storage backend
 	RegisterURL string
+
+	// TokenTTL defines the lifetime of the tokens issued by this kontrol. It
+	// is used both for new and renewed tokens. If zero, the package level
+	// TokenTTL is used.
+	TokenTTL time.Duration
+
+	// GetKitesTimeout limits the duration of the storage queries of getKites
+	// requests, so a slow storage can't tie up the handlers. The clients
+	// get ErrStorageTimeout and can retry with another kontrol. If zero,
+	// the package level GetKitesTimeout is used.
+	GetKitesTimeout time.Duration
+
+	// RegisterRate and RegisterBurst define the token bucket that limits the
+	// registrations per username. They are initialized with the package
+	// level defaults. Setting RegisterRate to zero disables rate limiting.
+	RegisterRate  float64
+	RegisterBurst int
+
+	registerLimiter     *rateLimiter
+	registerLimiterOnce sync.Once
+
+	metrics *Metrics
+
+	// StorageObserver is notified about every storage operation, it's
+	// optional.
+	StorageObserver StorageObserver
+
+	// inflight tracks the handlers that are being executed. closing is set
+	// once Shutdown is called, after that no new requests are accepted.
+	inflight   sync.WaitGroup
+	inflightMu sync.Mutex // protects closing
+	closing    bool
+	closeC     chan struct{}
 }
 
 // New creates a new kontrol instance with the given verson and config
@@ -86,26 +149,38 @@ func New(conf *config.Config, version, publicKey, privateKey string) *Kontrol {
 		publicKey:  publicKey,
 		privateKey: privateKey,
 		clients:    make(map[string]*kite.Client),
+		revoked:    newRevocationList(),
+		watchers:   make(map[string]*watcher),
+		metrics:    newMetrics(),
+		closeC:     make(chan struct{}),
+
+		RegisterRate:  RegisterRate,
+		RegisterBurst: RegisterBurst,
 	}
 
 	log = k.Log
 
-	k.HandleFunc("register", kontrol.handleRegister)
-	k.HandleFunc("registerMachine", kontrol.handleMachine).DisableAuthentication()
-	k.HandleFunc("getKites", kontrol.handleGetKites)
-	k.HandleFunc("getToken", kontrol.handleGetToken)
+	k.HandleFunc("register", kontrol.track(kontrol.handleRegister))
+	k.HandleFunc("registerMachine", kontrol.track(kontrol.handleMachine)).DisableAuthentication()
+	k.HandleFunc("getKites", kontrol.track(kontrol.handleGetKites))
+	k.HandleFunc("getToken", kontrol.track(kontrol.handleGetToken))
+	k.HandleFunc("getTokens", kontrol.track(kontrol.handleGetTokens))
+	k.HandleFunc("cancelWatcher", kontrol.track(kontrol.handleCancelWatcher))
+	k.HandleFunc("deregister", kontrol.track(kontrol.handleDeregister))
+
+	// reject any request coming from a revoked kite
+	k.PreHandleFunc(kontrol.handleRevoked)
 
-	var mu sync.Mutex
 	k.OnFirstRequest(func(c *kite.Client) {
-		mu.Lock()
+		kontrol.clientsMu.Lock()
 		kontrol.clients[c.ID] = c
-		mu.Unlock()
+		kontrol.clientsMu.Unlock()
 	})
 
 	k.OnDisconnect(func(c *kite.Client) {
-		mu.Lock()
+		kontrol.clientsMu.Lock()
 		delete(kontrol.clients, c.ID)
-		mu.Unlock()
+		kontrol.clientsMu.Unlock()
 	})
 
 	return kontrol
@@ -116,16 +191,33 @@ func (k *Kontrol) AddAuthenticator(keyType string, fn func(*kite.Request) error)
 }
 
 func (k *Kontrol) Run() {
+	k.Start()
+	k.Kite.Run()
+}
+
+// Start prepares kontrol for serving the kites and registers it to its
+// storage, without running the server of its kite. It's used to serve
+// kontrol with another server, like an httptest.Server in tests, Run should
+// be used otherwise.
+func (k *Kontrol) Start() {
 	rand.Seed(time.Now().UnixNano())
 
 	if k.storage == nil {
 		panic("kontrol storage is not set")
 	}
 
+	if w, ok := k.storage.(StorageWatcher); ok {
+		events, err := w.Watch()
+		if err != nil {
+			log.Error("cannot watch storage, only local kites are sent to watchers: %s", err)
+		} else {
+			k.storageWatch = true
+			go k.publishStorageEvents(events)
+		}
+	}
+
 	// now go and register ourself
 	go k.registerSelf()
-
-	k.Kite.Run()
 }
 
 // SetStorage sets the backend storage that kontrol is going to use to store
@@ -136,7 +228,62 @@ func (k *Kontrol) SetStorage(storage Storage) {
 
 // Close stops kontrol and closes all connections
 func (k *Kontrol) Close() {
+	k.Shutdown(context.Background())
+}
+
+// Shutdown stops kontrol gracefully. It stops accepting new connections and
+// requests, waits for the in-flight requests to finish and finally closes
+// the storage. If the context is done before all requests are finished, the
+// storage is closed anyway and the context's error is returned.
+func (k *Kontrol) Shutdown(ctx context.Context) error {
+	k.inflightMu.Lock()
+	if k.closing {
+		k.inflightMu.Unlock()
+		return nil
+	}
+	k.closing = true
+	k.inflightMu.Unlock()
+
+	close(k.closeC)
 	k.Kite.Close()
+
+	done := make(chan struct{})
+	go func() {
+		k.inflight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if c, ok := k.storage.(io.Closer); ok {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// track wraps the given handler so it's waited by Shutdown. Requests are
+// rejected once kontrol is shutting down.
+func (k *Kontrol) track(handler kite.HandlerFunc) kite.HandlerFunc {
+	return func(r *kite.Request) (interface{}, error) {
+		k.inflightMu.Lock()
+		if k.closing {
+			k.inflightMu.Unlock()
+			return nil, errors.New("kontrol is shutting down")
+		}
+		k.inflight.Add(1)
+		k.inflightMu.Unlock()
+
+		defer k.inflight.Done()
+		return handler(r)
+	}
 }
 
 // InitializeSelf registers his host by writing a key to ~/.kite/kite.key
@@ -189,41 +336,118 @@ func (k *Kontrol) handleRegister(r *kite.Request) (interface{}, error) {
 		return nil, errors.New("invalid url")
 	}
 
-	var args struct {
-		URL string `json:"url"`
-	}
+	var args protocol.RegisterArgs
 	r.Args.One().MustUnmarshal(&args)
 	if args.URL == "" {
 		return nil, errors.New("empty url")
 	}
 
+	if args.TTL < 0 {
+		return nil, errors.New("invalid ttl")
+	}
+
+	if args.Weight < 0 {
+		return nil, errors.New("invalid weight")
+	}
+
+	for _, u := range args.URLs {
+		if _, err := url.Parse(u); err != nil || u == "" {
+			return nil, errors.New("invalid alternate url: " + u)
+		}
+	}
+
 	// Only accept requests with kiteKey because we need this info
 	// for generating tokens for this kite.
 	if r.Auth.Type != "kiteKey" {
 		return nil, fmt.Errorf("Unexpected authentication type: %s", r.Auth.Type)
 	}
 
-	err := k.register(r.Client, args.URL)
+	if !k.allowRegister(r.Username) {
+		log.Warning("Registration of %s is rate limited", r.Client.Kite)
+		return nil, ErrRateLimited
+	}
+
+	value := &kontrolprotocol.RegisterValue{
+		URL:  args.URL,
+		URLs: args.URLs,
+		TTL:  time.Duration(args.TTL) * time.Second,
+
+		Capabilities: args.Capabilities,
+		Tags:         args.Tags,
+		Weight:       args.Weight,
+	}
+
+	interval := k.heartbeatIntervalFor(value)
+
+	err := k.register(r.Client, value, interval)
 	if err != nil {
 		return nil, err
 	}
 
 	// send response back to the kite, also identify him with the new name
-	return &protocol.RegisterResult{URL: args.URL}, nil
+	return &protocol.RegisterResult{
+		URL:               args.URL,
+		HeartbeatInterval: int64(interval / time.Second),
+	}, nil
 }
 
-func (k *Kontrol) register(r *kite.Client, kiteURL string) error {
-	if err := validateKiteKey(&r.Kite); err != nil {
-		return err
+// expirer is implemented by storages that remove kites which are not updated
+// within the expire interval.
+type expirer interface {
+	ExpireInterval() time.Duration
+}
+
+// readOnlyStorage is implemented by storages that can be configured to be
+// read-only.
+type readOnlyStorage interface {
+	IsReadOnly() bool
+}
+
+// versionDeleter is implemented by storages that can delete the kites of a
+// version at once.
+type versionDeleter interface {
+	DeleteVersion(username, environment, name, version string) ([]protocol.Kite, error)
+}
+
+// heartbeatInterval returns the interval the registered kites should send
+// their heartbeats. It's half of the storage's expire interval, so a single
+// missed heartbeat doesn't cause a kite to be evicted.
+func (k *Kontrol) heartbeatInterval() time.Duration {
+	if e, ok := k.storage.(expirer); ok && e.ExpireInterval() > 0 {
+		return e.ExpireInterval() / 2
 	}
 
-	value := &kontrolprotocol.RegisterValue{
-		URL: kiteURL,
+	return HeartbeatInterval
+}
+
+// heartbeatIntervalFor returns the heartbeat interval of a kite that is
+// registered with the given value. A kite with its own TTL must send its
+// heartbeats more frequently than the TTL.
+func (k *Kontrol) heartbeatIntervalFor(value *kontrolprotocol.RegisterValue) time.Duration {
+	interval := k.heartbeatInterval()
+	if value.TTL > 0 && value.TTL/2 < interval {
+		interval = value.TTL / 2
+	}
+
+	// heartbeats are sent in seconds resolution
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	return interval
+}
+
+func (k *Kontrol) register(r *kite.Client, value *kontrolprotocol.RegisterValue, interval time.Duration) error {
+	if err := validateKiteKey(&r.Kite); err != nil {
+		return err
 	}
 
 	// Register first by adding the value to the storage. Return if there is
 	// any error.
-	if err := k.storage.Upsert(&r.Kite, value); err != nil {
+	start := time.Now()
+	err := k.storage.Upsert(&r.Kite, value)
+	k.observeStorage("upsert", start, err)
+	if err != nil {
 		log.Error("storage add '%s' error: %s", r.Kite, err)
 		return errors.New("internal error - register")
 	}
@@ -233,35 +457,104 @@ func (k *Kontrol) register(r *kite.Client, kiteURL string) error {
 	// assume that the klient is disconnected.
 	updater := k.makeUpdater(&r.Kite, value)
 
-	if err := requestHeartbeat(r, updater); err != nil {
+	// the kites with a health score send their current weight with the
+	// heartbeats. The callbacks may run concurrently and the value is read
+	// by the registration, so a changed weight is set on a copy of it.
+	var mu sync.Mutex
+	current := value
+	heartbeat := func(args *dnode.Partial) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if weight, ok := heartbeatWeight(args); ok && weight != current.Weight {
+			v := *current
+			v.Weight = weight
+			current = &v
+			updater = k.makeUpdater(&r.Kite, current)
+		}
+
+		return updater()
+	}
+
+	if err := requestHeartbeat(r, interval, heartbeat); err != nil {
 		return err
 	}
 
 	log.Info("Kite registered: %s", r.Kite)
+	k.metrics.addRegistration()
+
+	if !k.storageWatch {
+		k.publish(protocol.KiteEvent{
+			Action: protocol.Register,
+			Kite:   r.Kite,
+			URL:    value.URL,
+		}, value)
+	}
 
 	r.OnDisconnect(func() {
 		// Delete from storage once the remote kite is disconnected.
-		k.storage.Delete(&r.Kite)
+		start := time.Now()
+		err := k.storage.Delete(&r.Kite)
+		k.observeStorage("delete", start, err)
+
+		if !k.storageWatch {
+			k.publish(protocol.KiteEvent{
+				Action: protocol.Deregister,
+				Kite:   r.Kite,
+			}, nil)
+		}
 	})
 
 	return nil
 }
 
+// allowRegister returns false if the given username exceeds its registration
+// rate.
+func (k *Kontrol) allowRegister(username string) bool {
+	if k.RegisterRate <= 0 {
+		return true
+	}
+
+	k.registerLimiterOnce.Do(func() {
+		k.registerLimiter = newRateLimiter(k.RegisterRate, k.RegisterBurst)
+		go k.registerLimiter.runGC(time.Minute, k.closeC)
+	})
+
+	return k.registerLimiter.Allow(username)
+}
+
 // requestHeartbeat is calling the remote kite's kite.heartbeat method with the
 // given updaterFunc callback. The remote kite is calling this updaterFunc
-// every 4 seconds
-func requestHeartbeat(r *kite.Client, updaterFunc func() error) error {
+// every interval duration.
+func requestHeartbeat(r *kite.Client, interval time.Duration, updaterFunc func(*dnode.Partial) error) error {
 	heartbeatArgs := []interface{}{
-		HeartbeatInterval / time.Second,
-		dnode.Callback(func(args *dnode.Partial) { updaterFunc() }),
+		interval / time.Second,
+		dnode.Callback(func(args *dnode.Partial) { updaterFunc(args) }),
 	}
 
 	_, err := r.TellWithTimeout("kite.heartbeat", 4*time.Second, heartbeatArgs...)
 	return err
 }
 
+// heartbeatWeight returns the weight sent with a heartbeat, if any. The kites
+// without a health score send no arguments.
+func heartbeatWeight(args *dnode.Partial) (float64, bool) {
+	var values []float64
+	if err := args.Unmarshal(&values); err != nil || len(values) == 0 || values[0] < 0 {
+		return 0, false
+	}
+
+	return values[0], true
+}
+
 // registerSelf adds Kontrol itself to the storage as a kite.
 func (k *Kontrol) registerSelf() {
+	// a read-only kontrol serves only discovery, it can't be registered
+	if r, ok := k.storage.(readOnlyStorage); ok && r.IsReadOnly() {
+		log.Info("storage is read-only, kontrol is not registered to it")
+		return
+	}
+
 	value := &kontrolprotocol.RegisterValue{
 		URL: k.Kite.Config.KontrolURL,
 	}
@@ -279,20 +572,27 @@ func (k *Kontrol) registerSelf() {
 
 	updater := k.makeUpdater(k.Kite.Kite(), value)
 	for {
+		wait := k.heartbeatInterval()
 		if err := updater(); err != nil {
 			log.Error(err.Error())
-			time.Sleep(time.Second)
-			continue
+			wait = time.Second
 		}
 
-		time.Sleep(HeartbeatInterval)
+		select {
+		case <-time.After(wait):
+		case <-k.closeC:
+			return
+		}
 	}
 }
 
 //  makeUpdater returns a func for updating the value for the given kite key with value.
 func (k *Kontrol) makeUpdater(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) func() error {
 	return func() error {
-		if err := k.storage.Update(kiteProt, value); err != nil {
+		start := time.Now()
+		err := k.storage.Update(kiteProt, value)
+		k.observeStorage("update", start, err)
+		if err != nil {
 			log.Error("storage update error: %s", err)
 			return err
 		}
@@ -301,6 +601,133 @@ func (k *Kontrol) makeUpdater(kiteProt *protocol.Kite, value *kontrolprotocol.Re
 	}
 }
 
+// DeleteVersion deletes the kites of the given version, registered with the
+// given username, environment and name, from the storage, like the kites of
+// a canary that is rolled back. The watchers get a deregister event for each
+// of them. It returns the number of deleted kites.
+func (k *Kontrol) DeleteVersion(username, environment, name, version string) (int, error) {
+	d, ok := k.storage.(versionDeleter)
+	if !ok {
+		return 0, errors.New("deleting versions is not supported by the storage")
+	}
+
+	start := time.Now()
+	kites, err := d.DeleteVersion(username, environment, name, version)
+	k.observeStorage("deleteVersion", start, err)
+	if err != nil {
+		return 0, err
+	}
+
+	// otherwise the storage sends the events of the deleted kites
+	if !k.storageWatch {
+		for _, deleted := range kites {
+			k.publish(protocol.KiteEvent{
+				Action: protocol.Deregister,
+				Kite:   deleted,
+			}, nil)
+		}
+	}
+
+	return len(kites), nil
+}
+
+// handleDeregister removes a stale registration of the calling kite, like
+// the one of its previous process that crashed. Only the kites registered
+// with the same identity as the caller, apart from the version and the ID,
+// can be removed, and only if they aren't updated in the storage by their
+// heartbeats to any kontrol sharing it. The kites remove their own
+// registration on shutdown, it's removed right away if it's registered by
+// the calling connection. Only the ID of the given kite is used, the
+// registration is looked up with it and compared with the caller.
+func (k *Kontrol) handleDeregister(r *kite.Request) (interface{}, error) {
+	var args protocol.Kite
+	if err := r.Args.One().Unmarshal(&args); err != nil || args.ID == "" {
+		return nil, errors.New("invalid kite")
+	}
+
+	start := time.Now()
+	kites, err := k.storage.Get(&protocol.KontrolQuery{ID: args.ID})
+	k.observeStorage("get", start, err)
+	if err != nil {
+		log.Error("storage get '%s' error: %s", args.ID, err)
+		return nil, errors.New("internal error - deregister")
+	}
+
+	if len(kites) != 1 {
+		return nil, ErrKiteNotFound
+	}
+
+	target := kites[0].Kite
+	caller := r.Client.Kite
+	if target.Username != r.Username ||
+		target.Environment != caller.Environment ||
+		target.Name != caller.Name ||
+		target.Region != caller.Region ||
+		target.Hostname != caller.Hostname {
+		return nil, errors.New("only the registrations of the same kite can be removed")
+	}
+
+	own := target.ID == caller.ID
+	if own {
+		// another connection may claim the same ID
+		k.clientsMu.Lock()
+		c := k.clients[caller.ID]
+		k.clientsMu.Unlock()
+
+		if c != r.Client {
+			return nil, errors.New("cannot remove the registration of another connection")
+		}
+	} else if err := k.checkStale(&target); err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	err = k.storage.Delete(&target)
+	k.observeStorage("delete", start, err)
+	if err != nil {
+		log.Error("storage delete '%s' error: %s", target, err)
+		return nil, errors.New("internal error - deregister")
+	}
+
+	if own {
+		log.Info("Kite is deregistered: %s", target)
+	} else {
+		log.Info("Stale kite is deregistered by %s: %s", caller, target)
+	}
+
+	if !k.storageWatch {
+		k.publish(protocol.KiteEvent{
+			Action: protocol.Deregister,
+			Kite:   target,
+		}, nil)
+	}
+
+	return nil, nil
+}
+
+// checkStale returns an error if the kite is updated in the storage by its
+// heartbeats.
+func (k *Kontrol) checkStale(target *protocol.Kite) error {
+	// a single missed heartbeat doesn't make a kite stale
+	fresh, err := k.storage.Get(&protocol.KontrolQuery{
+		ID:             target.ID,
+		SinceUpdatedAt: time.Now().UTC().Add(-2 * k.heartbeatInterval()),
+	})
+	if err == ErrSinceUpdatedAtNotSupported {
+		return errors.New("deregister is not supported by the storage")
+	}
+	if err != nil {
+		log.Error("storage get '%s' error: %s", target, err)
+		return errors.New("internal error - deregister")
+	}
+
+	if len(fresh) != 0 {
+		return errors.New("kite is not stale")
+	}
+
+	return nil
+}
+
 func (k *Kontrol) handleGetKites(r *kite.Request) (interface{}, error) {
 	// This type is here until inversion branch is merged.
 	// Reason: We can't use the same struct for marshaling and unmarshaling.
@@ -332,7 +759,9 @@ func (k *Kontrol) handleGetKites(r *kite.Request) (interface{}, error) {
 		// If the kite is connected to us, we can use the existing connection.
 		// Otherwise we need to open a new connection to the selected kite.
 		// TODO This approach will NOT work when there are more than one kontrol instance.
+		k.clientsMu.Lock()
 		whoClient := k.clients[whoKite.Kite.ID]
+		k.clientsMu.Unlock()
 		if whoClient == nil {
 			// TODO Enable code below after fix.
 			return nil, errors.New("target kite is not connected")
@@ -362,25 +791,52 @@ func (k *Kontrol) handleGetKites(r *kite.Request) (interface{}, error) {
 }
 
 func (k *Kontrol) getKites(r *kite.Request, query *protocol.KontrolQuery, watchCallback dnode.Function) (*protocol.GetKitesResult, error) {
+	if query != nil {
+		if err := validSelection(query.Selection); err != nil {
+			return nil, err
+		}
+	}
+
+	query, ok := k.tenantQuery(r, query)
+	if !ok {
+		// the query can't match any kite of the caller
+		return &protocol.GetKitesResult{
+			Kites: make(Kites, 0),
+		}, nil
+	}
+
 	// audience will go into the token as "aud" claim.
 	audience := getAudience(query)
 
 	// Generate token once here because we are using the same token for every
 	// kite we return and generating many tokens is really slow.
 	token, err := generateToken(audience, r.Username,
-		k.Kite.Kite().Username, k.privateKey)
+		k.Kite.Kite().Username, k.privateKey, k.tokenTTL())
 	if err != nil {
 		return nil, err
 	}
 
-	// disable this until it can be supported better with the storage interface
+	k.metrics.addTokensIssued(1)
+
+	// Start watching before getting the snapshot, so no kite registered in
+	// between is missed. The remote kite might get a register event for a
+	// kite that is also in the snapshot.
+	var watcherID string
 	if watchCallback.Caller != nil {
-		return nil, errors.New("watch functionality is disabled")
+		watcherID, err = k.addWatcher(r.Client, query, watchCallback, token)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Get kites from the storage
-	kites, err := k.storage.Get(query)
+	start := time.Now()
+	kites, err := k.getWithTimeout(query)
+	k.observeStorage("get", start, err)
 	if err != nil {
+		if watcherID != "" {
+			k.cancelWatcher(watcherID)
+		}
 		return nil, err
 	}
 
@@ -388,17 +844,90 @@ func (k *Kontrol) getKites(r *kite.Request, query *protocol.KontrolQuery, watchC
 	kites.Attach(token)
 
 	return &protocol.GetKitesResult{
-		Kites: kites,
+		Kites:     kites,
+		WatcherID: watcherID,
 	}, nil
 }
 
+// tenantQuery returns the query restricted to the kites of the caller if
+// tenant isolation is enabled. An empty username is replaced with the
+// caller's username. It returns false if the query is for the kites of
+// another user.
+func (k *Kontrol) tenantQuery(r *kite.Request, query *protocol.KontrolQuery) (*protocol.KontrolQuery, bool) {
+	if !k.IsolateTenants || query == nil {
+		return query, true
+	}
+
+	if k.IsAdmin != nil && k.IsAdmin(r) {
+		return query, true
+	}
+
+	if query.Username != "" && query.Username != r.Username {
+		return nil, false
+	}
+
+	// copy, so the caller's query is not modified
+	q := *query
+	q.Username = r.Username
+	return &q, true
+}
+
+// getWithTimeout gets the kites of the query from the storage. It returns
+// ErrStorageTimeout if the storage doesn't answer in time. The query is
+// cancelled if the storage supports it, otherwise it's left running.
+func (k *Kontrol) getWithTimeout(query *protocol.KontrolQuery) (Kites, error) {
+	timeout := k.GetKitesTimeout
+	if timeout == 0 {
+		timeout = GetKitesTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type result struct {
+		kites Kites
+		err   error
+	}
+
+	// buffered, so the goroutine can exit after a timeout
+	done := make(chan result, 1)
+
+	go func() {
+		var r result
+		if g, ok := k.storage.(ContextGetter); ok {
+			r.kites, r.err = g.GetContext(ctx, query)
+		} else {
+			r.kites, r.err = k.storage.Get(query)
+		}
+		done <- r
+	}()
+
+	select {
+	case r := <-done:
+		return r.kites, r.err
+	case <-ctx.Done():
+		return nil, ErrStorageTimeout
+	}
+}
+
+// tokenTTL returns the lifetime of the tokens issued by kontrol.
+func (k *Kontrol) tokenTTL() time.Duration {
+	if k.TokenTTL != 0 {
+		return k.TokenTTL
+	}
+
+	return TokenTTL
+}
+
 // generateToken returns a JWT token string. Please see the URL for details:
 // http://tools.ietf.org/html/draft-ietf-oauth-json-web-token-13#section-4.1
-func generateToken(aud, username, issuer, privateKey string) (string, error) {
+func generateToken(aud, username, issuer, privateKey string, ttl time.Duration) (string, error) {
 	tokenCacheMu.Lock()
 	defer tokenCacheMu.Unlock()
 
-	uniqKey := aud + username + issuer // neglect privateKey, its always the same
+	// neglect privateKey, its always the same. ttl is part of the key, so a
+	// changed TTL doesn't hand out a token with the old expiration.
+	uniqKey := aud + username + issuer + ttl.String()
 	signed, ok := tokenCache[uniqKey]
 	if ok {
 		return signed, nil
@@ -409,10 +938,6 @@ func generateToken(aud, username, issuer, privateKey string) (string, error) {
 		return "", errors.New("Server error: Cannot generate a token")
 	}
 
-	// Identifies the expiration time after which the JWT MUST NOT be accepted
-	// for processing.
-	ttl := TokenTTL
-
 	// Implementers MAY provide for some small leeway, usually no more than
 	// a few minutes, to account for clock skew.
 	leeway := TokenLeeway
@@ -437,7 +962,7 @@ func generateToken(aud, username, issuer, privateKey string) (string, error) {
 	// cache invalidation, because we cache the token in tokenCache we need to
 	// invalidate it expiration time. This was handled usually within JWT, but
 	// now we have to do it manually for our own cache.
-	time.AfterFunc(TokenTTL, func() {
+	time.AfterFunc(ttl, func() {
 		tokenCacheMu.Lock()
 		defer tokenCacheMu.Unlock()
 
@@ -454,8 +979,15 @@ func (k *Kontrol) handleGetToken(r *kite.Request) (interface{}, error) {
 		return nil, errors.New("Invalid query")
 	}
 
+	query, ok := k.tenantQuery(r, query)
+	if !ok {
+		return nil, ErrKiteNotFound
+	}
+
 	// check if it's exist
+	start := time.Now()
 	kites, err := k.storage.Get(query)
+	k.observeStorage("get", start, err)
 	if err != nil {
 		return nil, err
 	}
@@ -464,7 +996,66 @@ func (k *Kontrol) handleGetToken(r *kite.Request) (interface{}, error) {
 		return nil, errors.New("query matches more than one kite")
 	}
 
-	audience := getAudience(query)
+	return k.issueToken(getAudience(query), r.Username)
+}
+
+// handleGetTokens returns a token for each of the given kite IDs. A failure
+// for a single kite doesn't fail the whole request, it's reported in the
+// Errors field of the result instead.
+func (k *Kontrol) handleGetTokens(r *kite.Request) (interface{}, error) {
+	var ids []string
+	if err := r.Args.One().Unmarshal(&ids); err != nil {
+		return nil, errors.New("Invalid kite IDs")
+	}
+
+	result := &protocol.GetTokensResult{
+		Tokens: make(map[string]string, len(ids)),
+		Errors: make(map[string]string),
+	}
+
+	for _, id := range ids {
+		start := time.Now()
+		kites, err := k.storage.Get(&protocol.KontrolQuery{ID: id})
+		k.observeStorage("get", start, err)
+		if err != nil {
+			result.Errors[id] = err.Error()
+			continue
+		}
+
+		if len(kites) != 1 {
+			result.Errors[id] = ErrKiteNotFound.Error()
+			continue
+		}
+
+		// the audience is derived from the kite itself, a query with only an
+		// ID would create a token valid for every kite. The storages can't
+		// query an ID along with the username, so the kites of other users
+		// are filtered out here.
+		query, ok := k.tenantQuery(r, kites[0].Kite.Query())
+		if !ok {
+			result.Errors[id] = ErrKiteNotFound.Error()
+			continue
+		}
+
+		token, err := k.issueToken(getAudience(query), r.Username)
+		if err != nil {
+			result.Errors[id] = err.Error()
+			continue
+		}
+
+		result.Tokens[id] = token
+	}
+
+	return result, nil
+}
+
+// issueToken returns a token for the given audience and username.
+func (k *Kontrol) issueToken(audience, username string) (string, error) {
+	token, err := generateToken(audience, username, k.Kite.Kite().Username, k.privateKey, k.tokenTTL())
+	if err != nil {
+		return "", err
+	}
 
-	return generateToken(audience, r.Username, k.Kite.Kite().Username, k.privateKey)
+	k.metrics.addTokensIssued(1)
+	return token, nil
 }
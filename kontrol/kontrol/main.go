@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/gocql/gocql"
+	"github.com/koding/kite"
 	"github.com/koding/kite/config"
 	"github.com/koding/kite/kontrol"
 	"github.com/koding/multiconfig"
@@ -31,12 +38,84 @@ type Kontrol struct {
 	Machines []string
 	Version  string
 
+	// TokenTTL is the lifetime of the issued tokens, like "1h" or "48h"
+	TokenTTL time.Duration
+
+	// TokenLeeway is the clock skew tolerated when validating the exp and
+	// nbf of the tokens and kite keys, like "30s". Defaults to a minute.
+	TokenLeeway time.Duration
+
+	// IsolateTenants restricts the kite queries to the caller's own kites.
+	// AdminUsers can still query the kites of any user.
+	IsolateTenants bool
+	AdminUsers     []string
+
+	// MetricsAddr is the address to serve Prometheus metrics on "/metrics",
+	// like ":9090". Metrics are not served if empty. The registered kites
+	// are listed for the AdminUsers on "/debug/kites".
+	MetricsAddr string
+
 	Postgres struct {
 		Host     string `default:"localhost"`
 		Port     int    `default:"5432"`
-		Username string `required:"true"`
+		Username string
 		Password string
 		DBName   string `required:"true" `
+
+		// UsernameFile and PasswordFile are read instead of Username and
+		// Password if they are set, like the files of mounted secrets
+		UsernameFile string
+		PasswordFile string
+
+		// SSLMode defaults to "disable", SSLCert and SSLKey are the files of
+		// the client certificate
+		SSLMode     string `default:"disable"`
+		SSLRootCert string
+		SSLCert     string
+		SSLKey      string
+
+		// Schema of the kite table, defaults to "public"
+		Schema string `default:"public"`
+
+		// ApplicationName is shown in pg_stat_activity
+		ApplicationName string `default:"kontrol"`
+
+		// SlowQueryThreshold logs the queries slower than it, like "100ms"
+		SlowQueryThreshold time.Duration
+
+		// MaxResults limits the kites returned for a single query, zero
+		// means unlimited
+		MaxResults int
+
+		// CleanerJitter randomizes the cleaner interval, like 0.1 for ±10%
+		CleanerJitter float64
+
+		// ReadOnly serves only discovery without modifying the database
+		ReadOnly bool
+	}
+
+	MySQL struct {
+		Host     string `default:"localhost"`
+		Port     int    `default:"3306"`
+		Username string
+		Password string
+		DBName   string
+	}
+
+	DynamoDB struct {
+		Region    string
+		Endpoint  string
+		TableName string `default:"kite"`
+	}
+
+	Cassandra struct {
+		Hosts    []string
+		Keyspace string `default:"kontrol"`
+	}
+
+	Bolt struct {
+		// Path of the database file, it's created if it doesn't exist
+		Path string `default:"kontrol.db"`
 	}
 }
 
@@ -87,6 +166,10 @@ func main() {
 	kiteConf.IP = conf.Ip
 	kiteConf.Port = conf.Port
 
+	if conf.TokenLeeway != 0 {
+		kiteConf.TokenLeeway = conf.TokenLeeway
+	}
+
 	k := kontrol.New(kiteConf, conf.Version, string(publicKey), string(privateKey))
 
 	if conf.TLSCertFile != "" || conf.TLSKeyFile != "" {
@@ -102,6 +185,23 @@ func main() {
 		k.RegisterURL = conf.RegisterUrl
 	}
 
+	if conf.TokenTTL != 0 {
+		k.TokenTTL = conf.TokenTTL
+	}
+
+	k.IsolateTenants = conf.IsolateTenants
+
+	if len(conf.AdminUsers) != 0 {
+		admins := make(map[string]bool, len(conf.AdminUsers))
+		for _, username := range conf.AdminUsers {
+			admins[username] = true
+		}
+
+		k.IsAdmin = func(r *kite.Request) bool {
+			return admins[r.Username]
+		}
+	}
+
 	switch os.Getenv("KONTROL_STORAGE") {
 	case "etcd":
 		k.SetStorage(kontrol.NewEtcd(conf.Machines, k.Kite.Log))
@@ -112,12 +212,83 @@ func main() {
 			Username: conf.Postgres.Username,
 			Password: conf.Postgres.Password,
 			DBName:   conf.Postgres.DBName,
+
+			UsernameFile: conf.Postgres.UsernameFile,
+			PasswordFile: conf.Postgres.PasswordFile,
+
+			SSLMode:     conf.Postgres.SSLMode,
+			SSLRootCert: conf.Postgres.SSLRootCert,
+			SSLCert:     conf.Postgres.SSLCert,
+			SSLKey:      conf.Postgres.SSLKey,
+
+			Schema:             conf.Postgres.Schema,
+			ApplicationName:    conf.Postgres.ApplicationName,
+			MaxResults:         conf.Postgres.MaxResults,
+			SlowQueryThreshold: conf.Postgres.SlowQueryThreshold,
+			CleanerJitter:      conf.Postgres.CleanerJitter,
+			ReadOnly:           conf.Postgres.ReadOnly,
 		}
 
 		k.SetStorage(kontrol.NewPostgres(postgresConf, k.Kite.Log))
+	case "mysql":
+		mysqlConf := &kontrol.MySQLConfig{
+			Host:     conf.MySQL.Host,
+			Port:     conf.MySQL.Port,
+			Username: conf.MySQL.Username,
+			Password: conf.MySQL.Password,
+			DBName:   conf.MySQL.DBName,
+		}
+
+		k.SetStorage(kontrol.NewMySQL(mysqlConf, k.Kite.Log))
+	case "dynamodb":
+		dynamoConf := &kontrol.DynamoDBConfig{
+			Region:    conf.DynamoDB.Region,
+			Endpoint:  conf.DynamoDB.Endpoint,
+			TableName: conf.DynamoDB.TableName,
+		}
+
+		k.SetStorage(kontrol.NewDynamoDB(dynamoConf, k.Kite.Log))
+	case "cassandra":
+		cluster := gocql.NewCluster(conf.Cassandra.Hosts...)
+		cluster.Keyspace = conf.Cassandra.Keyspace
+
+		k.SetStorage(kontrol.NewCassandra(cluster, k.Kite.Log))
+	case "consul":
+		// the agent is configured with the CONSUL_HTTP_ADDR and other
+		// environment variables of Consul
+		k.SetStorage(kontrol.NewConsul(nil, k.Kite.Log))
+	case "bolt":
+		k.SetStorage(kontrol.NewBolt(conf.Bolt.Path, k.Kite.Log))
 	}
 
+	if conf.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", k.MetricsHandler())
+		mux.Handle("/debug/kites", k.DebugHandler())
+
+		go func() {
+			log.Fatal(http.ListenAndServe(conf.MetricsAddr, mux))
+		}()
+	}
+
+	// shutdown gracefully on termination, so in-flight requests are not cut
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		<-sig
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := k.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %s", err)
+		}
+		close(done)
+	}()
+
 	k.Run()
+	<-done
 }
 
 func initialKey(publicKey, privateKey []byte) {
@@ -1,19 +1,32 @@
 package kontrol
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/koding/kite"
 	"github.com/koding/kite/config"
+	"github.com/koding/kite/dnode"
 	"github.com/koding/kite/kitekey"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
 	"github.com/koding/kite/protocol"
 	"github.com/koding/kite/testkeys"
 	"github.com/koding/kite/testutil"
@@ -124,6 +137,217 @@ func TestTokenInvalidation(t *testing.T) {
 
 }
 
+func TestTokenTTL(t *testing.T) {
+	oldval := kon.TokenTTL
+	defer func() {
+		kon.TokenTTL = oldval
+	}()
+
+	kon.TokenTTL = 2 * time.Hour
+
+	signed, err := generateToken("/testuser/testenv/ttl", "testuser",
+		kon.Kite.Kite().Username, testkeys.Private, kon.tokenTTL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jwt.Parse(signed, func(*jwt.Token) (interface{}, error) {
+		return []byte(testkeys.Public), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp, ok := token.Claims["exp"].(float64)
+	if !ok {
+		t.Fatal("token doesn't have a valid exp claim")
+	}
+
+	want := time.Now().UTC().Add(kon.TokenTTL).Add(TokenLeeway)
+	if diff := time.Unix(int64(exp), 0).Sub(want); diff > 5*time.Second || diff < -5*time.Second {
+		t.Errorf("exp claim is off by %s, want %s", diff, want)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	id := "revoked-kite-id"
+
+	if kon.IsRevoked(id) {
+		t.Fatal("kite should not be revoked yet")
+	}
+
+	kon.Revoke(id)
+
+	if !kon.IsRevoked(id) {
+		t.Error("kite should be revoked")
+	}
+
+	k := New(conf.Copy(), "0.0.1", testkeys.Public, testkeys.Private)
+	key := testutil.NewKiteKey()
+
+	// the caller asserts another kite ID than the one of its key
+	c := k.Kite.NewClient("http://localhost:4444/kite")
+	c.Kite.ID = "asserted-kite-id"
+
+	r := &kite.Request{
+		Method:   "register",
+		Client:   c,
+		Auth:     &kite.Auth{Type: "kiteKey", Key: key.Raw},
+		Username: key.Claims["sub"].(string),
+	}
+
+	if _, err := k.handleRevoked(r); err != nil {
+		t.Fatalf("request should be accepted, got %s", err)
+	}
+
+	k.Revoke(key.Claims["jti"].(string))
+
+	if _, err := k.handleRevoked(r); err != ErrRevoked {
+		t.Errorf("got %v for a revoked kite key, want %v", err, ErrRevoked)
+	}
+
+	other := New(conf.Copy(), "0.0.1", testkeys.Public, testkeys.Private)
+	other.RevokeUser(r.Username)
+
+	if _, err := other.handleRevoked(r); err != ErrRevoked {
+		t.Errorf("got %v for a revoked user, want %v", err, ErrRevoked)
+	}
+
+	// the kite keys and the users don't expire, their revocations neither
+	if until := revokedUntil(k, "jti", key.Claims["jti"].(string)); !until.IsZero() {
+		t.Errorf("kite key revocation expires at %s", until)
+	}
+
+	if until := revokedUntil(other, "sub", r.Username); !until.IsZero() {
+		t.Errorf("user revocation expires at %s", until)
+	}
+}
+
+// revokedUntil returns the time the revocation of the claim expires at.
+func revokedUntil(k *Kontrol, claim, value string) time.Time {
+	l := k.revoked
+	if m, ok := k.storage.(*Memory); ok {
+		l = m.revoked
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.revoked[revocation{claim: claim, value: value}]
+}
+
+func TestRevokeStorage(t *testing.T) {
+	storage := NewMemory()
+
+	// the kontrol instances sharing the storage share the revocations
+	k := New(conf.Copy(), "0.0.1", testkeys.Public, testkeys.Private)
+	k.SetStorage(storage)
+
+	other := New(conf.Copy(), "0.0.1", testkeys.Public, testkeys.Private)
+	other.SetStorage(storage)
+
+	if err := k.Revoke("revoked-kite-key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.RevokeUser("revoked-user"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !other.IsRevoked("revoked-kite-key") || !other.IsUserRevoked("revoked-user") {
+		t.Error("revocations are not shared through the storage")
+	}
+
+	isRevoked := RevocationChecker(storage)
+
+	tests := []struct {
+		id, username string
+		want         bool
+	}{
+		{"revoked-kite-key", "user", true},
+		{"", "revoked-user", true},
+		{"kite-key", "user", false},
+	}
+
+	for _, test := range tests {
+		if got := isRevoked(test.id, test.username); got != test.want {
+			t.Errorf("%s of %s: got %t, want %t", test.id, test.username, got, test.want)
+		}
+	}
+
+	if RevocationChecker(struct{ Storage }{storage}) != nil {
+		t.Error("got a checker for a storage that can't keep revocations")
+	}
+}
+
+func TestRevokeCachedToken(t *testing.T) {
+	k := New(conf.Copy(), "0.0.1", testkeys.Public, testkeys.Private)
+
+	token, err := k.issueToken("/cached", "cached-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.RevokeToken(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// the revoked token is not handed out again
+	again, err := k.issueToken("/cached", "cached-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again == token {
+		t.Error("revoked token is handed out again")
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	k := New(conf.Copy(), "0.0.1", testkeys.Public, testkeys.Private)
+
+	token, err := generateToken("/revoked", "revoked-user", "kontrol", testkeys.Private, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.RevokeToken(token); err != nil {
+		t.Fatal(err)
+	}
+
+	id, expires, err := tokenExpiry(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !k.IsRevoked(id) {
+		t.Error("token should be revoked")
+	}
+
+	// the revocation is kept until the token is expired for all kites
+	want := time.Now().Add(time.Hour + 2*TokenLeeway)
+	if until := revokedUntil(k, "jti", id); until != expires || until.Sub(want) > 5*time.Second || want.Sub(until) > 5*time.Second {
+		t.Errorf("revocation expires at %s, want %s", until, want)
+	}
+
+	// a revocation that is already expired is not kept
+	k.revoke(revocation{claim: "jti", value: "expired"}, time.Now().Add(-time.Second))
+	if k.IsRevoked("expired") {
+		t.Error("expired revocation is kept")
+	}
+
+	// revoking a kite key with the same ID keeps it forever
+	k.Revoke(id)
+	k.revoke(revocation{claim: "jti", value: id}, expires)
+
+	if until := revokedUntil(k, "jti", id); !until.IsZero() {
+		t.Errorf("revocation expires at %s after revoking the ID", until)
+	}
+
+	if err := k.RevokeToken("invalid"); err == nil {
+		t.Error("expected an error for an invalid token")
+	}
+}
+
 func TestMultiple(t *testing.T) {
 	testDuration := time.Second * 10
 
@@ -273,6 +497,81 @@ func TestGetToken(t *testing.T) {
 	}
 }
 
+func TestGetTokens(t *testing.T) {
+	m := kite.New("mathworker7", "1.1.1")
+	m.Config = conf.Copy()
+	m.Config.Port = 6667
+
+	kiteURL := &url.URL{Scheme: "http", Host: "localhost:6667", Path: "/kite"}
+	_, err := m.Register(kiteURL)
+	if err != nil {
+		t.Error(err)
+	}
+	defer m.Close()
+
+	result, err := m.GetTokens([]string{m.Kite().ID, "non-existing-id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Tokens[m.Kite().ID] == "" {
+		t.Errorf("no token for registered kite, errors: %v", result.Errors)
+	}
+
+	if result.Errors["non-existing-id"] == "" {
+		t.Error("expected an error for non existing kite")
+	}
+}
+
+func TestWatchKites(t *testing.T) {
+	w := kite.New("watcher", "0.0.1")
+	w.Config = conf.Copy()
+	defer w.Close()
+
+	events := make(chan *kite.Event, 10)
+	query := &protocol.KontrolQuery{
+		Username:    w.Kite().Username,
+		Environment: w.Kite().Environment,
+		Name:        "mathworker8",
+	}
+
+	watcher, err := w.WatchKites(query, func(e *kite.Event, err *kite.Error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		events <- e
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Cancel()
+
+	m := kite.New("mathworker8", "1.1.1")
+	m.Config = conf.Copy()
+
+	kiteURL := &url.URL{Scheme: "http", Host: "localhost:6668", Path: "/kite"}
+	if _, err := m.Register(kiteURL); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(action protocol.KiteAction) {
+		select {
+		case e := <-events:
+			if e.Action != action || e.Kite.ID != m.Kite().ID {
+				t.Errorf("got %s event for %s, expected %s for %s", e.Action, e.Kite.ID, action, m.Kite().ID)
+			}
+		case <-time.After(4 * time.Second):
+			t.Fatalf("timeout waiting for %s event", action)
+		}
+	}
+
+	expect(protocol.Register)
+
+	m.Close()
+	expect(protocol.Deregister)
+}
+
 func TestRegister(t *testing.T) {
 	t.Log("Setting up mathworker3")
 	kiteURL := &url.URL{Scheme: "http", Host: "localhost:4444", Path: "/kite"}
@@ -415,3 +714,1332 @@ func TestGetQueryKey(t *testing.T) {
 		t.Errorf("Key is not expected: %s", key)
 	}
 }
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1, 2)
+
+	if !l.Allow("foo") || !l.Allow("foo") {
+		t.Fatal("burst should be allowed")
+	}
+
+	if l.Allow("foo") {
+		t.Error("exceeding the burst should be limited")
+	}
+
+	if !l.Allow("bar") {
+		t.Error("other usernames should not be limited")
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		l.runGC(time.Millisecond, stop)
+		close(done)
+	}()
+
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("gc is not stopped")
+	}
+}
+
+func TestTenantQuery(t *testing.T) {
+	k := &Kontrol{
+		IsolateTenants: true,
+		IsAdmin: func(r *kite.Request) bool {
+			return r.Username == "admin"
+		},
+	}
+
+	r := &kite.Request{Username: "cenk"}
+
+	q, ok := k.tenantQuery(r, &protocol.KontrolQuery{Environment: "production"})
+	if !ok || q.Username != "cenk" {
+		t.Errorf("empty username should be replaced with the caller's: %+v", q)
+	}
+
+	if _, ok := k.tenantQuery(r, &protocol.KontrolQuery{Username: "other"}); ok {
+		t.Error("query for another user's kites should not match")
+	}
+
+	admin := &kite.Request{Username: "admin"}
+	if q, ok := k.tenantQuery(admin, &protocol.KontrolQuery{Username: "other"}); !ok || q.Username != "other" {
+		t.Errorf("admin should be able to query any user: %+v", q)
+	}
+}
+
+func TestGetTokensIsolated(t *testing.T) {
+	k := New(conf.Copy(), "0.0.1", testkeys.Public, testkeys.Private)
+	k.SetStorage(NewMemory())
+	k.IsolateTenants = true
+
+	own := protocol.Kite{
+		Username:    "cenk",
+		Environment: "production",
+		Name:        "fs",
+		Version:     "1.0.0",
+		Region:      "sj",
+		Hostname:    "host",
+		ID:          "1",
+	}
+
+	other := own
+	other.Username = "other"
+	other.ID = "2"
+
+	for _, kt := range []protocol.Kite{own, other} {
+		kt := kt
+		k.storage.Add(&kt, &kontrolprotocol.RegisterValue{URL: "http://localhost:4444/kite"})
+	}
+
+	request := func(arg interface{}) *kite.Request {
+		args, err := json.Marshal([]interface{}{arg})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &kite.Request{
+			Username: "cenk",
+			Args:     &dnode.Partial{Raw: args},
+		}
+	}
+
+	if _, err := k.handleGetToken(request(other.Query())); err == nil {
+		t.Error("token should not be issued for the kite of another user")
+	}
+
+	if _, err := k.handleGetToken(request(own.Query())); err != nil {
+		t.Errorf("token should be issued for the own kite: %s", err)
+	}
+
+	v, err := k.handleGetTokens(request([]string{own.ID, other.ID}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := v.(*protocol.GetTokensResult)
+
+	if result.Tokens[own.ID] == "" {
+		t.Errorf("no token for the own kite, errors: %v", result.Errors)
+	}
+
+	if result.Tokens[other.ID] != "" || result.Errors[other.ID] == "" {
+		t.Error("token should not be issued for the kite of another user")
+	}
+}
+
+func TestWatcherMatch(t *testing.T) {
+	w, err := newWatcher(&protocol.KontrolQuery{
+		Username:     "devrim",
+		Environment:  "production",
+		Name:         "fs",
+		Capabilities: []string{"gpu"},
+		Tags:         []string{"tier:canary"},
+	}, dnode.Function{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := &protocol.Kite{Username: "devrim", Environment: "production", Name: "fs"}
+
+	tests := []struct {
+		value *kontrolprotocol.RegisterValue
+		match bool
+	}{
+		{&kontrolprotocol.RegisterValue{Capabilities: []string{"gpu", "ssd"}, Tags: []string{"tier:canary"}}, true},
+		{&kontrolprotocol.RegisterValue{Capabilities: []string{"ssd"}, Tags: []string{"tier:canary"}}, false},
+		{&kontrolprotocol.RegisterValue{Capabilities: []string{"gpu"}, Tags: []string{"tier:stable"}}, false},
+		{nil, true},
+	}
+
+	for i, test := range tests {
+		if match := w.match(k, test.value); match != test.match {
+			t.Errorf("%d: expected match=%t for %+v", i, test.match, test.value)
+		}
+	}
+
+	if w.match(&protocol.Kite{Username: "devrim", Environment: "production", Name: "os"}, nil) {
+		t.Error("a kite with another name is matched")
+	}
+}
+
+func TestParseNotification(t *testing.T) {
+	action, id, err := parseNotification(`INSERT 2ba5b5ad-3d3d-4b1f-5d5b-12ea8ab1a5b2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if action != protocol.Register || id != "2ba5b5ad-3d3d-4b1f-5d5b-12ea8ab1a5b2" {
+		t.Errorf("unexpected notification: %s %s", action, id)
+	}
+
+	action, id, err = parseNotification(`DELETE 1234`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if action != protocol.Deregister || id != "1234" {
+		t.Errorf("unexpected notification: %s %s", action, id)
+	}
+
+	for _, payload := range []string{`UPDATE 1234`, `INSERT`, `DELETE `} {
+		if _, _, err := parseNotification(payload); err == nil {
+			t.Errorf("expected an error for %q", payload)
+		}
+	}
+}
+
+func TestNotificationEventDelete(t *testing.T) {
+	p := &Postgres{}
+	known := map[string]protocol.Kite{"1234": {Username: "cenk", Name: "fs", ID: "1234"}}
+
+	e, err := p.notificationEvent(protocol.Deregister, "1234", known)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e == nil || e.Action != protocol.Deregister || e.Kite.Name != "fs" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+
+	if _, ok := known["1234"]; ok {
+		t.Error("the deleted kite is still known")
+	}
+
+	// the kites deleted before they are known are skipped
+	if e, err = p.notificationEvent(protocol.Deregister, "1234", known); e != nil || err != nil {
+		t.Errorf("expected no event, got %+v, %v", e, err)
+	}
+}
+
+func TestValidateKiteID(t *testing.T) {
+	if err := validateKiteID("2ba5b5ad-3d3d-4b1f-5d5b-12ea8ab1a5b2"); err != nil {
+		t.Error(err)
+	}
+
+	err := validateKiteID("not-a-uuid")
+	if e, ok := err.(*ErrInvalidKiteID); !ok || e.ID != "not-a-uuid" {
+		t.Errorf("expected ErrInvalidKiteID, got: %v", err)
+	}
+}
+
+func TestFillKiteID(t *testing.T) {
+	k := &protocol.Kite{}
+	fillKiteID(k)
+	if err := validateKiteID(k.ID); err != nil {
+		t.Error(err)
+	}
+
+	k = &protocol.Kite{ID: "2ba5b5ad-3d3d-4b1f-5d5b-12ea8ab1a5b2"}
+	fillKiteID(k)
+	if k.ID != "2ba5b5ad-3d3d-4b1f-5d5b-12ea8ab1a5b2" {
+		t.Errorf("the ID is changed to %q", k.ID)
+	}
+}
+
+func TestStorageError(t *testing.T) {
+	if err := newStorageError("add", "1234", nil); err != nil {
+		t.Errorf("expected nil, got: %v", err)
+	}
+
+	err := newStorageError("add", "1234", ErrReadOnly)
+	e, ok := err.(*StorageError)
+	if !ok || e.Op != "add" || e.KiteID != "1234" || e.Unwrap() != ErrReadOnly {
+		t.Errorf("unexpected error: %#v", err)
+	}
+}
+
+func TestWithDefaults(t *testing.T) {
+	k := &protocol.Kite{Username: "devrim", Region: "eu-west-1", Hostname: "host"}
+	if got, filled := withDefaults(k, "us-east-1"); got != k || filled != nil {
+		t.Errorf("expected the kite to be unchanged, got: %+v, %v", got, filled)
+	}
+
+	k = &protocol.Kite{Username: "devrim"}
+	got, filled := withDefaults(k, "us-east-1")
+	if got.Region != "us-east-1" || len(filled) != 1 {
+		t.Errorf("expected the defaults to be filled, got: %+v, %v", got, filled)
+	}
+
+	if k.Region != "" {
+		t.Errorf("the given kite is modified: %+v", k)
+	}
+
+	// the hostname of kontrol is not a default for the remote kites
+	if got.Hostname != "" {
+		t.Errorf("expected the hostname to be left empty, got %q", got.Hostname)
+	}
+}
+
+func TestPostgresSSLConfig(t *testing.T) {
+	conf := &PostgresConfig{DBName: "kite", Username: "kontrol", SSLCert: "client.crt"}
+	if _, err := postgresConnString(conf); err == nil {
+		t.Error("expected an error for a cert without a key")
+	}
+
+	conf = &PostgresConfig{DBName: "kite", Username: "kontrol", SSLCert: "no-such.crt", SSLKey: "no-such.key"}
+	if _, err := postgresConnString(conf); err == nil {
+		t.Error("expected an error for missing cert files")
+	}
+}
+
+func TestPostgresSecretFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kontrol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	usernameFile, passwordFile := dir+"/username", dir+"/password"
+	ioutil.WriteFile(usernameFile, []byte("rotated\n"), 0600)
+	ioutil.WriteFile(passwordFile, []byte("s3cret pass\n"), 0600)
+
+	conf := &PostgresConfig{
+		DBName:       "kite",
+		Username:     "kontrol",
+		Password:     "old",
+		UsernameFile: usernameFile,
+		PasswordFile: passwordFile,
+	}
+
+	connString, err := postgresConnString(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(connString, "user='rotated'") || !strings.Contains(connString, "password='s3cret pass'") {
+		t.Errorf("the credentials of the files are not used: %s", connString)
+	}
+
+	conf.PasswordFile = dir + "/no-such-file"
+	if _, err := postgresConnString(conf); err == nil {
+		t.Error("expected an error for a missing password file")
+	}
+}
+
+// TestPostgresClientCert connects with a client certificate. It's skipped
+// unless a Postgres server requiring one is configured with the
+// KONTROL_POSTGRES_SSLCERT, KONTROL_POSTGRES_SSLKEY and
+// KONTROL_POSTGRES_SSLROOTCERT environment variables.
+func TestPostgresClientCert(t *testing.T) {
+	cert, key := os.Getenv("KONTROL_POSTGRES_SSLCERT"), os.Getenv("KONTROL_POSTGRES_SSLKEY")
+	if cert == "" || key == "" {
+		t.Skip("KONTROL_POSTGRES_SSLCERT and KONTROL_POSTGRES_SSLKEY are not set")
+	}
+
+	p := NewPostgres(&PostgresConfig{
+		SSLMode:     "verify-full",
+		SSLRootCert: os.Getenv("KONTROL_POSTGRES_SSLROOTCERT"),
+		SSLCert:     cert,
+		SSLKey:      key,
+	}, kon.Kite.Log)
+	defer p.Close()
+
+	if _, err := p.Count(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeClock is a Clock whose After channels are fired by tick.
+type fakeClock struct {
+	now    time.Time
+	afterC chan chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC),
+		afterC: make(chan chan time.Time),
+	}
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.afterC <- ch
+	return ch
+}
+
+// tick fires the next After channel requested.
+func (c *fakeClock) tick() {
+	(<-c.afterC) <- c.now
+}
+
+func TestPostgresCleanerClock(t *testing.T) {
+	// the cleaner only counts the runs, the database doesn't need to exist
+	db, err := sql.Open("postgres", "host=localhost port=1 dbname=none sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock()
+	p := &Postgres{
+		DB:     db,
+		Log:    kon.Kite.Log,
+		clock:  clock,
+		closeC: make(chan struct{}),
+	}
+
+	go p.RunCleaner(time.Hour, time.Hour)
+
+	for i := 1; i <= 3; i++ {
+		clock.tick() // waits for the previous run to finish
+
+		if runs, _ := p.CleanerStats(); runs < int64(i) {
+			t.Fatalf("expected at least %d cleaner runs, got %d", i, runs)
+		}
+	}
+
+	// the cleaner is started once, calling RunCleaner again returns
+	done := make(chan struct{})
+	go func() {
+		p.RunCleaner(time.Hour, time.Hour)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second RunCleaner started another cleaner")
+	}
+
+	p.Close()
+}
+
+func TestPostgresDisableCleaner(t *testing.T) {
+	if os.Getenv("KONTROL_STORAGE") != "postgres" {
+		t.Skip("KONTROL_STORAGE is not postgres")
+	}
+
+	p := NewPostgres(&PostgresConfig{DisableCleaner: true}, kon.Kite.Log)
+	defer p.Close()
+
+	// the cleaner runs right after it's started
+	time.Sleep(100 * time.Millisecond)
+
+	if atomic.LoadInt32(&p.cleanerStarted) != 0 {
+		t.Error("cleaner is started")
+	}
+
+	if runs, _ := p.CleanerStats(); runs != 0 {
+		t.Errorf("got %d cleaner runs, want 0", runs)
+	}
+}
+
+func TestPostgresRevoke(t *testing.T) {
+	if os.Getenv("KONTROL_STORAGE") != "postgres" {
+		t.Skip("KONTROL_STORAGE is not postgres")
+	}
+
+	p := NewPostgres(&PostgresConfig{DisableCleaner: true}, kon.Kite.Log)
+	defer p.Close()
+
+	claim := "jti"
+	value := fmt.Sprintf("revoked-%d", time.Now().UnixNano())
+
+	revoked := func() bool {
+		revoked, err := p.IsRevoked(claim, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return revoked
+	}
+
+	if revoked() {
+		t.Fatal("revoked before revoking it")
+	}
+
+	// an expired revocation is dropped
+	if err := p.Revoke(claim, value, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if revoked() {
+		t.Error("expired revocation is kept")
+	}
+
+	if err := p.Revoke(claim, value, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// revoking it forever overrides the expiry, a shorter one doesn't
+	for _, expires := range []time.Time{{}, time.Now().Add(-time.Minute)} {
+		if err := p.Revoke(claim, value, expires); err != nil {
+			t.Fatal(err)
+		}
+
+		if !revoked() {
+			t.Errorf("not revoked after revoking it until %s", expires)
+		}
+	}
+}
+
+func TestPostgresNow(t *testing.T) {
+	clock := newFakeClock()
+	clock.now = time.Date(2014, 1, 1, 10, 30, 0, 500000000, time.FixedZone("EET", 2*60*60))
+
+	p := &Postgres{clock: clock}
+	if now := p.now(); now != sqlNow {
+		t.Errorf("got %q, want %q", now, sqlNow)
+	}
+
+	p.clockInSQL = true
+	if now, want := p.now(), "('2014-01-01 08:30:00.5'::timestamp)"; now != want {
+		t.Errorf("got %q, want %q", now, want)
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	k := New(conf.Copy(), "0.0.1", testkeys.Public, testkeys.Private)
+	k.SetStorage(NewMemory())
+	k.IsAdmin = func(r *kite.Request) bool {
+		return r.Username == "admin"
+	}
+
+	k.storage.Add(&protocol.Kite{
+		Username:    "devrim",
+		Environment: "production",
+		Name:        "mathworker",
+		Version:     "1.0.0",
+		Region:      "sj",
+		Hostname:    "host",
+		ID:          "1",
+	}, &kontrolprotocol.RegisterValue{URL: "http://localhost:4444/kite"})
+
+	get := func(username, url string) *httptest.ResponseRecorder {
+		key, err := k.registerUser(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+
+		rec := httptest.NewRecorder()
+		k.DebugHandler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("devrim", "/debug/kites?username=devrim"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d for a non-admin, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	rec := get("admin", "/debug/kites?username=devrim&environment=production&name=mathworker")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body)
+	}
+
+	var kites []*protocol.KiteWithToken
+	if err := json.Unmarshal(rec.Body.Bytes(), &kites); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kites) != 1 || kites[0].Kite.ID != "1" {
+		t.Errorf("unexpected kites: %+v", kites)
+	}
+
+	rec = get("admin", "/debug/kites?username=nobody")
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("expected an empty list, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// a key signed with HMAC, using the public key of kontrol as the secret
+	forged := jwt.New(jwt.SigningMethodHS256)
+	forged.Claims = map[string]interface{}{
+		"iss": k.Kite.Kite().Username,
+		"sub": "admin",
+		"iat": time.Now().UTC().Unix(),
+	}
+
+	key, err := forged.SignedString([]byte(k.publicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/debug/kites?username=devrim", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	rec = httptest.NewRecorder()
+	k.DebugHandler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d for a forged HMAC key, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+type slowStorage struct {
+	Storage
+	delay time.Duration
+}
+
+func (s *slowStorage) Get(query *protocol.KontrolQuery) (Kites, error) {
+	time.Sleep(s.delay)
+	return nil, nil
+}
+
+func TestGetKitesTimeout(t *testing.T) {
+	k := &Kontrol{
+		storage:         &slowStorage{delay: time.Second},
+		GetKitesTimeout: 10 * time.Millisecond,
+	}
+
+	if _, err := k.getWithTimeout(&protocol.KontrolQuery{Username: "devrim"}); err != ErrStorageTimeout {
+		t.Fatalf("expected ErrStorageTimeout, got %v", err)
+	}
+
+	// the timed out query is still running, it reads the storage of k
+	k = &Kontrol{
+		storage:         &slowStorage{},
+		GetKitesTimeout: 10 * time.Millisecond,
+	}
+
+	if _, err := k.getWithTimeout(&protocol.KontrolQuery{Username: "devrim"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type readOnlyMemory struct {
+	*Memory
+}
+
+func (readOnlyMemory) IsReadOnly() bool { return true }
+
+func TestRegisterSelfReadOnly(t *testing.T) {
+	k := New(conf.Copy(), "0.0.1", testkeys.Public, testkeys.Private)
+	m := NewMemory()
+	k.SetStorage(readOnlyMemory{m})
+
+	done := make(chan struct{})
+	go func() {
+		k.registerSelf()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("registerSelf didn't return for a read-only storage")
+	}
+
+	if n, _ := m.Count(); n != 0 {
+		t.Errorf("expected no registered kites, got %d", n)
+	}
+}
+
+func TestDeregister(t *testing.T) {
+	k := New(conf.Copy(), "0.0.1", testkeys.Public, testkeys.Private)
+	m := NewMemory()
+	k.SetStorage(m)
+
+	self := protocol.Kite{
+		Username:    "devrim",
+		Environment: "production",
+		Name:        "mathworker",
+		Version:     "1.0.1",
+		Region:      "sj",
+		Hostname:    "host",
+		ID:          "2",
+	}
+
+	stale := self
+	stale.Version = "1.0.0"
+	stale.ID = "1"
+
+	other := self
+	other.Name = "fs"
+	other.ID = "3"
+
+	// registered to another kontrol sharing the storage
+	fresh := self
+	fresh.ID = "4"
+
+	for _, kt := range []protocol.Kite{self, stale, other, fresh} {
+		kt := kt
+		k.storage.Add(&kt, &kontrolprotocol.RegisterValue{URL: "http://localhost:4444/kite"})
+	}
+
+	m.kites[stale.ID].updatedAt = time.Now().UTC().Add(-3 * k.heartbeatInterval())
+	m.kites[other.ID].updatedAt = time.Now().UTC().Add(-3 * k.heartbeatInterval())
+
+	caller := &kite.Client{Kite: self}
+
+	deregister := func(target protocol.Kite) error {
+		args, err := json.Marshal([]interface{}{target})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = k.handleDeregister(&kite.Request{
+			Username: "devrim",
+			Client:   caller,
+			Args:     &dnode.Partial{Raw: args},
+		})
+		return err
+	}
+
+	if err := deregister(other); err == nil {
+		t.Error("kite with another name should not be deregistered")
+	}
+
+	// the registration is compared with the caller, not the given kite
+	spoofed := self
+	spoofed.ID = other.ID
+	if err := deregister(spoofed); err == nil {
+		t.Error("kite with another name should not be deregistered by its ID")
+	}
+
+	if err := deregister(protocol.Kite{ID: "5"}); err != ErrKiteNotFound {
+		t.Errorf("expected ErrKiteNotFound for an unknown kite, got %v", err)
+	}
+
+	if err := deregister(self); err == nil {
+		t.Error("caller should not deregister the registration of another connection")
+	}
+
+	if err := deregister(fresh); err == nil {
+		t.Error("kite updated recently should not be deregistered")
+	}
+
+	if err := deregister(stale); err != nil {
+		t.Fatal(err)
+	}
+
+	k.clientsMu.Lock()
+	k.clients[self.ID] = caller
+	k.clientsMu.Unlock()
+
+	// the own registration is removed on shutdown while it's still fresh
+	if err := deregister(self); err != nil {
+		t.Fatal(err)
+	}
+
+	kites, err := k.storage.Get(&protocol.KontrolQuery{Username: "devrim"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := kiteIDs(kites); len(ids) != 2 || ids[0] != "3" || ids[1] != "4" {
+		t.Errorf("unexpected kites after deregister: %v", ids)
+	}
+}
+
+// versionMemory is a Memory storage that can delete the kites of a version.
+type versionMemory struct {
+	*Memory
+}
+
+func (m versionMemory) DeleteVersion(username, environment, name, version string) ([]protocol.Kite, error) {
+	kites, err := m.Get(&protocol.KontrolQuery{
+		Username:    username,
+		Environment: environment,
+		Name:        name,
+		Version:     version,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []protocol.Kite
+	for _, k := range kites {
+		if err := m.Delete(&k.Kite); err != nil {
+			return nil, err
+		}
+
+		deleted = append(deleted, k.Kite)
+	}
+
+	return deleted, nil
+}
+
+// eventRecorder is the callback of a watcher recording the events sent to it.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []protocol.KiteEvent
+}
+
+func (r *eventRecorder) Call(args ...interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, args[0].(kite.Response).Result.(protocol.KiteEvent))
+	return nil
+}
+
+func TestDeleteVersion(t *testing.T) {
+	k := New(conf.Copy(), "0.0.1", testkeys.Public, testkeys.Private)
+
+	if _, err := k.DeleteVersion("devrim", "production", "mathworker", "1.0.0"); err == nil {
+		t.Error("expected an error for a storage that can't delete versions")
+	}
+
+	k.SetStorage(versionMemory{NewMemory()})
+
+	canary := protocol.Kite{
+		Username:    "devrim",
+		Environment: "production",
+		Name:        "mathworker",
+		Version:     "1.0.1",
+		Region:      "sj",
+		Hostname:    "host1",
+		ID:          "1",
+	}
+
+	canary2 := canary
+	canary2.Hostname = "host2"
+	canary2.ID = "2"
+
+	stable := canary
+	stable.Version = "1.0.0"
+	stable.ID = "3"
+
+	for _, kt := range []protocol.Kite{canary, canary2, stable} {
+		kt := kt
+		k.storage.Add(&kt, &kontrolprotocol.RegisterValue{URL: "http://localhost:4444/kite"})
+	}
+
+	recorder := &eventRecorder{}
+	w, err := newWatcher(&protocol.KontrolQuery{Username: "devrim", Environment: "production", Name: "mathworker"}, dnode.Function{Caller: recorder}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.watchers["watcher"] = w
+
+	n, err := k.DeleteVersion("devrim", "production", "mathworker", "1.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 {
+		t.Errorf("got %d deleted kites, want 2", n)
+	}
+
+	kites, err := k.storage.Get(&protocol.KontrolQuery{Username: "devrim"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := kiteIDs(kites); len(ids) != 1 || ids[0] != "3" {
+		t.Errorf("unexpected kites after deleting the version: %v", ids)
+	}
+
+	var ids []string
+	for _, e := range recorder.events {
+		if e.Action != protocol.Deregister {
+			t.Errorf("unexpected event: %+v", e)
+		}
+
+		ids = append(ids, e.Kite.ID)
+	}
+	sort.Strings(ids)
+
+	if len(ids) != 2 || ids[0] != "1" || ids[1] != "2" {
+		t.Errorf("unexpected deregister events: %v", ids)
+	}
+}
+
+// kiteIDs returns the sorted IDs of the kites.
+func kiteIDs(kites Kites) []string {
+	ids := make([]string, 0, len(kites))
+	for _, k := range kites {
+		ids = append(ids, k.Kite.ID)
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+func TestHeartbeatWeight(t *testing.T) {
+	if _, ok := heartbeatWeight(&dnode.Partial{Raw: []byte(`[]`)}); ok {
+		t.Error("got a weight from a heartbeat without arguments")
+	}
+
+	if w, ok := heartbeatWeight(&dnode.Partial{Raw: []byte(`[0.25]`)}); !ok || w != 0.25 {
+		t.Errorf("got %v, %v, want 0.25", w, ok)
+	}
+
+	if _, ok := heartbeatWeight(&dnode.Partial{Raw: []byte(`[-1]`)}); ok {
+		t.Error("got a negative weight")
+	}
+}
+
+// TestPostgresReconnectStmts replaces the database handle while the prepared
+// statements are used, the queries must not fail with a closed statement.
+func TestPostgresReconnectStmts(t *testing.T) {
+	kites := []*protocol.Kite{
+		{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host1", ID: "1"},
+	}
+
+	p := &Postgres{
+		DB:    newFakeDB(kites),
+		stmts: make(map[string]*sql.Stmt),
+	}
+
+	query, args, err := selectQuery("kite", &protocol.KontrolQuery{Username: "cenk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				rows, err := p.query(query, args...)
+				if err != nil {
+					errs <- err
+					return
+				}
+				rows.Close()
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		p.setDB(newFakeDB(kites), nil).Close()
+	}
+
+	close(stop)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+}
+
+// TestPostgresMigrate migrates a new schema twice, the second run must not
+// change anything. It's skipped unless the tests are run with the postgres
+// storage.
+func TestPostgresLogSlow(t *testing.T) {
+	var buf bytes.Buffer
+	log, _ := kite.NewLoggerWithWriter("kontrol", &buf)
+
+	p := &Postgres{Log: log}
+	query := &protocol.KontrolQuery{Username: "devrim", Environment: "production", Name: "mathworker"}
+
+	// the threshold is not set
+	p.logSlow("get", time.Now().Add(-time.Second), query.String())
+
+	p.slowQuery = 100 * time.Millisecond
+	p.logSlow("get", time.Now(), query.String())
+
+	if buf.Len() != 0 {
+		t.Fatalf("expected no slow queries to be logged, got %q", buf.String())
+	}
+
+	p.logSlow("get", time.Now().Add(-time.Second), query.String())
+
+	if !strings.Contains(buf.String(), "slow query get /devrim/production/mathworker////") {
+		t.Errorf("expected the slow query to be logged, got %q", buf.String())
+	}
+}
+
+func TestPostgresMaxResults(t *testing.T) {
+	kites := []*protocol.Kite{
+		{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host1", ID: "1"},
+		{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host2", ID: "2"},
+		{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.1", Region: "sj", Hostname: "host3", ID: "3"},
+	}
+
+	p := &Postgres{DB: newFakeDB(kites), table: "kite", maxResults: 2}
+	query := &protocol.KontrolQuery{Username: "cenk"}
+
+	if _, err := p.Get(query); err != ErrTooManyResults {
+		t.Errorf("got %v, want %v", err, ErrTooManyResults)
+	}
+
+	// the limit is applied before the kites are filtered by the constraint
+	constraint := &protocol.KontrolQuery{Username: "cenk", Environment: "production", Name: "worker", Version: ">= 1.0.1"}
+	if _, err := p.Get(constraint); err != ErrTooManyResults {
+		t.Errorf("got %v for a constraint, want %v", err, ErrTooManyResults)
+	}
+
+	p.maxResults = 3
+
+	result, err := p.Get(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 3 {
+		t.Errorf("got %d kites, want 3", len(result))
+	}
+}
+
+func TestPostgresGetResult(t *testing.T) {
+	kites := []*protocol.Kite{
+		{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host1", ID: "1"},
+		{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.1", Region: "sj", Hostname: "host2", ID: "2"},
+		{Username: "cenk", Environment: "production", Name: "worker", Version: "1.1.0", Region: "sj", Hostname: "host3", ID: "3"},
+	}
+
+	p := &Postgres{DB: newFakeDB(kites), table: "kite"}
+
+	query := &protocol.KontrolQuery{Username: "cenk", Environment: "production", Name: "worker", Version: ">= 1.0.1"}
+	result, err := p.GetResult(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.BeforeFilter != 3 || result.AfterFilter != 2 || len(result.Kites) != 2 {
+		t.Errorf("got %d kites before and %d after the filter, %d returned, want 3, 2 and 2",
+			result.BeforeFilter, result.AfterFilter, len(result.Kites))
+	}
+
+	// without a constraint nothing is filtered
+	result, err = p.GetResult(&protocol.KontrolQuery{Username: "cenk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.BeforeFilter != 3 || result.AfterFilter != 3 {
+		t.Errorf("got %d kites before and %d after the filter, want 3 and 3",
+			result.BeforeFilter, result.AfterFilter)
+	}
+
+	if _, err := p.GetResult(&protocol.KontrolQuery{Username: "cenk", Name: "worker", Version: ">= bad"}); err == nil {
+		t.Error("expected an error for a malformed constraint")
+	}
+}
+
+func TestPostgresMigrate(t *testing.T) {
+	if os.Getenv("KONTROL_STORAGE") != "postgres" {
+		t.Skip("KONTROL_STORAGE is not postgres")
+	}
+
+	p, ok := kon.storage.(*Postgres)
+	if !ok {
+		t.Fatalf("unexpected storage: %T", kon.storage)
+	}
+
+	const schema = "kite_migrate_test"
+	defer p.DB.Exec(`DROP SCHEMA IF EXISTS ` + schema + ` CASCADE`)
+
+	for i := 0; i < 2; i++ {
+		if err := migrate(p.DB, schema, kon.Kite.Log); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+
+		var version int
+		if err := p.DB.QueryRow(`SELECT version FROM ` + schema + `.kite_schema_version`).Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+
+		if version != len(migrations) {
+			t.Errorf("%d: expected version %d, got %d", i, len(migrations), version)
+		}
+	}
+
+	// all of the columns selected for the kites exist
+	_, err := p.DB.Exec(`SELECT ` + strings.Join(kiteColumns, ", ") + `, expire_at, claimed_by, claim_expires_at FROM ` + schema + `.kite`)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// addPostgresVersions registers a kite of a unique username to the postgres
+// storage of the tests for each of the given versions. It returns the
+// username and the func deleting the kites.
+func addPostgresVersions(t *testing.T, versions ...string) (*Postgres, string, func()) {
+	if os.Getenv("KONTROL_STORAGE") != "postgres" {
+		t.Skip("KONTROL_STORAGE is not postgres")
+	}
+
+	p, ok := kon.storage.(*Postgres)
+	if !ok {
+		t.Fatalf("unexpected storage: %T", kon.storage)
+	}
+
+	username := "versiontest-" + protocol.NewKiteID()
+
+	var kites []*protocol.Kite
+	for i, v := range versions {
+		k := &protocol.Kite{
+			Username:    username,
+			Environment: "production",
+			Name:        "worker",
+			Version:     v,
+			Region:      "sj",
+			Hostname:    fmt.Sprintf("host%d", i),
+			ID:          protocol.NewKiteID(),
+		}
+
+		if err := p.Upsert(k, &kontrolprotocol.RegisterValue{URL: "ws://localhost:4444/kite"}); err != nil {
+			t.Fatal(err)
+		}
+
+		kites = append(kites, k)
+	}
+
+	return p, username, func() {
+		for _, k := range kites {
+			p.Delete(k)
+		}
+	}
+}
+
+func TestPostgresVersionHistogram(t *testing.T) {
+	p, username, cleanup := addPostgresVersions(t, "1.0.0", "1.0.1", "1.0.1", "1.0.1")
+	defer cleanup()
+
+	histogram, err := p.VersionHistogram(username, "production", "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int64{"1.0.0": 1, "1.0.1": 3}
+	if !reflect.DeepEqual(histogram, want) {
+		t.Errorf("got %v, want %v", histogram, want)
+	}
+
+	histogram, err = p.VersionHistogram(username, "production", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(histogram) != 0 {
+		t.Errorf("expected an empty histogram, got %v", histogram)
+	}
+}
+
+func TestPostgresDeleteVersion(t *testing.T) {
+	p, username, cleanup := addPostgresVersions(t, "1.0.0", "1.0.1", "1.0.1")
+	defer cleanup()
+
+	if _, err := p.DeleteVersion(username, "production", "worker", ""); err == nil {
+		t.Error("expected an error without a version")
+	}
+
+	deleted, err := p.DeleteVersion(username, "production", "worker", "1.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deleted) != 2 || deleted[0].Version != "1.0.1" || deleted[1].Version != "1.0.1" {
+		t.Errorf("unexpected deleted kites: %+v", deleted)
+	}
+
+	kites, err := p.Get(&protocol.KontrolQuery{Username: username})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kites) != 1 || kites[0].Kite.Version != "1.0.0" {
+		t.Errorf("unexpected kites after deleting the version: %+v", kites)
+	}
+}
+
+func TestPostgresTouchInvalid(t *testing.T) {
+	p := &Postgres{}
+
+	if n, err := p.Touch(nil); n != 0 || err != nil {
+		t.Errorf("got %d, %v touching no kites", n, err)
+	}
+
+	if _, err := p.Touch([]string{"not-a-kite-id"}); err == nil {
+		t.Error("expected an error for an invalid kite ID")
+	}
+
+	p.readOnly = true
+	if _, err := p.Touch([]string{protocol.NewKiteID()}); err != ErrReadOnly {
+		t.Errorf("got %v, want %v", err, ErrReadOnly)
+	}
+}
+
+func TestPostgresRekeyEncrypted(t *testing.T) {
+	p, username, cleanup := addPostgresVersions(t, "1.0.0")
+	defer cleanup()
+
+	cipher, err := newColumnCipher(testEncryptionKey, []string{"urls", "tags"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Postgres{DB: p.DB, Log: p.Log, table: p.table, cipher: cipher, clock: realClock{}}
+
+	kites, err := e.Get(&protocol.KontrolQuery{Username: username})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := kites[0].Kite
+	value := &kontrolprotocol.RegisterValue{
+		URL:  "ws://localhost:4444/kite",
+		URLs: []string{"ws://10.0.0.1:4444/kite"},
+		Tags: []string{"customer:acme"},
+	}
+
+	if err := e.Update(&k, value); err != nil {
+		t.Fatal(err)
+	}
+
+	oldID := k.ID
+	k.ID = protocol.NewKiteID()
+	defer e.Delete(&k)
+
+	if err := e.Rekey(oldID, k.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// the ciphertexts are authenticated with the new ID
+	kites, err = e.Get(&protocol.KontrolQuery{ID: k.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kites) != 1 {
+		t.Fatalf("got %d kites, want 1", len(kites))
+	}
+
+	if !reflect.DeepEqual(kites[0].URLs, value.URLs) || !reflect.DeepEqual(kites[0].Tags, value.Tags) {
+		t.Errorf("unexpected rekeyed kite: %+v", kites[0])
+	}
+}
+
+func TestPostgresTouch(t *testing.T) {
+	p, username, cleanup := addPostgresVersions(t, "1.0.0", "1.0.0")
+	defer cleanup()
+
+	kites, err := p.Get(&protocol.KontrolQuery{Username: username})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{kites[0].Kite.ID, kites[1].Kite.ID}
+
+	// move the kites an hour back in time, keeping their TTL
+	backdate := `UPDATE ` + p.table + ` SET updated_at = updated_at - interval '1 hour',
+	expire_at = expire_at - interval '1 hour' WHERE id = ANY($1::uuid[])`
+
+	if _, err := p.DB.Exec(backdate, textArray(ids)); err != nil {
+		t.Fatal(err)
+	}
+
+	ttl := func(id string) (age float64, ttl sql.NullFloat64) {
+		err := p.DB.QueryRow(`SELECT EXTRACT(EPOCH FROM now() - updated_at),
+		EXTRACT(EPOCH FROM expire_at - updated_at) FROM `+p.table+` WHERE id = $1`, id).Scan(&age, &ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return age, ttl
+	}
+
+	_, before := ttl(ids[0])
+
+	// the unknown kite is not counted
+	n, err := p.Touch(append(ids, protocol.NewKiteID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 {
+		t.Errorf("got %d touched kites, want 2", n)
+	}
+
+	for _, id := range ids {
+		age, after := ttl(id)
+		if age > 60 {
+			t.Errorf("kite %s is not touched, updated %.0fs ago", id, age)
+		}
+
+		if after != before {
+			t.Errorf("got TTL %v of kite %s after touching it, want %v", after, id, before)
+		}
+	}
+}
+
+func TestPostgresMaintain(t *testing.T) {
+	if os.Getenv("KONTROL_STORAGE") != "postgres" {
+		t.Skip("KONTROL_STORAGE is not postgres")
+	}
+
+	p, ok := kon.storage.(*Postgres)
+	if !ok {
+		t.Fatalf("unexpected storage: %T", kon.storage)
+	}
+
+	clock := newFakeClock()
+	m := &Postgres{DB: p.DB, Log: p.Log, table: p.table, cipher: p.cipher, clock: clock}
+
+	k := &protocol.Kite{
+		Username:    "maintaintest-" + protocol.NewKiteID(),
+		Environment: "production",
+		Name:        "worker",
+		Version:     "1.0.0",
+		Region:      "sj",
+		Hostname:    "host",
+		ID:          protocol.NewKiteID(),
+	}
+	query := &protocol.KontrolQuery{Username: k.Username}
+
+	registered := func() bool {
+		kites, err := p.Get(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(kites) == 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- m.Maintain(ctx, k, &kontrolprotocol.RegisterValue{URL: "ws://localhost:4444/kite"}, time.Minute)
+	}()
+
+	clock.tick() // the kite is registered before the first heartbeat
+
+	if !registered() {
+		t.Fatal("kite is not registered")
+	}
+
+	// a kite deleted behind its back is registered again by the next
+	// heartbeats, each tick waits for the previous one to finish
+	if err := p.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.tick()
+	clock.tick()
+
+	if !registered() {
+		t.Fatal("kite is not registered again")
+	}
+
+	cancel()
+
+wait:
+	for {
+		select {
+		case <-clock.afterC:
+			// never fire the heartbeat, so the cancellation is picked
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			break wait
+		}
+	}
+
+	if registered() {
+		t.Error("kite is not deleted after the cancellation")
+	}
+}
@@ -0,0 +1,86 @@
+package kontrol
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"sync"
+)
+
+// advisoryLock is a Postgres advisory lock used to elect a leader among the
+// kontrol instances sharing a database. Advisory locks belong to the
+// session, so the lock is held on a dedicated connection. It's released by
+// the server when the connection is lost, and another instance can acquire
+// it.
+type advisoryLock struct {
+	key int64
+
+	mu   sync.Mutex
+	conn *sql.Conn
+}
+
+// newAdvisoryLock returns a lock with a key derived from the given name.
+func newAdvisoryLock(name string) *advisoryLock {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+
+	return &advisoryLock{key: int64(h.Sum64())}
+}
+
+// acquire returns true if the lock is held, acquiring it if it's not held
+// yet. The connection of a held lock is checked, so a lost lock is noticed
+// and tried to be acquired again.
+func (l *advisoryLock) acquire(ctx context.Context, db *sql.DB) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn != nil {
+		if err := l.conn.PingContext(ctx); err == nil {
+			return true, nil
+		}
+
+		// the server released the lock with the connection
+		l.conn.Close()
+		l.conn = nil
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	var locked bool
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, l.key).Scan(&locked)
+	if err != nil || !locked {
+		conn.Close()
+		return false, err
+	}
+
+	l.conn = conn
+	return true, nil
+}
+
+// held returns true if the lock was held when it was last acquired.
+func (l *advisoryLock) held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conn != nil
+}
+
+// release releases the lock if it's held.
+func (l *advisoryLock) release(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		return nil
+	}
+
+	_, err := l.conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, l.key)
+
+	// the lock is released with the connection anyway
+	l.conn.Close()
+	l.conn = nil
+
+	return err
+}
@@ -0,0 +1,85 @@
+package kontrol
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestAdvisoryLock elects a leader between two contenders and terminates the
+// connection of the leader, the other one must take over. It's skipped unless
+// the tests are run with the postgres storage.
+func TestAdvisoryLock(t *testing.T) {
+	if os.Getenv("KONTROL_STORAGE") != "postgres" {
+		t.Skip("KONTROL_STORAGE is not postgres")
+	}
+
+	p, ok := kon.storage.(*Postgres)
+	if !ok {
+		t.Fatalf("unexpected storage: %T", kon.storage)
+	}
+
+	ctx := context.Background()
+	db := p.db()
+
+	a := newAdvisoryLock("kontrol-leader-test")
+	b := newAdvisoryLock("kontrol-leader-test")
+	defer a.release(ctx)
+	defer b.release(ctx)
+
+	acquire := func(name string, l *advisoryLock, want bool) {
+		t.Helper()
+
+		got, err := l.acquire(ctx, db)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if got != want || l.held() != want {
+			t.Fatalf("%s: got leader %t (held %t), want %t", name, got, l.held(), want)
+		}
+	}
+
+	acquire("a", a, true)
+	acquire("b", b, false)
+
+	// the lock is kept while the connection is alive
+	acquire("a again", a, true)
+
+	var pid int
+	if err := a.conn.QueryRowContext(ctx, `SELECT pg_backend_pid()`).Scan(&pid); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.ExecContext(ctx, `SELECT pg_terminate_backend($1)`, pid); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server releases the lock once the backend has exited
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		leader, err := b.acquire(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if leader {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("b didn't take over the lock of the lost connection")
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	acquire("a after its connection is lost", a, false)
+
+	if err := b.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	acquire("a after b released", a, true)
+}
@@ -0,0 +1,215 @@
+package kontrol
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+// Memory implements the Storage interface by keeping the kites in memory. It
+// is useful for tests and single instance setups. Kites are not expired, they
+// are only removed by Delete.
+type Memory struct {
+	kites map[string]*memoryKite // key is the ID of the kite
+	mu    sync.RWMutex           // protects kites
+
+	revoked *revocationList
+}
+
+var (
+	_ Storage           = (*Memory)(nil)
+	_ ConstraintGetter  = (*Memory)(nil)
+	_ RevocationStorage = (*Memory)(nil)
+)
+
+type memoryKite struct {
+	kite      protocol.Kite
+	value     kontrolprotocol.RegisterValue
+	updatedAt time.Time
+}
+
+// NewMemory returns a new, empty in-memory storage.
+func NewMemory() *Memory {
+	return &Memory{
+		kites:   make(map[string]*memoryKite),
+		revoked: newRevocationList(),
+	}
+}
+
+func (m *Memory) Get(query *protocol.KontrolQuery) (Kites, error) {
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		// version is a malformed, just return the error
+		return nil, err
+	}
+
+	return m.GetWithConstraint(query, constraint)
+}
+
+// GetWithConstraint retrieves the kites with the given query. If constraint
+// is not nil, it's used instead of the version field of the query.
+func (m *Memory) GetWithConstraint(query *protocol.KontrolQuery, constraint version.Constraints) (Kites, error) {
+	// only ID queries are allowed to have gaps between the fields, just like
+	// in the other storages.
+	if !onlyIDQuery(query) {
+		if _, err := GetQueryKey(query); err != nil {
+			return nil, err
+		}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	kites := make(Kites, 0)
+	for _, k := range m.kites {
+		if !matchQuery(&k.kite, query, constraint) ||
+			!hasCapabilities(k.value.Capabilities, query.Capabilities) ||
+			!hasTags(k.value.Tags, query) ||
+			!k.updatedAt.After(query.SinceUpdatedAt) {
+			continue
+		}
+
+		kites = append(kites, &protocol.KiteWithToken{
+			Kite: k.kite,
+			URL:  k.value.URL,
+			URLs: k.value.URLs,
+
+			Weight: k.value.Weight,
+			Tags:   k.value.Tags,
+		})
+	}
+
+	kites.Select(query.Selection)
+
+	return kites, nil
+}
+
+func (m *Memory) Add(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return m.Upsert(kiteProt, value)
+}
+
+func (m *Memory) Update(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return m.Upsert(kiteProt, value)
+}
+
+func (m *Memory) Upsert(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	// check that the incoming URL is valid to prevent malformed input
+	if _, err := url.Parse(value.URL); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.kites[kiteProt.ID] = &memoryKite{
+		kite:      *kiteProt,
+		value:     *value,
+		updatedAt: time.Now().UTC(),
+	}
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *Memory) Delete(kiteProt *protocol.Kite) error {
+	m.mu.Lock()
+	delete(m.kites, kiteProt.ID)
+	m.mu.Unlock()
+
+	return nil
+}
+
+// Count returns the number of kites in the storage.
+func (m *Memory) Count() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return int64(len(m.kites)), nil
+}
+
+// Revoke revokes the kite keys and the tokens with the given value of the
+// claim, see RevocationStorage.
+func (m *Memory) Revoke(claim, value string, expires time.Time) error {
+	return m.revoked.Revoke(claim, value, expires)
+}
+
+// IsRevoked returns true if the kite keys and the tokens with the given value
+// of the claim are revoked.
+func (m *Memory) IsRevoked(claim, value string) (bool, error) {
+	return m.revoked.IsRevoked(claim, value)
+}
+
+// hasCapabilities returns true if all of the wanted capabilities are in
+// capabilities.
+func hasCapabilities(capabilities, wanted []string) bool {
+	for _, w := range wanted {
+		found := false
+		for _, c := range capabilities {
+			if c == w {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasTags returns true if the given tags match the tags of the query: all of
+// query.Tags and at least one of query.AnyTags, if they are set.
+func hasTags(tags []string, query *protocol.KontrolQuery) bool {
+	if !hasCapabilities(tags, query.Tags) {
+		return false
+	}
+
+	if len(query.AnyTags) == 0 {
+		return true
+	}
+
+	for _, want := range query.AnyTags {
+		for _, tag := range tags {
+			if tag == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// hasTagQuery returns true if the query matches the kites by their tags.
+func hasTagQuery(query *protocol.KontrolQuery) bool {
+	return len(query.Tags) != 0 || len(query.AnyTags) != 0
+}
+
+// matchQuery returns true if the given kite matches all non-empty fields of
+// the query. If constraint is not nil, it's used for the version field
+// instead of an exact match.
+func matchQuery(k *protocol.Kite, query *protocol.KontrolQuery, constraint version.Constraints) bool {
+	fields := k.Query().Fields()
+	for key, v := range query.Fields() {
+		if v == "" {
+			continue
+		}
+
+		if key == "version" && constraint != nil {
+			kiteVersion, err := version.NewVersion(k.Version)
+			if err != nil || !constraint.Check(kiteVersion) {
+				return false
+			}
+			continue
+		}
+
+		if fields[key] != v {
+			return false
+		}
+	}
+
+	return true
+}
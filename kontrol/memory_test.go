@@ -0,0 +1,604 @@
+package kontrol
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+	sq "github.com/lann/squirrel"
+)
+
+// values the random kites and queries are picked from. The pools are small,
+// so the queries match some of the kites.
+var (
+	poolUsernames    = []string{"cenk", "arslan"}
+	poolEnvironments = []string{"production", "development"}
+	poolNames        = []string{"mathworker", "fs"}
+	poolVersions     = []string{"0.0.1", "1.0.0", "1.1.0", "1.2.3", "2.0.0"}
+	poolConstraints  = []string{">= 1.0", "< 1.1", "~> 1.1", ">= 1.0, < 2.0", "!= 1.0.0"}
+	poolRegions      = []string{"sj", "ams"}
+	poolHostnames    = []string{"host1", "host2"}
+)
+
+func pick(rand *rand.Rand, values []string) string {
+	return values[rand.Intn(len(values))]
+}
+
+// randomQuery is a KontrolQuery that sets a random prefix of the fields in
+// keyOrder, the version being either exact or a constraint.
+type randomQuery struct {
+	Query *protocol.KontrolQuery
+}
+
+func (randomQuery) Generate(rand *rand.Rand, size int) reflect.Value {
+	q := &protocol.KontrolQuery{}
+	setters := []func(){
+		func() { q.Username = pick(rand, poolUsernames) },
+		func() { q.Environment = pick(rand, poolEnvironments) },
+		func() { q.Name = pick(rand, poolNames) },
+		func() {
+			if rand.Intn(2) == 0 {
+				q.Version = pick(rand, poolVersions)
+			} else {
+				q.Version = pick(rand, poolConstraints)
+			}
+		},
+		func() { q.Region = pick(rand, poolRegions) },
+		func() { q.Hostname = pick(rand, poolHostnames) },
+	}
+
+	// username is always set, otherwise the query is invalid
+	for i := 0; i <= rand.Intn(len(setters)); i++ {
+		setters[i]()
+	}
+
+	return reflect.ValueOf(randomQuery{Query: q})
+}
+
+// newRandomTable returns a database with a kite table of n random kites,
+// served by the fakeDriver.
+func newRandomTable(rand *rand.Rand, n int) (*sql.DB, []*protocol.Kite) {
+	kites := make([]*protocol.Kite, n)
+	for i := range kites {
+		kites[i] = &protocol.Kite{
+			Username:    pick(rand, poolUsernames),
+			Environment: pick(rand, poolEnvironments),
+			Name:        pick(rand, poolNames),
+			Version:     pick(rand, poolVersions),
+			Region:      pick(rand, poolRegions),
+			Hostname:    pick(rand, poolHostnames),
+			ID:          strconv.Itoa(i),
+		}
+	}
+
+	return newFakeDB(kites), kites
+}
+
+// getSQLKites runs the query like the SQL storages do, the version constraint
+// being rewritten to a name query and filtered by Kites.Filter.
+func getSQLKites(db *sql.DB, query *protocol.KontrolQuery) (Kites, error) {
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		return nil, err
+	}
+
+	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+	result, err := getKites(db.Query, psql, "kite", query, nil, constraint, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Kites, nil
+}
+
+func TestGetKitesProperties(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	db, all := newRandomTable(r, 200)
+	defer db.Close()
+
+	// every returned kite matches every set field and no matching kite is
+	// missing from the result
+	f := func(rq randomQuery) bool {
+		q := rq.Query
+		kites, err := getSQLKites(db, q)
+		if err != nil {
+			t.Logf("query %+v: %s", q, err)
+			return false
+		}
+
+		var c version.Constraints
+		if _, err := version.NewVersion(q.Version); err != nil && q.Version != "" {
+			c, _ = version.NewConstraint(q.Version)
+		}
+
+		expected := 0
+		for _, k := range all {
+			if matchesField(k, q, c) {
+				expected++
+			}
+		}
+
+		for _, k := range kites {
+			if !matchesField(&k.Kite, q, c) {
+				t.Logf("query %+v returned a non matching kite: %+v", q, k.Kite)
+				return false
+			}
+		}
+
+		if len(kites) != expected {
+			t.Logf("query %+v: got %d kites, expected %d", q, len(kites), expected)
+			return false
+		}
+
+		return true
+	}
+
+	if err := quick.Check(f, &quick.Config{Rand: r, MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetKitesSingleResult(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	db, all := newRandomTable(r, 50)
+	defer db.Close()
+
+	// a query for a single kite returns exactly that kite, with an exact
+	// version or with a constraint matching only its version
+	f := func(i uint8, constraint bool) bool {
+		k := all[int(i)%len(all)]
+		q := k.Query()
+		if constraint {
+			q.Version = "= " + k.Version
+		}
+
+		kites, err := getSQLKites(db, q)
+		if err != nil {
+			t.Logf("query %+v: %s", q, err)
+			return false
+		}
+
+		return len(kites) == 1 && kites[0].Kite == *k
+	}
+
+	if err := quick.Check(f, &quick.Config{Rand: r}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSelectQueryProperties(t *testing.T) {
+	// the select query has an argument for each set field
+	f := func(rq randomQuery) bool {
+		sqlQuery, args, err := selectQuery("kite", rq.Query)
+		if err != nil || sqlQuery == "" {
+			return false
+		}
+
+		set := 0
+		for _, v := range rq.Query.Fields() {
+			if v != "" {
+				set++
+			}
+		}
+
+		return len(args) == set
+	}
+
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSelectQuerySinceUpdatedAt(t *testing.T) {
+	since := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	sqlQuery, args, err := selectQuery("kite", &protocol.KontrolQuery{
+		Username:       "cenk",
+		SinceUpdatedAt: since,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(sqlQuery, "updated_at > $2") {
+		t.Errorf("expected an updated_at condition, got: %s", sqlQuery)
+	}
+
+	if len(args) != 2 || args[1] != since {
+		t.Errorf("unexpected args: %v", args)
+	}
+}
+
+func TestProjection(t *testing.T) {
+	columns, err := projection([]string{"id", "url"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(columns, []string{"id", "url"}) {
+		t.Errorf("unexpected columns: %v", columns)
+	}
+
+	// the kites are filtered by the version and the key after it
+	columns, err = projection([]string{"id", "url"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(columns, []string{"id", "url", "version", "region", "hostname"}) {
+		t.Errorf("unexpected columns: %v", columns)
+	}
+
+	if _, err := projection([]string{"id", "password"}, false); err == nil {
+		t.Error("expected an error for an unknown column")
+	}
+
+	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+	sqlQuery, _, err := buildSelectQuery(psql, "kite", &protocol.KontrolQuery{Username: "cenk"}, []string{"id", "url"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(sqlQuery, "SELECT id, url FROM kite") {
+		t.Errorf("expected only the projected columns, got: %s", sqlQuery)
+	}
+}
+
+func TestRandomSelectQuery(t *testing.T) {
+	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+	sqlQuery, args, err := randomSelectQuery(psql, "kite", &protocol.KontrolQuery{Username: "cenk", Environment: "production"}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(sqlQuery, " ORDER BY random() LIMIT 3") {
+		t.Errorf("expected the kites to be picked by the database, got: %s", sqlQuery)
+	}
+
+	if len(args) != 2 {
+		t.Errorf("unexpected args: %v", args)
+	}
+
+	if _, _, err := randomSelectQuery(psql, "kite", &protocol.KontrolQuery{}, 3); err == nil {
+		t.Error("expected an error for an empty query")
+	}
+}
+
+// matchesField is the reference implementation of a query match, written
+// independently of matchQuery.
+func matchesField(k *protocol.Kite, q *protocol.KontrolQuery, c version.Constraints) bool {
+	if q.Version != "" {
+		if c != nil {
+			v, err := version.NewVersion(k.Version)
+			if err != nil || !c.Check(v) {
+				return false
+			}
+		} else if k.Version != q.Version {
+			return false
+		}
+	}
+
+	return (q.Username == "" || q.Username == k.Username) &&
+		(q.Environment == "" || q.Environment == k.Environment) &&
+		(q.Name == "" || q.Name == k.Name) &&
+		(q.Region == "" || q.Region == k.Region) &&
+		(q.Hostname == "" || q.Hostname == k.Hostname) &&
+		(q.ID == "" || q.ID == k.ID)
+}
+
+func TestMemoryCapabilities(t *testing.T) {
+	m := NewMemory()
+
+	gpu := &protocol.Kite{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host1", ID: "1"}
+	cpu := &protocol.Kite{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host2", ID: "2"}
+
+	m.Add(gpu, &kontrolprotocol.RegisterValue{URL: "http://host1/kite", Capabilities: []string{"gpu", "ssd"}})
+	m.Add(cpu, &kontrolprotocol.RegisterValue{URL: "http://host2/kite", Capabilities: []string{"ssd"}})
+
+	kites, err := m.Get(&protocol.KontrolQuery{Username: "cenk", Capabilities: []string{"ssd", "gpu"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kites) != 1 || kites[0].Kite.ID != "1" {
+		t.Errorf("expected only the gpu kite, got %d kites", len(kites))
+	}
+
+	kites, err = m.Get(&protocol.KontrolQuery{Username: "cenk", Capabilities: []string{"ssd"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kites) != 2 {
+		t.Errorf("expected 2 kites with ssd, got %d", len(kites))
+	}
+}
+
+func TestTextArray(t *testing.T) {
+	if s := textArray([]string{"gpu", `a"b`}); s != `{"gpu","a\"b"}` {
+		t.Errorf("unexpected array literal: %s", s)
+	}
+
+	if s := textArray(nil); s != "{}" {
+		t.Errorf("unexpected empty array literal: %s", s)
+	}
+}
+
+func TestParseTextArray(t *testing.T) {
+	for _, values := range [][]string{
+		nil,
+		{"tier:canary"},
+		{"gpu", `a"b`, `c\d`, "e,f", "g h"},
+	} {
+		if got := parseTextArray(textArray(values)); !reflect.DeepEqual(got, values) {
+			t.Errorf("got %q, want %q", got, values)
+		}
+	}
+
+	// Postgres quotes only the elements that need it
+	if got := parseTextArray(`{a,"b c"}`); !reflect.DeepEqual(got, []string{"a", "b c"}) {
+		t.Errorf("unexpected array: %q", got)
+	}
+}
+
+func TestMemoryTags(t *testing.T) {
+	m := NewMemory()
+
+	canary := &protocol.Kite{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host1", ID: "1"}
+	stable := &protocol.Kite{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host2", ID: "2"}
+
+	m.Add(canary, &kontrolprotocol.RegisterValue{URL: "http://host1/kite", Tags: []string{"tier:canary", "team:infra"}})
+	m.Add(stable, &kontrolprotocol.RegisterValue{URL: "http://host2/kite", Tags: []string{"tier:stable", "team:infra"}})
+
+	tests := []struct {
+		query *protocol.KontrolQuery
+		ids   []string
+	}{
+		{&protocol.KontrolQuery{Username: "cenk", Tags: []string{"tier:canary"}}, []string{"1"}},
+		{&protocol.KontrolQuery{Username: "cenk", Tags: []string{"team:infra", "tier:stable"}}, []string{"2"}},
+		{&protocol.KontrolQuery{Username: "cenk", Tags: []string{"team:infra"}}, []string{"1", "2"}},
+		{&protocol.KontrolQuery{Username: "cenk", AnyTags: []string{"tier:canary", "tier:stable"}}, []string{"1", "2"}},
+		{&protocol.KontrolQuery{Username: "cenk", Tags: []string{"team:infra"}, AnyTags: []string{"tier:canary"}}, []string{"1"}},
+		{&protocol.KontrolQuery{Username: "cenk", AnyTags: []string{"tier:beta"}}, nil},
+	}
+
+	for _, test := range tests {
+		kites, err := m.Get(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []string
+		for _, k := range kites {
+			ids = append(ids, k.Kite.ID)
+		}
+		sort.Strings(ids)
+
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("query %+v: got kites %v, want %v", test.query, ids, test.ids)
+		}
+	}
+
+	kites, err := m.Get(&protocol.KontrolQuery{Username: "cenk", Tags: []string{"tier:canary"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kites) != 1 || !reflect.DeepEqual(kites[0].Tags, []string{"tier:canary", "team:infra"}) {
+		t.Errorf("expected the tags of the kite to be returned, got %+v", kites)
+	}
+}
+
+func TestMemoryAlternateURLs(t *testing.T) {
+	m := NewMemory()
+
+	k := &protocol.Kite{Username: "cenk", Environment: "production", Name: "worker", Version: "1.0.0", Region: "sj", Hostname: "host1", ID: "1"}
+	m.Add(k, &kontrolprotocol.RegisterValue{URL: "wss://example.com/kite", URLs: []string{"ws://10.0.0.1:4444/kite"}})
+
+	kites, err := m.Get(&protocol.KontrolQuery{Username: "cenk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kites) != 1 || kites[0].URL != "wss://example.com/kite" ||
+		len(kites[0].URLs) != 1 || kites[0].URLs[0] != "ws://10.0.0.1:4444/kite" {
+		t.Errorf("unexpected kites: %+v", kites)
+	}
+}
+
+func TestURLsJSON(t *testing.T) {
+	if v := urlsJSON(&kontrolprotocol.RegisterValue{URL: "ws://host/kite"}); v != nil {
+		t.Errorf("expected NULL for a single URL, got %v", v)
+	}
+
+	v := urlsJSON(&kontrolprotocol.RegisterValue{URLs: []string{"ws://10.0.0.1/kite"}})
+	if v != `["ws://10.0.0.1/kite"]` {
+		t.Errorf("unexpected urls: %v", v)
+	}
+}
+
+// fakeDriver is a database/sql driver serving the select queries of
+// buildSelectQuery on the kites of a fakeDB. Only the equality conditions
+// of the key fields are supported.
+type fakeDriver struct{}
+
+var (
+	fakeDBs   = make(map[string][]*protocol.Kite)
+	fakeDBsMu sync.Mutex
+	fakeOnce  sync.Once
+)
+
+// newFakeDB returns a database with a kite table of the given kites.
+func newFakeDB(kites []*protocol.Kite) *sql.DB {
+	fakeOnce.Do(func() { sql.Register("kontrolfake", fakeDriver{}) })
+
+	name := protocol.NewKiteID()
+
+	fakeDBsMu.Lock()
+	fakeDBs[name] = kites
+	fakeDBsMu.Unlock()
+
+	db, err := sql.Open("kontrolfake", name)
+	if err != nil {
+		panic(err)
+	}
+
+	return db
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBsMu.Lock()
+	defer fakeDBsMu.Unlock()
+
+	kites, ok := fakeDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown database %q", name)
+	}
+
+	return &fakeConn{kites: kites}, nil
+}
+
+type fakeConn struct {
+	kites []*protocol.Kite
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+var (
+	fakeSelect    = regexp.MustCompile(`^SELECT (.+) FROM kite WHERE (.+?)(?: LIMIT (\d+))?$`)
+	fakeCondition = regexp.MustCompile(`(\w+) = \$(\d+)`)
+)
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("only select queries are supported")
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	m := fakeSelect.FindStringSubmatch(s.query)
+	if m == nil {
+		return nil, fmt.Errorf("unsupported query: %s", s.query)
+	}
+
+	columns := strings.Split(m[1], ", ")
+
+	// the conditions are the key fields joined with AND
+	conditions := make(map[string]string)
+	for _, c := range fakeCondition.FindAllStringSubmatch(m[2], -1) {
+		i, _ := strconv.Atoi(c[2])
+		if i < 1 || i > len(args) {
+			return nil, fmt.Errorf("missing argument $%d", i)
+		}
+
+		conditions[c[1]] = fmt.Sprint(args[i-1])
+	}
+
+	rest := fakeCondition.ReplaceAllString(m[2], "")
+	if strings.Trim(strings.Replace(rest, " AND ", "", -1), "()") != "" {
+		return nil, fmt.Errorf("unsupported conditions: %s", m[2])
+	}
+
+	rows := &fakeRows{columns: columns}
+	for _, k := range s.conn.kites {
+		values := map[string]string{
+			"username":    k.Username,
+			"environment": k.Environment,
+			"kitename":    k.Name,
+			"version":     k.Version,
+			"region":      k.Region,
+			"hostname":    k.Hostname,
+			"id":          k.ID,
+		}
+
+		match := true
+		for column, v := range conditions {
+			if values[column] != v {
+				match = false
+			}
+		}
+
+		if !match {
+			continue
+		}
+
+		row := make([]driver.Value, len(columns))
+		for i, column := range columns {
+			switch column {
+			case "url":
+				row[i] = "http://" + k.Hostname + "/kite"
+			case "updated_at", "created_at":
+				row[i] = time.Time{}
+			case "urls":
+				row[i] = nil
+			case "weight":
+				row[i] = float64(0)
+			case "tags", "capabilities":
+				row[i] = "{}"
+			default:
+				v, ok := values[column]
+				if !ok {
+					return nil, fmt.Errorf("unknown column: %q", column)
+				}
+				row[i] = v
+			}
+		}
+
+		rows.rows = append(rows.rows, row)
+	}
+
+	if m[3] != "" {
+		if limit, _ := strconv.Atoi(m[3]); len(rows.rows) > limit {
+			rows.rows = rows.rows[:limit]
+		}
+	}
+
+	return rows, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
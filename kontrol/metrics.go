@@ -0,0 +1,238 @@
+package kontrol
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds (in seconds) of the storage latency
+// histogram buckets.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// countBuckets are the upper bounds of the histograms counting rows.
+var countBuckets = []float64{0, 1, 10, 100, 1000, 10000, 100000}
+
+// Metrics holds the raw counters of a kontrol instance. It can be used to
+// wire the values to any metrics system. MetricsHandler serves them in the
+// Prometheus text format.
+type Metrics struct {
+	// the counters are accessed atomically, see Registrations and
+	// TokensIssued
+	registrations uint64
+	tokensIssued  uint64
+
+	// storage holds a latency histogram for each storage operation.
+	storage   map[string]*Histogram
+	storageMu sync.Mutex
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		storage: make(map[string]*Histogram),
+	}
+}
+
+// Registrations returns the total number of successful registrations.
+func (m *Metrics) Registrations() uint64 {
+	return atomic.LoadUint64(&m.registrations)
+}
+
+// TokensIssued returns the total number of tokens issued by kontrol.
+func (m *Metrics) TokensIssued() uint64 {
+	return atomic.LoadUint64(&m.tokensIssued)
+}
+
+func (m *Metrics) addRegistration() {
+	atomic.AddUint64(&m.registrations, 1)
+}
+
+func (m *Metrics) addTokensIssued(n uint64) {
+	atomic.AddUint64(&m.tokensIssued, n)
+}
+
+// StorageLatency returns the latency histogram of the given storage operation,
+// like "get" or "upsert".
+func (m *Metrics) StorageLatency(op string) *Histogram {
+	m.storageMu.Lock()
+	defer m.storageMu.Unlock()
+
+	h, ok := m.storage[op]
+	if !ok {
+		h = newHistogram(latencyBuckets)
+		m.storage[op] = h
+	}
+
+	return h
+}
+
+// StorageObserver is notified about every storage operation of kontrol with
+// its duration and error. It can be used to feed an external metrics system
+// or to log slow operations.
+type StorageObserver interface {
+	ObserveOp(op string, d time.Duration, err error)
+}
+
+// observeStorage records the storage operation started at the given time and
+// passes it to the StorageObserver, if any.
+func (k *Kontrol) observeStorage(op string, start time.Time, err error) {
+	d := time.Since(start)
+	k.metrics.StorageLatency(op).Observe(d.Seconds())
+
+	if k.StorageObserver != nil {
+		k.StorageObserver.ObserveOp(op, d, err)
+	}
+}
+
+// Histogram counts observed values in buckets.
+type Histogram struct {
+	buckets []float64 // upper bounds of the buckets
+	counts  []uint64  // cumulative counts, index matches buckets
+	count   uint64
+	sum     float64
+	mu      sync.Mutex
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Observe adds a single value to the histogram.
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+
+	h.count++
+	h.sum += v
+}
+
+// Metrics returns the counters of kontrol.
+func (k *Kontrol) Metrics() *Metrics {
+	return k.metrics
+}
+
+// kiteCounter is implemented by storages that can count the registered kites.
+type kiteCounter interface {
+	Count() (int64, error)
+}
+
+// cleanerStatser is implemented by storages that run a cleaner.
+type cleanerStatser interface {
+	CleanerStats() (runs, cleaned int64)
+}
+
+// queryStatser is implemented by storages that count their slow path queries.
+type queryStatser interface {
+	QueryStats() *QueryStats
+}
+
+// MetricsHandler returns a http.Handler that serves the metrics of kontrol in
+// the Prometheus text exposition format.
+func (k *Kontrol) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		k.writeMetrics(w)
+	})
+}
+
+func (k *Kontrol) writeMetrics(w io.Writer) {
+	m := k.metrics
+
+	if c, ok := k.storage.(kiteCounter); ok {
+		if n, err := c.Count(); err == nil {
+			writeMetric(w, "kontrol_registered_kites", "gauge",
+				"Number of kites in the storage.", n)
+		}
+	}
+
+	writeMetric(w, "kontrol_registrations_total", "counter",
+		"Total number of kite registrations.", m.Registrations())
+
+	writeMetric(w, "kontrol_tokens_issued_total", "counter",
+		"Total number of issued tokens.", m.TokensIssued())
+
+	if c, ok := k.storage.(cleanerStatser); ok {
+		runs, cleaned := c.CleanerStats()
+		writeMetric(w, "kontrol_cleaner_runs_total", "counter",
+			"Total number of cleaner runs.", runs)
+		writeMetric(w, "kontrol_cleaner_cleaned_total", "counter",
+			"Total number of kites removed by the cleaner.", cleaned)
+	}
+
+	if q, ok := k.storage.(queryStatser); ok {
+		stats := q.QueryStats()
+		writeMetric(w, "kontrol_storage_slow_path_total", "counter",
+			"Total number of queries fetching all versions to filter by a version constraint.",
+			atomic.LoadUint64(&stats.SlowPath))
+
+		const name = "kontrol_storage_slow_path_discarded_rows"
+		fmt.Fprintf(w, "# HELP %s Rows fetched and discarded by a version constraint.\n", name)
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		writeHistogram(w, name, "", stats.Discarded)
+	}
+
+	m.storageMu.Lock()
+	ops := make([]string, 0, len(m.storage))
+	for op := range m.storage {
+		ops = append(ops, op)
+	}
+	m.storageMu.Unlock()
+	sort.Strings(ops)
+
+	const name = "kontrol_storage_latency_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency of storage operations.\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+
+	for _, op := range ops {
+		writeHistogram(w, name, fmt.Sprintf("op=%q", op), m.StorageLatency(op))
+	}
+}
+
+// writeHistogram writes the samples of the histogram. labels are added to
+// each sample, like: op="get"
+func writeHistogram(w io.Writer, name, labels string, h *Histogram) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	with := func(extra string) string {
+		if labels == "" {
+			return extra
+		}
+		if extra == "" {
+			return labels
+		}
+		return labels + "," + extra
+	}
+
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, with(fmt.Sprintf("le=\"%g\"", upper)), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, with(`le="+Inf"`), h.count)
+
+	if labels != "" {
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	} else {
+		fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+		fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+	}
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
@@ -0,0 +1,158 @@
+package kontrol
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/testkeys"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 5})
+
+	for _, v := range []float64{0.5, 3, 10} {
+		h.Observe(v)
+	}
+
+	var buf bytes.Buffer
+	writeHistogram(&buf, "test", `op="get"`, h)
+
+	want := `test_bucket{op="get",le="1"} 1
+test_bucket{op="get",le="5"} 2
+test_bucket{op="get",le="+Inf"} 3
+test_sum{op="get"} 13.5
+test_count{op="get"} 3
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	writeHistogram(&buf, "test", "", h)
+
+	if !strings.Contains(buf.String(), `test_bucket{le="+Inf"} 3`) ||
+		!strings.Contains(buf.String(), "\ntest_count 3\n") {
+		t.Errorf("unexpected histogram without labels:\n%s", buf.String())
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	k := New(conf.Copy(), "0.0.1", testkeys.Public, testkeys.Private)
+	k.SetStorage(NewMemory())
+
+	k.storage.Add(&protocol.Kite{
+		Username:    "devrim",
+		Environment: "production",
+		Name:        "mathworker",
+		Version:     "1.0.0",
+		Region:      "sj",
+		Hostname:    "host",
+		ID:          "1",
+	}, &kontrolprotocol.RegisterValue{URL: "http://localhost:4444/kite"})
+
+	k.metrics.addRegistration()
+	k.metrics.addTokensIssued(2)
+
+	if n := k.Metrics().Registrations(); n != 1 {
+		t.Errorf("expected 1 registration, got %d", n)
+	}
+
+	if n := k.Metrics().TokensIssued(); n != 2 {
+		t.Errorf("expected 2 issued tokens, got %d", n)
+	}
+	k.observeStorage("get", time.Now(), nil)
+
+	rec := httptest.NewRecorder()
+	k.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected content type: %s", ct)
+	}
+
+	for _, line := range []string{
+		"# TYPE kontrol_registered_kites gauge",
+		"kontrol_registered_kites 1",
+		"# TYPE kontrol_registrations_total counter",
+		"kontrol_registrations_total 1",
+		"kontrol_tokens_issued_total 2",
+		"# TYPE kontrol_storage_latency_seconds histogram",
+		`kontrol_storage_latency_seconds_count{op="get"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+// observedOp is a storage operation passed to an opRecorder.
+type observedOp struct {
+	op  string
+	err error
+}
+
+// opRecorder is a StorageObserver recording the operations.
+type opRecorder struct {
+	mu  sync.Mutex
+	ops []observedOp
+}
+
+func (r *opRecorder) ObserveOp(op string, d time.Duration, err error) {
+	r.mu.Lock()
+	r.ops = append(r.ops, observedOp{op, err})
+	r.mu.Unlock()
+}
+
+func TestStorageObserver(t *testing.T) {
+	k := New(conf.Copy(), "0.0.1", testkeys.Public, testkeys.Private)
+	k.SetStorage(NewMemory())
+
+	recorder := &opRecorder{}
+	k.StorageObserver = recorder
+
+	kite := &protocol.Kite{
+		Username:    "devrim",
+		Environment: "production",
+		Name:        "mathworker",
+		Version:     "1.0.0",
+		Region:      "sj",
+		Hostname:    "host",
+		ID:          "1",
+	}
+
+	if err := k.makeUpdater(kite, &kontrolprotocol.RegisterValue{URL: "http://localhost:4444/kite"})(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the memory storage rejects malformed URLs
+	if err := k.makeUpdater(kite, &kontrolprotocol.RegisterValue{URL: "http://%zz/kite"})(); err == nil {
+		t.Fatal("expected an error for a malformed URL")
+	}
+
+	if len(recorder.ops) != 2 {
+		t.Fatalf("got %d observed operations, want 2", len(recorder.ops))
+	}
+
+	if op := recorder.ops[0]; op.op != "update" || op.err != nil {
+		t.Errorf("unexpected first operation: %+v", op)
+	}
+
+	if op := recorder.ops[1]; op.op != "update" || op.err == nil {
+		t.Errorf("unexpected second operation: %+v", op)
+	}
+
+	// the operations are recorded in the latency histograms too
+	if n := k.Metrics().StorageLatency("update").count; n != 2 {
+		t.Errorf("got %d observed latencies, want 2", n)
+	}
+}
@@ -0,0 +1,204 @@
+package kontrol
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/koding/kite"
+)
+
+// migrations are the ordered steps creating and evolving the kite table of
+// the Postgres storage and the tables next to it. The schema version of a database is the number of
+// steps applied to it. New steps must be appended to the end and the
+// existing ones must never be changed, because they are not run again on
+// databases already migrated. Each step returns its statements for the given
+// schema. The statements are idempotent, so the databases created before the
+// schema version was tracked can be migrated too.
+//
+// The statements require Postgres 9.6 or newer, for ADD COLUMN IF NOT EXISTS.
+// The jsonb column needs 9.4, CREATE INDEX IF NOT EXISTS and ON CONFLICT of
+// Postgres.Revoke need 9.5.
+var migrations = []func(schema string) []string{
+	// 1: the kite table
+	// * url is containing the kite's register url
+	// * id is going to be kites' unique id. We are adding it as a primary key
+	// so each kite with the full path can only exist once.
+	// * created_at and updated_at are updated at creation and updating (like
+	//  if the URL has changed)
+	func(schema string) []string {
+		return []string{
+			`CREATE TABLE IF NOT EXISTS ` + schema + `.kite (
+				username text NOT NULL,
+				environment text NOT NULL,
+				kitename text NOT NULL,
+				version text NOT NULL,
+				region text NOT NULL,
+				hostname text NOT NULL,
+				id uuid PRIMARY KEY,
+				url text NOT NULL,
+				created_at timestamptz NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC'),
+				updated_at timestamptz NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC')
+			)`,
+			`CREATE INDEX IF NOT EXISTS kite_updated_at_btree_idx ON ` + schema + `.kite USING BTREE(updated_at)`,
+		}
+	},
+
+	// 2: expire_at is set for kites that are registered with their own TTL
+	func(schema string) []string {
+		return []string{
+			`ALTER TABLE ` + schema + `.kite ADD COLUMN IF NOT EXISTS expire_at timestamptz`,
+		}
+	},
+
+	// 3: capabilities are queried with the @> operator, which is supported
+	// by the GIN index
+	func(schema string) []string {
+		return []string{
+			`ALTER TABLE ` + schema + `.kite ADD COLUMN IF NOT EXISTS capabilities text[] NOT NULL DEFAULT '{}'`,
+			`CREATE INDEX IF NOT EXISTS kite_capabilities_gin_idx ON ` + schema + `.kite USING GIN(capabilities)`,
+		}
+	},
+
+	// 4: the kite_notify trigger notifies the listeners of Watch about the
+	// added and deleted kites. Updates are not notified, they are just
+	// heartbeats. The function sending the rows is replaced by 9.
+	func(schema string) []string {
+		return []string{
+			fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s.kite_notify() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		PERFORM pg_notify('%s', TG_OP || ' ' || row_to_json(OLD)::text);
+		RETURN OLD;
+	END IF;
+
+	PERFORM pg_notify('%[2]s', TG_OP || ' ' || row_to_json(NEW)::text);
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql`, schema, notifyChannel),
+			`DROP TRIGGER IF EXISTS kite_notify ON ` + schema + `.kite`,
+			`CREATE TRIGGER kite_notify AFTER INSERT OR DELETE ON ` + schema + `.kite` +
+				` FOR EACH ROW EXECUTE PROCEDURE ` + schema + `.kite_notify()`,
+		}
+	},
+
+	// 5: urls are the alternate URLs of the kite as a JSON array, it's NULL
+	// for the kites registered with a single URL
+	func(schema string) []string {
+		return []string{
+			`ALTER TABLE ` + schema + `.kite ADD COLUMN IF NOT EXISTS urls jsonb`,
+		}
+	},
+
+	// 6: weight is the weight the kite is registered with, 0 being the
+	// default weight
+	func(schema string) []string {
+		return []string{
+			`ALTER TABLE ` + schema + `.kite ADD COLUMN IF NOT EXISTS weight double precision NOT NULL DEFAULT 0`,
+		}
+	},
+
+	// 7: tags are queried with the @> and && operators, both are supported
+	// by the GIN index
+	func(schema string) []string {
+		return []string{
+			`ALTER TABLE ` + schema + `.kite ADD COLUMN IF NOT EXISTS tags text[] NOT NULL DEFAULT '{}'`,
+			`CREATE INDEX IF NOT EXISTS kite_tags_gin_idx ON ` + schema + `.kite USING GIN(tags)`,
+		}
+	},
+
+	// 8: claimed_by is the claimant of the kite, the claim is valid until
+	// claim_expires_at, see Postgres.Claim
+	func(schema string) []string {
+		return []string{
+			`ALTER TABLE ` + schema + `.kite ADD COLUMN IF NOT EXISTS claimed_by text`,
+			`ALTER TABLE ` + schema + `.kite ADD COLUMN IF NOT EXISTS claim_expires_at timestamp`,
+		}
+	},
+
+	// 9: the kite_notify trigger sends only the ids of the kites, the rows
+	// may exceed the size limit of the notifications
+	func(schema string) []string {
+		return []string{
+			fmt.Sprintf(notifyFunction, schema, notifyChannel),
+		}
+	},
+
+	// 10: the revoked kite keys and tokens, see Postgres.Revoke
+	func(schema string) []string {
+		return []string{
+			`CREATE TABLE IF NOT EXISTS ` + schema + `.kite_revocation (
+				claim text NOT NULL,
+				value text NOT NULL,
+				expires_at timestamp,
+				PRIMARY KEY (claim, value)
+			)`,
+		}
+	},
+}
+
+// migrate creates the given schema and applies the migrations that are not
+// applied yet. The applied version is stored in the kite_schema_version
+// table. The migrations are run in a single transaction holding a lock on
+// that table, so kontrol instances started at the same time don't run them
+// concurrently.
+func migrate(db *sql.DB, schema string, log kite.Logger) error {
+	if _, err := db.Exec(`CREATE SCHEMA IF NOT EXISTS ` + schema); err != nil {
+		return err
+	}
+
+	versionTable := schema + ".kite_schema_version"
+
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + versionTable + ` (version integer NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`LOCK TABLE ` + versionTable + ` IN EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+
+	var current int
+	err = tx.QueryRow(`SELECT version FROM ` + versionTable).Scan(&current)
+	switch {
+	case err == sql.ErrNoRows:
+		if _, err := tx.Exec(`INSERT INTO ` + versionTable + ` (version) VALUES (0)`); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	}
+
+	if current > len(migrations) {
+		return fmt.Errorf("postgres: schema version %d is newer than the latest known version %d",
+			current, len(migrations))
+	}
+
+	if current == len(migrations) {
+		return tx.Commit()
+	}
+
+	for i, step := range migrations[current:] {
+		for _, stmt := range step(schema) {
+			if _, err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("postgres: migration %d: %s", current+i+1, err)
+			}
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE `+versionTable+` SET version = $1`, len(migrations)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Info("postgres: migrated schema %s from version %d to %d", schema, current, len(migrations))
+	return nil
+}
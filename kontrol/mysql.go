@@ -0,0 +1,339 @@
+package kontrol
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/hashicorp/go-version"
+	sq "github.com/lann/squirrel"
+
+	"github.com/koding/kite"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+// MySQLConfig holds MySQL database related configuration
+type MySQLConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	DBName   string
+}
+
+// MySQL implements the Storage interface with a MySQL database
+type MySQL struct {
+	DB  *sql.DB
+	Log kite.Logger
+
+	// expire is the duration after which a kite that isn't updated is
+	// deleted by the cleaner.
+	expire time.Duration
+
+	// closeC stops the cleaner once closed
+	closeC    chan struct{}
+	closeOnce sync.Once
+}
+
+var (
+	_ Storage          = (*MySQL)(nil)
+	_ ConstraintGetter = (*MySQL)(nil)
+)
+
+// mysqlErrDupFieldName is the error number of adding a column that exists
+const mysqlErrDupFieldName = 1060
+
+func NewMySQL(conf *MySQLConfig, log kite.Logger) *MySQL {
+	if conf == nil {
+		conf = &MySQLConfig{}
+	}
+
+	if conf.Port == 0 {
+		conf.Port = 3306
+	}
+
+	if conf.Host == "" {
+		conf.Host = "localhost"
+	}
+
+	if conf.DBName == "" {
+		conf.DBName = os.Getenv("KONTROL_MYSQL_DBNAME")
+		if conf.DBName == "" {
+			panic("db name is not set for mysql kontrol storage")
+		}
+	}
+
+	if conf.Username == "" {
+		conf.Username = os.Getenv("KONTROL_MYSQL_USERNAME")
+		if conf.Username == "" {
+			panic("username is not set for mysql kontrol storage")
+		}
+	}
+
+	// parseTime is needed to scan DATETIME columns into time.Time
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true&loc=UTC",
+		conf.Username, conf.Password, conf.Host, conf.Port, conf.DBName)
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		panic(err)
+	}
+
+	// create our initial kite table. The columns are the same as in the
+	// Postgres storage. The timestamps are stored in UTC.
+	table := `CREATE TABLE IF NOT EXISTS kite (
+		username VARCHAR(255) NOT NULL,
+		environment VARCHAR(255) NOT NULL,
+		kitename VARCHAR(255) NOT NULL,
+		version VARCHAR(255) NOT NULL,
+		region VARCHAR(255) NOT NULL,
+		hostname VARCHAR(255) NOT NULL,
+		id CHAR(36) PRIMARY KEY,
+		url TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		expire_at DATETIME NULL,
+		urls TEXT NULL,
+		weight DOUBLE NOT NULL DEFAULT 0,
+		tags TEXT NULL,
+		INDEX kite_updated_at_idx (updated_at),
+		INDEX kite_query_idx (username, environment, kitename)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8`
+
+	if _, err := db.Exec(table); err != nil {
+		panic(err)
+	}
+
+	// the tables created before the alternate URLs, the weights and the
+	// tags were stored don't have their columns yet. The tags are stored in
+	// the format of the Postgres arrays, so the kites are scanned the same.
+	for _, column := range []string{"urls TEXT NULL", "weight DOUBLE NOT NULL DEFAULT 0", "tags TEXT NULL"} {
+		_, err = db.Exec(`ALTER TABLE kite ADD COLUMN ` + column)
+		if err != nil {
+			if e, ok := err.(*mysql.MySQLError); !ok || e.Number != mysqlErrDupFieldName {
+				panic(err)
+			}
+		}
+	}
+
+	cleanInterval := 30 * time.Second  // clean every 30 second
+	expireInterval := 20 * time.Second // clean rows that are 20 second old
+
+	m := &MySQL{
+		DB:     db,
+		Log:    log,
+		expire: expireInterval,
+		closeC: make(chan struct{}),
+	}
+
+	go m.RunCleaner(cleanInterval, expireInterval)
+
+	return m
+}
+
+// RunCleaner deletes every "interval" duration rows which are older than
+// "expire" duration based on the "updated_at" field.
+func (m *MySQL) RunCleaner(interval, expire time.Duration) {
+	cleanFunc := func() {
+		affectedRows, err := m.CleanExpiredRows(expire)
+		if err != nil {
+			m.Log.Warning("mysql: cleaning old rows failed: %s", err)
+		} else if affectedRows != 0 {
+			m.Log.Info("mysql: cleaned up %d rows", affectedRows)
+		}
+	}
+
+	cleanFunc() // run for the first time
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cleanFunc()
+		case <-m.closeC:
+			return
+		}
+	}
+}
+
+// CleanExpiredRows deletes rows that are at least "expire" duration old.
+// Rows of kites that are registered with their own TTL are deleted once
+// their expire_at time has passed.
+func (m *MySQL) CleanExpiredRows(expire time.Duration) (int64, error) {
+	cleanOldRows := `DELETE FROM kite WHERE
+	(expire_at IS NOT NULL AND expire_at < UTC_TIMESTAMP()) OR
+	(expire_at IS NULL AND updated_at < DATE_SUB(UTC_TIMESTAMP(), INTERVAL ? SECOND))`
+
+	rows, err := m.DB.Exec(cleanOldRows, int64(expire/time.Second))
+	if err != nil {
+		return 0, err
+	}
+
+	return rows.RowsAffected()
+}
+
+// ExpireInterval returns the duration after which a kite that isn't updated
+// is removed from the storage.
+func (m *MySQL) ExpireInterval() time.Duration {
+	return m.expire
+}
+
+// Count returns the number of kites in the storage.
+func (m *MySQL) Count() (int64, error) {
+	var count int64
+	err := m.DB.QueryRow(`SELECT COUNT(*) FROM kite`).Scan(&count)
+	return count, err
+}
+
+// Close stops the cleaner and closes the database connection.
+func (m *MySQL) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closeC)
+	})
+
+	return m.DB.Close()
+}
+
+func (m *MySQL) Get(query *protocol.KontrolQuery) (Kites, error) {
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		// version is a malformed, just return the error
+		return nil, err
+	}
+
+	return m.GetWithConstraint(query, constraint)
+}
+
+// GetWithConstraint retrieves the kites with the given query. If constraint
+// is not nil, it's used instead of the version field of the query.
+func (m *MySQL) GetWithConstraint(query *protocol.KontrolQuery, constraint version.Constraints) (Kites, error) {
+	if len(query.Capabilities) != 0 {
+		return nil, ErrCapabilitiesNotSupported
+	}
+
+	if hasTagQuery(query) {
+		return nil, ErrTagsNotSupported
+	}
+
+	result, err := getKites(m.DB.Query, sq.StatementBuilder, "kite", query, nil, constraint, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Kites, nil
+}
+
+func (m *MySQL) Add(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	// check that the incoming URL is valid to prevent malformed input
+	_, err := url.Parse(value.URL)
+	if err != nil {
+		return err
+	}
+
+	sqlQuery, args, err := mysqlInsertQuery(kiteProt, value)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.Exec(sqlQuery, args...)
+	return err
+}
+
+func (m *MySQL) Update(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	// check that the incoming url is valid to prevent malformed input
+	_, err := url.Parse(value.URL)
+	if err != nil {
+		return err
+	}
+
+	ttl := ttlSeconds(value)
+	_, err = m.DB.Exec(`UPDATE kite SET url = ?, updated_at = UTC_TIMESTAMP(),
+	expire_at = CASE WHEN ? > 0 THEN DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND) ELSE NULL END,
+	urls = ?, weight = ?, tags = ?
+	WHERE id = ?`, value.URL, ttl, ttl, urlsJSON(value), value.Weight, textArray(value.Tags), kiteProt.ID)
+
+	return err
+}
+
+// Upsert inserts the kite or updates its value if it already exists, in a
+// single statement.
+func (m *MySQL) Upsert(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	// check that the incoming URL is valid to prevent malformed input
+	_, err := url.Parse(value.URL)
+	if err != nil {
+		return err
+	}
+
+	sqlQuery, args, err := mysqlInsertQuery(kiteProt, value)
+	if err != nil {
+		return err
+	}
+
+	sqlQuery += ` ON DUPLICATE KEY UPDATE url = VALUES(url),
+	updated_at = VALUES(updated_at), expire_at = VALUES(expire_at), urls = VALUES(urls),
+	weight = VALUES(weight), tags = VALUES(tags)`
+
+	_, err = m.DB.Exec(sqlQuery, args...)
+	return err
+}
+
+func (m *MySQL) Delete(kiteProt *protocol.Kite) error {
+	_, err := m.DB.Exec(`DELETE FROM kite WHERE id = ?`, kiteProt.ID)
+	return err
+}
+
+// mysqlInsertQuery returns the INSERT statement for the given kite.
+func mysqlInsertQuery(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) (string, []interface{}, error) {
+	if kiteProt.ID == "" {
+		return "", nil, errors.New("empty kite id")
+	}
+
+	kiteValues := kiteProt.Values()
+	values := make([]interface{}, len(kiteValues))
+
+	for i, kiteVal := range kiteValues {
+		values[i] = kiteVal
+	}
+
+	// kites without their own TTL are expired by the cleaner's expire
+	// interval, which is denoted with a NULL expire_at.
+	var expireAt interface{}
+	if ttl := ttlSeconds(value); ttl > 0 {
+		expireAt = sq.Expr("DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND)", ttl)
+	}
+
+	values = append(values,
+		value.URL,
+		sq.Expr("UTC_TIMESTAMP()"),
+		sq.Expr("UTC_TIMESTAMP()"),
+		expireAt,
+		urlsJSON(value),
+		value.Weight,
+		textArray(value.Tags),
+	)
+
+	return sq.StatementBuilder.Insert("kite").Columns(
+		"username",
+		"environment",
+		"kitename",
+		"version",
+		"region",
+		"hostname",
+		"id",
+		"url",
+		"created_at",
+		"updated_at",
+		"expire_at",
+		"urls",
+		"weight",
+		"tags",
+	).Values(values...).ToSql()
+}
@@ -52,14 +52,18 @@ func (n *Node) Kite() (*protocol.KiteWithToken, error) {
 		return nil, err
 	}
 
-	url, err := n.Value()
+	value, err := n.registerValue()
 	if err != nil {
 		return nil, err
 	}
 
 	return &protocol.KiteWithToken{
 		Kite: *kite,
-		URL:  url,
+		URL:  value.URL,
+		URLs: value.URLs,
+
+		Weight: value.Weight,
+		Tags:   value.Tags,
 	}, nil
 }
 
@@ -85,8 +89,7 @@ func (n *Node) KiteFromKey() (*protocol.Kite, error) {
 
 // Value returns the value associated with the current node.
 func (n *Node) Value() (string, error) {
-	var rv kontrolprotocol.RegisterValue
-	err := json.Unmarshal([]byte(n.Node.Value), &rv)
+	rv, err := n.registerValue()
 	if err != nil {
 		return "", err
 	}
@@ -94,6 +97,16 @@ func (n *Node) Value() (string, error) {
 	return rv.URL, nil
 }
 
+// registerValue returns the decoded value of the current node.
+func (n *Node) registerValue() (*kontrolprotocol.RegisterValue, error) {
+	var rv kontrolprotocol.RegisterValue
+	if err := json.Unmarshal([]byte(n.Node.Value), &rv); err != nil {
+		return nil, err
+	}
+
+	return &rv, nil
+}
+
 // Kites returns a list of kites that are gathered by collecting recursively
 // all nodes under the current node.
 func (n *Node) Kites() (Kites, error) {
@@ -0,0 +1,250 @@
+package kontrol
+
+import (
+	"strings"
+	"time"
+
+	"github.com/koding/kite/protocol"
+	"github.com/lib/pq"
+)
+
+// notifyChannel is the channel the kite_notify trigger sends the
+// notifications on.
+const notifyChannel = "kite"
+
+// notifyFunction is the trigger function that notifies about the added and
+// deleted kites. The payload is the operation followed by the id of the
+// kite, like: INSERT 2ba5b5ad-3d3d-4b1f-5d5b-12ea8ab1a5b2. The rows are not
+// sent, they may exceed the 8000 bytes limit of the payloads. The schema and
+// the channel need to be formatted into it.
+const notifyFunction = `CREATE OR REPLACE FUNCTION %s.kite_notify() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		PERFORM pg_notify('%s', TG_OP || ' ' || OLD.id::text);
+		RETURN OLD;
+	END IF;
+
+	PERFORM pg_notify('%[2]s', TG_OP || ' ' || NEW.id::text);
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql`
+
+const (
+	// minReconnectInterval and maxReconnectInterval define the exponential
+	// backoff of the listener when the connection to the database is lost.
+	minReconnectInterval = time.Second
+	maxReconnectInterval = time.Minute
+
+	// pingInterval is the interval the listener's connection is checked if
+	// there are no notifications, so a dead connection is detected.
+	pingInterval = 90 * time.Second
+)
+
+// Watch returns a channel of the kites added to and deleted from the storage
+// by any kontrol instance using the same database. The listener reconnects
+// with an exponential backoff if the connection is lost. The notifications
+// sent in between are lost, therefore an event with the protocol.Resync
+// action is sent after a reconnect. Consumers must treat it as "re-read
+// everything" with Get. The channel is closed when the storage is closed.
+func (p *Postgres) Watch() (<-chan *StorageEvent, error) {
+	conn, notify, err := p.listen()
+	if err != nil {
+		return nil, err
+	}
+
+	// the deleted rows can't be read, their kites are known by their ids
+	known, err := p.watchedKites()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	events := make(chan *StorageEvent, 100)
+	go p.watch(conn, notify, known, events)
+
+	return events, nil
+}
+
+// listen opens a connection listening for the notifications of the
+// kite_notify trigger. The connection string is built each time, so the
+// credentials changed by Reconnect or rotated in the PasswordFile are used.
+func (p *Postgres) listen() (*pq.ListenerConn, <-chan *pq.Notification, error) {
+	p.dbMu.RLock()
+	connString, err := postgresConnString(p.conf)
+	p.dbMu.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notify := make(chan *pq.Notification, 32)
+
+	conn, err := pq.NewListenerConn(connString, notify)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := conn.Listen(notifyChannel); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, notify, nil
+}
+
+// relisten opens a new listening connection, retrying with an exponential
+// backoff until it succeeds. It returns a nil connection if the storage is
+// closed in the meantime.
+func (p *Postgres) relisten() (*pq.ListenerConn, <-chan *pq.Notification, map[string]protocol.Kite) {
+	interval := minReconnectInterval
+
+	for {
+		select {
+		case <-time.After(interval):
+		case <-p.closeC:
+			return nil, nil, nil
+		}
+
+		conn, notify, err := p.listen()
+		if err == nil {
+			known, err := p.watchedKites()
+			if err == nil {
+				return conn, notify, known
+			}
+
+			conn.Close()
+		}
+
+		p.Log.Warning("postgres: listener reconnect failed: %s", err)
+
+		if interval *= 2; interval > maxReconnectInterval {
+			interval = maxReconnectInterval
+		}
+	}
+}
+
+// watchedKites returns the kites in the storage by their ids.
+func (p *Postgres) watchedKites() (map[string]protocol.Kite, error) {
+	known := make(map[string]protocol.Kite)
+
+	err := p.Each(&protocol.KontrolQuery{}, func(k *protocol.KiteWithToken) error {
+		known[k.Kite.ID] = k.Kite
+		return nil
+	})
+
+	return known, err
+}
+
+func (p *Postgres) watch(conn *pq.ListenerConn, notify <-chan *pq.Notification, known map[string]protocol.Kite, events chan<- *StorageEvent) {
+	defer close(events)
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	send := func(e *StorageEvent) bool {
+		select {
+		case events <- e:
+			return true
+		case <-p.closeC:
+			return false
+		}
+	}
+
+	for {
+		select {
+		case n, ok := <-notify:
+			// the channel is closed when the connection is lost,
+			// anything might have happened until it's re-established.
+			if !ok {
+				p.Log.Warning("postgres: listener disconnected: %s", conn.Err())
+				conn.Close()
+
+				if conn, notify, known = p.relisten(); conn == nil {
+					return
+				}
+
+				p.Log.Info("postgres: listener reconnected")
+
+				if !send(&StorageEvent{Action: protocol.Resync}) {
+					return
+				}
+				continue
+			}
+
+			action, id, err := parseNotification(n.Extra)
+			if err != nil {
+				p.Log.Warning("postgres: invalid notification %q: %s", n.Extra, err)
+				continue
+			}
+
+			e, err := p.notificationEvent(action, id, known)
+			if err != nil {
+				p.Log.Warning("postgres: cannot read the kite of notification %q: %s", n.Extra, err)
+				continue
+			}
+
+			if e != nil && !send(e) {
+				return
+			}
+		case <-time.After(pingInterval):
+			// a failed ping closes the connection, which closes notify
+			go func(conn *pq.ListenerConn) {
+				if err := conn.Ping(); err != nil {
+					conn.Close()
+				}
+			}(conn)
+		case <-p.closeC:
+			return
+		}
+	}
+}
+
+// notificationEvent returns the event of a notification. The added kites are
+// read from the storage, the deleted ones are taken from the known kites. It
+// returns nil if there is nothing to send, like for a kite that is deleted
+// before it's read.
+func (p *Postgres) notificationEvent(action protocol.KiteAction, id string, known map[string]protocol.Kite) (*StorageEvent, error) {
+	if action == protocol.Deregister {
+		k, ok := known[id]
+		if !ok {
+			return nil, nil
+		}
+
+		delete(known, id)
+		return &StorageEvent{Action: action, Kite: k}, nil
+	}
+
+	var e *StorageEvent
+	err := p.Each(&protocol.KontrolQuery{ID: id}, func(k *protocol.KiteWithToken) error {
+		known[id] = k.Kite
+		e = &StorageEvent{
+			Action:       action,
+			Kite:         k.Kite,
+			URL:          k.URL,
+			Capabilities: k.Capabilities,
+			Tags:         k.Tags,
+		}
+		return nil
+	})
+
+	return e, err
+}
+
+// parseNotification parses the payload sent by the kite_notify trigger. It
+// returns the action and the id of the kite.
+func parseNotification(payload string) (protocol.KiteAction, string, error) {
+	parts := strings.SplitN(payload, " ", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", errInvalidNotification
+	}
+
+	switch parts[0] {
+	case "INSERT":
+		return protocol.Register, parts[1], nil
+	case "DELETE":
+		return protocol.Deregister, parts[1], nil
+	}
+
+	return "", "", errInvalidNotification
+}
@@ -1,12 +1,19 @@
 package kontrol
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/go-version"
@@ -16,6 +23,7 @@ import (
 	"github.com/koding/kite"
 	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
 	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/utils"
 )
 
 // Postgres holds Postgresql database related configuration
@@ -25,18 +33,278 @@ type PostgresConfig struct {
 	Username string
 	Password string
 	DBName   string
+
+	// UsernameFile and PasswordFile are the files the username and the
+	// password are read from, like the mounted secrets of Kubernetes. They
+	// are read every time the connection is opened, so Reconnect picks up
+	// the rotated credentials. Username and Password are used if they are
+	// empty.
+	UsernameFile string
+	PasswordFile string
+
+	// SSLMode is the sslmode of the connection, like "require" or
+	// "verify-full". Defaults to "disable".
+	SSLMode string
+
+	// SSLRootCert is the file of the root certificates the server's
+	// certificate is verified with.
+	SSLRootCert string
+
+	// SSLCert and SSLKey are the files of the client certificate and its
+	// key, for servers requiring clients to authenticate with a
+	// certificate. Both must be set together.
+	SSLCert string
+	SSLKey  string
+
+	// Schema is the schema of the kite table. It's created if it doesn't
+	// exist and is used as the connection's search_path. Defaults to
+	// "public".
+	Schema string
+
+	// ApplicationName is reported to the server, so kontrol's connections
+	// can be identified in pg_stat_activity. Defaults to "kontrol".
+	ApplicationName string
+
+	// SlowQueryThreshold enables logging the queries that take longer than
+	// the given duration. Zero disables it.
+	SlowQueryThreshold time.Duration
+
+	// MaxResults is the maximum number of kites a single Get can return.
+	// ErrTooManyResults is returned for queries matching more kites, so a
+	// broad query can't exhaust kontrol's memory. Zero means unlimited.
+	MaxResults int
+
+	// CleanerJitter randomizes the interval of the cleaner by the given
+	// fraction, like 0.1 for ±10%, so the cleaners of many kontrol instances
+	// don't hit the database at the same time. The first run is delayed by a
+	// random duration too. Zero disables it.
+	CleanerJitter float64
+
+	// ReadOnly prevents kontrol from modifying the database, like a standby
+	// that serves only discovery. The table isn't created, the cleaner isn't
+	// run and the methods that modify the storage return ErrReadOnly.
+	ReadOnly bool
+
+	// DriverName is the name of the database/sql driver, defaults to
+	// "postgres" of lib/pq. The driver needs to be imported by the caller,
+	// like "pgx" of github.com/jackc/pgx/stdlib. The connection string is in
+	// the key=value format, which is accepted by both drivers. Watch always
+	// uses lib/pq, because it needs the LISTEN support of it.
+	DriverName string
+
+	// PrepareStatements caches the prepared statements of the queries run
+	// by Get, Update and Delete, so the server doesn't parse and plan them
+	// again for every call. The statements are prepared lazily, the first
+	// time a query is run. Compare BenchmarkPostgresGet and
+	// BenchmarkPostgresGetPrepared to see the difference for a workload.
+	PrepareStatements bool
+
+	// DefaultRegion is set as the region of the kites added with an empty
+	// region. The hostnames are not defaulted, the kites set their own, see
+	// kite.Kite.Kite.
+	DefaultRegion string
+
+	// Clock is used for the scheduling of the cleaner and Maintain. Defaults
+	// to the real time, tests can replace it to control the time. The
+	// expiration of kites is computed by the database with now(), unless
+	// ClockInSQL is set.
+	Clock Clock
+
+	// ClockInSQL makes the statements use the time of Clock instead of the
+	// database's now(), so the tests can add a kite in the past and check
+	// that it's expired without waiting. It's meant for the tests only, the
+	// statements aren't prepared with it.
+	ClockInSQL bool
+
+	// DisableCleaner doesn't start the cleaner, which deletes the expired
+	// kites in the background. They can be deleted with CleanExpiredRows
+	// or RunCleaner instead, like when the cleaner is run by another
+	// process or by the tests. A read-only storage never starts it.
+	DisableCleaner bool
+
+	// CleanerLeaderElection runs the cleaner only on the kontrol instance
+	// holding a Postgres advisory lock of the schema, the others stand by
+	// and take over once the lock is released, like when the leader is
+	// stopped or loses its connection. Without it, every instance cleans
+	// the same rows.
+	CleanerLeaderElection bool
+
+	// EncryptedColumns are encrypted with AES-GCM and EncryptionKey before
+	// they are stored, and decrypted when the kites are read. Only "urls"
+	// and "tags" can be encrypted, the key must be 16, 24 or 32 bytes long.
+	// The kites can't be queried by encrypted tags. The existing rows are
+	// encrypted once they are updated.
+	EncryptedColumns []string
+	EncryptionKey    []byte
 }
 
 type Postgres struct {
+	// DB is the database handle. It's replaced by Reconnect, so it should
+	// only be accessed directly if Reconnect is not used.
 	DB  *sql.DB
 	Log kite.Logger
+
+	// dbMu protects DB, conf and stmts while they are swapped by
+	// Reconnect. The conf is used to connect the listener of Watch. It's
+	// held for reading while the statements are used, so they aren't closed
+	// under the running queries.
+	dbMu sync.RWMutex
+	conf *PostgresConfig
+
+	// schema of the kite table, it can't be changed by Reconnect
+	schema string
+
+	// table is the schema qualified name of the kite table
+	table string
+
+	// revocationTable is the schema qualified name of the table of the
+	// revocations
+	revocationTable string
+
+	// expire is the duration after which a kite that isn't updated is
+	// deleted by the cleaner.
+	expire time.Duration
+
+	// jitter is the fraction the cleaner's interval is randomized by
+	jitter float64
+
+	// maxResults is the maximum number of kites returned by Get
+	maxResults int
+
+	// slowQuery is the threshold for logging slow queries
+	slowQuery time.Duration
+
+	stats *QueryStats
+
+	// readOnly disables the methods modifying the storage
+	readOnly bool
+
+	// defaultRegion is set for the kites added without a region
+	defaultRegion string
+
+	clock Clock
+
+	// clockInSQL replaces now() in the statements with the time of clock
+	clockInSQL bool
+
+	// stmts caches the prepared statements by their query. It's nil if
+	// PrepareStatements is not set. The statements are bound to the table,
+	// which can't be changed, and the database handle, which is replaced by
+	// Reconnect, so Reconnect clears them while holding dbMu. stmtsMu
+	// serializes the queries preparing them while dbMu is held for reading.
+	stmtsMu sync.Mutex
+	stmts   map[string]*sql.Stmt
+
+	// cleaner statistics, updated atomically
+	cleanerRuns int64
+	cleanedRows int64
+
+	// cleanerStarted is 1 once RunCleaner is called, so the cleaner isn't
+	// run twice
+	cleanerStarted int32
+
+	// cleanerLock elects the instance running the cleaner, it's nil if
+	// CleanerLeaderElection is not set
+	cleanerLock *advisoryLock
+
+	// cipher encrypts the EncryptedColumns, it's nil if there are none
+	cipher *columnCipher
+
+	// closeC stops the cleaner once closed
+	closeC    chan struct{}
+	closeOnce sync.Once
 }
 
+var (
+	_ Storage          = (*Postgres)(nil)
+	_ ConstraintGetter = (*Postgres)(nil)
+	_ StorageWatcher   = (*Postgres)(nil)
+	_ ContextGetter    = (*Postgres)(nil)
+
+	_ RevocationStorage = (*Postgres)(nil)
+)
+
+// NewPostgres connects to the database of the config and migrates the kite
+// table, unless the config is ReadOnly. It panics on errors. Postgres 9.6 or
+// newer is required, see migrations.
 func NewPostgres(conf *PostgresConfig, log kite.Logger) *Postgres {
 	if conf == nil {
 		conf = &PostgresConfig{}
 	}
 
+	connString, err := postgresConnString(conf)
+	if err != nil {
+		panic(err)
+	}
+
+	cipher, err := newColumnCipher(conf.EncryptionKey, conf.EncryptedColumns)
+	if err != nil {
+		panic(fmt.Errorf("postgres kontrol storage: %s", err))
+	}
+
+	db, err := sql.Open(conf.DriverName, connString)
+	if err != nil {
+		panic(err)
+	}
+
+	// a read-only kontrol must not modify the database, the table is
+	// expected to be created and migrated by the primary
+	if !conf.ReadOnly {
+		if err := migrate(db, conf.Schema, log); err != nil {
+			panic(err)
+		}
+	}
+
+	kiteTable := conf.Schema + ".kite"
+
+	cleanInterval := 30 * time.Second  // clean every 30 second
+	expireInterval := 20 * time.Second // clean rows that are 20 second old
+
+	p := &Postgres{
+		DB:         db,
+		conf:       conf,
+		schema:     conf.Schema,
+		Log:        log,
+		table:      kiteTable,
+		expire:     expireInterval,
+		jitter:     conf.CleanerJitter,
+		maxResults: conf.MaxResults,
+		slowQuery:  conf.SlowQueryThreshold,
+		stats:      newQueryStats(),
+		readOnly:   conf.ReadOnly,
+		closeC:     make(chan struct{}),
+
+		defaultRegion: conf.DefaultRegion,
+		clock:         conf.Clock,
+		clockInSQL:    conf.ClockInSQL,
+		cipher:        cipher,
+
+		revocationTable: conf.Schema + ".kite_revocation",
+	}
+
+	if p.clock == nil {
+		p.clock = realClock{}
+	}
+
+	// the statements with the time of the clock are all different
+	if conf.PrepareStatements && !conf.ClockInSQL {
+		p.stmts = make(map[string]*sql.Stmt)
+	}
+
+	if conf.CleanerLeaderElection {
+		p.cleanerLock = newAdvisoryLock("kontrol-cleaner:" + conf.Schema)
+	}
+
+	if !p.readOnly && !conf.DisableCleaner {
+		go p.RunCleaner(cleanInterval, expireInterval)
+	}
+
+	return p
+}
+
+// postgresConnString applies the defaults to the config and returns the
+// connection string for it.
+func postgresConnString(conf *PostgresConfig) (string, error) {
 	if conf.Port == 0 {
 		conf.Port = 5432
 	}
@@ -45,110 +313,449 @@ func NewPostgres(conf *PostgresConfig, log kite.Logger) *Postgres {
 		conf.Host = "localhost"
 	}
 
+	if conf.ApplicationName == "" {
+		conf.ApplicationName = "kontrol"
+	}
+
+	if conf.DriverName == "" {
+		conf.DriverName = "postgres"
+	}
+
+	if conf.Schema == "" {
+		conf.Schema = "public"
+	}
+
+	// the schema is interpolated into the statements, only allow plain
+	// identifiers
+	if !validIdentifier.MatchString(conf.Schema) {
+		return "", fmt.Errorf("invalid schema name for postgres kontrol storage: %q", conf.Schema)
+	}
+
 	if conf.DBName == "" {
 		conf.DBName = os.Getenv("KONTROL_POSTGRES_DBNAME")
 		if conf.DBName == "" {
-			panic("db name is not set for postgres kontrol storage")
+			return "", errors.New("db name is not set for postgres kontrol storage")
+		}
+	}
+
+	if conf.SSLMode == "" {
+		conf.SSLMode = "disable"
+	}
+
+	if (conf.SSLCert == "") != (conf.SSLKey == "") {
+		return "", errors.New("both ssl cert and key must be set for postgres kontrol storage")
+	}
+
+	// check the files now, otherwise the errors are only seen on the first
+	// query
+	for _, file := range []string{conf.SSLRootCert, conf.SSLCert, conf.SSLKey} {
+		if file == "" {
+			continue
 		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return "", fmt.Errorf("postgres kontrol storage: %s", err)
+		}
+		f.Close()
 	}
 
 	connString := fmt.Sprintf(
-		"host=%s port=%d dbname=%s sslmode=disable",
-		conf.Host, conf.Port, conf.DBName,
+		"host=%s port=%d dbname=%s sslmode=%s",
+		conf.Host, conf.Port, conf.DBName, conf.SSLMode,
 	)
 
-	if conf.Password != "" {
-		connString += " password=" + conf.Password
+	if conf.SSLRootCert != "" {
+		connString += " sslrootcert=" + quoteConnValue(conf.SSLRootCert)
+	}
+
+	if conf.SSLCert != "" {
+		connString += " sslcert=" + quoteConnValue(conf.SSLCert)
+		connString += " sslkey=" + quoteConnValue(conf.SSLKey)
+	}
+
+	password := conf.Password
+	if conf.PasswordFile != "" {
+		var err error
+		if password, err = readSecretFile(conf.PasswordFile); err != nil {
+			return "", err
+		}
+	}
+
+	if password != "" {
+		connString += " password=" + quoteConnValue(password)
 	}
 
-	if conf.Username == "" {
+	username := conf.Username
+	if conf.UsernameFile != "" {
+		var err error
+		if username, err = readSecretFile(conf.UsernameFile); err != nil {
+			return "", err
+		}
+	}
+
+	if username == "" {
 		conf.Username = os.Getenv("KONTROL_POSTGRES_USERNAME")
 		if conf.Username == "" {
-			panic("username is not set for postgres kontrol storage")
+			return "", errors.New("username is not set for postgres kontrol storage")
 		}
+		username = conf.Username
+	}
+
+	connString += " user=" + quoteConnValue(username)
+	connString += " application_name=" + quoteConnValue(conf.ApplicationName)
+	connString += " search_path=" + conf.Schema
+
+	return connString, nil
+}
+
+// Reconnect opens a new connection with the given config and replaces the
+// current one, which is closed after its in-flight queries are finished.
+// It's used to rotate the credentials without restarting kontrol. The schema
+// of the kite table can't be changed.
+func (p *Postgres) Reconnect(conf *PostgresConfig) error {
+	if conf == nil {
+		conf = &PostgresConfig{}
 	}
 
-	connString += " user=" + conf.Username
+	if conf.Schema == "" {
+		conf.Schema = p.schema
+	}
+
+	if conf.Schema != p.schema {
+		return fmt.Errorf("postgres: schema can't be changed from %q to %q", p.schema, conf.Schema)
+	}
 
-	db, err := sql.Open("postgres", connString)
+	connString, err := postgresConnString(conf)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	// create our initial kite table
-	// * url is containing the kite's register url
-	// * id is going to be kites' unique id. We are adding it as a primary key
-	// so each kite with the full path can only exist once.
-	// * created_at and updated_at are updated at creation and updating (like
-	//  if the URL has changed)
-	table := `CREATE TABLE IF NOT EXISTS kite (
-		username text NOT NULL,
-		environment text NOT NULL,
-		kitename text NOT NULL,
-		version text NOT NULL,
-		region text NOT NULL,
-		hostname text NOT NULL,
-		id uuid PRIMARY KEY,
-		url text NOT NULL,
-		created_at timestamptz NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC'),
-		updated_at timestamptz NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC')
-	);`
-
-	if _, err := db.Exec(table); err != nil {
-		panic(err)
+	db, err := sql.Open(conf.DriverName, connString)
+	if err != nil {
+		return err
 	}
 
-	// We enable index on the kite and updated_at columns. We don't return on
-	// errors because the operator `IF NOT EXISTS` doesn't work for index
-	// creation, therefore we assume the indexes might be already created.
-	enableBtreeIndex := `CREATE INDEX kite_updated_at_btree_idx ON kite USING BTREE(updated_at)`
-	if _, err := db.Exec(enableBtreeIndex); err != nil {
-		log.Warning("postgres: enable btree index: %s", err)
+	// check the new credentials before replacing the working connection
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return err
 	}
 
-	p := &Postgres{
-		DB:  db,
-		Log: log,
+	old := p.setDB(db, conf)
+
+	p.Log.Info("postgres: reconnected to %s:%d", conf.Host, conf.Port)
+
+	// Close waits for the queries that have already started
+	return old.Close()
+}
+
+// setDB replaces the database handle and its config, and clears the prepared
+// statements of the old handle. It returns the old handle.
+func (p *Postgres) setDB(db *sql.DB, conf *PostgresConfig) *sql.DB {
+	p.dbMu.Lock()
+	defer p.dbMu.Unlock()
+
+	old := p.DB
+	p.DB = db
+	p.conf = conf
+	p.clearStmts()
+
+	return old
+}
+
+// logSlow logs the operation started at the given time if it took longer than
+// the slow query threshold. It's meant to be deferred.
+func (p *Postgres) logSlow(op string, start time.Time, detail string) {
+	if p.slowQuery == 0 {
+		return
 	}
 
-	cleanInterval := 30 * time.Second  // clean every 30 second
-	expireInterval := 20 * time.Second // clean rows that are 20 second old
-	go p.RunCleaner(cleanInterval, expireInterval)
+	if d := time.Since(start); d > p.slowQuery {
+		p.Log.Warning("postgres: slow query %s %s took %s", op, detail, d)
+	}
+}
 
-	return p
+// db returns the current database handle.
+func (p *Postgres) db() *sql.DB {
+	p.dbMu.RLock()
+	defer p.dbMu.RUnlock()
+	return p.DB
+}
+
+// validKiteID matches the UUIDs that are used as kite IDs, like
+// "2ba5b5ad-3d3d-4b1f-5d5b-12ea8ab1a5b2".
+var validKiteID = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// query runs the given query, with a prepared statement if PrepareStatements
+// is set.
+func (p *Postgres) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return p.queryContext(context.Background(), query, args...)
+}
+
+// queryContext is like query, the query is cancelled once ctx is done.
+func (p *Postgres) queryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	p.dbMu.RLock()
+	defer p.dbMu.RUnlock()
+
+	stmt, err := p.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if stmt == nil {
+		return p.DB.QueryContext(ctx, query, args...)
+	}
+
+	return stmt.QueryContext(ctx, args...)
+}
+
+// exec executes the given query, with a prepared statement if
+// PrepareStatements is set.
+func (p *Postgres) exec(query string, args ...interface{}) (sql.Result, error) {
+	p.dbMu.RLock()
+	defer p.dbMu.RUnlock()
+
+	stmt, err := p.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if stmt == nil {
+		return p.DB.Exec(query, args...)
+	}
+
+	return stmt.Exec(args...)
+}
+
+// stmt returns the cached prepared statement of the query and prepares it if
+// it's not cached yet. It returns nil if PrepareStatements is not set. dbMu
+// must be held for reading.
+func (p *Postgres) stmt(query string) (*sql.Stmt, error) {
+	p.stmtsMu.Lock()
+	defer p.stmtsMu.Unlock()
+
+	if p.stmts == nil {
+		return nil, nil
+	}
+
+	if stmt, ok := p.stmts[query]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := p.DB.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p.stmts[query] = stmt
+	return stmt, nil
+}
+
+// clearStmts closes and removes the cached prepared statements. dbMu must be
+// held for writing.
+func (p *Postgres) clearStmts() {
+	p.stmtsMu.Lock()
+	defer p.stmtsMu.Unlock()
+
+	if p.stmts == nil {
+		return
+	}
+
+	for query, stmt := range p.stmts {
+		stmt.Close()
+		delete(p.stmts, query)
+	}
+}
+
+// fillKiteID sets a new ID to the kite if its ID is empty. It's set on the
+// given kite, so the caller knows the ID the kite is stored with.
+func fillKiteID(kiteProt *protocol.Kite) {
+	if kiteProt.ID == "" {
+		kiteProt.ID = protocol.NewKiteID()
+	}
+}
+
+// validateKiteID returns an ErrInvalidKiteID error if the id can't be stored
+// in the uuid typed id column.
+func validateKiteID(id string) error {
+	if !validKiteID.MatchString(id) {
+		return &ErrInvalidKiteID{ID: id}
+	}
+
+	return nil
+}
+
+// validIdentifier matches the identifiers that can be safely interpolated into
+// SQL statements.
+var validIdentifier = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]{0,62}$`)
+
+// readSecretFile returns the content of the file without the trailing newline
+// the secrets are usually written with.
+func readSecretFile(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("postgres kontrol storage: %s", err)
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// quoteConnValue quotes the value to be used in a connection string, so it
+// can contain spaces and quotes.
+func quoteConnValue(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `'`, `\'`, -1)
+	return "'" + v + "'"
 }
 
 // RunCleaner delets every "interval" duration rows which are older than
 // "expire" duration based on the "updated_at" field. For more info check
-// CleanExpireRows which is used to delete old rows.
+// CleanExpireRows which is used to delete old rows. The interval is
+// randomized if a CleanerJitter is configured. With CleanerLeaderElection,
+// the rows are deleted only while the instance is the leader. It returns
+// right away if the cleaner of the storage is already running.
 func (p *Postgres) RunCleaner(interval, expire time.Duration) {
+	if !atomic.CompareAndSwapInt32(&p.cleanerStarted, 0, 1) {
+		p.Log.Warning("postgres: cleaner is already running")
+		return
+	}
+
 	cleanFunc := func() {
+		if !p.cleanerLeader() {
+			return
+		}
+
 		affectedRows, err := p.CleanExpiredRows(expire)
+		atomic.AddInt64(&p.cleanerRuns, 1)
 		if err != nil {
 			p.Log.Warning("postgres: cleaning old rows failed: %s", err)
 		} else if affectedRows != 0 {
+			atomic.AddInt64(&p.cleanedRows, affectedRows)
 			p.Log.Info("postgres: cleaned up %d rows", affectedRows)
 		}
 	}
 
+	// delay the first run randomly, so the cleaners of kontrol instances
+	// started at the same time are not aligned
+	if p.jitter > 0 {
+		select {
+		case <-p.clock.After(time.Duration(rand.Int63n(int64(interval)))):
+		case <-p.closeC:
+			return
+		}
+	}
+
 	cleanFunc() // run for the first time
-	for _ = range time.Tick(interval) {
-		cleanFunc()
+
+	for {
+		select {
+		case <-p.clock.After(utils.Jitter(interval, p.jitter)):
+			cleanFunc()
+		case <-p.closeC:
+			return
+		}
+	}
+}
+
+// cleanerLeader returns true if the cleaner should run on this instance. It
+// logs the changes of the leadership.
+func (p *Postgres) cleanerLeader() bool {
+	if p.cleanerLock == nil {
+		return true
+	}
+
+	wasLeader := p.cleanerLock.held()
+
+	leader, err := p.cleanerLock.acquire(context.Background(), p.db())
+	if err != nil {
+		p.Log.Warning("postgres: cleaner leader election failed: %s", err)
+	}
+
+	switch {
+	case leader && !wasLeader:
+		p.Log.Info("postgres: became the cleaner leader")
+	case !leader && wasLeader:
+		p.Log.Warning("postgres: lost the cleaner leadership")
+	}
+
+	return leader
+}
+
+// IsReadOnly returns true if the storage is configured to be read-only.
+func (p *Postgres) IsReadOnly() bool {
+	return p.readOnly
+}
+
+// IsCleanerLeader returns true if the instance runs the cleaner. It's always
+// true if CleanerLeaderElection is not set and the storage is not read-only.
+func (p *Postgres) IsCleanerLeader() bool {
+	if p.readOnly {
+		return false
+	}
+
+	return p.cleanerLock == nil || p.cleanerLock.held()
+}
+
+// sqlNow is the current time of the database in UTC, as the timestamps are
+// stored.
+const sqlNow = `(now() at time zone 'utc')`
+
+// now returns the SQL expression of the current time used by the statements,
+// the time of the database or the time of the clock if ClockInSQL is set.
+func (p *Postgres) now() string {
+	if !p.clockInSQL {
+		return sqlNow
 	}
+
+	return "('" + p.clock.Now().UTC().Format("2006-01-02 15:04:05.999999") + "'::timestamp)"
+}
+
+// Close stops the cleaner and closes the database connection.
+func (p *Postgres) Close() error {
+	p.closeOnce.Do(func() {
+		if p.closeC != nil {
+			close(p.closeC)
+		}
+	})
+
+	// let another instance take over the cleaner right away
+	if p.cleanerLock != nil {
+		if err := p.cleanerLock.release(context.Background()); err != nil {
+			p.Log.Warning("postgres: releasing the cleaner leadership failed: %s", err)
+		}
+	}
+
+	p.dbMu.Lock()
+	p.clearStmts()
+	db := p.DB
+	p.dbMu.Unlock()
+
+	return db.Close()
 }
 
 // CleanExpiredRows deletes rows that are at least "expire" duration old. So if
 // say an expire duration of 10 second is given, it will delete all rows that
-// were updated 10 seconds ago
+// were updated 10 seconds ago. Rows of kites that are registered with their
+// own TTL are deleted once their expire_at time has passed.
 func (p *Postgres) CleanExpiredRows(expire time.Duration) (int64, error) {
+	defer p.logSlow("clean", time.Now(), "")
+
+	if p.readOnly {
+		return 0, ErrReadOnly
+	}
+
 	// See: http://stackoverflow.com/questions/14465727/how-to-insert-things-like-now-interval-2-minutes-into-php-pdo-query
 	// basically by passing an integer to INTERVAL is not possible, we need to
 	// cast it. However there is a more simpler way, we can multiply INTERVAL
 	// with an integer so we just declare a one second INTERVAL and multiply it
 	// with the amount we want.
-	cleanOldRows := `DELETE FROM kite WHERE updated_at < (now() at time zone 'utc') - ((INTERVAL '1 second') * $1)`
+	now := p.now()
+	cleanOldRows := `DELETE FROM ` + p.table + ` WHERE
+	(expire_at IS NOT NULL AND expire_at < ` + now + `) OR
+	(expire_at IS NULL AND updated_at < ` + now + ` - ((INTERVAL '1 second') * $1))`
 
-	rows, err := p.DB.Exec(cleanOldRows, int64(expire/time.Second))
+	rows, err := p.db().Exec(cleanOldRows, int64(expire/time.Second))
 	if err != nil {
 		return 0, err
 	}
@@ -156,37 +763,438 @@ func (p *Postgres) CleanExpiredRows(expire time.Duration) (int64, error) {
 	return rows.RowsAffected()
 }
 
-func (p *Postgres) Get(query *protocol.KontrolQuery) (Kites, error) {
+// ExpireInterval returns the duration after which a kite that isn't updated
+// is removed from the storage.
+func (p *Postgres) ExpireInterval() time.Duration {
+	return p.expire
+}
+
+// CleanerStats returns the number of cleaner runs and the total number of rows
+// deleted by the cleaner.
+func (p *Postgres) CleanerStats() (runs, cleaned int64) {
+	return atomic.LoadInt64(&p.cleanerRuns), atomic.LoadInt64(&p.cleanedRows)
+}
+
+// Count returns the number of kites in the storage.
+func (p *Postgres) Count() (int64, error) {
+	defer p.logSlow("count", time.Now(), "")
+
+	var count int64
+	err := p.db().QueryRow(`SELECT COUNT(*) FROM ` + p.table).Scan(&count)
+	return count, err
+}
+
+// DistinctNames returns the distinct names of the kites registered for the
+// given username and environment.
+func (p *Postgres) DistinctNames(username, environment string) ([]string, error) {
+	return p.distinct("kitename", sq.Eq{
+		"username":    username,
+		"environment": environment,
+	})
+}
+
+// DistinctVersions returns the distinct versions of the kites registered
+// with the given username, environment and name.
+func (p *Postgres) DistinctVersions(username, environment, name string) ([]string, error) {
+	return p.distinct("version", sq.Eq{
+		"username":    username,
+		"environment": environment,
+		"kitename":    name,
+	})
+}
+
+// VersionHistogram returns the number of kites registered with the given
+// username, environment and name for each of their versions, like the split
+// of the canary and the stable versions during a rollout.
+func (p *Postgres) VersionHistogram(username, environment, name string) (map[string]int64, error) {
+	defer p.logSlow("versionHistogram", time.Now(), name)
+
+	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+
+	sqlQuery, args, err := psql.Select("version", "COUNT(*)").From(p.table).
+		Where(sq.Eq{
+			"username":    username,
+			"environment": environment,
+			"kitename":    name,
+		}).GroupBy("version").ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db().Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	histogram := make(map[string]int64)
+	for rows.Next() {
+		var (
+			version string
+			count   int64
+		)
+
+		if err := rows.Scan(&version, &count); err != nil {
+			return nil, err
+		}
+
+		histogram[version] = count
+	}
+
+	return histogram, rows.Err()
+}
+
+// distinct returns the distinct values of the column for rows matching the
+// given condition.
+func (p *Postgres) distinct(column string, where sq.Eq) ([]string, error) {
+	defer p.logSlow("distinct", time.Now(), column)
+
+	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+
+	sqlQuery, args, err := psql.Select("DISTINCT " + column).From(p.table).
+		Where(where).OrderBy(column).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db().Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make([]string, 0)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
+
+func (p *Postgres) Get(query *protocol.KontrolQuery) (Kites, error) {
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		// version is a malformed, just return the error
+		return nil, err
+	}
+
+	return p.GetWithConstraint(query, constraint)
+}
+
+// GetWithConstraint retrieves the kites with the given query. If constraint
+// is not nil, it's used instead of the version field of the query.
+func (p *Postgres) GetWithConstraint(query *protocol.KontrolQuery, constraint version.Constraints) (Kites, error) {
+	defer p.logSlow("get", time.Now(), query.String())
+
+	result, err := p.getResult(context.Background(), query, constraint)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Kites, nil
+}
+
+// GetContext retrieves the kites with the given query like Get. The query is
+// cancelled once ctx is done.
+func (p *Postgres) GetContext(ctx context.Context, query *protocol.KontrolQuery) (Kites, error) {
+	defer p.logSlow("get", time.Now(), query.String())
+
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		// version is a malformed, just return the error
+		return nil, err
+	}
+
+	result, err := p.getResult(ctx, query, constraint)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Kites, nil
+}
+
+// GetResult retrieves the kites with the given query like Get. The result
+// tells how many kites matched the query before they were filtered by the
+// version constraint, so a query matching no kites can be told apart from a
+// version constraint no kite satisfies.
+func (p *Postgres) GetResult(query *protocol.KontrolQuery) (*GetResult, error) {
+	defer p.logSlow("get", time.Now(), query.String())
+
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		// version is a malformed, just return the error
+		return nil, err
+	}
+
+	return p.getResult(context.Background(), query, constraint)
+}
+
+// GetN retrieves at most n of the kites matching the query, picked at random,
+// for the callers that only need a few of them, like for load balancing.
+// Without a version constraint the kites are picked by the database, so the
+// others are never read. With a constraint all matching kites are read and
+// filtered like Get first. The Selection of the query is ignored.
+func (p *Postgres) GetN(query *protocol.KontrolQuery, n int) (Kites, error) {
+	defer p.logSlow("getN", time.Now(), query.String())
+
+	if n <= 0 {
+		return nil, errors.New("n must be positive")
+	}
+
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		// version is a malformed, just return the error
+		return nil, err
+	}
+
+	if constraint != nil {
+		result, err := p.getResult(context.Background(), query, constraint)
+		if err != nil {
+			return nil, err
+		}
+
+		kites := result.Kites
+		kites.Shuffle()
+		if len(kites) > n {
+			kites = kites[:n]
+		}
+
+		return kites, nil
+	}
+
+	if err := p.checkEncryptedQuery(query); err != nil {
+		return nil, err
+	}
+
+	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+	sqlQuery, args, err := randomSelectQuery(psql, p.table, query, n)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	kites := make(Kites, 0, n)
+	for rows.Next() {
+		kite, err := scanKite(rows, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		kites = append(kites, kite)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := p.decryptKites(kites); err != nil {
+		return nil, err
+	}
+
+	return kites, nil
+}
+
+// randomSelectQuery returns the select query of n random kites matching the
+// query. The version of the query must be exact.
+func randomSelectQuery(psql sq.StatementBuilderType, table string, query *protocol.KontrolQuery, n int) (string, []interface{}, error) {
+	sqlQuery, args, err := buildSelectQuery(psql, table, query, nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return sqlQuery + fmt.Sprintf(" ORDER BY random() LIMIT %d", n), args, nil
+}
+
+func (p *Postgres) getResult(ctx context.Context, query *protocol.KontrolQuery, constraint version.Constraints) (*GetResult, error) {
+	if err := p.checkEncryptedQuery(query); err != nil {
+		return nil, err
+	}
+
+	runQuery := func(query string, args ...interface{}) (*sql.Rows, error) {
+		return p.queryContext(ctx, query, args...)
+	}
+
+	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+	result, err := getKites(runQuery, psql, p.table, query, nil, constraint, p.maxResults, p.stats)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.decryptKites(result.Kites); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// checkEncryptedQuery returns ErrTagsNotSupported if the query matches the
+// tags while they are encrypted.
+func (p *Postgres) checkEncryptedQuery(query *protocol.KontrolQuery) error {
+	if p.cipher.encrypts("tags") && hasTagQuery(query) {
+		return ErrTagsNotSupported
+	}
+
+	return nil
+}
+
+// decryptKites decrypts the encrypted columns of the kites.
+func (p *Postgres) decryptKites(kites Kites) error {
+	for _, k := range kites {
+		if err := p.cipher.decryptKite(k); err != nil {
+			return fmt.Errorf("postgres: decrypting kite %s: %s", k.Kite.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// GetColumns retrieves the kites with the given query like Get, but selects
+// only the given columns of kiteColumns, like "id" and "url" for the callers
+// that only connect to the kites. The fields of the other columns are left
+// zero. The columns needed to filter the kites by a version constraint are
+// always selected.
+func (p *Postgres) GetColumns(query *protocol.KontrolQuery, columns ...string) (Kites, error) {
+	defer p.logSlow("get", time.Now(), query.String())
+
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		// version is a malformed, just return the error
+		return nil, err
+	}
+
+	columns, err = projection(columns, constraint != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.checkEncryptedQuery(query); err != nil {
+		return nil, err
+	}
+
+	runQuery := func(query string, args ...interface{}) (*sql.Rows, error) {
+		return p.query(query, args...)
+	}
+
+	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+	result, err := getKites(runQuery, psql, p.table, query, columns, constraint, p.maxResults, p.stats)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.decryptKites(result.Kites); err != nil {
+		return nil, err
+	}
+
+	return result.Kites, nil
+}
+
+// projection returns the columns to select for the given columns. The key
+// columns after the name are added if the kites are filtered by a version
+// constraint.
+func projection(columns []string, filtered bool) ([]string, error) {
+	if len(columns) == 0 {
+		return nil, errors.New("no columns given")
+	}
+
+	selected := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		if !isKiteColumn(c) {
+			return nil, fmt.Errorf("unknown column: %q", c)
+		}
+
+		selected[c] = true
+	}
+
+	projected := append([]string(nil), columns...)
+	if filtered {
+		for _, c := range []string{"version", "region", "hostname", "id"} {
+			if !selected[c] {
+				projected = append(projected, c)
+			}
+		}
+	}
+
+	return projected, nil
+}
+
+// isKiteColumn returns true if the column is one of kiteColumns.
+func isKiteColumn(column string) bool {
+	for _, c := range kiteColumns {
+		if c == column {
+			return true
+		}
+	}
+
+	return false
+}
+
+// QueryStats counts the Get queries with a version constraint. Those fetch
+// all kites under the name and filter them afterwards, which is slower than
+// the queries that are made up of only exact fields.
+type QueryStats struct {
+	// SlowPath is the number of queries with a version constraint, updated
+	// atomically.
+	SlowPath uint64
+
+	// Discarded is the histogram of the rows fetched and discarded by the
+	// slow path queries.
+	Discarded *Histogram
+}
+
+func newQueryStats() *QueryStats {
+	return &QueryStats{
+		Discarded: newHistogram(countBuckets),
+	}
+}
+
+// QueryStats returns the statistics of the Get queries.
+func (p *Postgres) QueryStats() *QueryStats {
+	return p.stats
+}
+
+// queryFunc runs a query returning rows, like sql.DB.Query.
+type queryFunc func(query string, args ...interface{}) (*sql.Rows, error)
+
+// getKites retrieves the kites matching the query from the given kite table
+// of a SQL database with runQuery. psql builds the statements in the database's dialect.
+// If maxResults is positive and more rows are matching, ErrTooManyResults is
+// returned. The limit is applied before filtering by the version constraint.
+// The slow path queries are counted in stats, if it's not nil.
+func getKites(runQuery queryFunc, psql sq.StatementBuilderType, table string, query *protocol.KontrolQuery, columns []string, constraint version.Constraints, maxResults int, stats *QueryStats) (*GetResult, error) {
 	// only let query with usernames, otherwise the whole tree will be fetched
 	// which is not good for us
-	sqlQuery, args, err := selectQuery(query)
+	sqlQuery, args, err := buildSelectQuery(psql, table, query, columns)
 	if err != nil {
 		return nil, err
 	}
 
 	var hasVersionConstraint bool // does query contains a constraint on version?
 	var keyRest string            // query key after the version field
-	var versionConstraint version.Constraints
-	// NewVersion returns an error if it's a constraint, like: ">= 1.0, < 1.4"
-	_, err = version.NewVersion(query.Version)
-	if err != nil && query.Version != "" {
-		// now parse our constraint
-		versionConstraint, err = version.NewConstraint(query.Version)
-		if err != nil {
-			// version is a malformed, just return the error
-			return nil, err
-		}
-
+	if constraint != nil {
 		hasVersionConstraint = true
 		nameQuery := &protocol.KontrolQuery{
-			Username:    query.Username,
-			Environment: query.Environment,
-			Name:        query.Name,
+			Username:       query.Username,
+			Environment:    query.Environment,
+			Name:           query.Name,
+			Capabilities:   query.Capabilities,
+			Tags:           query.Tags,
+			AnyTags:        query.AnyTags,
+			SinceUpdatedAt: query.SinceUpdatedAt,
 		}
 
 		// We will make a get request to all nodes under this name
 		// and filter the result later.
-		sqlQuery, args, err = selectQuery(nameQuery)
+		sqlQuery, args, err = buildSelectQuery(psql, table, nameQuery, columns)
 		if err != nil {
 			return nil, err
 		}
@@ -196,89 +1204,253 @@ func (p *Postgres) Get(query *protocol.KontrolQuery) (Kites, error) {
 			query.Region+"/"+query.Hostname+"/"+query.ID, "/")
 	}
 
-	rows, err := p.DB.Query(sqlQuery, args...)
+	// fetch one more row than allowed, so we know the limit is exceeded
+	// without reading all rows
+	if maxResults > 0 {
+		sqlQuery += fmt.Sprintf(" LIMIT %d", maxResults+1)
+	}
+
+	rows, err := runQuery(sqlQuery, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var (
-		username    string
-		environment string
-		kitename    string
-		version     string
-		region      string
-		hostname    string
-		id          string
-		url         string
-		updated_at  time.Time
-		created_at  time.Time
-	)
-
 	kites := make(Kites, 0)
 
 	for rows.Next() {
-		err := rows.Scan(
-			&username,
-			&environment,
-			&kitename,
-			&version,
-			&region,
-			&hostname,
-			&id,
-			&url,
-			&updated_at,
-			&created_at,
-		)
+		kite, err := scanKite(rows, columns)
 		if err != nil {
 			return nil, err
 		}
 
-		kites = append(kites, &protocol.KiteWithToken{
-			Kite: protocol.Kite{
-				Username:    username,
-				Environment: environment,
-				Name:        kitename,
-				Version:     version,
-				Region:      region,
-				Hostname:    hostname,
-				ID:          id,
-			},
-			URL: url,
-		})
+		if maxResults > 0 && len(kites) == maxResults {
+			return nil, ErrTooManyResults
+		}
+
+		kites = append(kites, kite)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	// if it's just single result there is no need to shuffle or filter
-	// according to the version constraint
-	if len(kites) == 1 {
-		return kites, nil
-	}
+	result := &GetResult{BeforeFilter: len(kites)}
 
 	// Filter kites by version constraint
 	if hasVersionConstraint {
-		kites.Filter(versionConstraint, keyRest)
+		discarded := kites.Filter(constraint, keyRest)
+
+		if stats != nil {
+			atomic.AddUint64(&stats.SlowPath, 1)
+			stats.Discarded.Observe(float64(discarded))
+		}
 	}
 
-	// randomize the result
-	kites.Shuffle()
+	kites.Select(query.Selection)
 
-	return kites, nil
+	result.Kites = kites
+	result.AfterFilter = len(kites)
+
+	return result, nil
+}
+
+// kiteColumns are the columns selected for the kites. They are listed
+// explicitly, so scanKite doesn't depend on the table layout.
+var kiteColumns = []string{
+	"username",
+	"environment",
+	"kitename",
+	"version",
+	"region",
+	"hostname",
+	"id",
+	"url",
+	"updated_at",
+	"created_at",
+	"urls",
+	"weight",
+	"tags",
+	"capabilities",
+}
+
+// isEmptyQuery returns true if the query doesn't restrict the kites at all.
+func isEmptyQuery(query *protocol.KontrolQuery) bool {
+	for _, v := range query.Fields() {
+		if v != "" {
+			return false
+		}
+	}
+
+	return len(query.Capabilities) == 0 && !hasTagQuery(query) && query.SinceUpdatedAt.IsZero()
+}
+
+// scanKite scans the current row of the rows of a select query of the given
+// columns, all of kiteColumns if nil. The fields of the columns that are not
+// selected are left zero. The values of the columns selected after them are
+// scanned into extra.
+func scanKite(rows *sql.Rows, columns []string, extra ...interface{}) (*protocol.KiteWithToken, error) {
+	if columns == nil {
+		columns = kiteColumns
+	}
+
+	var (
+		kite         = &protocol.KiteWithToken{}
+		updated_at   time.Time
+		created_at   time.Time
+		urls         []byte
+		tags         []byte
+		capabilities []byte
+	)
+
+	dest := make([]interface{}, len(columns))
+	for i, column := range columns {
+		switch column {
+		case "username":
+			dest[i] = &kite.Kite.Username
+		case "environment":
+			dest[i] = &kite.Kite.Environment
+		case "kitename":
+			dest[i] = &kite.Kite.Name
+		case "version":
+			dest[i] = &kite.Kite.Version
+		case "region":
+			dest[i] = &kite.Kite.Region
+		case "hostname":
+			dest[i] = &kite.Kite.Hostname
+		case "id":
+			dest[i] = &kite.Kite.ID
+		case "url":
+			dest[i] = &kite.URL
+		case "updated_at":
+			dest[i] = &updated_at
+		case "created_at":
+			dest[i] = &created_at
+		case "urls":
+			dest[i] = &urls
+		case "weight":
+			dest[i] = &kite.Weight
+		case "tags":
+			dest[i] = &tags
+		case "capabilities":
+			dest[i] = &capabilities
+		default:
+			return nil, fmt.Errorf("unknown column: %q", column)
+		}
+	}
+
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	if len(urls) != 0 {
+		if err := json.Unmarshal(urls, &kite.URLs); err != nil {
+			return nil, err
+		}
+	}
+
+	kite.Tags = parseTextArray(string(tags))
+	kite.Capabilities = parseTextArray(string(capabilities))
+
+	return kite, nil
+}
+
+// Each calls fn for each kite matching the query, while the rows are read
+// from the database, so the kites are not loaded into memory at once. Unlike
+// Get, the query can be empty to iterate over all kites, and MaxResults
+// isn't applied. The iteration is stopped if fn returns an error, which is
+// returned by Each.
+func (p *Postgres) Each(query *protocol.KontrolQuery, fn func(*protocol.KiteWithToken) error) error {
+	defer p.logSlow("each", time.Now(), query.String())
+
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		return err
+	}
+
+	if err := p.checkEncryptedQuery(query); err != nil {
+		return err
+	}
+
+	// the version constraint is checked for each kite
+	selectQuery := *query
+	if constraint != nil {
+		selectQuery.Version = ""
+	}
+
+	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+
+	var sqlQuery string
+	var args []interface{}
+
+	if isEmptyQuery(&selectQuery) {
+		sqlQuery, args, err = psql.Select(kiteColumns...).From(p.table).ToSql()
+	} else {
+		sqlQuery, args, err = buildSelectQuery(psql, p.table, &selectQuery, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	rows, err := p.db().Query(sqlQuery, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		kite, err := scanKite(rows, nil)
+		if err != nil {
+			return err
+		}
+
+		if err := p.decryptKites(Kites{kite}); err != nil {
+			return err
+		}
+
+		if constraint != nil && !matchQuery(&kite.Kite, query, constraint) {
+			continue
+		}
+
+		if err := fn(kite); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
 }
 
+// Upsert updates the kite, or inserts it if it's not registered. If the ID of
+// the kite is empty, a new one is generated and set on kiteProt.
 func (p *Postgres) Upsert(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) (err error) {
+	defer p.logSlow("upsert", time.Now(), kiteProt.String())
+	defer func() { err = newStorageError("upsert", kiteProt.ID, err) }()
+
+	if p.readOnly {
+		return ErrReadOnly
+	}
+
+	fillKiteID(kiteProt)
+	kiteProt = p.withDefaults(kiteProt)
+
+	if err := validateKiteID(kiteProt.ID); err != nil {
+		return err
+	}
+
 	// check that the incoming URL is valid to prevent malformed input
 	_, err = url.Parse(value.URL)
 	if err != nil {
 		return err
 	}
 
+	value, err = p.cipher.encryptValue(kiteProt.ID, value)
+	if err != nil {
+		return err
+	}
+
 	// we are going to try an UPDATE, if it's not successfull we are going to
 	// INSERT the document, all ine one single transaction
-	tx, err := p.DB.Begin()
+	tx, err := p.db().Begin()
 	if err != nil {
 		return err
 	}
@@ -292,8 +1464,9 @@ func (p *Postgres) Upsert(kiteProt *protocol.Kite, value *kontrolprotocol.Regist
 		}
 	}()
 
-	res, err := tx.Exec(`UPDATE kite SET url = $1, updated_at = (now() at time zone 'utc') 
-	WHERE id = $2`, value.URL, kiteProt.ID)
+	res, err := tx.Exec(fmt.Sprintf(updateKite, p.table, p.now()), value.URL, kiteProt.ID,
+		ttlSeconds(value), textArray(value.Capabilities), urlsJSON(value), value.Weight,
+		textArray(value.Tags))
 	if err != nil {
 		return err
 	}
@@ -308,7 +1481,7 @@ func (p *Postgres) Upsert(kiteProt *protocol.Kite, value *kontrolprotocol.Regist
 		return nil
 	}
 
-	insertSQL, args, err := insertQuery(kiteProt, value.URL)
+	insertSQL, args, err := insertQuery(p.table, p.now(), kiteProt, value)
 	if err != nil {
 		return err
 	}
@@ -317,49 +1490,409 @@ func (p *Postgres) Upsert(kiteProt *protocol.Kite, value *kontrolprotocol.Regist
 	return err
 }
 
-func (p *Postgres) Add(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+// Rekey changes the ID of a registered kite from oldID to newID in a single
+// transaction, so clients never see both registrations at the same time. If
+// the kite is already registered with newID, the registration with oldID is
+// deleted. ErrKiteNotFound is returned if there is no kite with oldID. The
+// encrypted columns are encrypted again in the transaction, as they are
+// authenticated with the ID of the kite.
+func (p *Postgres) Rekey(oldID, newID string) error {
+	defer p.logSlow("rekey", time.Now(), oldID)
+
+	if p.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := validateKiteID(newID); err != nil {
+		return err
+	}
+
+	tx, err := p.db().Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`UPDATE `+p.table+` SET id = $2, updated_at = `+p.now()+`
+	WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM `+p.table+` WHERE id = $2)`, oldID, newID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	rowAffected, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if rowAffected != 0 && p.cipher != nil {
+		if err := p.reencrypt(tx, oldID, newID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if rowAffected == 0 {
+		// either the old kite is gone or the new one is already registered
+		res, err = tx.Exec(`DELETE FROM `+p.table+` WHERE id = $1`, oldID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		rowAffected, err = res.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if rowAffected == 0 {
+			tx.Rollback()
+			return ErrKiteNotFound
+		}
+	}
+
+	return tx.Commit()
+}
+
+// reencrypt replaces the ciphertexts of the encrypted columns of the kite
+// rekeyed from oldID to newID in the transaction, as they are authenticated
+// with the ID of the kite.
+func (p *Postgres) reencrypt(tx *sql.Tx, oldID, newID string) error {
+	var urls, tags []byte
+	err := tx.QueryRow(`SELECT urls, tags FROM `+p.table+` WHERE id = $1 FOR UPDATE`, newID).Scan(&urls, &tags)
+	if err != nil {
+		return err
+	}
+
+	value := &kontrolprotocol.RegisterValue{Tags: parseTextArray(string(tags))}
+	if len(urls) != 0 {
+		if err := json.Unmarshal(urls, &value.URLs); err != nil {
+			return err
+		}
+	}
+
+	if value, err = p.cipher.rekeyValue(oldID, newID, value); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE `+p.table+` SET urls = $2::jsonb, tags = $3::text[] WHERE id = $1`,
+		newID, urlsJSON(value), textArray(value.Tags))
+	return err
+}
+
+// Add inserts the kite. If the ID of the kite is empty, a new one is
+// generated and set on kiteProt.
+func (p *Postgres) Add(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) (err error) {
+	defer p.logSlow("add", time.Now(), kiteProt.String())
+	defer func() { err = newStorageError("add", kiteProt.ID, err) }()
+
+	if p.readOnly {
+		return ErrReadOnly
+	}
+
+	fillKiteID(kiteProt)
+	kiteProt = p.withDefaults(kiteProt)
+
+	if err := validateKiteID(kiteProt.ID); err != nil {
+		return err
+	}
+
 	// check that the incoming URL is valid to prevent malformed input
-	_, err := url.Parse(value.URL)
+	_, err = url.Parse(value.URL)
+	if err != nil {
+		return err
+	}
+
+	value, err = p.cipher.encryptValue(kiteProt.ID, value)
 	if err != nil {
 		return err
 	}
 
-	sqlQuery, args, err := insertQuery(kiteProt, value.URL)
+	sqlQuery, args, err := insertQuery(p.table, p.now(), kiteProt, value)
 	if err != nil {
 		return err
 	}
 
-	_, err = p.DB.Exec(sqlQuery, args...)
+	_, err = p.db().Exec(sqlQuery, args...)
 	return err
 }
 
-func (p *Postgres) Update(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+func (p *Postgres) Update(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) (err error) {
+	defer p.logSlow("update", time.Now(), kiteProt.String())
+	defer func() { err = newStorageError("update", kiteProt.ID, err) }()
+
+	if p.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := validateKiteID(kiteProt.ID); err != nil {
+		return err
+	}
+
 	// check that the incoming url is valid to prevent malformed input
-	_, err := url.Parse(value.URL)
+	_, err = url.Parse(value.URL)
+	if err != nil {
+		return err
+	}
+
+	value, err = p.cipher.encryptValue(kiteProt.ID, value)
 	if err != nil {
 		return err
 	}
 
 	// TODO: also consider just using WHERE id = kiteProt.ID, see how it's
 	// performs out
-	_, err = p.DB.Exec(`UPDATE kite SET url = $1, updated_at = (now() at time zone 'utc') 
-	WHERE id = $2`,
-		value.URL, kiteProt.ID)
+	_, err = p.exec(fmt.Sprintf(updateKite, p.table, p.now()), value.URL, kiteProt.ID,
+		ttlSeconds(value), textArray(value.Capabilities), urlsJSON(value), value.Weight,
+		textArray(value.Tags))
 
 	return err
 }
 
-func (p *Postgres) Delete(kiteProt *protocol.Kite) error {
-	deleteKite := `DELETE FROM kite WHERE id = $1`
-	_, err := p.DB.Exec(deleteKite, kiteProt.ID)
+// withDefaults fills the empty region of the kite before it's added. See PostgresConfig.DefaultRegion.
+func (p *Postgres) withDefaults(kiteProt *protocol.Kite) *protocol.Kite {
+	k, filled := withDefaults(kiteProt, p.defaultRegion)
+	if filled != nil {
+		p.Log.Debug("postgres: filled empty fields of %s: %s", k, strings.Join(filled, ", "))
+	}
+
+	return k
+}
+
+// Touch extends the expiration of the kites with the given ids in a single
+// query, like a heartbeat for all of them. Kites registered with their own TTL
+// are extended by their TTL. It returns the number of kites touched, ids that
+// are not registered are ignored.
+func (p *Postgres) Touch(ids []string) (int64, error) {
+	defer p.logSlow("touch", time.Now(), fmt.Sprintf("%d kites", len(ids)))
+
+	if p.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	for _, id := range ids {
+		if err := validateKiteID(id); err != nil {
+			return 0, err
+		}
+	}
+
+	// the TTL of a kite is the difference of expire_at and updated_at, the
+	// values on the right side are the ones before the update.
+	now := p.now()
+	touchKites := `UPDATE ` + p.table + ` SET updated_at = ` + now + `,
+	expire_at = ` + now + ` + (expire_at - updated_at)
+	WHERE id = ANY($1::uuid[])`
+
+	res, err := p.db().Exec(touchKites, textArray(ids))
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// Maintain keeps the given kite registered until ctx is cancelled. It adds the
+// kite and touches it every interval, which should be shorter than the expire
+// interval of the storage. If the kite was removed meanwhile, like by the
+// cleaner after a network partition, it's added again. Errors while touching
+// are logged and retried on the next interval. Once ctx is cancelled the kite
+// is deleted and the error of the deletion is returned.
+func (p *Postgres) Maintain(ctx context.Context, kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue, interval time.Duration) error {
+	if err := p.Upsert(kiteProt, value); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-p.clock.After(interval):
+			n, err := p.Touch([]string{kiteProt.ID})
+			if err != nil {
+				p.Log.Warning("postgres: heartbeat of %s failed: %s", kiteProt, err)
+				continue
+			}
+
+			if n != 0 {
+				continue
+			}
+
+			p.Log.Info("postgres: %s is not registered anymore, registering again", kiteProt)
+			if err := p.Upsert(kiteProt, value); err != nil {
+				p.Log.Warning("postgres: register of %s failed: %s", kiteProt, err)
+			}
+		case <-ctx.Done():
+			return p.Delete(kiteProt)
+		}
+	}
+}
+
+// updateKite updates the url of a kite and extends its expiration. expire_at
+// is only set if the kite is registered with its own TTL. The table name and
+// the current time need to be formatted into it.
+const updateKite = `UPDATE %[1]s SET url = $1, updated_at = %[2]s,
+	expire_at = CASE WHEN $3 > 0
+		THEN %[2]s + ((INTERVAL '1 second') * $3)
+		ELSE NULL END,
+	capabilities = $4::text[],
+	urls = $5::jsonb,
+	weight = $6,
+	tags = $7::text[]
+	WHERE id = $2`
+
+// textArray returns the given values as a Postgres text[] literal, like
+// {"gpu","ssd"}.
+func textArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		v = strings.Replace(v, `\`, `\\`, -1)
+		v = strings.Replace(v, `"`, `\"`, -1)
+		quoted[i] = `"` + v + `"`
+	}
+
+	return "{" + strings.Join(quoted, ",") + "}"
+}
+
+// parseTextArray parses a text[] literal returned by Postgres, like
+// {a,"b c"}. It's the inverse of textArray.
+func parseTextArray(s string) []string {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	if s == "" {
+		return nil
+	}
+
+	var (
+		values  []string
+		value   []rune
+		quoted  bool
+		escaped bool
+	)
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			value = append(value, r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			values = append(values, string(value))
+			value = value[:0]
+		default:
+			value = append(value, r)
+		}
+	}
+
+	return append(values, string(value))
+}
+
+// urlsJSON returns the alternate URLs of the given value as a JSON array, or
+// nil if there are none, so the column is NULL.
+func urlsJSON(value *kontrolprotocol.RegisterValue) interface{} {
+	if len(value.URLs) == 0 {
+		return nil
+	}
+
+	p, _ := json.Marshal(value.URLs)
+	return string(p)
+}
+
+// ttlSeconds returns the TTL of the given value in seconds.
+func ttlSeconds(value *kontrolprotocol.RegisterValue) int64 {
+	return int64(value.TTL / time.Second)
+}
+
+func (p *Postgres) Delete(kiteProt *protocol.Kite) (err error) {
+	defer p.logSlow("delete", time.Now(), kiteProt.String())
+	defer func() { err = newStorageError("delete", kiteProt.ID, err) }()
+
+	if p.readOnly {
+		return ErrReadOnly
+	}
+
+	deleteKite := `DELETE FROM ` + p.table + ` WHERE id = $1`
+	_, err = p.exec(deleteKite, kiteProt.ID)
 	return err
 }
 
-// selectQuery returns a SQL query for the given query
-func selectQuery(query *protocol.KontrolQuery) (string, []interface{}, error) {
+// DeleteUser deletes all kites of the given user and returns the number of
+// deleted kites.
+func (p *Postgres) DeleteUser(username string) (int64, error) {
+	defer p.logSlow("deleteUser", time.Now(), username)
+
+	if p.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	if username == "" {
+		return 0, errors.New("empty username")
+	}
+
+	res, err := p.db().Exec(`DELETE FROM `+p.table+` WHERE username = $1`, username)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// DeleteVersion deletes the kites of the given version, registered with the
+// given username, environment and name, on all hosts and regions. It returns
+// the deleted kites. Kontrol.DeleteVersion should be used to delete them
+// from a running kontrol, so the watchers are notified.
+func (p *Postgres) DeleteVersion(username, environment, name, version string) ([]protocol.Kite, error) {
+	defer p.logSlow("deleteVersion", time.Now(), name+"/"+version)
+
+	if p.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	if username == "" || environment == "" || name == "" || version == "" {
+		return nil, errors.New("username, environment, name and version are required")
+	}
+
+	rows, err := p.db().Query(`DELETE FROM `+p.table+`
+	WHERE username = $1 AND environment = $2 AND kitename = $3 AND version = $4
+	RETURNING username, environment, kitename, version, region, hostname, id`,
+		username, environment, name, version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var kites []protocol.Kite
+	for rows.Next() {
+		var k protocol.Kite
+		if err := rows.Scan(&k.Username, &k.Environment, &k.Name, &k.Version, &k.Region, &k.Hostname, &k.ID); err != nil {
+			return nil, err
+		}
+
+		kites = append(kites, k)
+	}
+
+	return kites, rows.Err()
+}
+
+// selectQuery returns a SQL query for the given query on the given table
+func selectQuery(table string, query *protocol.KontrolQuery) (string, []interface{}, error) {
 	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+	return buildSelectQuery(psql, table, query, nil)
+}
+
+// buildSelectQuery returns a SQL query for the given query on the given table
+// built with the given statement builder. It selects the given columns, all
+// of kiteColumns if nil.
+func buildSelectQuery(psql sq.StatementBuilderType, table string, query *protocol.KontrolQuery, columns []string) (string, []interface{}, error) {
+	if columns == nil {
+		columns = kiteColumns
+	}
 
-	kites := psql.Select("*").From("kite")
+	kites := psql.Select(columns...).From(table)
 	fields := query.Fields()
 	andQuery := sq.And{}
 
@@ -382,11 +1915,31 @@ func selectQuery(query *protocol.KontrolQuery) (string, []interface{}, error) {
 		return "", nil, errors.New("all query fields are empty")
 	}
 
+	// the kites must have all of the capabilities
+	if len(query.Capabilities) != 0 {
+		andQuery = append(andQuery, sq.Expr("capabilities @> ?::text[]", textArray(query.Capabilities)))
+	}
+
+	// the kites must have all of the tags, and one of the any tags
+	if len(query.Tags) != 0 {
+		andQuery = append(andQuery, sq.Expr("tags @> ?::text[]", textArray(query.Tags)))
+	}
+
+	if len(query.AnyTags) != 0 {
+		andQuery = append(andQuery, sq.Expr("tags && ?::text[]", textArray(query.AnyTags)))
+	}
+
+	// the updated_at index makes it efficient
+	if !query.SinceUpdatedAt.IsZero() {
+		andQuery = append(andQuery, sq.Expr("updated_at > ?", query.SinceUpdatedAt.UTC()))
+	}
+
 	return kites.Where(andQuery).ToSql()
 }
 
-// inseryQuery
-func insertQuery(kiteProt *protocol.Kite, url string) (string, []interface{}, error) {
+// insertQuery returns the statement inserting the kite into the table. now is
+// the SQL expression of the current time.
+func insertQuery(table, now string, kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) (string, []interface{}, error) {
 	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
 
 	kiteValues := kiteProt.Values()
@@ -396,9 +1949,26 @@ func insertQuery(kiteProt *protocol.Kite, url string) (string, []interface{}, er
 		values[i] = kiteVal
 	}
 
-	values = append(values, url)
+	values = append(values, value.URL)
+
+	// kites without their own TTL are expired by the cleaner's expire
+	// interval, which is denoted with a NULL expire_at.
+	var expireAt interface{}
+	if ttl := ttlSeconds(value); ttl > 0 {
+		expireAt = sq.Expr(now+" + ((INTERVAL '1 second') * ?)", ttl)
+	}
+
+	values = append(values,
+		expireAt,
+		sq.Expr("?::text[]", textArray(value.Capabilities)),
+		sq.Expr("?::jsonb", urlsJSON(value)),
+		value.Weight,
+		sq.Expr("?::text[]", textArray(value.Tags)),
+		sq.Expr(now),
+		sq.Expr(now),
+	)
 
-	return psql.Insert("kite").Columns(
+	return psql.Insert(table).Columns(
 		"username",
 		"environment",
 		"kitename",
@@ -407,5 +1977,12 @@ func insertQuery(kiteProt *protocol.Kite, url string) (string, []interface{}, er
 		"hostname",
 		"id",
 		"url",
+		"expire_at",
+		"capabilities",
+		"urls",
+		"weight",
+		"tags",
+		"created_at",
+		"updated_at",
 	).Values(values...).ToSql()
 }
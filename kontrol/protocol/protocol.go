@@ -1,6 +1,26 @@
 package protocol
 
+import "time"
+
 // RegisterValue is the type of the value that is saved to etcd.
 type RegisterValue struct {
 	URL string `json:"url"`
+
+	// URLs are the alternate URLs of the kite, like the internal ws URL of a
+	// kite that is registered with its public wss URL. Clients can connect
+	// to any of them.
+	URLs []string `json:"urls,omitempty"`
+
+	// TTL is the duration after which the kite is removed from the storage
+	// if it's not updated. If zero, the storage's default is used.
+	TTL time.Duration `json:"ttl,omitempty"`
+
+	// Capabilities advertised by the kite, like "gpu" or "ssd"
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Tags of the kite, like "tier:canary"
+	Tags []string `json:"tags,omitempty"`
+
+	// Weight of the kite relative to the others, zero is the default
+	Weight float64 `json:"weight,omitempty"`
 }
@@ -0,0 +1,102 @@
+package kontrol
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// RegisterRate is the default number of registrations per second that are
+	// allowed for a single username. Heartbeats don't go through the
+	// register path, so a healthy kite only registers once per connection.
+	RegisterRate = 10.0
+
+	// RegisterBurst is the default number of registrations a single username
+	// can make at once before being limited by RegisterRate.
+	RegisterBurst = 100
+
+	// ErrRateLimited is returned when a username exceeds its registration
+	// rate.
+	ErrRateLimited = errors.New("too many registrations, please try again later")
+)
+
+// rateLimiter is an in-memory token bucket rate limiter keyed by a string.
+type rateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // maximum tokens in a bucket
+
+	buckets map[string]*bucket
+	mu      sync.Mutex // protects buckets
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket of the given key. It returns false if
+// the bucket is empty.
+func (l *rateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	// refill the bucket for the elapsed time
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// gc removes the buckets that are refilled completely. They are the same as
+// a non existing bucket, so there is no need to keep them.
+func (l *rateLimiter) gc() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// runGC calls gc every interval duration until stop is closed.
+func (l *rateLimiter) runGC(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.gc()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package kontrol
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite"
+)
+
+// ErrRevoked is returned for requests of kites that are revoked.
+var ErrRevoked = errors.New("kite is revoked")
+
+// RevocationStorage is implemented by storages that can keep the revoked
+// kite keys and tokens, so the revocations survive the restarts of kontrol
+// and are shared by the kontrol instances and the kites using the storage.
+// Kontrol keeps them in memory if its storage doesn't implement it.
+type RevocationStorage interface {
+	// Revoke revokes the kite keys and the tokens with the given value of
+	// the claim, "jti" or "sub". The revocation can be dropped after
+	// expires, a zero expires keeps it forever.
+	Revoke(claim, value string, expires time.Time) error
+
+	// IsRevoked returns true if the kite keys and the tokens with the given
+	// value of the claim are revoked.
+	IsRevoked(claim, value string) (bool, error)
+}
+
+// revocation is an entry of the revocation list, the claim of the tokens
+// that are revoked and its value.
+type revocation struct {
+	claim string // "jti" or "sub"
+	value string
+}
+
+// revocationList is a RevocationStorage keeping the revocations in memory.
+type revocationList struct {
+	// revoked holds the revocations along with the time their entries can
+	// be dropped from the list, zero for the ones kept forever.
+	revoked map[revocation]time.Time
+	mu      sync.Mutex // protects revoked
+}
+
+var _ RevocationStorage = (*revocationList)(nil)
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		revoked: make(map[revocation]time.Time),
+	}
+}
+
+func (l *revocationList) Revoke(claim, value string, expires time.Time) error {
+	r := revocation{claim: claim, value: value}
+
+	l.mu.Lock()
+	// keep it for longer if it's already revoked for longer
+	if until, ok := l.revoked[r]; ok && !expires.IsZero() && (until.IsZero() || until.After(expires)) {
+		expires = until
+	}
+	l.revoked[r] = expires
+	l.mu.Unlock()
+
+	if expires.IsZero() {
+		return nil
+	}
+
+	time.AfterFunc(time.Until(expires), func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		// it might be revoked for longer in the meantime
+		if until, ok := l.revoked[r]; ok && !until.IsZero() && !time.Now().Before(until) {
+			delete(l.revoked, r)
+		}
+	})
+
+	return nil
+}
+
+func (l *revocationList) IsRevoked(claim, value string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until, ok := l.revoked[revocation{claim: claim, value: value}]
+	return ok && (until.IsZero() || time.Now().Before(until)), nil
+}
+
+// Revoke revokes the kite keys and the tokens with the given value of the
+// claim, see RevocationStorage. The expired revocations are deleted with it,
+// so the table doesn't grow unbounded.
+func (p *Postgres) Revoke(claim, value string, expires time.Time) error {
+	defer p.logSlow("revoke", time.Now(), "")
+
+	if p.readOnly {
+		return ErrReadOnly
+	}
+
+	var expiresAt interface{} // NULL keeps it forever
+	if !expires.IsZero() {
+		expiresAt = expires.UTC()
+	}
+
+	_, err := p.exec(`DELETE FROM ` + p.revocationTable + ` WHERE expires_at < ` + p.now())
+	if err != nil {
+		return err
+	}
+
+	// keep it for longer if it's already revoked for longer
+	_, err = p.exec(`INSERT INTO `+p.revocationTable+` AS r (claim, value, expires_at) VALUES ($1, $2, $3)
+	ON CONFLICT (claim, value) DO UPDATE SET expires_at = CASE
+		WHEN r.expires_at IS NULL OR EXCLUDED.expires_at IS NULL THEN NULL
+		ELSE GREATEST(r.expires_at, EXCLUDED.expires_at)
+	END`, claim, value, expiresAt)
+
+	return err
+}
+
+// IsRevoked returns true if the kite keys and the tokens with the given value
+// of the claim are revoked.
+func (p *Postgres) IsRevoked(claim, value string) (bool, error) {
+	defer p.logSlow("isRevoked", time.Now(), "")
+
+	var revoked bool
+	err := p.db().QueryRow(`SELECT EXISTS (SELECT 1 FROM `+p.revocationTable+`
+	WHERE claim = $1 AND value = $2 AND (expires_at IS NULL OR expires_at > `+p.now()+`))`,
+		claim, value).Scan(&revoked)
+
+	return revoked, err
+}
+
+// Revoke invalidates the kite key or the token with the given ID, the jti
+// claim of the token. Kontrol rejects any further request authenticated with
+// it, so the kite can't register itself or get new tokens anymore. The kites
+// use the ID of their kite key as their kite ID by default, if the kite with
+// the ID is connected, it's disconnected immediately, which also removes it
+// from the storage.
+//
+// Kontrol hands out the same token to all kites of a user asking for a token
+// of the same kite until it expires, see generateToken, so revoking a token
+// revokes it for all of them. The following requests get a new token.
+//
+// The kite keys don't expire, so the revocation is kept forever. Use
+// RevokeToken for tokens, their revocations are dropped once they expire.
+func (k *Kontrol) Revoke(id string) error {
+	if err := k.revoke(revocation{claim: "jti", value: id}, time.Time{}); err != nil {
+		return err
+	}
+
+	k.disconnect(id)
+	return nil
+}
+
+// RevokeToken invalidates the given token like Revoke does with its ID. The
+// revocation is kept until the token expires, so the list doesn't grow
+// unbounded. The signature of the token is not verified, only its claims are
+// read.
+func (k *Kontrol) RevokeToken(token string) error {
+	id, expires, err := tokenExpiry(token)
+	if err != nil {
+		return err
+	}
+
+	return k.revoke(revocation{claim: "jti", value: id}, expires)
+}
+
+// tokenExpiry returns the ID of the token and the time its revocation can be
+// dropped, when it's expired even for the kites tolerating the clock skew.
+func tokenExpiry(token string) (id string, expires time.Time, err error) {
+	tkn, _ := jwt.Parse(token, nil)
+	if tkn == nil {
+		return "", time.Time{}, errors.New("invalid token")
+	}
+
+	id, ok := tkn.Claims["jti"].(string)
+	if !ok || id == "" {
+		return "", time.Time{}, errors.New("token has no ID")
+	}
+
+	// a token without exp never expires
+	if exp, ok := tkn.Claims["exp"].(float64); ok {
+		expires = time.Unix(int64(exp), 0).Add(TokenLeeway)
+	}
+
+	return id, expires, nil
+}
+
+// RevokeUser invalidates all kite keys and tokens of the given username, the
+// sub claim of the tokens, like Revoke does for a single one. The revocation
+// is kept forever. The connected kites of the user are disconnected.
+func (k *Kontrol) RevokeUser(username string) error {
+	if err := k.revoke(revocation{claim: "sub", value: username}, time.Time{}); err != nil {
+		return err
+	}
+
+	var clients []*kite.Client
+
+	k.clientsMu.Lock()
+	for _, c := range k.clients {
+		if c.Kite.Username == username {
+			clients = append(clients, c)
+		}
+	}
+	k.clientsMu.Unlock()
+
+	for _, c := range clients {
+		log.Info("Disconnecting revoked kite: %s", c.Kite)
+		c.Close()
+	}
+
+	return nil
+}
+
+// disconnect closes the connection of the kite with the given ID, if it's
+// connected.
+func (k *Kontrol) disconnect(id string) {
+	k.clientsMu.Lock()
+	c, ok := k.clients[id]
+	k.clientsMu.Unlock()
+
+	if ok {
+		log.Info("Disconnecting revoked kite: %s", c.Kite)
+		c.Close()
+	}
+}
+
+// revocations returns the storage of the revocations, the storage of kontrol
+// if it can keep them.
+func (k *Kontrol) revocations() RevocationStorage {
+	if s, ok := k.storage.(RevocationStorage); ok {
+		return s
+	}
+
+	return k.revoked
+}
+
+// revoke stores the revocation r. It's dropped after expires, a zero expires
+// keeps it forever. The cached tokens with the revoked ID are dropped, so
+// they aren't handed out anymore.
+func (k *Kontrol) revoke(r revocation, expires time.Time) error {
+	if err := k.revocations().Revoke(r.claim, r.value, expires); err != nil {
+		return err
+	}
+
+	if r.claim == "jti" {
+		dropCachedToken(r.value)
+	}
+
+	return nil
+}
+
+// dropCachedToken removes the token with the given ID from the token cache.
+func dropCachedToken(id string) {
+	tokenCacheMu.Lock()
+	defer tokenCacheMu.Unlock()
+
+	for key, signed := range tokenCache {
+		if tkn, _ := jwt.Parse(signed, nil); tkn != nil && tkn.Claims["jti"] == id {
+			delete(tokenCache, key)
+		}
+	}
+}
+
+// IsRevoked returns true if the kite key or the token with the given ID is
+// revoked.
+func (k *Kontrol) IsRevoked(id string) bool {
+	return isRevoked(k.revocations(), revocation{claim: "jti", value: id})
+}
+
+// IsUserRevoked returns true if the kite keys and the tokens of the given
+// username are revoked.
+func (k *Kontrol) IsUserRevoked(username string) bool {
+	return isRevoked(k.revocations(), revocation{claim: "sub", value: username})
+}
+
+// isRevoked returns true if r is revoked in the storage. The kites are
+// treated as revoked if the storage fails, so a revoked kite isn't accepted
+// while the storage is unavailable.
+func isRevoked(s RevocationStorage, r revocation) bool {
+	revoked, err := s.IsRevoked(r.claim, r.value)
+	if err != nil {
+		log.Error("checking the revocation of %s %q: %s", r.claim, r.value, err)
+		return true
+	}
+
+	return revoked
+}
+
+// RevocationChecker returns a function for kite.Kite.IsRevoked, checking the
+// revocations in the given storage. The kites sharing the storage with
+// kontrol reject the revoked kite keys and tokens with it, otherwise they
+// accept the tokens until they expire. It returns nil if the storage can't
+// keep revocations.
+func RevocationChecker(storage Storage) func(id, username string) bool {
+	s, ok := storage.(RevocationStorage)
+	if !ok {
+		return nil
+	}
+
+	return func(id, username string) bool {
+		return isRevoked(s, revocation{claim: "sub", value: username}) ||
+			id != "" && isRevoked(s, revocation{claim: "jti", value: id})
+	}
+}
+
+// handleRevoked is a PreHandler that rejects requests authenticated with a
+// revoked kite key or token. The kite ID sent by the caller is not trusted,
+// the claims of the token the request is authenticated with are checked.
+func (k *Kontrol) handleRevoked(r *kite.Request) (interface{}, error) {
+	revoked := k.IsUserRevoked(r.Username)
+
+	if id, ok := tokenClaims(r)["jti"].(string); ok && k.IsRevoked(id) {
+		revoked = true
+	}
+
+	if revoked {
+		k.Kite.ReportRejection(r, kite.RejectRevoked, ErrRevoked)
+		return nil, ErrRevoked
+	}
+
+	return nil, nil
+}
+
+// tokenClaims returns the claims of the token the request is authenticated
+// with, nil if it's not a token. The PreHandlers run after the request is
+// authenticated, so the signature is not verified again.
+func tokenClaims(r *kite.Request) map[string]interface{} {
+	if r.Auth == nil {
+		return nil
+	}
+
+	token, _ := jwt.Parse(r.Auth.Key, nil)
+	if token == nil {
+		return nil
+	}
+
+	return token.Claims
+}
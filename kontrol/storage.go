@@ -1,10 +1,52 @@
 package kontrol
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-version"
 	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
 	"github.com/koding/kite/protocol"
 )
 
+var (
+	// ErrKiteNotFound is returned when the kite doesn't exist in the storage.
+	ErrKiteNotFound = errors.New("kite not found")
+
+	// ErrTooManyResults is returned when a query matches more kites than
+	// the storage is configured to return. The query should be narrowed.
+	ErrTooManyResults = errors.New("too many results, please narrow the query")
+
+	// ErrCapabilitiesNotSupported is returned by the storages that can't
+	// query the kites by their capabilities.
+	ErrCapabilitiesNotSupported = errors.New("querying by capabilities is not supported")
+
+	// ErrTagsNotSupported is returned by the storages that can't query the
+	// kites by their tags.
+	ErrTagsNotSupported = errors.New("querying by tags is not supported")
+
+	// ErrSinceUpdatedAtNotSupported is returned by the storages that don't
+	// keep the update times of the kites to query them by SinceUpdatedAt.
+	ErrSinceUpdatedAtNotSupported = errors.New("querying by the update time is not supported")
+
+	// ErrReadOnly is returned by the methods modifying a storage that is
+	// configured to be read-only.
+	ErrReadOnly = errors.New("storage is read-only")
+
+	// ErrStorageTimeout is returned to the clients if the storage doesn't
+	// answer a query within the Kontrol's GetKitesTimeout.
+	ErrStorageTimeout = errors.New("kontrol: storage query timed out, try another kontrol")
+
+	// ErrClaimLost is returned when a claim is renewed or released by a
+	// claimant that doesn't hold it, like after it's expired, and when the
+	// kites are claimed by another claimant.
+	ErrClaimLost = errors.New("claim is not held")
+
+	errInvalidNotification = errors.New("invalid notification")
+)
+
 // Storage is an interface to a kite storage. A storage should be safe to
 // concurrent access.
 type Storage interface {
@@ -23,3 +65,101 @@ type Storage interface {
 	// Upsert inserts or updates the value for the given kite
 	Upsert(kite *protocol.Kite, value *kontrolprotocol.RegisterValue) error
 }
+
+// ContextGetter is implemented by storages whose queries can be cancelled.
+type ContextGetter interface {
+	GetContext(ctx context.Context, query *protocol.KontrolQuery) (Kites, error)
+}
+
+// GetResult is the result of a query with the number of kites matched before
+// and after filtering them by the version constraint of the query. If
+// BeforeFilter is zero the query didn't match any kite, if only AfterFilter
+// is zero no kite satisfied the version constraint.
+type GetResult struct {
+	Kites        Kites
+	BeforeFilter int
+	AfterFilter  int
+}
+
+// Clock tells the time to the storages. It can be replaced in tests, so the
+// time dependent code can be tested without sleeping.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel the current time is sent to after the given
+	// duration.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock of the real time.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// ErrInvalidKiteID is returned when the ID of a kite is not a valid UUID.
+type ErrInvalidKiteID struct {
+	ID string
+}
+
+func (e *ErrInvalidKiteID) Error() string {
+	return fmt.Sprintf("invalid kite id %q, it must be a UUID", e.ID)
+}
+
+// StorageError is returned when modifying a kite in the storage fails. It
+// tells which kite and operation failed, so the callers modifying many kites
+// can handle the failures one by one.
+type StorageError struct {
+	Op     string // like "add", "update", "upsert" or "delete"
+	KiteID string
+	Err    error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("storage %s of kite %s: %s", e.Op, e.KiteID, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// newStorageError returns a StorageError wrapping err. It returns nil if err
+// is nil.
+func newStorageError(op, kiteID string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &StorageError{Op: op, KiteID: kiteID, Err: err}
+}
+
+// StorageEvent is sent by a StorageWatcher when a kite is added to or deleted
+// from the storage.
+type StorageEvent struct {
+	Action protocol.KiteAction
+	Kite   protocol.Kite
+
+	// URL, Capabilities and Tags are only set for the protocol.Register
+	// action
+	URL          string
+	Capabilities []string
+	Tags         []string
+}
+
+// StorageWatcher is implemented by storages that can notify about the kites
+// added and deleted by any kontrol instance sharing the storage. An event
+// with the protocol.Resync action is sent when events might have been
+// missed, consumers must re-read everything with Get then.
+type StorageWatcher interface {
+	Watch() (<-chan *StorageEvent, error)
+}
+
+// ConstraintGetter is implemented by storages that can retrieve kites with an
+// already parsed version constraint, so callers filtering with the same
+// constraint frequently don't need to parse it for every call. A non-nil
+// constraint is preferred over the version field of the query.
+type ConstraintGetter interface {
+	GetWithConstraint(query *protocol.KontrolQuery, constraint version.Constraints) (Kites, error)
+}
@@ -0,0 +1,84 @@
+package kontrol_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gocql/gocql"
+	"github.com/koding/kite"
+	"github.com/koding/kite/kontrol"
+	"github.com/koding/kite/kontrol/storagetest"
+)
+
+// The storages other than Memory and Bolt need a server, they are tested if
+// KONTROL_STORAGE is set to their name.
+func TestStorageConformance(t *testing.T) {
+	log := kite.New("storage-test", "0.0.1").Log
+
+	storages := []struct {
+		name string
+		new  func(t *testing.T) (kontrol.Storage, func())
+	}{
+		{"memory", func(t *testing.T) (kontrol.Storage, func()) {
+			return kontrol.NewMemory(), func() {}
+		}},
+		{"bolt", func(t *testing.T) (kontrol.Storage, func()) {
+			dir, err := ioutil.TempDir("", "kontrol-bolt")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b := kontrol.NewBolt(filepath.Join(dir, "kontrol.db"), log)
+			return b, func() {
+				b.Close()
+				os.RemoveAll(dir)
+			}
+		}},
+		{"postgres", func(t *testing.T) (kontrol.Storage, func()) {
+			p := kontrol.NewPostgres(nil, log)
+			return p, func() { p.Close() }
+		}},
+		{"mysql", func(t *testing.T) (kontrol.Storage, func()) {
+			m := kontrol.NewMySQL(nil, log)
+			return m, func() { m.Close() }
+		}},
+		{"etcd", func(t *testing.T) (kontrol.Storage, func()) {
+			return kontrol.NewEtcd(nil, log), func() {}
+		}},
+		{"consul", func(t *testing.T) (kontrol.Storage, func()) {
+			return kontrol.NewConsul(nil, log), func() {}
+		}},
+		{"dynamodb", func(t *testing.T) (kontrol.Storage, func()) {
+			return kontrol.NewDynamoDB(&kontrol.DynamoDBConfig{
+				Endpoint: os.Getenv("KONTROL_DYNAMODB_ENDPOINT"),
+			}, log), func() {}
+		}},
+		{"cassandra", func(t *testing.T) (kontrol.Storage, func()) {
+			cluster := gocql.NewCluster("127.0.0.1")
+			cluster.Keyspace = os.Getenv("KONTROL_CASSANDRA_KEYSPACE")
+			if cluster.Keyspace == "" {
+				cluster.Keyspace = "kontrol"
+			}
+
+			c := kontrol.NewCassandra(cluster, log)
+			return c, func() { c.Close() }
+		}},
+	}
+
+	for _, storage := range storages {
+		storage := storage
+		t.Run(storage.name, func(t *testing.T) {
+			if storage.name != "memory" && storage.name != "bolt" &&
+				os.Getenv("KONTROL_STORAGE") != storage.name {
+				t.Skipf("KONTROL_STORAGE is not %s", storage.name)
+			}
+
+			s, cleanup := storage.new(t)
+			defer cleanup()
+
+			storagetest.Run(t, s)
+		})
+	}
+}
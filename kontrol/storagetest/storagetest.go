@@ -0,0 +1,178 @@
+// Package storagetest provides a conformance suite for the implementations of
+// the kontrol.Storage interface.
+package storagetest
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/kontrol"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+// Run tests the given storage against the behaviour expected by kontrol. The
+// kites are registered under a username unique to the run, so it can be run
+// against a storage shared with other tests. The kites are deleted when it
+// returns.
+func Run(t *testing.T, s kontrol.Storage) {
+	username := "storagetest" + protocol.NewKiteID()[:8]
+
+	newKite := func(name, version, hostname string) *protocol.Kite {
+		return &protocol.Kite{
+			Username:    username,
+			Environment: "production",
+			Name:        name,
+			Version:     version,
+			Region:      "sj",
+			Hostname:    hostname,
+			ID:          protocol.NewKiteID(),
+		}
+	}
+
+	k1 := newKite("worker", "1.0.0", "host1")
+	k2 := newKite("worker", "2.0.0", "host2")
+	k3 := newKite("workerx", "1.0.0", "host3")
+
+	defer func() {
+		for _, k := range []*protocol.Kite{k1, k2, k3} {
+			s.Delete(k)
+		}
+	}()
+
+	for _, k := range []*protocol.Kite{k1, k2, k3} {
+		if err := s.Add(k, &kontrolprotocol.RegisterValue{URL: "http://" + k.Hostname + "/kite"}); err != nil {
+			t.Fatalf("add %s: %s", k, err)
+		}
+	}
+
+	workers := &protocol.KontrolQuery{Username: username, Environment: "production", Name: "worker"}
+
+	get := func(query *protocol.KontrolQuery) kontrol.Kites {
+		kites, err := s.Get(query)
+		if err != nil {
+			t.Fatalf("get %+v: %s", query, err)
+		}
+
+		return kites
+	}
+
+	ids := func(kites kontrol.Kites) []string {
+		ids := make([]string, 0, len(kites))
+		for _, k := range kites {
+			ids = append(ids, k.Kite.ID)
+		}
+
+		sort.Strings(ids)
+		return ids
+	}
+
+	expect := func(what string, kites kontrol.Kites, want ...*protocol.Kite) {
+		wantIDs := make([]string, 0, len(want))
+		for _, k := range want {
+			wantIDs = append(wantIDs, k.ID)
+		}
+
+		sort.Strings(wantIDs)
+
+		if got := ids(kites); !equal(got, wantIDs) {
+			t.Errorf("%s: got kites %v, want %v", what, got, wantIDs)
+		}
+	}
+
+	expect("name query", get(workers), k1, k2)
+
+	expect("username query", get(&protocol.KontrolQuery{Username: username}), k1, k2, k3)
+
+	exact := *workers
+	exact.Version = "1.0.0"
+	expect("exact version query", get(&exact), k1)
+
+	constraint := *workers
+	constraint.Version = ">= 2.0.0"
+	expect("version constraint query", get(&constraint), k2)
+
+	constraint.Version = "< 1.0.0"
+	expect("unmatched version constraint query", get(&constraint))
+
+	// the storages keep the update times with different precisions
+	since := &protocol.KontrolQuery{Username: username, SinceUpdatedAt: time.Now().Add(-time.Hour)}
+	if kites, err := s.Get(since); err != kontrol.ErrSinceUpdatedAtNotSupported {
+		if err != nil {
+			t.Fatalf("get %+v: %s", since, err)
+		}
+
+		expect("updated since query", kites, k1, k2, k3)
+
+		since.SinceUpdatedAt = time.Now().Add(time.Hour)
+		expect("updated since query in the future", get(since))
+	}
+
+	kites := get(&protocol.KontrolQuery{ID: k3.ID})
+	expect("ID query", kites, k3)
+
+	if len(kites) == 1 {
+		if kites[0].Kite != *k3 {
+			t.Errorf("ID query: got kite %+v, want %+v", kites[0].Kite, *k3)
+		}
+
+		if kites[0].URL != "http://host3/kite" {
+			t.Errorf("ID query: got URL %q, want %q", kites[0].URL, "http://host3/kite")
+		}
+	}
+
+	if err := s.Update(k1, &kontrolprotocol.RegisterValue{URL: "http://host1:4000/kite"}); err != nil {
+		t.Fatalf("update %s: %s", k1, err)
+	}
+
+	expectURL := func(what string, k *protocol.Kite, url string) {
+		kites := get(&protocol.KontrolQuery{ID: k.ID})
+		if len(kites) != 1 || kites[0].URL != url {
+			t.Errorf("%s: got %+v, want the kite %s with URL %q", what, kites, k.ID, url)
+		}
+	}
+
+	expectURL("update", k1, "http://host1:4000/kite")
+
+	if err := s.Upsert(k2, &kontrolprotocol.RegisterValue{URL: "http://host2:4000/kite"}); err != nil {
+		t.Fatalf("upsert %s: %s", k2, err)
+	}
+
+	expectURL("upsert of an existing kite", k2, "http://host2:4000/kite")
+
+	k4 := newKite("worker", "3.0.0", "host4")
+	defer s.Delete(k4)
+
+	if err := s.Upsert(k4, &kontrolprotocol.RegisterValue{URL: "http://host4/kite"}); err != nil {
+		t.Fatalf("upsert %s: %s", k4, err)
+	}
+
+	expectURL("upsert of a new kite", k4, "http://host4/kite")
+	expect("name query after upsert", get(workers), k1, k2, k4)
+
+	if err := s.Delete(k2); err != nil {
+		t.Fatalf("delete %s: %s", k2, err)
+	}
+
+	expect("name query after delete", get(workers), k1, k4)
+
+	// some storages return an error for the IDs that don't exist
+	if kites, err := s.Get(&protocol.KontrolQuery{ID: k2.ID}); err == nil && len(kites) != 0 {
+		t.Errorf("ID query after delete: got %+v, want no kites", kites)
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,167 @@
+package kontrol
+
+import (
+	"errors"
+
+	"github.com/hashicorp/go-version"
+	"github.com/koding/kite"
+	"github.com/koding/kite/dnode"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+	"github.com/nu7hatch/gouuid"
+)
+
+// watcher sends the register and deregister events of the kites that are
+// matching its query to a remote kite.
+type watcher struct {
+	query    *protocol.KontrolQuery
+	callback dnode.Function
+	token    string
+
+	// constraint is non-nil if the query's version field is a constraint
+	// like ">= 1.0, < 1.4" instead of an exact version.
+	constraint version.Constraints
+}
+
+func newWatcher(query *protocol.KontrolQuery, callback dnode.Function, token string) (*watcher, error) {
+	if query == nil {
+		return nil, errors.New("empty query")
+	}
+
+	if _, err := GetQueryKey(query); err != nil {
+		return nil, err
+	}
+
+	w := &watcher{
+		query:    query,
+		callback: callback,
+		token:    token,
+	}
+
+	// the constraint is parsed once, not for every event
+	constraint, err := versionConstraint(query)
+	if err != nil {
+		return nil, err
+	}
+	w.constraint = constraint
+
+	return w, nil
+}
+
+// match returns true if the given kite matches the watcher's query. Empty
+// fields of the query match any value. The capabilities and tags of the
+// query are checked against the value the kite is registered with. They are
+// not checked if the value is nil, like for the deregistered kites, whose
+// events are harmless to the watchers that don't know them.
+func (w *watcher) match(k *protocol.Kite, value *kontrolprotocol.RegisterValue) bool {
+	if !matchQuery(k, w.query, w.constraint) {
+		return false
+	}
+
+	if value == nil {
+		return true
+	}
+
+	return hasCapabilities(value.Capabilities, w.query.Capabilities) && hasTags(value.Tags, w.query)
+}
+
+// send sends the event to the remote kite if the event's kite matches the
+// query. Resync events are sent to all watchers.
+func (w *watcher) send(e protocol.KiteEvent, value *kontrolprotocol.RegisterValue) {
+	if e.Action != protocol.Resync && !w.match(&e.Kite, value) {
+		return
+	}
+
+	if e.Action == protocol.Register {
+		e.Token = w.token
+	}
+
+	if err := w.callback.Call(kite.Response{Result: e}); err != nil {
+		log.Warning("watcher: cannot send event: %s", err)
+	}
+}
+
+// addWatcher starts sending the events matching the query to the given
+// callback until the watcher is canceled or the remote kite disconnects.
+// It returns the ID of the watcher.
+//
+// If the storage is not a StorageWatcher, only the events of the kites that
+// are registered to this kontrol instance are sent.
+func (k *Kontrol) addWatcher(r *kite.Client, query *protocol.KontrolQuery, callback dnode.Function, token string) (string, error) {
+	w, err := newWatcher(query, callback, token)
+	if err != nil {
+		return "", err
+	}
+
+	watcherID, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+
+	id := watcherID.String()
+
+	k.watchersMu.Lock()
+	k.watchers[id] = w
+	k.watchersMu.Unlock()
+
+	r.OnDisconnect(func() {
+		k.cancelWatcher(id)
+	})
+
+	return id, nil
+}
+
+func (k *Kontrol) handleCancelWatcher(r *kite.Request) (interface{}, error) {
+	id := r.Args.One().MustString()
+	return nil, k.cancelWatcher(id)
+}
+
+func (k *Kontrol) cancelWatcher(watcherID string) error {
+	k.watchersMu.Lock()
+	defer k.watchersMu.Unlock()
+
+	if _, ok := k.watchers[watcherID]; !ok {
+		return errors.New("Watcher not found")
+	}
+
+	delete(k.watchers, watcherID)
+	return nil
+}
+
+// publishStorageEvents sends the events of the storage to the watchers until
+// the channel is closed.
+func (k *Kontrol) publishStorageEvents(events <-chan *StorageEvent) {
+	for e := range events {
+		var value *kontrolprotocol.RegisterValue
+		if e.Action == protocol.Register {
+			value = &kontrolprotocol.RegisterValue{
+				URL:          e.URL,
+				Capabilities: e.Capabilities,
+				Tags:         e.Tags,
+			}
+		}
+
+		k.publish(protocol.KiteEvent{
+			Action: e.Action,
+			Kite:   e.Kite,
+			URL:    e.URL,
+		}, value)
+	}
+}
+
+// publish sends the event to all watchers with a matching query. The value is
+// the one the kite is registered with, it's nil for the other actions.
+func (k *Kontrol) publish(e protocol.KiteEvent, value *kontrolprotocol.RegisterValue) {
+	k.watchersMu.Lock()
+	watchers := make([]*watcher, 0, len(k.watchers))
+	for _, w := range k.watchers {
+		watchers = append(watchers, w)
+	}
+	k.watchersMu.Unlock()
+
+	// callbacks are called outside of the lock, so a slow remote kite
+	// doesn't block registrations.
+	for _, w := range watchers {
+		w.send(e, value)
+	}
+}
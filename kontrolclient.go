@@ -3,6 +3,7 @@ package kite
 
 import (
 	"container/list"
+	"context"
 	"errors"
 	"math/rand"
 	"net/url"
@@ -10,12 +11,15 @@ import (
 	"sync"
 	"time"
 
+	"github.com/cenkalti/backoff"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/koding/kite/dnode"
 	"github.com/koding/kite/protocol"
 )
 
 const (
+	// kontrolRetryDuration is the longest wait between the register
+	// attempts, they are retried with an exponential backoff.
 	kontrolRetryDuration = 10 * time.Second
 	proxyRetryDuration   = 10 * time.Second
 )
@@ -45,6 +49,21 @@ type kontrolClient struct {
 
 	// registerChan registers the url's it receives from the channel to Kontrol
 	registerChan chan *url.URL
+
+	// cache keeps the results of GetKites, if it's enabled
+	cache *discoveryCache
+
+	// activeURL is the URL of the kontrol connected to, protected by the
+	// mutex
+	activeURL string
+
+	// relayURL is the URL of the proxy kite the kite is reachable with, if
+	// it's registered with RegisterWithRelay, protected by the mutex
+	relayURL string
+
+	// registered is true once the kite is registered with Register, until
+	// it's deregistered on Shutdown, protected by the mutex
+	registered bool
 }
 
 // Event is the struct that is emitted from Kontrol.WatchKites method.
@@ -56,6 +75,9 @@ type Event struct {
 
 type registerResult struct {
 	URL *url.URL
+
+	// HeartbeatInterval is the interval kontrol expects heartbeats with.
+	HeartbeatInterval time.Duration
 }
 
 // SetupKontrolClient setups and prepares a the kontrol instance. It connects
@@ -67,11 +89,16 @@ func (k *Kite) SetupKontrolClient() error {
 		return nil // already prepared
 	}
 
-	if k.Config.KontrolURL == "" {
+	urls := k.kontrolURLs()
+	if len(urls) == 0 {
 		return errors.New("no kontrol URL given in config")
 	}
 
-	client := k.NewClient(k.Config.KontrolURL)
+	client := k.NewClient(urls[0])
+	if len(urls) > 1 {
+		client.failoverURLs = urls
+	}
+
 	client.Kite = protocol.Kite{Name: "kontrol"} // for logging purposes
 	client.Auth = &Auth{
 		Type: "kiteKey",
@@ -85,7 +112,12 @@ func (k *Kite) SetupKontrolClient() error {
 	k.kontrol.watchers = list.New()
 
 	k.kontrol.OnConnect(func() {
-		k.Log.Info("Connected to Kontrol ")
+		activeURL := client.dialURL()
+		k.Log.Info("Connected to Kontrol %s", activeURL)
+
+		k.kontrol.Lock()
+		k.kontrol.activeURL = activeURL
+		k.kontrol.Unlock()
 
 		// try to re-register on connect
 		if k.kontrol.lastRegisteredURL != nil {
@@ -112,6 +144,10 @@ func (k *Kite) SetupKontrolClient() error {
 
 	k.kontrol.OnDisconnect(func() {
 		k.Log.Warning("Disconnected from Kontrol.")
+
+		k.kontrol.Lock()
+		k.kontrol.activeURL = ""
+		k.kontrol.Unlock()
 	})
 
 	// non blocking, is going to reconnect if the connection goes down.
@@ -122,8 +158,36 @@ func (k *Kite) SetupKontrolClient() error {
 	return nil
 }
 
+// kontrolURLs returns the URLs of the kontrols in the order they are tried.
+func (k *Kite) kontrolURLs() []string {
+	var urls []string
+	seen := make(map[string]bool)
+
+	for _, u := range append([]string{k.Config.KontrolURL}, k.Config.KontrolURLs...) {
+		if u == "" || seen[u] {
+			continue
+		}
+
+		seen[u] = true
+		urls = append(urls, u)
+	}
+
+	return urls
+}
+
+// KontrolURL returns the URL of the kontrol the kite is connected to, or an
+// empty string if it's not connected.
+func (k *Kite) KontrolURL() string {
+	k.kontrol.Lock()
+	defer k.kontrol.Unlock()
+
+	return k.kontrol.activeURL
+}
+
 // WatchKites watches for Kites that matches the query. The onEvent functions
-// is called for current kites and every nekite event.
+// is called for current kites and every nekite event. An event with the
+// protocol.Resync action means events might have been missed, the current
+// kites should be re-read with GetKites.
 func (k *Kite) WatchKites(query *protocol.KontrolQuery, onEvent EventHandler) (*Watcher, error) {
 	if err := k.SetupKontrolClient(); err != nil {
 		return nil, err
@@ -193,7 +257,19 @@ func (k *Kite) GetKites(query *protocol.KontrolQuery) ([]*Client, error) {
 		return nil, err
 	}
 
-	clients, _, err := k.getKites(protocol.GetKitesArgs{Query: query})
+	var clients []*Client
+	var err error
+
+	if k.Config.DiscoveryCacheTTL > 0 {
+		var kites []*protocol.KiteWithToken
+		kites, err = k.getCachedKites(query)
+		if err == nil {
+			clients, err = k.newKiteClients(kites)
+		}
+	} else {
+		clients, _, err = k.getKites(protocol.GetKitesArgs{Query: query})
+	}
+
 	if err != nil {
 		return nil, err
 	}
@@ -205,26 +281,117 @@ func (k *Kite) GetKites(query *protocol.KontrolQuery) ([]*Client, error) {
 	return clients, nil
 }
 
+// GetOwnKites returns the other registrations of this kite in kontrol: the
+// kites with the same username, environment, name, region and hostname, but
+// a different ID. They are usually left by the previous processes of the kite
+// that crashed, and can be removed with Deregister instead of waiting for
+// kontrol to expire them.
+func (k *Kite) GetOwnKites() ([]*protocol.Kite, error) {
+	if err := k.SetupKontrolClient(); err != nil {
+		return nil, err
+	}
+
+	self := k.Kite()
+
+	// the discovery cache is skipped, a stale result would hide the kites
+	// that registered recently
+	result, err := k.fetchKites(protocol.GetKitesArgs{
+		Query: &protocol.KontrolQuery{
+			Username:    self.Username,
+			Environment: self.Environment,
+			Name:        self.Name,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var kites []*protocol.Kite
+	for _, kt := range result.Kites {
+		if kt.Kite.Region == self.Region && kt.Kite.Hostname == self.Hostname && kt.Kite.ID != self.ID {
+			kite := kt.Kite
+			kites = append(kites, &kite)
+		}
+	}
+
+	return kites, nil
+}
+
+// Deregister removes a stale registration of this kite returned by
+// GetOwnKites from kontrol. Kontrol refuses to remove the kites that are
+// still sending heartbeats, to it or to another kontrol.
+func (k *Kite) Deregister(kite *protocol.Kite) error {
+	if err := k.SetupKontrolClient(); err != nil {
+		return err
+	}
+
+	<-k.kontrol.readyConnected
+
+	_, err := k.kontrol.TellWithTimeout("deregister", 4*time.Second, kite)
+	return err
+}
+
+// deregister removes the registration of this kite from kontrol if it's
+// registered, so the other kites aren't routed to it while it's shutting
+// down.
+func (k *Kite) deregister(ctx context.Context) error {
+	k.kontrol.Lock()
+	c, registered := k.kontrol.Client, k.kontrol.registered
+	k.kontrol.registered = false
+	k.kontrol.Unlock()
+
+	if c == nil || !registered {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 4*time.Second)
+	defer cancel()
+
+	_, err := c.TellWithContext(ctx, "deregister", k.Kite())
+	return err
+}
+
 // used internally for GetKites() and WatchKites()
 func (k *Kite) getKites(args protocol.GetKitesArgs) (kites []*Client, watcherID string, err error) {
+	result, err := k.fetchKites(args)
+	if err != nil {
+		return nil, "", err
+	}
+
+	clients, err := k.newKiteClients(result.Kites)
+	if err != nil {
+		return nil, result.WatcherID, err
+	}
+
+	return clients, result.WatcherID, nil
+}
+
+// fetchKites calls the getKites method of kontrol.
+func (k *Kite) fetchKites(args protocol.GetKitesArgs) (*protocol.GetKitesResult, error) {
 	<-k.kontrol.readyConnected
 
 	response, err := k.kontrol.TellWithTimeout("getKites", 4*time.Second, args)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
 	var result = new(protocol.GetKitesResult)
 	err = response.Unmarshal(&result)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
-	clients := make([]*Client, len(result.Kites))
-	for i, currentKite := range result.Kites {
+	return result, nil
+}
+
+// newKiteClients returns the clients of the kites returned by kontrol. Their
+// tokens are renewed when they expire.
+func (k *Kite) newKiteClients(kites []*protocol.KiteWithToken) ([]*Client, error) {
+	clients := make([]*Client, len(kites))
+	for i, currentKite := range kites {
 		_, err := jwt.Parse(currentKite.Token, k.RSAKey)
 		if err != nil {
-			return nil, result.WatcherID, err
+			return nil, err
 		}
 
 		// exp := time.Unix(int64(token.Claims["exp"].(float64)), 0).UTC()
@@ -236,6 +403,13 @@ func (k *Kite) getKites(args protocol.GetKitesArgs) (kites []*Client, watcherID
 		clients[i] = k.NewClient(currentKite.URL)
 		clients[i].Kite = currentKite.Kite
 		clients[i].Auth = auth
+		clients[i].Weight = currentKite.Weight
+
+		// the alternate URLs, ending with the relay of the kite if it
+		// has one, are dialed if URL can't be
+		if len(currentKite.URLs) > 0 {
+			clients[i].failoverURLs = append([]string{currentKite.URL}, currentKite.URLs...)
+		}
 	}
 
 	// Renew tokens
@@ -248,7 +422,7 @@ func (k *Kite) getKites(args protocol.GetKitesArgs) (kites []*Client, watcherID
 		token.RenewWhenExpires()
 	}
 
-	return clients, result.WatcherID, nil
+	return clients, nil
 }
 
 // GetToken is used to get a new token for a single Kite.
@@ -273,6 +447,30 @@ func (k *Kite) GetToken(kite *protocol.Kite) (string, error) {
 	return tkn, nil
 }
 
+// GetTokens is used to get tokens for many kites in a single request. The
+// kites are identified by their IDs. The error is only returned if the whole
+// request fails, errors for single kites are returned in the Errors field of
+// the result.
+func (k *Kite) GetTokens(ids []string) (*protocol.GetTokensResult, error) {
+	if err := k.SetupKontrolClient(); err != nil {
+		return nil, err
+	}
+
+	<-k.kontrol.readyConnected
+
+	response, err := k.kontrol.TellWithTimeout("getTokens", 4*time.Second, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var result protocol.GetTokensResult
+	if err := response.Unmarshal(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
 // Create new Client from Register events. It panics if the action is not
 // Register.
 func (e *Event) Client() *Client {
@@ -308,11 +506,14 @@ func (k *Kite) signalReady() {
 func (k *Kite) RegisterForever(kiteURL *url.URL) error {
 	errs := make(chan error, 1)
 	go func() {
+		b := newRegisterBackOff()
+
 		for u := range k.kontrol.registerChan {
 			_, err := k.Register(u)
 			if err == nil {
 				k.kontrol.lastRegisteredURL = u
 				k.signalReady()
+				b.Reset()
 				continue
 			}
 
@@ -321,10 +522,10 @@ func (k *Kite) RegisterForever(kiteURL *url.URL) error {
 			default:
 			}
 
-			k.Log.Error("Cannot register to Kontrol: %s Will retry after %d seconds",
-				err, kontrolRetryDuration/time.Second)
+			wait := b.NextBackOff()
+			k.Log.Warning("Cannot register to Kontrol: %s Will retry after %s", err, wait)
 
-			time.AfterFunc(kontrolRetryDuration, func() {
+			time.AfterFunc(wait, func() {
 				select {
 				case k.kontrol.registerChan <- u:
 				default:
@@ -349,6 +550,49 @@ func (k *Kite) RegisterForever(kiteURL *url.URL) error {
 	}
 }
 
+// RegisterWithContext is like Register, but it retries with an exponential
+// backoff until the kite is registered or ctx is done, so the kite can be
+// started before kontrol is reachable. The error of ctx is returned if it's
+// done first.
+func (k *Kite) RegisterWithContext(ctx context.Context, kiteURL *url.URL) (*registerResult, error) {
+	if err := k.SetupKontrolClient(); err != nil {
+		return nil, err
+	}
+
+	b := newRegisterBackOff()
+
+	for {
+		select {
+		case <-k.kontrol.readyConnected:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		result, err := k.Register(kiteURL)
+		if err == nil {
+			return result, nil
+		}
+
+		wait := b.NextBackOff()
+		k.Log.Warning("Cannot register to Kontrol: %s Will retry after %s", err, wait)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// newRegisterBackOff returns the backoff of the register attempts, which
+// never stops.
+func newRegisterBackOff() *backoff.ExponentialBackOff {
+	b := backoff.NewExponentialBackOff()
+	b.MaxInterval = kontrolRetryDuration
+	b.MaxElapsedTime = 0
+	return b
+}
+
 // Register registers current Kite to Kontrol. After registration other Kites
 // can find it via GetKites() or WatchKites() method.  This method does not
 // handle the reconnection case. If you want to keep registered to kontrol, use
@@ -361,7 +605,13 @@ func (k *Kite) Register(kiteURL *url.URL) (*registerResult, error) {
 	<-k.kontrol.readyConnected
 
 	args := protocol.RegisterArgs{
-		URL: kiteURL.String(),
+		URL:  kiteURL.String(),
+		URLs: k.registerURLs(),
+		TTL:  int64(k.Config.RegisterTTL / time.Second),
+
+		Capabilities: k.Config.Capabilities,
+		Tags:         k.Config.Tags,
+		Weight:       k.weight(),
 	}
 
 	k.Log.Info("Registering to kontrol with URL: %s", kiteURL.String())
@@ -380,12 +630,41 @@ func (k *Kite) Register(kiteURL *url.URL) (*registerResult, error) {
 	k.Log.Info("Registered to kontrol with URL: %s and Kite query: %s",
 		rr.URL, k.Kite())
 
+	k.kontrol.Lock()
+	k.kontrol.registered = true
+	k.kontrol.Unlock()
+
 	parsed, err := url.Parse(rr.URL)
 	if err != nil {
 		k.Log.Error("Cannot parse registered URL: %s", err.Error())
 	}
 
-	return &registerResult{parsed}, nil
+	heartbeat := time.Duration(rr.HeartbeatInterval) * time.Second
+	if heartbeat != 0 {
+		k.Log.Debug("Kontrol expects heartbeats every %s", heartbeat)
+	}
+
+	return &registerResult{
+		URL:               parsed,
+		HeartbeatInterval: heartbeat,
+	}, nil
+}
+
+// registerURLs returns the alternate URLs the kite is registered with. The
+// relay URL is the last one, so the clients try it only when they can't
+// reach the kite directly.
+func (k *Kite) registerURLs() []string {
+	k.kontrol.Lock()
+	relayURL := k.kontrol.relayURL
+	k.kontrol.Unlock()
+
+	if relayURL == "" {
+		return k.Config.AlternateURLs
+	}
+
+	urls := make([]string, 0, len(k.Config.AlternateURLs)+1)
+	urls = append(urls, k.Config.AlternateURLs...)
+	return append(urls, relayURL)
 }
 
 // RegisterToTunnel finds a tunnel proxy kite by asking kontrol then registers
@@ -410,6 +689,33 @@ func (k *Kite) RegisterToTunnel() {
 func (k *Kite) RegisterToProxy(registerURL *url.URL, query *protocol.KontrolQuery) {
 	go k.RegisterForever(nil)
 
+	k.proxyLoop(registerURL, query, func(proxyURL *url.URL) {
+		k.kontrol.registerChan <- proxyURL
+	})
+}
+
+// RegisterWithRelay is like RegisterForever, but the kite is also registered
+// to a proxy kite found with the given query, and the proxy URL is registered
+// to kontrol as the relay of the kite. The kites discovering it dial
+// registerURL and fall back to the relay if they can't reach the kite, like
+// when it's behind a firewall or NAT. This is a blocking function.
+func (k *Kite) RegisterWithRelay(registerURL *url.URL, query *protocol.KontrolQuery) {
+	go k.RegisterForever(nil)
+
+	k.proxyLoop(registerURL, query, func(proxyURL *url.URL) {
+		k.kontrol.Lock()
+		k.kontrol.relayURL = proxyURL.String()
+		k.kontrol.Unlock()
+
+		// registered again, so kontrol has the new relay URL
+		k.kontrol.registerChan <- registerURL
+	})
+}
+
+// proxyLoop registers registerURL to a proxy kite and calls registered with
+// the proxy URL. It registers to a proxy kite again whenever it's
+// disconnected.
+func (k *Kite) proxyLoop(registerURL *url.URL, query *protocol.KontrolQuery, registered func(proxyURL *url.URL)) {
 	for {
 		var proxyKite *Client
 
@@ -453,7 +759,7 @@ func (k *Kite) RegisterToProxy(registerURL *url.URL, query *protocol.KontrolQuer
 			continue
 		}
 
-		k.kontrol.registerChan <- proxyURL
+		registered(proxyURL)
 
 		// Block until disconnect from Proxy Kite.
 		<-disconnect
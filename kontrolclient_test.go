@@ -0,0 +1,48 @@
+package kite
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRegisterWithContext(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.KontrolURL = "http://127.0.0.1:1/kite" // nothing listens here
+	defer k.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := k.RegisterWithContext(ctx, &url.URL{Scheme: "http", Host: "127.0.0.1:3999"})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestRegisterBackOff(t *testing.T) {
+	b := newRegisterBackOff()
+
+	for i := 0; i < 20; i++ {
+		wait := b.NextBackOff()
+		if wait <= 0 || wait > kontrolRetryDuration*3/2 {
+			t.Fatalf("unexpected backoff %s at attempt %d", wait, i)
+		}
+	}
+}
+
+func TestKontrolURLs(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.KontrolURL = "http://kontrol1/kite"
+	k.Config.KontrolURLs = []string{"http://kontrol2/kite", "http://kontrol1/kite", ""}
+
+	urls := k.kontrolURLs()
+	if len(urls) != 2 || urls[0] != "http://kontrol1/kite" || urls[1] != "http://kontrol2/kite" {
+		t.Errorf("unexpected kontrol URLs: %v", urls)
+	}
+
+	if u := k.KontrolURL(); u != "" {
+		t.Errorf("expected no active kontrol, got %s", u)
+	}
+}
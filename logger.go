@@ -1,6 +1,7 @@
 package kite
 
 import (
+	"io"
 	"os"
 	"os/signal"
 	"strings"
@@ -95,6 +96,43 @@ func newLogger(name string) (Logger, func(Level)) {
 	return logger, setLevel
 }
 
+// NewLoggerWithWriter returns a logger writing to w instead of stdout and
+// stderr, like a buffer to assert on the logs in tests, and a function to
+// change its level. The level is set as for the default logger of a kite.
+// The output is colorized only if w is a terminal. It can replace the logger
+// of a kite:
+//
+//	k.Log, k.SetLogLevel = kite.NewLoggerWithWriter("math", &buf)
+func NewLoggerWithWriter(name string, w io.Writer) (Logger, func(Level)) {
+	logger := logging.NewLogger(name)
+	logger.SetLevel(convertLevel(getLogLevel()))
+
+	handler := logging.NewWriterHandler(w)
+	handler.Colorize = isTerminal(w) && os.Getenv("KITE_LOG_NOCOLOR") == ""
+	logger.SetHandler(handler)
+
+	setLevel := func(l Level) {
+		logger.SetLevel(convertLevel(l))
+	}
+
+	return logger, setLevel
+}
+
+// isTerminal returns true if w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
 // SetupSignalHandler listens to signals and toggles the log level to DEBUG
 // mode when it received a SIGUSR2 signal. Another SIGUSR2 toggles the log
 // level back to the old level.
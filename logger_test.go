@@ -0,0 +1,45 @@
+package kite
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIsTerminal(t *testing.T) {
+	if isTerminal(&bytes.Buffer{}) {
+		t.Error("a buffer is not a terminal")
+	}
+
+	f, err := ioutil.TempFile("", "kite-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if isTerminal(f) {
+		t.Error("a regular file is not a terminal")
+	}
+}
+
+func TestNewLoggerWithWriter(t *testing.T) {
+	var buf bytes.Buffer
+
+	k := New("exp", "0.0.1")
+	k.Log, k.SetLogLevel = NewLoggerWithWriter("exp", &buf)
+
+	// the level can be changed as the level of the default logger
+	k.SetLogLevel(DEBUG)
+	k.Log.Debug("debug %d", 1)
+
+	if !strings.Contains(buf.String(), "debug 1") {
+		t.Errorf("expected the message to be written to the writer, got %q", buf.String())
+	}
+
+	if strings.Contains(buf.String(), "\x1b[") {
+		t.Errorf("expected no colors for a buffer, got %q", buf.String())
+	}
+}
@@ -25,6 +25,11 @@ type Handler interface {
 	ServeKite(*Request) (result interface{}, err error)
 }
 
+// Middleware wraps the handling of the method calls. The returned Handler can
+// run code before and after calling next, or reject the call by returning an
+// error without calling it.
+type Middleware func(next Handler) Handler
+
 // HandlerFunc is a type adapter to allow the use of ordinary functions as
 // Kite handlers. If h is a function with the appropriate signature,
 // HandlerFunc(h) is a Handler object that calls h.
@@ -53,6 +58,12 @@ type Method struct {
 	// handling defines how to handle chaining of kite.Handler middlewares.
 	handling MethodHandling
 
+	// description is returned by the "kite.methods" method.
+	description string
+
+	// namespace is the namespace the method is registered in, if any.
+	namespace *Namespace
+
 	// initialized is used to indicate whether all pre and post handlers are
 	// initialized.
 	initialized bool
@@ -86,6 +97,13 @@ func (m *Method) DisableAuthentication() *Method {
 	return m
 }
 
+// Description sets the description of the method, which is returned with its
+// name by the "kite.methods" method.
+func (m *Method) Description(description string) *Method {
+	m.description = description
+	return m
+}
+
 // PreHandler adds a new kite handler which is executed before the method.
 func (m *Method) PreHandle(handler Handler) *Method {
 	m.preHandlers = append(m.preHandlers, handler)
@@ -149,6 +167,30 @@ func (k *Kite) PostHandleFunc(handler HandlerFunc) {
 	k.PostHandle(handler)
 }
 
+// Use registers middlewares that are invoked around every method call,
+// including its pre and post handlers. Unlike PreHandle and PostHandle, a
+// middleware sees both the request and the result, like for logging or
+// metrics. The first registered middleware is the outermost one. Panics in
+// the middlewares are recovered like in the handlers.
+func (k *Kite) Use(middlewares ...Middleware) {
+	k.middlewares = append(k.middlewares, middlewares...)
+}
+
+// withMiddlewares returns the handler of the method wrapped with the
+// middlewares of its namespace and of the kite.
+func (k *Kite) withMiddlewares(m *Method) Handler {
+	var h Handler = m
+	if m.namespace != nil {
+		h = m.namespace.wrap(h)
+	}
+
+	for i := len(k.middlewares) - 1; i >= 0; i-- {
+		h = k.middlewares[i](h)
+	}
+
+	return h
+}
+
 func (m *Method) ServeKite(r *Request) (interface{}, error) {
 	var firstResp interface{}
 	var resp interface{}
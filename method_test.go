@@ -2,6 +2,7 @@ package kite
 
 import (
 	"errors"
+	"strings"
 	"testing"
 	"time"
 )
@@ -197,3 +198,89 @@ func TestMethod_Base(t *testing.T) {
 	}
 
 }
+
+func TestMethod_Middlewares(t *testing.T) {
+	k := New("testkite", "0.0.1")
+
+	var calls []string
+	k.Use(func(next Handler) Handler {
+		return HandlerFunc(func(r *Request) (interface{}, error) {
+			calls = append(calls, "outer")
+			return next.ServeKite(r)
+		})
+	}, func(next Handler) Handler {
+		return HandlerFunc(func(r *Request) (interface{}, error) {
+			if r.Username != "admin" {
+				return nil, errors.New("rejected")
+			}
+
+			calls = append(calls, "inner")
+			return next.ServeKite(r)
+		})
+	})
+
+	m := k.HandleFunc("foo", func(r *Request) (interface{}, error) {
+		calls = append(calls, "handler")
+		return "handle", nil
+	})
+
+	result, err := k.withMiddlewares(m).ServeKite(&Request{Username: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != "handle" {
+		t.Errorf("expected the handler's response, got %v", result)
+	}
+
+	if strings.Join(calls, ",") != "outer,inner,handler" {
+		t.Errorf("unexpected call order: %v", calls)
+	}
+
+	calls = nil
+	if _, err := k.withMiddlewares(m).ServeKite(&Request{Username: "guest"}); err == nil {
+		t.Error("expected the call to be rejected")
+	}
+
+	if strings.Join(calls, ",") != "outer" {
+		t.Errorf("handler is called after rejection: %v", calls)
+	}
+}
+
+func TestMethod_PanicRecovery(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+	k.Config.Port = 9999
+
+	k.HandleFunc("panic", func(r *Request) (interface{}, error) {
+		panic("something went wrong")
+	})
+
+	k.HandleFunc("foo", func(r *Request) (interface{}, error) {
+		return "handle", nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient("http://127.0.0.1:9999/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := c.TellWithTimeout("panic", 4*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "something went wrong") {
+		t.Errorf("expected the panic as an error, got %v", err)
+	}
+
+	// the kite keeps serving after the panic
+	result, err := c.TellWithTimeout("foo", 4*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.MustString() != "handle" {
+		t.Errorf("expected handle, got %s", result.MustString())
+	}
+}
@@ -0,0 +1,187 @@
+package kite
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics holds the raw counters of a kite. It can be used to wire the values
+// to any metrics system. MetricsHandler serves them in the Prometheus text
+// format. The fields must be read with the sync/atomic functions.
+type Metrics struct {
+	// ActiveConnections is the number of kites connected to this kite.
+	ActiveConnections int64
+
+	// TotalCalls is the total number of method calls received.
+	TotalCalls uint64
+
+	// InFlightCalls is the number of method calls being handled.
+	InFlightCalls int64
+
+	// BytesIn and BytesOut are the total sizes of the messages received
+	// and sent on all connections, as they are on the wire.
+	BytesIn  uint64
+	BytesOut uint64
+
+	// SendQueueDepth is the number of messages queued to be sent on all
+	// connections, and SendQueueDropped the number of messages dropped
+	// because a peer couldn't keep up, see Config.SendQueuePolicy.
+	SendQueueDepth   int64
+	SendQueueDropped uint64
+
+	// calls counts the calls of each method
+	calls   map[string]*uint64
+	callsMu sync.Mutex
+
+	// rejections counts the rejected calls by their reasons
+	rejections   map[string]*uint64
+	rejectionsMu sync.Mutex
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		calls:      make(map[string]*uint64),
+		rejections: make(map[string]*uint64),
+	}
+}
+
+// Rejections returns the number of calls rejected for the given reason, see
+// Rejection.
+func (m *Metrics) Rejections(reason string) uint64 {
+	m.rejectionsMu.Lock()
+	n, ok := m.rejections[reason]
+	m.rejectionsMu.Unlock()
+
+	if !ok {
+		return 0
+	}
+
+	return atomic.LoadUint64(n)
+}
+
+// rejected records a call rejected for the given reason.
+func (m *Metrics) rejected(reason string) {
+	m.rejectionsMu.Lock()
+	n, ok := m.rejections[reason]
+	if !ok {
+		n = new(uint64)
+		m.rejections[reason] = n
+	}
+	m.rejectionsMu.Unlock()
+
+	atomic.AddUint64(n, 1)
+}
+
+// MethodCalls returns the number of calls received for the given method.
+func (m *Metrics) MethodCalls(method string) uint64 {
+	m.callsMu.Lock()
+	n, ok := m.calls[method]
+	m.callsMu.Unlock()
+
+	if !ok {
+		return 0
+	}
+
+	return atomic.LoadUint64(n)
+}
+
+// callStarted records a call of the given method. The returned function must
+// be called once it's handled.
+func (m *Metrics) callStarted(method string) func() {
+	m.callsMu.Lock()
+	n, ok := m.calls[method]
+	if !ok {
+		n = new(uint64)
+		m.calls[method] = n
+	}
+	m.callsMu.Unlock()
+
+	atomic.AddUint64(n, 1)
+	atomic.AddUint64(&m.TotalCalls, 1)
+	atomic.AddInt64(&m.InFlightCalls, 1)
+
+	return func() {
+		atomic.AddInt64(&m.InFlightCalls, -1)
+	}
+}
+
+// Metrics returns the metrics of the kite.
+func (k *Kite) Metrics() *Metrics {
+	return k.metrics
+}
+
+// MetricsHandler returns an HTTP handler that serves the metrics of the kite
+// in the Prometheus text format.
+func (k *Kite) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		k.writeMetrics(w)
+	})
+}
+
+func (k *Kite) writeMetrics(w io.Writer) {
+	m := k.metrics
+
+	writeMetric(w, "kite_active_connections", "gauge",
+		"Number of kites connected to this kite.", atomic.LoadInt64(&m.ActiveConnections))
+
+	writeMetric(w, "kite_calls_total", "counter",
+		"Total number of method calls received.", atomic.LoadUint64(&m.TotalCalls))
+
+	writeMetric(w, "kite_in_flight_calls", "gauge",
+		"Number of method calls being handled.", atomic.LoadInt64(&m.InFlightCalls))
+
+	writeMetric(w, "kite_received_bytes_total", "counter",
+		"Total size of the received messages.", atomic.LoadUint64(&m.BytesIn))
+
+	writeMetric(w, "kite_sent_bytes_total", "counter",
+		"Total size of the sent messages.", atomic.LoadUint64(&m.BytesOut))
+
+	writeMetric(w, "kite_send_queue_depth", "gauge",
+		"Number of messages queued to be sent.", atomic.LoadInt64(&m.SendQueueDepth))
+
+	writeMetric(w, "kite_send_queue_dropped_total", "counter",
+		"Total number of messages dropped from the send queues.", atomic.LoadUint64(&m.SendQueueDropped))
+
+	m.callsMu.Lock()
+	methods := make([]string, 0, len(m.calls))
+	for method := range m.calls {
+		methods = append(methods, method)
+	}
+	m.callsMu.Unlock()
+	sort.Strings(methods)
+
+	const name = "kite_method_calls_total"
+	fmt.Fprintf(w, "# HELP %s Total number of calls of each method.\n", name)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+
+	for _, method := range methods {
+		fmt.Fprintf(w, "%s{method=%q} %d\n", name, method, m.MethodCalls(method))
+	}
+
+	m.rejectionsMu.Lock()
+	reasons := make([]string, 0, len(m.rejections))
+	for reason := range m.rejections {
+		reasons = append(reasons, reason)
+	}
+	m.rejectionsMu.Unlock()
+	sort.Strings(reasons)
+
+	const rejectedName = "kite_rejected_calls_total"
+	fmt.Fprintf(w, "# HELP %s Total number of rejected calls by their reasons.\n", rejectedName)
+	fmt.Fprintf(w, "# TYPE %s counter\n", rejectedName)
+
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "%s{reason=%q} %d\n", rejectedName, reason, m.Rejections(reason))
+	}
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
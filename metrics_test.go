@@ -0,0 +1,39 @@
+package kite
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	m := k.Metrics()
+
+	done := m.callStarted("square")
+	m.callStarted("square")()
+
+	if n := atomic.LoadInt64(&m.InFlightCalls); n != 1 {
+		t.Errorf("expected 1 call in flight, got %d", n)
+	}
+
+	done()
+
+	if n := m.MethodCalls("square"); n != 2 {
+		t.Errorf("expected 2 calls of square, got %d", n)
+	}
+
+	var buf bytes.Buffer
+	k.writeMetrics(&buf)
+
+	for _, line := range []string{
+		"kite_calls_total 2",
+		"kite_in_flight_calls 0",
+		`kite_method_calls_total{method="square"} 2`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, buf.String())
+		}
+	}
+}
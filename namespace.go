@@ -0,0 +1,76 @@
+package kite
+
+import "strings"
+
+// Namespace registers a group of methods under a common prefix, so a kite can
+// host several APIs without name collisions. It's created with
+// Kite.Namespace:
+//
+//	billing := k.Namespace("billing")
+//	billing.HandleFunc("charge", charge) // handles "billing.charge"
+//	billing.HandleFunc("refund", refund) // handles "billing.refund"
+type Namespace struct {
+	kite   *Kite
+	parent *Namespace
+	prefix string
+
+	// middlewares are wrapped around the calls of the methods in the
+	// namespace, inside the ones of the kite
+	middlewares []Middleware
+}
+
+// Namespace returns a namespace registering its methods with the given
+// prefix and a dot, like "billing.charge" for the prefix "billing".
+func (k *Kite) Namespace(prefix string) *Namespace {
+	return &Namespace{
+		kite:   k,
+		prefix: strings.TrimSuffix(prefix, "."),
+	}
+}
+
+// Namespace returns a namespace nested in n, like "billing.invoices" for the
+// prefix "invoices" of the "billing" namespace.
+func (n *Namespace) Namespace(prefix string) *Namespace {
+	return &Namespace{
+		kite:   n.kite,
+		parent: n,
+		prefix: n.prefix + "." + strings.TrimSuffix(prefix, "."),
+	}
+}
+
+// Prefix returns the prefix of the methods of the namespace, without the
+// trailing dot.
+func (n *Namespace) Prefix() string {
+	return n.prefix
+}
+
+// Handle registers the handler for the given method in the namespace.
+func (n *Namespace) Handle(method string, handler Handler) *Method {
+	m := n.kite.addHandle(n.prefix+"."+method, handler)
+	m.namespace = n
+	return m
+}
+
+// HandleFunc registers the handler function for the given method in the
+// namespace.
+func (n *Namespace) HandleFunc(method string, handler HandlerFunc) *Method {
+	return n.Handle(method, handler)
+}
+
+// Use registers middlewares that are invoked around the calls of the methods
+// in the namespace and in its nested namespaces, like Kite.Use.
+func (n *Namespace) Use(middlewares ...Middleware) {
+	n.middlewares = append(n.middlewares, middlewares...)
+}
+
+// wrap returns h wrapped with the middlewares of the namespace and of its
+// parents, the parents' ones being the outer ones.
+func (n *Namespace) wrap(h Handler) Handler {
+	for ; n != nil; n = n.parent {
+		for i := len(n.middlewares) - 1; i >= 0; i-- {
+			h = n.middlewares[i](h)
+		}
+	}
+
+	return h
+}
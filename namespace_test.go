@@ -0,0 +1,62 @@
+package kite
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNamespace(t *testing.T) {
+	k := New("exp", "0.0.1")
+
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(r *Request) (interface{}, error) {
+				calls = append(calls, name)
+				return next.ServeKite(r)
+			})
+		}
+	}
+
+	k.Use(record("kite"))
+
+	billing := k.Namespace("billing")
+	billing.Use(record("billing"))
+
+	invoices := billing.Namespace("invoices")
+	invoices.Use(record("invoices"))
+	invoices.HandleFunc("list", func(r *Request) (interface{}, error) {
+		return "invoices", nil
+	})
+
+	k.HandleFunc("list", func(r *Request) (interface{}, error) {
+		return "root", nil
+	})
+
+	m, ok := k.handlers["billing.invoices.list"]
+	if !ok {
+		t.Fatal("method is not registered with the prefix")
+	}
+
+	result, err := k.withMiddlewares(m).ServeKite(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != "invoices" {
+		t.Errorf("got %v, want the namespaced method's result", result)
+	}
+
+	if want := []string{"kite", "billing", "invoices"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("got middlewares %v, want %v", calls, want)
+	}
+
+	calls = nil
+	if result, _ := k.withMiddlewares(k.handlers["list"]).ServeKite(&Request{}); result != "root" {
+		t.Errorf("got %v, want the root method's result", result)
+	}
+
+	if want := []string{"kite"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("got middlewares %v, want %v", calls, want)
+	}
+}
@@ -0,0 +1,243 @@
+package kite
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/koding/kite/dnode"
+)
+
+// ClientPoolOptions are the options of a ClientPool.
+type ClientPoolOptions struct {
+	// Auth is used by all clients of the pool.
+	Auth *Auth
+
+	// HealthCheckInterval is the interval the clients are pinged with the
+	// "kite.ping" method. Clients that don't respond are replaced with new
+	// connections. Defaults to 30 seconds.
+	HealthCheckInterval time.Duration
+
+	// HealthCheckTimeout is the duration a client has to respond to the
+	// ping. Defaults to 5 seconds.
+	HealthCheckTimeout time.Duration
+}
+
+// ClientPool keeps multiple connections to the same remote kite and
+// distributes the calls across them in round-robin order. It's useful when
+// a single connection can't keep up with the calls, like in proxies. Its
+// methods are the same as of Client.
+type ClientPool struct {
+	// URL of the remote kite
+	URL string
+
+	localKite *Kite
+	opts      ClientPoolOptions
+
+	clients   []*Client
+	clientsMu sync.RWMutex // protects clients
+	next      uint32
+
+	closeC    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewClientPool returns a pool of size clients to the kite at remoteURL. The
+// clients are not connected, call Dial before making calls. opts can be nil.
+func (k *Kite) NewClientPool(remoteURL string, size int, opts *ClientPoolOptions) *ClientPool {
+	if size < 1 {
+		panic("kite: client pool size must be positive")
+	}
+
+	p := &ClientPool{
+		URL:       remoteURL,
+		localKite: k,
+		clients:   make([]*Client, size),
+		closeC:    make(chan struct{}),
+	}
+
+	if opts != nil {
+		p.opts = *opts
+	}
+
+	if p.opts.HealthCheckInterval == 0 {
+		p.opts.HealthCheckInterval = 30 * time.Second
+	}
+
+	if p.opts.HealthCheckTimeout == 0 {
+		p.opts.HealthCheckTimeout = 5 * time.Second
+	}
+
+	for i := range p.clients {
+		p.clients[i] = p.newClient()
+	}
+
+	return p
+}
+
+func (p *ClientPool) newClient() *Client {
+	c := p.localKite.NewClient(p.URL)
+	c.Auth = p.opts.Auth
+	return c
+}
+
+// Dial connects all clients of the pool and starts the health checks. If a
+// client can't connect, the connected ones are closed and the error is
+// returned.
+func (p *ClientPool) Dial() error {
+	p.clientsMu.RLock()
+	clients := p.clients
+	p.clientsMu.RUnlock()
+
+	for i, c := range clients {
+		if err := c.Dial(); err != nil {
+			for _, connected := range clients[:i] {
+				connected.Close()
+			}
+
+			return err
+		}
+	}
+
+	go p.runHealthCheck()
+
+	return nil
+}
+
+// Close stops the health checks and closes all clients of the pool.
+func (p *ClientPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closeC)
+	})
+
+	p.clientsMu.RLock()
+	defer p.clientsMu.RUnlock()
+
+	for _, c := range p.clients {
+		c.Close()
+	}
+}
+
+// Client returns the next client of the pool in round-robin order.
+func (p *ClientPool) Client() *Client {
+	i := atomic.AddUint32(&p.next, 1)
+
+	p.clientsMu.RLock()
+	defer p.clientsMu.RUnlock()
+
+	return p.clients[int(i)%len(p.clients)]
+}
+
+// Tell calls Tell on the next client of the pool.
+func (p *ClientPool) Tell(method string, args ...interface{}) (*dnode.Partial, error) {
+	return p.Client().Tell(method, args...)
+}
+
+// TellWithTimeout calls TellWithTimeout on the next client of the pool.
+func (p *ClientPool) TellWithTimeout(method string, timeout time.Duration, args ...interface{}) (*dnode.Partial, error) {
+	return p.Client().TellWithTimeout(method, timeout, args...)
+}
+
+// TellWithContext calls TellWithContext on the next client of the pool.
+func (p *ClientPool) TellWithContext(ctx context.Context, method string, args ...interface{}) (*dnode.Partial, error) {
+	return p.Client().TellWithContext(ctx, method, args...)
+}
+
+// Go calls Go on the next client of the pool.
+func (p *ClientPool) Go(method string, args ...interface{}) chan *response {
+	return p.Client().Go(method, args...)
+}
+
+// GoWithTimeout calls GoWithTimeout on the next client of the pool.
+func (p *ClientPool) GoWithTimeout(method string, timeout time.Duration, args ...interface{}) chan *response {
+	return p.Client().GoWithTimeout(method, timeout, args...)
+}
+
+// runHealthCheck pings the clients periodically until the pool is closed.
+func (p *ClientPool) runHealthCheck() {
+	ticker := time.NewTicker(p.opts.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.healthCheck()
+		case <-p.closeC:
+			return
+		}
+	}
+}
+
+// healthCheck pings all clients and replaces the ones that don't respond.
+func (p *ClientPool) healthCheck() {
+	p.clientsMu.RLock()
+	clients := make([]*Client, len(p.clients))
+	copy(clients, p.clients)
+	p.clientsMu.RUnlock()
+
+	var wg sync.WaitGroup
+
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *Client) {
+			defer wg.Done()
+
+			err := p.ping(c)
+			if err == nil {
+				return
+			}
+
+			p.localKite.Log.Warning("Client %d of the pool to %s is not healthy: %s", i, p.URL, err)
+
+			if err := p.replace(i, c); err != nil {
+				p.localKite.Log.Warning("Cannot replace client %d of the pool to %s: %s", i, p.URL, err)
+			}
+		}(i, c)
+	}
+
+	wg.Wait()
+}
+
+// ping calls the "kite.ping" method of the client.
+func (p *ClientPool) ping(c *Client) error {
+	result, err := c.TellWithTimeout("kite.ping", p.opts.HealthCheckTimeout)
+	if err != nil {
+		return err
+	}
+
+	if s, err := result.String(); err != nil || s != "pong" {
+		return errors.New("unexpected ping response")
+	}
+
+	return nil
+}
+
+// replace connects a new client and replaces the old one at index i with
+// it. The old client is kept if the new one can't connect, so it's tried to
+// be replaced again with the next health check.
+func (p *ClientPool) replace(i int, old *Client) error {
+	c := p.newClient()
+	if err := c.Dial(); err != nil {
+		return err
+	}
+
+	// Close closes the pool before locking the clients, so either the pool
+	// is seen closed here or Close closes the new client
+	p.clientsMu.Lock()
+	select {
+	case <-p.closeC:
+		// the pool is closed while dialing
+		p.clientsMu.Unlock()
+		c.Close()
+		return nil
+	default:
+	}
+
+	p.clients[i] = c
+	p.clientsMu.Unlock()
+
+	old.Close()
+	return nil
+}
@@ -0,0 +1,30 @@
+package kite
+
+import "testing"
+
+func TestClientPoolRoundRobin(t *testing.T) {
+	p := New("exp", "0.0.1").NewClientPool("http://127.0.0.1:9999/kite", 3, &ClientPoolOptions{
+		Auth: &Auth{Type: "kiteKey", Key: "key"},
+	})
+
+	seen := make(map[*Client]int)
+	for i := 0; i < 9; i++ {
+		c := p.Client()
+		if c.Auth == nil || c.Auth.Key != "key" {
+			t.Fatal("pool options are not applied to the clients")
+		}
+
+		seen[c]++
+	}
+
+	if len(seen) != 3 {
+		t.Fatalf("expected 3 distinct clients, got %d", len(seen))
+	}
+
+	for _, n := range seen {
+		if n != 3 {
+			t.Errorf("calls are not distributed evenly: %v", seen)
+			break
+		}
+	}
+}
@@ -8,8 +8,10 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/koding/kite/dnode"
+	"github.com/nu7hatch/gouuid"
 )
 
 // Kite is the base struct containing the public fields. It is usually embeded
@@ -24,7 +26,8 @@ type Kite struct {
 
 	// Every Kite instance has different identifier.
 	// If a kite is restarted, it's id will change.
-	// This is generated on the Kite.
+	// This is generated on the Kite, it must be a UUID like the ones
+	// returned by NewKiteID.
 	ID string `json:"id"`
 
 	// Environment is defines as something like "production", "testing",
@@ -43,6 +46,17 @@ type Kite struct {
 	Hostname string `json:"hostname"`
 }
 
+// NewKiteID returns a new random (version 4) UUID to be used as the ID of a
+// kite. It panics if the random bytes can't be read.
+func NewKiteID() string {
+	id, err := uuid.NewV4()
+	if err != nil {
+		panic(fmt.Sprintf("kite: cannot generate unique ID: %s", err))
+	}
+
+	return id.String()
+}
+
 func (k Kite) String() string {
 	return "/" + k.Username +
 		"/" + k.Environment +
@@ -115,11 +129,39 @@ func KiteFromString(stringRepr string) (*Kite, error) {
 // method.
 type RegisterArgs struct {
 	URL string `json:"url"`
+
+	// URLs are the alternate URLs the kite can be reached with, in addition
+	// to URL. They are optional.
+	URLs []string `json:"urls,omitempty"`
+
+	// TTL in seconds after which the kite is removed if it doesn't send any
+	// heartbeats. It's optional, kontrol's default is used if zero.
+	TTL int64 `json:"ttl,omitempty"`
+
+	// Capabilities advertised by the kite, like "gpu" or "ssd". Kites can
+	// be queried by them with KontrolQuery.Capabilities.
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Tags are free-form labels of the kite, like "team:payments" or
+	// "tier:canary". Kites can be queried by them with KontrolQuery.Tags
+	// and KontrolQuery.AnyTags.
+	Tags []string `json:"tags,omitempty"`
+
+	// Weight is the share of the traffic the kite should receive relative
+	// to the other kites of a query, see WeightedPick. It's updated with
+	// the heartbeats if the kite has a health score. Zero means the
+	// default weight of 1.
+	Weight float64 `json:"weight,omitempty"`
 }
 
 // RegisterResult is a response to Register request from Kite to Kontrol.
 type RegisterResult struct {
 	URL string `json:"url"`
+
+	// HeartbeatInterval is the interval in seconds the registered kite is
+	// expected to send heartbeats with. It's derived from the expire
+	// interval of kontrol's storage.
+	HeartbeatInterval int64 `json:"heartbeatInterval,omitempty"`
 }
 
 type GetKitesArgs struct {
@@ -137,10 +179,33 @@ type GetKitesResult struct {
 	WatcherID string           `json:"watcherID,omitempty"`
 }
 
+// GetTokensResult is the response of Kontrol's getTokens method. Both maps
+// are keyed by kite ID. A kite ID is either in Tokens or in Errors.
+type GetTokensResult struct {
+	Tokens map[string]string `json:"tokens"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
 type KiteWithToken struct {
 	Kite  Kite   `json:"kite"`
 	URL   string `json:"url"`
 	Token string `json:"token"`
+
+	// URLs are the alternate URLs of the kite, if it's registered with
+	// any. The clients returned by GetKites dial them in order when URL
+	// can't be dialed. The relay URL of the kite, if any, is the last one.
+	URLs []string `json:"urls,omitempty"`
+
+	// Weight is the weight the kite is registered with, zero if it's the
+	// default or the storage of kontrol doesn't keep it.
+	Weight float64 `json:"weight,omitempty"`
+
+	// Tags are the tags the kite is registered with.
+	Tags []string `json:"tags,omitempty"`
+
+	// Capabilities are the capabilities the kite is registered with, if
+	// the storage of kontrol keeps them.
+	Capabilities []string `json:"capabilities,omitempty"`
 }
 
 // KiteEvent is the struct that is sent as an argument in watchCallback of
@@ -159,6 +224,11 @@ type KiteAction string
 const (
 	Register   KiteAction = "REGISTER"
 	Deregister KiteAction = "DEREGISTER"
+
+	// Resync is sent when events might have been missed, for example after
+	// kontrol reconnected to its storage. The current kites should be
+	// re-read with a new query.
+	Resync KiteAction = "RESYNC"
 )
 
 // KontrolQuery is a structure of message sent to Kontrol. It is used for
@@ -174,6 +244,93 @@ type KontrolQuery struct {
 	Region      string `json:"region"`
 	Hostname    string `json:"hostname"`
 	ID          string `json:"id"`
+
+	// Capabilities the kites must all have. It's not a part of the key,
+	// therefore it's not included in Fields and String. It's only supported
+	// by some kontrol storages.
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Tags the kites must all have, and AnyTags the kites must have at
+	// least one of. As Capabilities, they are not a part of the key and
+	// they are only supported by some kontrol storages.
+	Tags    []string `json:"tags,omitempty"`
+	AnyTags []string `json:"anyTags,omitempty"`
+
+	// SinceUpdatedAt restricts the query to the kites updated after the
+	// given time, if it's not zero. It's useful to poll for the changes
+	// only. As Capabilities, it's not a part of the key and it's only
+	// supported by some kontrol storages, the others return an error.
+	SinceUpdatedAt time.Time `json:"sinceUpdatedAt,omitempty"`
+
+	// Selection is the order of the kites returned, they are shuffled by
+	// default. As Capabilities, it's not a part of the key.
+	Selection Selection `json:"selection,omitempty"`
+}
+
+// Selection is the order of the kites returned by kontrol for a query.
+type Selection string
+
+const (
+	// Shuffle returns the kites in random order, so the callers picking the
+	// first one are spread over them. It's the default.
+	Shuffle Selection = "shuffle"
+
+	// SortByVersion returns the kites sorted by their versions, the oldest
+	// first. The kites with the same version are sorted by their IDs.
+	SortByVersion Selection = "version"
+
+	// SortByID returns the kites sorted by their IDs, so the callers picking
+	// the first one stick to the same kite.
+	SortByID Selection = "id"
+
+	// None returns the kites in the order of the storage.
+	None Selection = "none"
+)
+
+// String returns the query in the same form as Kite.String, empty fields are
+// left empty.
+func (k KontrolQuery) String() string {
+	return "/" + k.Username +
+		"/" + k.Environment +
+		"/" + k.Name +
+		"/" + k.Version +
+		"/" + k.Region +
+		"/" + k.Hostname +
+		"/" + k.ID
+}
+
+// ParseKontrolQuery returns the query of the given path, like
+// "/devrim/production/mathworker". It's the inverse of KontrolQuery.String.
+// The fields are in the order of the Kite fields, the trailing ones can be
+// omitted or empty, but a field can't follow an empty one.
+func ParseKontrolQuery(path string) (*KontrolQuery, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid query path, it must start with a slash: %s", path)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(path[1:], "/"), "/")
+	if len(fields) > 7 {
+		return nil, fmt.Errorf("invalid query path, it has more than 7 fields: %s", path)
+	}
+
+	var values [7]string
+	for i, field := range fields {
+		if field != "" && i > 0 && fields[i-1] == "" {
+			return nil, fmt.Errorf("invalid query path, field %d follows an empty field: %s", i+1, path)
+		}
+
+		values[i] = field
+	}
+
+	return &KontrolQuery{
+		Username:    values[0],
+		Environment: values[1],
+		Name:        values[2],
+		Version:     values[3],
+		Region:      values[4],
+		Hostname:    values[5],
+		ID:          values[6],
+	}, nil
 }
 
 func (k KontrolQuery) Fields() map[string]string {
@@ -1,6 +1,10 @@
 package protocol
 
-import "testing"
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
 
 var (
 	k = Kite{
@@ -45,6 +49,19 @@ func TestKiteString(t *testing.T) {
 	expect(d.Hostname, "hostname")
 }
 
+func TestNewKiteID(t *testing.T) {
+	v4 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+	id := NewKiteID()
+	if !v4.MatchString(id) {
+		t.Errorf("%q is not a v4 UUID", id)
+	}
+
+	if other := NewKiteID(); other == id {
+		t.Errorf("got the same ID twice: %q", id)
+	}
+}
+
 func TestKiteQuery(t *testing.T) {
 	q := k.Query()
 	expect := func(expecting, got string) {
@@ -61,3 +78,41 @@ func TestKiteQuery(t *testing.T) {
 	expect(q.Version, "version")
 	expect(q.Hostname, "hostname")
 }
+
+func TestParseKontrolQuery(t *testing.T) {
+	q, err := ParseKontrolQuery(k.Query().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(q, k.Query()) {
+		t.Errorf("got %+v, want %+v", q, k.Query())
+	}
+
+	for path, want := range map[string]KontrolQuery{
+		"/":                        {},
+		"/devrim":                  {Username: "devrim"},
+		"/devrim/production/math/": {Username: "devrim", Environment: "production", Name: "math"},
+		"/devrim/production//////": {Username: "devrim", Environment: "production"},
+	} {
+		q, err := ParseKontrolQuery(path)
+		if err != nil {
+			t.Errorf("%s: %s", path, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(*q, want) {
+			t.Errorf("%s: got %+v, want %+v", path, q, want)
+		}
+	}
+
+	for _, path := range []string{
+		"devrim/production",
+		"/devrim//math",
+		"/a/b/c/d/e/f/g/h",
+	} {
+		if _, err := ParseKontrolQuery(path); err == nil {
+			t.Errorf("%s: expected an error", path)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package kite
+
+import (
+	"errors"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite/protocol"
+)
+
+// The reasons of the rejected calls, see Rejection.
+const (
+	// RejectUnauthenticated is for the calls with missing or invalid
+	// credentials, like a token with a bad signature.
+	RejectUnauthenticated = "unauthenticated"
+
+	// RejectExpired is for the calls with an expired or not yet valid
+	// token.
+	RejectExpired = "expired"
+
+	// RejectRevoked is for the calls of revoked kites. It's reported by the
+	// kites that revoke others, like kontrol, and the kites checking the
+	// revocations with Kite.IsRevoked.
+	RejectRevoked = "revoked"
+
+	// RejectPermissionDenied is for the calls denied by the Authorizer.
+	RejectPermissionDenied = "permissionDenied"
+
+	// RejectRateLimited is for the calls exceeding the concurrency limits
+	// of the config.
+	RejectRateLimited = "rateLimited"
+
+	// RejectShuttingDown is for the calls received after Kite.Shutdown is
+	// called.
+	RejectShuttingDown = "shuttingDown"
+)
+
+// ErrRevoked is returned by the authenticators for the kite keys and tokens
+// that are revoked, see Kite.IsRevoked.
+var ErrRevoked = errors.New("kite: kite key or token is revoked")
+
+// Rejection describes a method call that is rejected before reaching its
+// handler.
+type Rejection struct {
+	// Method is the name of the called method.
+	Method string
+
+	// Reason is one of the Reject constants.
+	Reason string
+
+	// RemoteAddr is the address the call came from. It's empty if it's
+	// unknown, like for the SockJS transports other than websocket.
+	RemoteAddr string
+
+	// Kite is the kite the caller claims to be, it's not authenticated.
+	Kite protocol.Kite
+
+	// Err is the error sent to the caller.
+	Err error
+}
+
+// OnRejected registers a function to run when a method call is rejected,
+// like because of an invalid token. It can be used to detect misconfigured
+// credentials or brute force attempts. The rejections are also logged and
+// counted by the metrics.
+func (k *Kite) OnRejected(handler func(*Rejection)) {
+	k.onRejectedHandlers = append(k.onRejectedHandlers, handler)
+}
+
+// ReportRejection reports that the call of the request is rejected for the
+// given reason with err. The calls rejected by the kite itself are reported
+// already, it's for the handlers rejecting calls on their own, like the
+// PreHandlers checking for revoked kites.
+func (k *Kite) ReportRejection(r *Request, reason string, err error) {
+	r.Client.muProt.Lock()
+	caller := r.Client.Kite
+	r.Client.muProt.Unlock()
+
+	rejection := &Rejection{
+		Method:     r.Method,
+		Reason:     reason,
+		RemoteAddr: r.Client.RemoteAddr(),
+		Kite:       caller,
+		Err:        err,
+	}
+
+	k.metrics.rejected(reason)
+
+	k.Log.Warning("Rejected call of %q from %s (%s) as %s: %s",
+		rejection.Method, rejection.Kite, rejection.RemoteAddr, reason, err)
+
+	for _, handler := range k.onRejectedHandlers {
+		handler(rejection)
+	}
+}
+
+// authenticationRejectReason returns the reason of a call rejected because of
+// the error of an authenticator.
+func authenticationRejectReason(err error) string {
+	const timeErrors = jwt.ValidationErrorExpired | jwt.ValidationErrorNotValidYet
+
+	if err == ErrRevoked {
+		return RejectRevoked
+	}
+
+	if vErr, ok := err.(*jwt.ValidationError); ok && vErr.Errors&timeErrors != 0 &&
+		vErr.Errors&^timeErrors == 0 {
+		return RejectExpired
+	}
+
+	return RejectUnauthenticated
+}
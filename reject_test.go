@@ -0,0 +1,84 @@
+package kite
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite/protocol"
+	"gopkg.in/igm/sockjs-go.v2/sockjs"
+)
+
+func TestReportRejection(t *testing.T) {
+	k := New("testkite", "0.0.1")
+
+	var got *Rejection
+	k.OnRejected(func(r *Rejection) { got = r })
+
+	r := &Request{
+		Method: "admin.evict",
+		Client: &Client{
+			Kite:       protocol.Kite{Username: "devrim", ID: "1"},
+			remoteAddr: "10.0.0.1:5000",
+		},
+	}
+
+	k.ReportRejection(r, RejectExpired, errors.New("token is expired"))
+
+	if got == nil || got.Method != "admin.evict" || got.Reason != RejectExpired ||
+		got.RemoteAddr != "10.0.0.1:5000" || got.Kite.Username != "devrim" {
+		t.Errorf("unexpected rejection: %+v", got)
+	}
+
+	if n := k.Metrics().Rejections(RejectExpired); n != 1 {
+		t.Errorf("expected 1 expired rejection, got %d", n)
+	}
+
+	var buf bytes.Buffer
+	k.writeMetrics(&buf)
+
+	if line := `kite_rejected_calls_total{reason="expired"} 1`; !strings.Contains(buf.String(), line+"\n") {
+		t.Errorf("missing %q in:\n%s", line, buf.String())
+	}
+}
+
+func TestAuthenticationRejectReason(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason string
+	}{
+		{errors.New("Invalid audience in token"), RejectUnauthenticated},
+		{&jwt.ValidationError{Errors: jwt.ValidationErrorExpired}, RejectExpired},
+		{&jwt.ValidationError{Errors: jwt.ValidationErrorNotValidYet}, RejectExpired},
+		{&jwt.ValidationError{Errors: jwt.ValidationErrorExpired | jwt.ValidationErrorSignatureInvalid}, RejectUnauthenticated},
+		{ErrRevoked, RejectRevoked},
+	}
+
+	for i, test := range tests {
+		if reason := authenticationRejectReason(test.err); reason != test.reason {
+			t.Errorf("%d: expected %q, got %q", i, test.reason, reason)
+		}
+	}
+}
+
+type requestSession struct {
+	sockjs.Session
+	req *http.Request
+}
+
+func (s requestSession) Request() *http.Request { return s.req }
+
+func TestSessionRequest(t *testing.T) {
+	req := &http.Request{RemoteAddr: "10.0.0.1:5000"}
+
+	if got := sessionRequest(requestSession{req: req}); got != req {
+		t.Errorf("expected the request of the session, got %+v", got)
+	}
+
+	if got := sessionRequest(requestSession{}.Session); got != nil {
+		t.Errorf("expected no request, got %+v", got)
+	}
+}
@@ -1,16 +1,20 @@
 package kite
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"runtime/debug"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/koding/cache"
 	"github.com/koding/kite/dnode"
 	"github.com/koding/kite/kitekey"
 	"github.com/koding/kite/sockjsclient"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Request contains information about the incoming request.
@@ -40,6 +44,32 @@ type Request struct {
 	// chain. This is useful with PreHandle and PostHandle handlers to pass
 	// data between handlers.
 	Context cache.Cache
+
+	// CorrelationID identifies the chain of calls this request belongs to.
+	// It's sent by the caller, or generated if the caller didn't send any.
+	CorrelationID string
+
+	// Ctx carries the CorrelationID. Pass it to Client.TellWithContext to
+	// make the calls made by the handler inherit it.
+	Ctx context.Context
+
+	// Log is the logger of the local kite, prefixing the messages with the
+	// CorrelationID.
+	Log Logger
+
+	// streamID is sent by the callers using TellStream, see Stream
+	streamID string
+	stream   *Stream
+
+	// compression is the compression accepted by the caller, like "gzip"
+	compression string
+
+	// codecs are the codecs accepted by the caller and codec is the one
+	// the result is encoded with, see Codec. argsErr is set if the
+	// arguments are encoded with a codec the local kite doesn't support.
+	codecs  []string
+	codec   Codec
+	argsErr *Error
 }
 
 // Response is the type of the object that is returned from request handlers
@@ -49,8 +79,9 @@ type Response struct {
 	Result interface{} `json:"result"`
 }
 
-// runMethod is called when a method is received from remote Kite.
-func (c *Client) runMethod(method *Method, args *dnode.Partial) {
+// runMethod is called when a method is received from remote Kite. The call is
+// rejected if it's received above the concurrency limit of the connection.
+func (c *Client) runMethod(method *Method, args *dnode.Partial, overLimit bool) {
 	var (
 		callFunc func(interface{}, *Error)
 		request  *Request
@@ -58,19 +89,56 @@ func (c *Client) runMethod(method *Method, args *dnode.Partial) {
 
 	// Recover dnode argument errors and send them back. The caller can use
 	// functions like MustString(), MustSlice()... without the fear of panic.
+	// Other panics of the handlers are sent back as errors too, unless
+	// panic recovery is disabled.
 	defer func() {
 		if r := recover(); r != nil {
-			debug.PrintStack()
+			if c.LocalKite.Config.DisablePanicRecovery && !isArgumentPanic(r) {
+				panic(r)
+			}
+
+			log := c.LocalKite.Log
+			if request != nil {
+				log = request.Log
+			}
+
 			kiteErr := createError(r)
-			c.LocalKite.Log.Error(kiteErr.Error()) // let's log it too :)
-			callFunc(nil, kiteErr)
+			if !isArgumentPanic(r) {
+				kiteErr.CodeVal = CodeInternal
+			}
+
+			log.Error("Panic in method %q: %s\n%s", method.name, kiteErr, debug.Stack())
+
+			// the arguments may be invalid, so there is no callback
+			if callFunc != nil {
+				callFunc(nil, kiteErr)
+			}
 		}
 	}()
 
+	defer c.LocalKite.metrics.callStarted(method.name)()
+
 	// The request that will be constructed from incoming dnode message.
 	request, callFunc = c.newRequest(method.name, args)
+
+	if !c.LocalKite.beginCall() {
+		err := errShuttingDown()
+		c.LocalKite.ReportRejection(request, RejectShuttingDown, err)
+		callFunc(nil, err)
+		return
+	}
+	defer c.LocalKite.calls.Done()
+
+	if overLimit {
+		err := errTooManyRequests()
+		c.LocalKite.ReportRejection(request, RejectRateLimited, err)
+		callFunc(nil, err)
+		return
+	}
+
 	if method.authenticate {
-		if err := request.authenticate(); err != nil {
+		if reason, err := request.authenticate(); err != nil {
+			c.LocalKite.ReportRejection(request, reason, err)
 			callFunc(nil, err)
 			return
 		}
@@ -80,6 +148,40 @@ func (c *Client) runMethod(method *Method, args *dnode.Partial) {
 		request.Username = request.Client.Kite.Username
 	}
 
+	c.markHandshaken()
+
+	if err := request.authorize(method.authenticate); err != nil {
+		c.LocalKite.ReportRejection(request, RejectPermissionDenied, err)
+		callFunc(nil, err)
+		return
+	}
+
+	// only the accepted calls count for the total limit, so the callers
+	// that can't authenticate can't exhaust it
+	if err := c.LocalKite.acquireCall(); err != nil {
+		c.LocalKite.ReportRejection(request, RejectRateLimited, err)
+		callFunc(nil, err)
+		return
+	}
+	defer atomic.AddInt64(&c.LocalKite.acceptedCalls, -1)
+
+	// Compress the messages to the caller if both sides support it. It's
+	// only negotiated by the accepted calls, see Client.receiveData.
+	if request.compression == compressionGzip && c.LocalKite.Config.Compression {
+		atomic.StoreInt32(&c.compress, 1)
+	}
+
+	if request.argsErr != nil {
+		callFunc(nil, request.argsErr)
+		return
+	}
+
+	// Encode the result with a codec the caller accepts, the arguments of
+	// the calls to the caller can be encoded with it too.
+	if request.codec = c.LocalKite.acceptCodec(request.codecs); request.codec != nil {
+		c.setCodec(request.codec)
+	}
+
 	method.mu.Lock()
 	if !method.initialized {
 		method.preHandlers = append(method.preHandlers, c.LocalKite.preHandlers...)
@@ -89,11 +191,91 @@ func (c *Client) runMethod(method *Method, args *dnode.Partial) {
 	method.mu.Unlock()
 
 	// Call the handler functions.
-	result, err := method.ServeKite(request)
+	result, err := c.LocalKite.withMiddlewares(method).ServeKite(request)
+
+	// the response must be received after the chunks of the stream
+	if request.stream != nil {
+		request.stream.flush()
+	}
 
 	callFunc(result, createError(err))
 }
 
+// acquireMessage counts a message of the remote kite before it's handled. It
+// returns false if the message exceeds Config.MaxConcurrentCalls.
+func (c *Client) acquireMessage() bool {
+	n := atomic.AddInt32(&c.inFlightCalls, 1)
+
+	if limit := c.LocalKite.Config.MaxConcurrentCalls; limit > 0 && int(n) > limit {
+		atomic.AddInt32(&c.inFlightCalls, -1)
+		return false
+	}
+
+	return true
+}
+
+// acquireCall counts an accepted method call. It returns an error if the call
+// exceeds Config.MaxConcurrentCallsTotal.
+func (k *Kite) acquireCall() *Error {
+	n := atomic.AddInt64(&k.acceptedCalls, 1)
+
+	if limit := k.Config.MaxConcurrentCallsTotal; limit > 0 && n > int64(limit) {
+		atomic.AddInt64(&k.acceptedCalls, -1)
+		return errTooManyRequests()
+	}
+
+	return nil
+}
+
+// beginCall adds a method call to the ones Shutdown waits for. It returns
+// false if the kite is shutting down, the call must be rejected then.
+func (k *Kite) beginCall() bool {
+	k.shutdownMu.Lock()
+	defer k.shutdownMu.Unlock()
+
+	if k.shuttingDown {
+		return false
+	}
+
+	k.calls.Add(1)
+	return true
+}
+
+// errShuttingDown is sent back for the calls received during Shutdown.
+func errShuttingDown() *Error {
+	return &Error{
+		Type:    "shuttingDown",
+		Message: "Kite is shutting down",
+		CodeVal: CodeUnavailable,
+	}
+}
+
+// errTooManyRequests is sent back for the calls above the concurrency limits.
+func errTooManyRequests() *Error {
+	return &Error{
+		Type:    "tooManyRequests",
+		Message: "Too many concurrent requests",
+		CodeVal: CodeTooManyRequests,
+	}
+}
+
+// InFlightCalls returns the number of messages of the remote kite, method
+// calls and callbacks, that are being handled by the local kite.
+func (c *Client) InFlightCalls() int {
+	return int(atomic.LoadInt32(&c.inFlightCalls))
+}
+
+// isArgumentPanic returns true if r is a panic of the dnode argument helpers
+// or a kite error, which are meant to be sent back to the caller.
+func isArgumentPanic(r interface{}) bool {
+	switch r.(type) {
+	case *Error, *dnode.ArgumentError:
+		return true
+	}
+
+	return false
+}
+
 // runCallback is called when a callback method call is received from remote Kite.
 func (c *Client) runCallback(callback func(*dnode.Partial), args *dnode.Partial) {
 	// Do not panic no matter what.
@@ -130,8 +312,48 @@ func (c *Client) newRequest(method string, args *dnode.Partial) (*Request, func(
 		Context:   cache.NewMemory(),
 	}
 
+	request.streamID = options.StreamID
+	request.compression = options.Compression
+	request.codecs = options.Codecs
+
+	if options.Codec != "" {
+		codec := c.LocalKite.codec(options.Codec)
+		if codec == nil {
+			request.argsErr = &Error{
+				Type:    "unsupportedCodec",
+				Message: fmt.Sprintf("Arguments are encoded with unsupported codec %q", options.Codec),
+				CodeVal: CodeInvalidArgument,
+			}
+		}
+
+		request.Args = &dnode.Partial{Raw: options.EncodedArgs, Codec: codec}
+	}
+
+	request.CorrelationID = options.CorrelationID
+	if request.CorrelationID == "" {
+		request.CorrelationID = newCorrelationID()
+	}
+
+	request.Ctx = WithCorrelationID(context.Background(), request.CorrelationID)
+	request.Log = &correlationLogger{Logger: c.LocalKite.Log, id: request.CorrelationID}
+
+	// The span is ended once the response is sent back, the calls made by
+	// the handler with Request.Ctx are its children.
+	var span trace.Span
+	if c.LocalKite.Config.Tracing {
+		request.Ctx, span = c.startServerSpan(request.Ctx, method, options.TraceContext)
+	}
+
 	// Call response callback function, send back our response
 	callFunc := func(result interface{}, err *Error) {
+		if span != nil {
+			if err != nil {
+				endSpan(span, err)
+			} else {
+				endSpan(span, nil)
+			}
+		}
+
 		if options.ResponseCallback.Caller == nil {
 			return
 		}
@@ -142,7 +364,12 @@ func (c *Client) newRequest(method string, args *dnode.Partial) (*Request, func(
 			Error:  err,
 		}
 
-		if err := options.ResponseCallback.Call(response); err != nil {
+		var arg interface{} = response
+		if request.codec != nil {
+			arg = c.encodeResult(request.codec, response)
+		}
+
+		if err := options.ResponseCallback.Call(arg); err != nil {
 			c.LocalKite.Log.Error(err.Error())
 		}
 	}
@@ -151,48 +378,52 @@ func (c *Client) newRequest(method string, args *dnode.Partial) (*Request, func(
 }
 
 // authenticate tries to authenticate the user by selecting appropriate
-// authenticator function.
-func (r *Request) authenticate() *Error {
+// authenticator function. If it fails, the reason of the rejection is
+// returned with the error.
+func (r *Request) authenticate() (string, *Error) {
 	// Trust the Kite if we have initiated the connection.
 	// Following cast means, session is opened by the client.
 	if _, ok := r.Client.session.(*sockjsclient.WebsocketSession); ok {
-		return nil
+		return "", nil
 	}
 
 	if r.Auth == nil {
-		return &Error{
+		return RejectUnauthenticated, &Error{
 			Type:    "authenticationError",
 			Message: "No authentication information is provided",
+			CodeVal: CodeUnauthenticated,
 		}
 	}
 
 	// Select authenticator function.
 	f := r.LocalKite.Authenticators[r.Auth.Type]
 	if f == nil {
-		return &Error{
+		return RejectUnauthenticated, &Error{
 			Type:    "authenticationError",
 			Message: fmt.Sprintf("Unknown authentication type: %s", r.Auth.Type),
+			CodeVal: CodeUnauthenticated,
 		}
 	}
 
 	// Call authenticator function. It sets the Request.Username field.
 	err := f(r)
 	if err != nil {
-		return &Error{
+		return authenticationRejectReason(err), &Error{
 			Type:    "authenticationError",
 			Message: err.Error(),
+			CodeVal: CodeUnauthenticated,
 		}
 	}
 
 	// Replace username of the remote Kite with the username that client send
 	// us. This prevents a Kite to impersonate someone else's Kite.
 	r.Client.SetUsername(r.Username)
-	return nil
+	return "", nil
 }
 
 // AuthenticateFromToken is the default Authenticator for Kite.
 func (k *Kite) AuthenticateFromToken(r *Request) error {
-	token, err := jwt.Parse(r.Auth.Key, r.LocalKite.RSAKey)
+	token, err := parseToken(r.Auth.Key, r.LocalKite.RSAKey, k.Config.TokenLeeway)
 	if err != nil {
 		return err
 	}
@@ -205,19 +436,19 @@ func (k *Kite) AuthenticateFromToken(r *Request) error {
 		return fmt.Errorf("Invalid audience in token. \nHave: %s \nMust be a part of: %s", audience, k.Kite().String())
 	}
 
-	// We don't check for exp and nbf claims here because jwt-go package already checks them.
+	// We don't check for exp and nbf claims here because parseToken already checks them.
 	if username, ok := token.Claims["sub"].(string); !ok {
 		return errors.New("Username is not present in token")
 	} else {
 		r.Username = username
 	}
 
-	return nil
+	return k.checkRevoked(token)
 }
 
 // AuthenticateFromKiteKey authenticates user from kite key.
 func (k *Kite) AuthenticateFromKiteKey(r *Request) error {
-	token, err := jwt.Parse(r.Auth.Key, kitekey.GetKontrolKey)
+	token, err := parseToken(r.Auth.Key, kitekey.GetKontrolKey, k.Config.TokenLeeway)
 	if err != nil {
 		return err
 	}
@@ -232,5 +463,51 @@ func (k *Kite) AuthenticateFromKiteKey(r *Request) error {
 		r.Username = username
 	}
 
+	return k.checkRevoked(token)
+}
+
+// checkRevoked returns ErrRevoked if the kite key or the token is revoked,
+// see Kite.IsRevoked.
+func (k *Kite) checkRevoked(token *jwt.Token) error {
+	if k.IsRevoked == nil {
+		return nil
+	}
+
+	id, _ := token.Claims["jti"].(string)
+	username, _ := token.Claims["sub"].(string)
+
+	if k.IsRevoked(id, username) {
+		return ErrRevoked
+	}
+
 	return nil
 }
+
+// parseToken parses and validates the token like jwt.Parse, but tolerates the
+// clock skew between the issuer and the local kite by the given leeway when
+// checking the exp and nbf claims.
+func parseToken(tokenString string, keyFunc jwt.Keyfunc, leeway time.Duration) (*jwt.Token, error) {
+	token, err := jwt.Parse(tokenString, keyFunc)
+	if err == nil || leeway <= 0 {
+		return token, err
+	}
+
+	// only check the tokens again that are rejected just because of time
+	vErr, ok := err.(*jwt.ValidationError)
+	if !ok || vErr.Errors&^(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
+		return token, err
+	}
+
+	now := jwt.TimeFunc()
+
+	if exp, ok := token.Claims["exp"].(float64); ok && now.Add(-leeway).Unix() > int64(exp) {
+		return token, err
+	}
+
+	if nbf, ok := token.Claims["nbf"].(float64); ok && now.Add(leeway).Unix() < int64(nbf) {
+		return token, err
+	}
+
+	token.Valid = true
+	return token, nil
+}
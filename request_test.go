@@ -0,0 +1,96 @@
+package kite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite/testkeys"
+)
+
+func TestParseTokenLeeway(t *testing.T) {
+	now := time.Now()
+
+	sign := func(claims map[string]interface{}) string {
+		token := jwt.New(jwt.GetSigningMethod("RS256"))
+		token.Claims = claims
+
+		signed, err := token.SignedString([]byte(testkeys.Private))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return signed
+	}
+
+	keyFunc := func(*jwt.Token) (interface{}, error) {
+		return []byte(testkeys.Public), nil
+	}
+
+	tests := []struct {
+		claims map[string]interface{}
+		leeway time.Duration
+		valid  bool
+	}{
+		{map[string]interface{}{"exp": now.Add(time.Minute).Unix()}, 0, true},
+		{map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}, 0, false},
+		{map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}, time.Minute, true},
+		{map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()}, time.Minute, false},
+		{map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()}, 0, false},
+		{map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()}, time.Minute, true},
+		{map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()}, time.Minute, false},
+	}
+
+	for i, test := range tests {
+		token, err := parseToken(sign(test.claims), keyFunc, test.leeway)
+		if valid := err == nil && token.Valid; valid != test.valid {
+			t.Errorf("%d: expected valid=%t, got error %v", i, test.valid, err)
+		}
+	}
+
+	// the leeway doesn't make up for an invalid signature
+	expired := sign(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})
+	if _, err := parseToken(expired+"x", keyFunc, time.Minute); err == nil {
+		t.Error("expected an error for an invalid signature")
+	}
+}
+
+func TestAuthenticateRevoked(t *testing.T) {
+	k := New("revoked", "0.0.1")
+	k.Config.KontrolUser = "kontrol"
+	k.Config.KontrolKey = testkeys.Public
+
+	token := jwt.New(jwt.GetSigningMethod("RS256"))
+	token.Claims = map[string]interface{}{
+		"iss": "kontrol",
+		"sub": "user",
+		"aud": "/",
+		"jti": "token-id",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+
+	signed, err := token.SignedString([]byte(testkeys.Private))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Request{LocalKite: k, Auth: &Auth{Type: "token", Key: signed}}
+
+	if err := k.AuthenticateFromToken(r); err != nil {
+		t.Fatalf("token is rejected without IsRevoked: %s", err)
+	}
+
+	var id, username string
+	k.IsRevoked = func(i, u string) bool {
+		id, username = i, u
+		return true
+	}
+
+	if err := k.AuthenticateFromToken(r); err != ErrRevoked {
+		t.Errorf("got %v for a revoked token, want %v", err, ErrRevoked)
+	}
+
+	if id != "token-id" || username != "user" {
+		t.Errorf("IsRevoked is called with %q and %q", id, username)
+	}
+}
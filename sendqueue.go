@@ -0,0 +1,112 @@
+package kite
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/koding/kite/config"
+)
+
+// defaultSendQueueSize is the size of the send queues if
+// Config.SendQueueSize is not set.
+const defaultSendQueueSize = 512
+
+// ErrSendQueueFull is returned when a message can't be queued because the
+// peer doesn't receive the previous ones fast enough, see
+// Config.SendQueuePolicy.
+var ErrSendQueueFull = errors.New("kite: send queue is full")
+
+func (k *Kite) sendQueueSize() int {
+	if k.Config.SendQueueSize > 0 {
+		return k.Config.SendQueueSize
+	}
+
+	return defaultSendQueueSize
+}
+
+// SendQueueDepth returns the number of messages queued to be sent to the
+// peer.
+func (c *Client) SendQueueDepth() int {
+	return len(c.send)
+}
+
+// enqueue queues the message to be sent by sendHub. If the queue is full,
+// the message is handled according to Config.SendQueuePolicy.
+func (c *Client) enqueue(msg []byte) error {
+	metrics := c.LocalKite.metrics
+
+	if c.push(msg, nil) {
+		return nil
+	}
+
+	switch c.LocalKite.Config.SendQueuePolicy {
+	case config.SendQueueDropOldest:
+		for {
+			select {
+			case <-c.send:
+				atomic.AddInt64(&metrics.SendQueueDepth, -1)
+				atomic.AddUint64(&metrics.SendQueueDropped, 1)
+				c.LocalKite.Log.Warning("Send queue of %q is full, dropped the oldest message", c.Kite)
+			default:
+			}
+
+			// other senders may fill the queue again
+			if c.push(msg, nil) {
+				return nil
+			}
+		}
+	case config.SendQueueDisconnect:
+		atomic.AddUint64(&metrics.SendQueueDropped, 1)
+		c.LocalKite.Log.Warning("Send queue of %q is full, disconnecting", c.Kite)
+
+		if c.session != nil {
+			c.session.Close(3000, ErrSendQueueFull.Error())
+		}
+
+		return ErrSendQueueFull
+	default:
+		// a nil channel doesn't wait in push, this one waits forever
+		timeout := make(<-chan time.Time)
+		if d := c.LocalKite.Config.SendQueueTimeout; d > 0 {
+			t := time.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		if c.push(msg, timeout) {
+			return nil
+		}
+
+		atomic.AddUint64(&metrics.SendQueueDropped, 1)
+		c.LocalKite.Log.Warning("Send queue of %q is full for %s, dropped the message",
+			c.Kite, c.LocalKite.Config.SendQueueTimeout)
+		return ErrSendQueueFull
+	}
+}
+
+// push queues the message, waiting for room until timeout fires. It doesn't
+// wait if timeout is nil.
+func (c *Client) push(msg []byte, timeout <-chan time.Time) bool {
+	depth := &c.LocalKite.metrics.SendQueueDepth
+
+	// counted before it's queued, so sendHub never sees a negative depth
+	atomic.AddInt64(depth, 1)
+
+	if timeout == nil {
+		select {
+		case c.send <- msg:
+			return true
+		default:
+		}
+	} else {
+		select {
+		case c.send <- msg:
+			return true
+		case <-timeout:
+		}
+	}
+
+	atomic.AddInt64(depth, -1)
+	return false
+}
@@ -0,0 +1,66 @@
+package kite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/koding/kite/config"
+)
+
+// newQueueClient returns a client with a send queue of the given size that
+// is not drained.
+func newQueueClient(policy config.SendQueuePolicy, size int) (*Client, *recvSession) {
+	k := New("exp", "0.0.1")
+	k.Config.SendQueuePolicy = policy
+	k.Config.SendQueueTimeout = 10 * time.Millisecond
+
+	s := &recvSession{}
+	return &Client{LocalKite: k, session: s, send: make(chan []byte, size)}, s
+}
+
+func TestSendQueueBlock(t *testing.T) {
+	c, _ := newQueueClient(config.SendQueueBlock, 1)
+
+	if err := c.enqueue([]byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.enqueue([]byte("2")); err != ErrSendQueueFull {
+		t.Fatalf("got %v, want ErrSendQueueFull", err)
+	}
+
+	if d := c.SendQueueDepth(); d != 1 {
+		t.Errorf("got depth %d, want 1", d)
+	}
+}
+
+func TestSendQueueDropOldest(t *testing.T) {
+	c, _ := newQueueClient(config.SendQueueDropOldest, 2)
+
+	for _, msg := range []string{"1", "2", "3"} {
+		if err := c.enqueue([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if msg := string(<-c.send); msg != "2" {
+		t.Errorf("got %q, want the oldest message dropped", msg)
+	}
+
+	if n := c.LocalKite.metrics.SendQueueDropped; n != 1 {
+		t.Errorf("got %d dropped messages, want 1", n)
+	}
+}
+
+func TestSendQueueDisconnect(t *testing.T) {
+	c, s := newQueueClient(config.SendQueueDisconnect, 1)
+
+	c.enqueue([]byte("1"))
+	if err := c.enqueue([]byte("2")); err != ErrSendQueueFull {
+		t.Fatalf("got %v, want ErrSendQueueFull", err)
+	}
+
+	if s.closed == 0 {
+		t.Error("connection is not closed")
+	}
+}
@@ -2,14 +2,18 @@
 package kite
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // Run is a blocking method. It runs the kite server and then accepts requests
@@ -52,6 +56,79 @@ func (k *Kite) Close() {
 
 }
 
+// Shutdown stops the kite gracefully. It stops accepting method calls, the
+// new ones are rejected with an unavailable error, stops the heartbeats and
+// deregisters the kite from kontrol, so other kites aren't routed to it
+// anymore. Then it closes the connection to kontrol and the listener, and
+// waits for the method calls that are being handled to finish. If ctx is done
+// before they finish, its error is returned.
+func (k *Kite) Shutdown(ctx context.Context) error {
+	k.shutdownMu.Lock()
+	if !k.shuttingDown {
+		k.shuttingDown = true
+		close(k.shutdownC)
+	}
+	k.shutdownMu.Unlock()
+
+	if err := k.deregister(ctx); err != nil {
+		k.Log.Warning("Cannot deregister from kontrol: %s", err)
+	}
+
+	k.Close()
+
+	// no calls are added once shutting down, so they can be waited for
+	done := make(chan struct{})
+	go func() {
+		k.calls.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// OnShutdown registers a function to run when the kite is shut down by the
+// signal handler of SetupShutdownHandler. The handlers are called in order,
+// before the kite is deregistered from kontrol.
+func (k *Kite) OnShutdown(handler func()) {
+	k.onShutdownHandlers = append(k.onShutdownHandlers, handler)
+}
+
+// SetupShutdownHandler listens to SIGTERM and SIGINT. On the first one, the
+// OnShutdown handlers are called, the kite is stopped with Shutdown, waiting
+// for at most the given timeout for the method calls being handled, and the
+// process exits.
+func (k *Kite) SetupShutdownHandler(timeout time.Duration) {
+	c := make(chan os.Signal, 1)
+
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		s := <-c
+		k.Log.Info("Got signal: %s, shutting down", s)
+
+		k.shutdown(timeout)
+		os.Exit(0)
+	}()
+}
+
+// shutdown calls the OnShutdown handlers and shuts down the kite.
+func (k *Kite) shutdown(timeout time.Duration) {
+	for _, handler := range k.onShutdownHandlers {
+		handler()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := k.Shutdown(ctx); err != nil {
+		k.Log.Warning("Method calls didn't finish in %s: %s", timeout, err)
+	}
+}
+
 func (k *Kite) Addr() string {
 	return net.JoinHostPort(k.Config.IP, strconv.Itoa(k.Config.Port))
 }
@@ -61,6 +138,10 @@ func (k *Kite) Addr() string {
 func (k *Kite) listenAndServe() error {
 	var err error
 
+	if err = k.setupTLS(); err != nil {
+		return err
+	}
+
 	// create a new one if there doesn't exist
 	k.listener, err = net.Listen("tcp4", k.Addr())
 	if err != nil {
@@ -79,9 +160,20 @@ func (k *Kite) listenAndServe() error {
 	// listener is ready, notify waiters.
 	close(k.readyC)
 
+	// the connections that don't complete the TLS handshake and send the
+	// upgrade request in time are closed, the rest of the handshake is
+	// timed from the same accept time by the sockjs handler
+	server := &http.Server{
+		Handler:           k,
+		ReadHeaderTimeout: k.Config.HandshakeTimeout,
+		ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+			return withAcceptTime(ctx, time.Now())
+		},
+	}
+
 	defer close(k.closeC) // serving is finished, notify waiters.
 	k.Log.Info("Serving...")
-	return http.Serve(k.listener, k)
+	return server.Serve(k.listener)
 }
 
 func (k *Kite) UseTLS(certPEM, keyPEM string) {
@@ -118,3 +210,17 @@ func (k *Kite) ServerCloseNotify() chan bool {
 func (k *Kite) ServerReadyNotify() chan bool {
 	return k.readyC
 }
+
+// acceptTimeKey is the context key of the time a connection is accepted.
+type acceptTimeKey struct{}
+
+// withAcceptTime returns a context carrying the accept time of a connection.
+func withAcceptTime(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, acceptTimeKey{}, t)
+}
+
+// acceptTime returns the accept time of the connection of the context.
+func acceptTime(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(acceptTimeKey{}).(time.Time)
+	return t, ok
+}
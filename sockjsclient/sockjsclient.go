@@ -4,6 +4,7 @@ package sockjsclient
 
 import (
 	crand "crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -29,6 +30,23 @@ type Rand struct {
 var r = Rand{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
 
 func ConnectWebsocketSession(baseURL string) (*WebsocketSession, error) {
+	return DialWebsocketSession(baseURL, nil)
+}
+
+// DialWebsocketSession is like ConnectWebsocketSession, but uses the given
+// TLS config for wss connections, like for presenting a client certificate.
+// The default config is used if it's nil.
+func DialWebsocketSession(baseURL string, tlsConfig *tls.Config) (*WebsocketSession, error) {
+	return DialWebsocketSessionTimeout(baseURL, tlsConfig, 0)
+}
+
+// DialWebsocketSessionTimeout is like DialWebsocketSession, but fails if the
+// handshake, which is the connection, the websocket upgrade and the open
+// frame of the session, doesn't complete in the given timeout. The default
+// timeout of the websocket dialer is used if it's zero.
+func DialWebsocketSessionTimeout(baseURL string, tlsConfig *tls.Config, timeout time.Duration) (*WebsocketSession, error) {
+	start := time.Now()
+
 	dialURL, err := url.Parse(baseURL)
 	if err != nil {
 		return nil, err
@@ -54,16 +72,47 @@ func ConnectWebsocketSession(baseURL string) (*WebsocketSession, error) {
 	requestHeader := http.Header{}
 	requestHeader.Add("Origin", originalScheme+"://"+dialURL.Host)
 
-	conn, _, err := websocket.DefaultDialer.Dial(dialURL.String(), requestHeader)
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	if timeout > 0 {
+		dialer.HandshakeTimeout = timeout
+	}
+
+	conn, _, err := dialer.Dial(dialURL.String(), requestHeader)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := readOpenFrame(conn, start, timeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
 	session := NewWebsocketSession(conn)
 	session.id = sessionID
 	return session, nil
 }
 
+// readOpenFrame reads the open frame the server sends once the session is
+// created, waiting at most until the timeout passes since start.
+func readOpenFrame(conn *websocket.Conn, start time.Time, timeout time.Duration) error {
+	if timeout > 0 {
+		conn.SetReadDeadline(start.Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	_, buf, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	if string(buf) != "o" {
+		return fmt.Errorf("unexpected frame instead of open frame: %q", buf)
+	}
+
+	return nil
+}
+
 type WebsocketSession struct {
 	conn     *websocket.Conn
 	id       string
@@ -80,6 +129,13 @@ func (w *WebsocketSession) RemoteAddr() string {
 	return w.conn.RemoteAddr().String()
 }
 
+// SetReadLimit sets the size of the largest frame read from the server. The
+// connection is closed if the server sends a larger one, and Recv returns
+// websocket.ErrReadLimit.
+func (w *WebsocketSession) SetReadLimit(limit int64) {
+	w.conn.SetReadLimit(limit)
+}
+
 // ID returns a session id
 func (w *WebsocketSession) ID() string {
 	return w.id
@@ -110,7 +166,7 @@ read_frame:
 
 	switch frameType {
 	case 'o':
-		// TODO handle open
+		// the open frame is read by DialWebsocketSession
 		goto read_frame
 	case 'a':
 		var messages []string
@@ -0,0 +1,79 @@
+package sockjsclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newServer returns a websocket server that sends the given frames once a
+// session is created and then waits for the client to close it.
+func newServer(frames ...string) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for _, frame := range frames {
+			conn.WriteMessage(websocket.TextMessage, []byte(frame))
+		}
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	// the server never opens the session
+	server := newServer()
+	defer server.Close()
+
+	start := time.Now()
+	_, err := DialWebsocketSessionTimeout(server.URL+"/kite", nil, 100*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected the dial to time out")
+	}
+
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("dial returned after %s", d)
+	}
+}
+
+func TestDialOpenFrame(t *testing.T) {
+	server := newServer("o", `a["hello"]`)
+	defer server.Close()
+
+	session, err := DialWebsocketSessionTimeout(server.URL+"/kite", nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close(0, "")
+
+	msg, err := session.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg != "hello" {
+		t.Errorf("got message %q, want %q", msg, "hello")
+	}
+}
+
+func TestDialUnexpectedFrame(t *testing.T) {
+	server := newServer(`a["hello"]`)
+	defer server.Close()
+
+	if _, err := DialWebsocketSessionTimeout(server.URL+"/kite", nil, time.Second); err == nil {
+		t.Error("expected an error for a session without an open frame")
+	}
+}
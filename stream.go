@@ -0,0 +1,302 @@
+package kite
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/koding/kite/dnode"
+)
+
+// streamWindow is the number of chunks a stream sends before waiting for
+// the caller to receive them, so a slow caller pauses the handler.
+const streamWindow = 16
+
+// ErrStreamClosed is returned from Stream.Send when the caller closed the
+// stream or disconnected.
+var ErrStreamClosed = errors.New("kite: stream is closed")
+
+type streamIDKey struct{}
+
+// Stream sends the result of a method call in chunks, like the lines of a
+// log file being tailed. It's returned by Request.Stream.
+//
+// The chunks are sent to the caller as the "kite.streamChunk" method calls,
+// which are acknowledged with the "kite.streamAck" calls once the caller
+// receives them. The response of the method is sent once all chunks are
+// received.
+type Stream struct {
+	client     *Client
+	id         string
+	seq        int
+	unacked    int
+	acks       chan bool
+	disconnect chan struct{}
+	closed     bool
+}
+
+// Stream returns the stream of the request to send the chunks of the result
+// with. It returns an error if the method isn't called with
+// Client.TellStream.
+func (r *Request) Stream() (*Stream, error) {
+	if r.streamID == "" {
+		return nil, errors.New("kite: method is not called as a stream")
+	}
+
+	if r.stream != nil {
+		return r.stream, nil
+	}
+
+	c := r.Client
+	s := &Stream{
+		client:     c,
+		id:         r.streamID,
+		acks:       make(chan bool, streamWindow+1),
+		disconnect: c.disconnect,
+	}
+
+	c.streamsMu.Lock()
+	c.serverStreams[s.id] = s
+	c.streamsMu.Unlock()
+
+	r.stream = s
+	return s, nil
+}
+
+// Send sends a chunk to the caller. It blocks while the caller has not
+// received the previous chunks yet.
+func (s *Stream) Send(chunk interface{}) error {
+	for s.unacked >= streamWindow {
+		if err := s.waitAck(); err != nil {
+			return err
+		}
+	}
+
+	if s.closed {
+		return ErrStreamClosed
+	}
+
+	args := s.client.wrapMethodArgs(context.Background(), []interface{}{s.id, s.seq, chunk}, dnode.Function{})
+	if _, err := s.client.marshalAndSend("kite.streamChunk", args); err != nil {
+		return err
+	}
+
+	s.seq++
+	s.unacked++
+	return nil
+}
+
+// waitAck waits for the caller to receive a chunk.
+func (s *Stream) waitAck() error {
+	select {
+	case ok := <-s.acks:
+		s.unacked--
+		if !ok {
+			s.closed = true
+			return ErrStreamClosed
+		}
+
+		return nil
+	case <-s.disconnect:
+		s.closed = true
+		return ErrStreamClosed
+	}
+}
+
+// flush waits until the caller receives all chunks, so the response is sent
+// after them, and forgets the stream.
+func (s *Stream) flush() {
+	for s.unacked > 0 && !s.closed {
+		s.waitAck()
+	}
+
+	s.client.streamsMu.Lock()
+	delete(s.client.serverStreams, s.id)
+	s.client.streamsMu.Unlock()
+}
+
+// ClientStream receives the chunks of a method call made with TellStream.
+// It's used like:
+//
+//	s := c.TellStream(ctx, "tail", "/var/log/syslog")
+//	defer s.Close()
+//
+//	for s.Next() {
+//		line := s.Chunk().MustString()
+//		...
+//	}
+//
+//	if err := s.Err(); err != nil {
+//		...
+//	}
+type ClientStream struct {
+	client *Client
+	id     string
+	cancel context.CancelFunc
+
+	// pending keeps the chunks received out of order, until the chunks
+	// before them are received.
+	pending map[int]*dnode.Partial
+	next    int
+	mu      sync.Mutex
+
+	chunks   chan *dnode.Partial
+	response chan *response
+
+	chunk  *dnode.Partial
+	result *dnode.Partial
+	err    error
+	done   bool
+}
+
+// TellStream calls a method that sends its result in chunks with
+// Request.Stream. The chunks are received with the Next method of the
+// returned stream, until the method returns. The handler is paused while the
+// received chunks are not read.
+func (c *Client) TellStream(ctx context.Context, method string, args ...interface{}) *ClientStream {
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := &ClientStream{
+		client:  c,
+		id:      newCorrelationID(),
+		cancel:  cancel,
+		pending: make(map[int]*dnode.Partial),
+		chunks:  make(chan *dnode.Partial, streamWindow),
+	}
+
+	c.streamsMu.Lock()
+	c.clientStreams[s.id] = s
+	c.streamsMu.Unlock()
+
+	s.response = c.GoWithContext(context.WithValue(ctx, streamIDKey{}, s.id), method, args...)
+	return s
+}
+
+// Next waits for the next chunk and returns true if it's received. It
+// returns false once the method returns, Result and Err return its result
+// then.
+func (s *ClientStream) Next() bool {
+	if s.done {
+		return false
+	}
+
+	select {
+	case chunk := <-s.chunks:
+		s.chunk = chunk
+		s.ack(true)
+		return true
+	case resp := <-s.response:
+		// the response is sent after all chunks are received
+		s.result, s.err = resp.Result, resp.Err
+		s.finish()
+		return false
+	}
+}
+
+// Chunk returns the chunk received by the last Next call.
+func (s *ClientStream) Chunk() *dnode.Partial {
+	return s.chunk
+}
+
+// Result returns the result of the method once Next returns false.
+func (s *ClientStream) Result() *dnode.Partial {
+	return s.result
+}
+
+// Err returns the error of the method once Next returns false.
+func (s *ClientStream) Err() error {
+	return s.err
+}
+
+// Close stops receiving the chunks. The Send calls of the handler return
+// ErrStreamClosed.
+func (s *ClientStream) Close() {
+	if s.done {
+		return
+	}
+
+	s.ack(false)
+	s.err = ErrStreamClosed
+	s.finish()
+}
+
+func (s *ClientStream) finish() {
+	s.done = true
+	s.cancel()
+
+	s.client.streamsMu.Lock()
+	delete(s.client.clientStreams, s.id)
+	s.client.streamsMu.Unlock()
+}
+
+// ack tells the handler that a chunk is received, or that the stream is
+// closed if ok is false.
+func (s *ClientStream) ack(ok bool) {
+	args := s.client.wrapMethodArgs(context.Background(), []interface{}{s.id, ok}, dnode.Function{})
+	if _, err := s.client.marshalAndSend("kite.streamAck", args); err != nil {
+		s.client.LocalKite.Log.Warning("Cannot acknowledge stream chunk: %s", err)
+	}
+}
+
+// receive queues a chunk, the chunks are read in the order they are sent.
+func (s *ClientStream) receive(seq int, chunk *dnode.Partial) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending[seq] = chunk
+
+	for {
+		chunk, ok := s.pending[s.next]
+		if !ok {
+			return
+		}
+
+		delete(s.pending, s.next)
+		s.next++
+
+		// the handler doesn't send more chunks than the buffer size
+		// before they are read
+		select {
+		case s.chunks <- chunk:
+		default:
+			s.client.LocalKite.Log.Warning("Stream %s received too many chunks", s.id)
+		}
+	}
+}
+
+// handleStreamChunk receives a chunk sent by Stream.Send.
+func handleStreamChunk(r *Request) (interface{}, error) {
+	args := r.Args.MustSliceOfLength(3)
+	id := args[0].MustString()
+	seq := int(args[1].MustFloat64())
+
+	r.Client.streamsMu.Lock()
+	s, ok := r.Client.clientStreams[id]
+	r.Client.streamsMu.Unlock()
+
+	if ok {
+		s.receive(seq, args[2])
+	}
+
+	return nil, nil
+}
+
+// handleStreamAck receives an acknowledgement sent by ClientStream.
+func handleStreamAck(r *Request) (interface{}, error) {
+	args := r.Args.MustSliceOfLength(2)
+	id := args[0].MustString()
+	ok := args[1].MustBool()
+
+	r.Client.streamsMu.Lock()
+	s, found := r.Client.serverStreams[id]
+	r.Client.streamsMu.Unlock()
+
+	if found {
+		select {
+		case s.acks <- ok:
+		default:
+		}
+	}
+
+	return nil, nil
+}
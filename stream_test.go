@@ -0,0 +1,94 @@
+package kite
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/dnode"
+)
+
+func TestClientStreamOrder(t *testing.T) {
+	c := New("exp", "0.0.1").NewClient("http://127.0.0.1:9999/kite")
+	s := c.TellStream(context.Background(), "tail")
+
+	// the chunks may be processed out of order
+	for _, seq := range []int{1, 0, 2} {
+		s.receive(seq, &dnode.Partial{Raw: []byte{byte('0' + seq)}})
+	}
+
+	for want := 0; want < 3; want++ {
+		if !s.Next() {
+			t.Fatalf("expected chunk %d", want)
+		}
+
+		if got := s.Chunk().MustFloat64(); int(got) != want {
+			t.Errorf("expected chunk %d, got %v", want, got)
+		}
+	}
+
+	s.response <- &response{Result: &dnode.Partial{Raw: []byte(`"done"`)}}
+
+	if s.Next() {
+		t.Fatal("expected the stream to end")
+	}
+
+	if s.Err() != nil || s.Result().MustString() != "done" {
+		t.Errorf("unexpected result: %v %v", s.Result(), s.Err())
+	}
+
+	if _, ok := c.clientStreams[s.id]; ok {
+		t.Error("finished stream should be forgotten")
+	}
+}
+
+func TestStreamWindow(t *testing.T) {
+	c := New("exp", "0.0.1").NewClient("")
+
+	r := &Request{Client: c}
+	if _, err := r.Stream(); err == nil {
+		t.Error("expected an error for a call without stream")
+	}
+
+	r.streamID = "1234"
+	s, err := r.Stream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < streamWindow; i++ {
+		if err := s.Send(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- s.Send("blocked")
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("send should block until a chunk is received")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	s.acks <- true
+
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	// the caller closes the stream
+	s.acks <- false
+
+	if err := s.Send("closed"); err != ErrStreamClosed {
+		t.Errorf("expected %s, got %v", ErrStreamClosed, err)
+	}
+
+	s.flush()
+
+	if _, ok := c.serverStreams["1234"]; ok {
+		t.Error("flushed stream should be forgotten")
+	}
+}
@@ -0,0 +1,164 @@
+package kite
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// certReloader serves the certificate of the given files and reloads it on
+// demand, so the certificate can be rotated without restarting the kite.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// reload reads the certificate files again. The old certificate is kept if
+// they can't be read.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+
+	return nil
+}
+
+// getCertificate is used as tls.Config.GetCertificate.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// RunTLS runs the kite server like Run, serving https and wss with the given
+// certificate files. The certificate is reloaded when the kite receives
+// SIGHUP.
+func (k *Kite) RunTLS(certFile, keyFile string) {
+	k.Config.TLSCertFile = certFile
+	k.Config.TLSKeyFile = keyFile
+
+	k.Run()
+}
+
+// setupTLS loads the certificate files of the config, if any, and reloads
+// them on SIGHUP until the server is closed. An explicit TLSConfig is kept,
+// only its certificate and client CAs are set.
+func (k *Kite) setupTLS() error {
+	if k.Config.TLSCertFile != "" || k.Config.TLSKeyFile != "" {
+		if err := k.setupCertReloader(); err != nil {
+			return err
+		}
+	}
+
+	if k.Config.TLSClientCAFile == "" {
+		return nil
+	}
+
+	if k.TLSConfig == nil {
+		return errors.New("kite: client CA file is set but TLS is not configured")
+	}
+
+	pool, err := loadCertPool(k.Config.TLSClientCAFile)
+	if err != nil {
+		return err
+	}
+
+	k.TLSConfig.ClientCAs = pool
+	k.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return nil
+}
+
+func (k *Kite) setupCertReloader() error {
+	r, err := newCertReloader(k.Config.TLSCertFile, k.Config.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+
+	if k.TLSConfig == nil {
+		k.TLSConfig = &tls.Config{}
+	}
+
+	k.TLSConfig.GetCertificate = r.getCertificate
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(sig)
+
+		for {
+			select {
+			case <-sig:
+				if err := r.reload(); err != nil {
+					k.Log.Error("Cannot reload the TLS certificate: %s", err)
+					continue
+				}
+
+				k.Log.Info("Reloaded the TLS certificate %s", r.certFile)
+			case <-k.closeC:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// loadCertPool returns a pool of the PEM encoded certificates in the file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("kite: no certificates in %s", file)
+	}
+
+	return pool, nil
+}
+
+// clientTLSConfig returns the TLS config of the clients with the client
+// certificate files of the config, or nil if they are not set.
+func (k *Kite) clientTLSConfig() (*tls.Config, error) {
+	if k.Config.TLSClientCertFile == "" && k.Config.TLSClientKeyFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(k.Config.TLSClientCertFile, k.Config.TLSClientKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
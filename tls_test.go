@@ -0,0 +1,110 @@
+package kite
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate with the given common name
+// and its key into dir.
+func writeTestCert(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kite-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "old")
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commonName := func() string {
+		cert, err := r.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return leaf.Subject.CommonName
+	}
+
+	if name := commonName(); name != "old" {
+		t.Fatalf("expected the old certificate, got %q", name)
+	}
+
+	writeTestCert(t, dir, "new")
+
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if name := commonName(); name != "new" {
+		t.Errorf("expected the reloaded certificate, got %q", name)
+	}
+
+	os.Remove(keyFile)
+
+	if err := r.reload(); err == nil {
+		t.Error("expected an error for the missing key file")
+	}
+
+	if name := commonName(); name != "new" {
+		t.Errorf("expected the certificate to be kept, got %q", name)
+	}
+}
@@ -0,0 +1,68 @@
+package kite
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans of the kites.
+const tracerName = "github.com/koding/kite"
+
+// startClientSpan starts the span of a call to the given method of the
+// remote kite. The span is ended by endSpan once the response is received.
+func (c *Client) startClientSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, "kite/"+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "kite"),
+			attribute.String("rpc.service", c.Kite.Name),
+			attribute.String("rpc.method", method),
+			attribute.String("kite.correlation_id", CorrelationID(ctx)),
+		),
+	)
+}
+
+// startServerSpan starts the span of handling the given method as a child of
+// the span the caller sent with the call, if any.
+func (c *Client) startServerSpan(ctx context.Context, method string, carrier map[string]string) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+
+	return otel.Tracer(tracerName).Start(ctx, "kite/"+method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "kite"),
+			attribute.String("rpc.service", c.LocalKite.Kite().Name),
+			attribute.String("rpc.method", method),
+			attribute.String("kite.correlation_id", CorrelationID(ctx)),
+		),
+	)
+}
+
+// injectTraceContext returns the trace context of ctx to be sent with a
+// call, or nil if ctx has no span.
+func injectTraceContext(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// endSpan records the status of the call and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetStatus(codes.Ok, "")
+	}
+
+	span.End()
+}
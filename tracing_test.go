@@ -0,0 +1,40 @@
+package kite
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceContextPropagation(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+
+	if carrier := injectTraceContext(context.Background()); carrier != nil {
+		t.Errorf("expected no trace context without a span, got %v", carrier)
+	}
+
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		SpanID:     trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+		TraceFlags: trace.FlagsSampled,
+	})
+
+	carrier := injectTraceContext(trace.ContextWithSpanContext(context.Background(), parent))
+	if carrier["traceparent"] == "" {
+		t.Fatalf("expected a traceparent, got %v", carrier)
+	}
+
+	k := New("testkite", "0.0.1")
+	c := k.NewClient("http://localhost:3999/kite")
+
+	_, span := c.startServerSpan(context.Background(), "foo", carrier)
+	defer span.End()
+
+	if id := span.SpanContext().TraceID(); id != parent.TraceID() {
+		t.Errorf("expected the span in trace %s, got %s", parent.TraceID(), id)
+	}
+}
@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"math/rand"
 	"net"
 	"strconv"
+	"time"
 )
 
 // RandomPort() returns a random port to be used with net.Listen(). It's an
@@ -23,3 +25,15 @@ func RandomPort() (int, error) {
 
 	return strconv.Atoi(port)
 }
+
+// Jitter returns a random duration in the range of d ± d*fraction. It's used
+// to spread the periodic work of many processes, like heartbeats, so they
+// don't happen all at once.
+func Jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+
+	delta := float64(d) * fraction
+	return d + time.Duration(delta*(2*rand.Float64()-1))
+}
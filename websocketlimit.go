@@ -0,0 +1,136 @@
+package kite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// isWebsocketUpgrade returns true if the request asks to upgrade the
+// connection to websocket.
+func isWebsocketUpgrade(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// limitResponseWriter limits the size of the websocket messages read from the
+// connections hijacked from it. The SockJS handler doesn't expose its
+// websocket connections to set a read limit on, so the frames are checked
+// while they are read from the underlying connection.
+type limitResponseWriter struct {
+	http.ResponseWriter
+	limit int64
+}
+
+func (w *limitResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("kite: response writer can't be hijacked")
+	}
+
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the client can't send frames before the handshake is complete, so
+	// nothing is lost by replacing the source of the reader
+	if rw.Reader.Buffered() != 0 {
+		return conn, rw, nil
+	}
+
+	lc := &limitConn{Conn: conn, limit: w.limit}
+	rw.Reader.Reset(lc)
+
+	return lc, rw, nil
+}
+
+// limitConn is a websocket connection failing with ErrMessageTooLarge once a
+// message larger than limit is started to be read. The frame headers are
+// parsed as they are read, the payloads are passed through.
+type limitConn struct {
+	net.Conn
+	limit int64
+
+	header    [14]byte
+	pending   []byte // the rest of the last header to return
+	remaining int64  // the rest of the payload of the last frame
+	message   int64  // the size of the frames of the current message
+}
+
+func (c *limitConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 && c.remaining == 0 {
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(c.pending) != 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+
+	n, err := c.Conn.Read(p)
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// readHeader reads the header of the next frame and checks the size of its
+// message.
+func (c *limitConn) readHeader() error {
+	if _, err := io.ReadFull(c.Conn, c.header[:2]); err != nil {
+		return err
+	}
+
+	final := c.header[0]&0x80 != 0
+	opcode := c.header[0] & 0x0f
+	length := int64(c.header[1] & 0x7f)
+
+	size := 2
+	switch length {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+
+	// the frames of the clients are masked
+	if c.header[1]&0x80 != 0 {
+		size += 4
+	}
+
+	if _, err := io.ReadFull(c.Conn, c.header[2:size]); err != nil {
+		return err
+	}
+
+	switch length {
+	case 126:
+		length = int64(binary.BigEndian.Uint16(c.header[2:4]))
+	case 127:
+		length = int64(binary.BigEndian.Uint64(c.header[2:10]))
+	}
+
+	// the control frames can be sent between the frames of a message
+	if opcode < 8 {
+		c.message += length
+		if length < 0 || c.message > c.limit {
+			return ErrMessageTooLarge
+		}
+
+		if final {
+			c.message = 0
+		}
+	}
+
+	c.pending = c.header[:size]
+	c.remaining = length
+	return nil
+}
@@ -0,0 +1,84 @@
+package kite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// maskedFrame returns a masked websocket frame of the given opcode and
+// payload, like the ones sent by the clients.
+func maskedFrame(final bool, opcode byte, payload []byte) []byte {
+	var frame bytes.Buffer
+
+	b0 := opcode
+	if final {
+		b0 |= 0x80
+	}
+	frame.WriteByte(b0)
+
+	switch n := len(payload); {
+	case n < 126:
+		frame.WriteByte(0x80 | byte(n))
+	case n <= 0xffff:
+		frame.WriteByte(0x80 | 126)
+		binary.Write(&frame, binary.BigEndian, uint16(n))
+	default:
+		frame.WriteByte(0x80 | 127)
+		binary.Write(&frame, binary.BigEndian, uint64(n))
+	}
+
+	// a zero mask key leaves the payload as is
+	frame.Write([]byte{0, 0, 0, 0})
+	frame.Write(payload)
+
+	return frame.Bytes()
+}
+
+func TestLimitConn(t *testing.T) {
+	tests := []struct {
+		frames [][]byte
+		ok     bool
+	}{
+		{[][]byte{maskedFrame(true, 1, make([]byte, 100))}, true},
+		{[][]byte{maskedFrame(true, 1, make([]byte, 300))}, true},
+		{[][]byte{maskedFrame(true, 1, make([]byte, 301))}, false},
+		// the fragments of a message count together, the pings don't
+		{[][]byte{
+			maskedFrame(false, 1, make([]byte, 200)),
+			maskedFrame(true, 9, make([]byte, 100)),
+			maskedFrame(true, 0, make([]byte, 100)),
+			maskedFrame(true, 1, make([]byte, 300)),
+		}, true},
+		{[][]byte{
+			maskedFrame(false, 1, make([]byte, 200)),
+			maskedFrame(true, 0, make([]byte, 101)),
+		}, false},
+		{[][]byte{maskedFrame(true, 2, make([]byte, 70000))}, false},
+	}
+
+	for i, test := range tests {
+		client, server := net.Pipe()
+		data := bytes.Join(test.frames, nil)
+
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+
+		got, err := ioutil.ReadAll(&limitConn{Conn: server, limit: 300})
+		server.Close()
+
+		if test.ok {
+			if err != nil {
+				t.Errorf("%d: unexpected error: %s", i, err)
+			} else if !bytes.Equal(got, data) {
+				t.Errorf("%d: the frames are changed", i)
+			}
+		} else if err != ErrMessageTooLarge {
+			t.Errorf("%d: expected ErrMessageTooLarge, got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package kite
+
+import "math/rand"
+
+// minWeight is the weight of a kite with a zero health score. The kite still
+// receives a little traffic, so it's noticed once it recovers.
+const minWeight = 0.01
+
+// weight returns the weight the kite is registered with, see
+// Config.HealthScore.
+func (k *Kite) weight() float64 {
+	weight := k.Config.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+
+	if k.Config.HealthScore == nil {
+		return k.Config.Weight
+	}
+
+	score := k.Config.HealthScore()
+	switch {
+	case score < 0:
+		score = 0
+	case score > 1:
+		score = 1
+	}
+
+	if weight *= score; weight < minWeight {
+		weight = minWeight
+	}
+
+	return weight
+}
+
+// WeightedPick returns one of the given clients randomly, proportional to
+// their weights, so the kites with a decayed health score receive less
+// traffic. The clients with a zero weight have the default weight of 1. It
+// returns nil if clients is empty.
+func WeightedPick(clients []*Client) *Client {
+	if len(clients) == 0 {
+		return nil
+	}
+
+	var total float64
+	for _, c := range clients {
+		total += clientWeight(c)
+	}
+
+	n := rand.Float64() * total
+	for _, c := range clients {
+		if n -= clientWeight(c); n < 0 {
+			return c
+		}
+	}
+
+	// rounding errors
+	return clients[len(clients)-1]
+}
+
+func clientWeight(c *Client) float64 {
+	if c.Weight <= 0 {
+		return 1
+	}
+
+	return c.Weight
+}
@@ -0,0 +1,49 @@
+package kite
+
+import "testing"
+
+func TestWeight(t *testing.T) {
+	k := New("exp", "0.0.1")
+
+	if w := k.weight(); w != 0 {
+		t.Errorf("got %v, want the default weight", w)
+	}
+
+	score := 1.0
+	k.Config.Weight = 4
+	k.Config.HealthScore = func() float64 { return score }
+
+	for _, test := range []struct {
+		score, weight float64
+	}{
+		{1, 4},
+		{0.5, 2},
+		{2, 4},
+		{0, minWeight},
+		{-1, minWeight},
+	} {
+		score = test.score
+		if w := k.weight(); w != test.weight {
+			t.Errorf("score %v: got weight %v, want %v", test.score, w, test.weight)
+		}
+	}
+}
+
+func TestWeightedPick(t *testing.T) {
+	if WeightedPick(nil) != nil {
+		t.Error("got a client from an empty list")
+	}
+
+	heavy := &Client{Weight: 9}
+	light := &Client{} // default weight of 1
+	clients := []*Client{heavy, light}
+
+	picks := make(map[*Client]int)
+	for i := 0; i < 10000; i++ {
+		picks[WeightedPick(clients)]++
+	}
+
+	if n := picks[heavy]; n < 8500 || n > 9500 {
+		t.Errorf("heavy client is picked %d times out of 10000, want about 9000", n)
+	}
+}